@@ -4,12 +4,24 @@ import (
 	"bufio"
 	"bytes"
 	"compress/gzip"
+	"context"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
+	"net"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/Al3x-Myku/FlyDB/pkg/db"
+	"github.com/Al3x-Myku/FlyDB/pkg/query"
+	"github.com/Al3x-Myku/FlyDB/pkg/raft"
+	"github.com/Al3x-Myku/FlyDB/pkg/schema"
 	"github.com/Al3x-Myku/FlyDB/pkg/toon"
 )
 
@@ -18,15 +30,53 @@ type Shell struct {
 	current     *db.Collection
 	dbPath      string
 	compression bool
+	follower    *db.Follower
+	replication net.Listener
+	cluster     *db.ClusterNode
+	transport   *raft.TCPTransport
+	config      db.Config
 }
 
-func NewShell(dbPath string) (*Shell, error) {
-	config := db.Config{Compression: true}
+// NewShell opens dbPath with config, keeping a mutation log for recovery
+// and replication.
+func NewShell(dbPath string, config db.Config) (*Shell, error) {
+	config.MutationLog = true
 	database, err := db.NewDBWithConfig(dbPath, config)
 	if err != nil {
 		return nil, err
 	}
-	return &Shell{db: database, dbPath: dbPath, compression: true}, nil
+	return &Shell{db: database, dbPath: dbPath, compression: config.Compression, config: config}, nil
+}
+
+// NewFollowerShell opens dbPath as a read-only follower of the FlyDB shell
+// serving replication at leader.
+func NewFollowerShell(dbPath, leader string, config db.Config) (*Shell, error) {
+	follower, err := db.Follow(dbPath, leader, config)
+	if err != nil {
+		return nil, err
+	}
+	return &Shell{db: follower.DB(), dbPath: dbPath, compression: config.Compression, follower: follower, config: config}, nil
+}
+
+// NewClusterShell opens dbPath as the cluster member listening on addr,
+// which is also its ID. peers lists the founding members when starting a
+// new cluster; a node joining an existing one has none.
+func NewClusterShell(dbPath, addr string, peers []string, config db.Config) (*Shell, error) {
+	transport, err := raft.ListenTCP(addr)
+	if err != nil {
+		return nil, err
+	}
+	node, err := db.OpenCluster(dbPath, config, db.ClusterConfig{
+		ID:        addr,
+		Peers:     peers,
+		Transport: transport,
+	})
+	if err != nil {
+		transport.Close()
+		return nil, err
+	}
+	go transport.Serve(node.Step)
+	return &Shell{db: node.DB(), dbPath: dbPath, compression: config.Compression, cluster: node, transport: transport, config: config}, nil
 }
 
 func (s *Shell) Run() {
@@ -34,6 +84,9 @@ func (s *Shell) Run() {
 
 	fmt.Println("FlyDB Shell v1.0")
 	fmt.Println("Type 'help' for available commands")
+	if s.config.ReadOnly {
+		fmt.Println("Opened read-only: changes are rejected")
+	}
 	fmt.Println()
 
 	for {
@@ -59,7 +112,18 @@ func (s *Shell) Run() {
 		s.executeCommand(line)
 	}
 
-	s.db.Close()
+	if s.replication != nil {
+		s.replication.Close()
+	}
+	switch {
+	case s.follower != nil:
+		s.follower.Close()
+	case s.cluster != nil:
+		s.cluster.Close()
+		s.transport.Close()
+	default:
+		s.db.Close()
+	}
 	fmt.Println("\nBye!")
 }
 
@@ -92,6 +156,16 @@ func (s *Shell) executeCommand(line string) {
 			return
 		}
 		s.handleInsert(strings.TrimPrefix(line, "insert "))
+	case "patch":
+		if s.current == nil {
+			fmt.Println("Error: No collection selected. Use 'use <collection>' first")
+			return
+		}
+		if len(parts) < 3 {
+			fmt.Println("Error: 'patch' requires a document ID and a JSON object")
+			return
+		}
+		s.handlePatch(parts[1], strings.TrimSpace(strings.TrimPrefix(strings.TrimPrefix(line, "patch "), parts[1])))
 	case "find":
 		if s.current == nil {
 			fmt.Println("Error: No collection selected. Use 'use <collection>' first")
@@ -108,6 +182,16 @@ func (s *Shell) executeCommand(line string) {
 			return
 		}
 		s.handleCommit()
+	case "compact":
+		if s.current == nil {
+			fmt.Println("Error: No collection selected. Use 'use <collection>' first")
+			return
+		}
+		if err := s.current.Compact(); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		fmt.Printf("✓ Compacted '%s'\n", s.current.Name())
 	case "count":
 		if s.current == nil {
 			fmt.Println("Error: No collection selected. Use 'use <collection>' first")
@@ -122,6 +206,141 @@ func (s *Shell) executeCommand(line string) {
 			return
 		}
 		s.handleQuery(strings.TrimPrefix(line, "query "))
+	case "search":
+		if s.current == nil {
+			fmt.Println("Error: No collection selected. Use 'use <collection>' first")
+			return
+		}
+		if len(parts) < 3 {
+			fmt.Println("Error: 'search' requires a field and a query")
+			return
+		}
+		rest := strings.TrimSpace(strings.TrimPrefix(line, "search"))
+		_, text, _ := strings.Cut(rest, parts[1])
+		s.handleSearch(parts[1], strings.TrimSpace(text))
+	case "explain":
+		if s.current == nil {
+			fmt.Println("Error: No collection selected. Use 'use <collection>' first")
+			return
+		}
+		s.handleExplain(strings.TrimSpace(strings.TrimPrefix(line, "explain")))
+	case "aggregate", "agg":
+		if s.current == nil {
+			fmt.Println("Error: No collection selected. Use 'use <collection>' first")
+			return
+		}
+		s.handleAggregate(strings.TrimSpace(strings.TrimPrefix(line, cmd)))
+	case "index":
+		if s.current == nil {
+			fmt.Println("Error: No collection selected. Use 'use <collection>' first")
+			return
+		}
+		if len(parts) < 2 {
+			fmt.Println("Error: 'index' requires a field name")
+			return
+		}
+		s.handleIndex(parts[1])
+	case "schema":
+		if s.current == nil {
+			fmt.Println("Error: No collection selected. Use 'use <collection>' first")
+			return
+		}
+		s.handleSchema(strings.TrimSpace(strings.TrimPrefix(line, "schema")))
+	case "idgen":
+		if s.current == nil {
+			fmt.Println("Error: No collection selected. Use 'use <collection>' first")
+			return
+		}
+		if len(parts) < 2 {
+			strategy := s.current.IDStrategy()
+			if strategy == db.IDNone {
+				strategy = "none"
+			}
+			fmt.Printf("ID generation: %s\n", strategy)
+			fmt.Println("Usage: idgen none|ulid|uuid|sequence")
+			return
+		}
+		s.handleIDGen(parts[1])
+	case "encrypt":
+		if s.current == nil {
+			fmt.Println("Error: No collection selected. Use 'use <collection>' first")
+			return
+		}
+		s.handleEncrypt(parts[1:])
+	case "validate":
+		if s.current == nil {
+			fmt.Println("Error: No collection selected. Use 'use <collection>' first")
+			return
+		}
+		s.handleValidate()
+	case "backup":
+		if len(parts) < 2 {
+			fmt.Println("Error: 'backup' requires a filename")
+			return
+		}
+		switch {
+		case len(parts) == 2:
+			s.handleBackup(parts[1], "")
+		case len(parts) == 4 && strings.EqualFold(parts[2], "since"):
+			s.handleBackup(parts[1], parts[3])
+		default:
+			fmt.Println("Usage: backup <file> [since <previous backup file>]")
+		}
+	case "restore":
+		if len(parts) < 3 {
+			fmt.Println("Error: 'restore' requires an archive and a target directory")
+			return
+		}
+		s.handleRestore(parts[1:len(parts)-1], parts[len(parts)-1])
+	case "replicate":
+		if len(parts) < 2 {
+			fmt.Println("Usage: replicate <listen address>  (e.g. replicate :7070)")
+			return
+		}
+		s.handleReplicate(parts[1])
+	case "replication":
+		s.handleReplicationStatus()
+	case "cluster":
+		s.handleCluster(parts[1:])
+	case "recover":
+		// recover <file>... <dir> [to <seq|time>]
+		args := parts[1:]
+		to := ""
+		if len(args) >= 2 && strings.EqualFold(args[len(args)-2], "to") {
+			to = args[len(args)-1]
+			args = args[:len(args)-2]
+		}
+		if len(args) < 2 {
+			fmt.Println("Usage: recover <backup file>... <dir> [to <seq|time>]")
+			return
+		}
+		s.handleRecover(args[:len(args)-1], args[len(args)-1], to)
+	case "codec":
+		if s.current == nil {
+			fmt.Println("Error: No collection selected. Use 'use <collection>' first")
+			return
+		}
+		if len(parts) < 2 {
+			fmt.Printf("Codec: %s (available: %s)\n", s.current.Codec(), strings.Join(db.Codecs(), ", "))
+			fmt.Println("Usage: codec <name>[:<level>] | codec default")
+			return
+		}
+		name := parts[1]
+		if name == "default" {
+			name = ""
+		}
+		if err := s.current.SetCodec(name); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		fmt.Printf("✓ New blocks in '%s' use %s (run 'compact' to convert existing ones)\n", s.current.Name(), s.current.Codec())
+	case "upgrade":
+		upgraded, err := s.db.Upgrade()
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		printUpgraded(upgraded)
 	case "compress":
 		if len(parts) < 2 {
 			fmt.Printf("Compression is currently: %s\n", onOff(s.compression))
@@ -154,15 +373,41 @@ func (s *Shell) showHelp() {
 	fmt.Println()
 	fmt.Println("  Collection Commands (require 'use <collection>' first):")
 	fmt.Println("    insert <json>          - Insert a document (e.g., insert {\"id\":\"1\",\"name\":\"Alice\"})")
+	fmt.Println("    patch <id> <json>      - Merge fields into a document (null removes a field)")
 	fmt.Println("    find <id>              - Find a document by ID (outputs TOON format)")
 	fmt.Println("    query <expr>           - Query documents (e.g., query age > 30) (outputs TOON format)")
+	fmt.Println("    aggregate <spec>       - Group and summarize (e.g., aggregate count(), sum(total) BY status)")
+	fmt.Println("    explain <query>        - Run a query and show the plan it used")
+	fmt.Println("    index <field>          - Create a secondary index used for lookups and sorted queries")
+	fmt.Println("    search <field> <text>  - Full-text search on a field (e.g., search bio \"go developer\" data*)")
+	fmt.Println("    schema [set <json>|clear] - Show, set or remove the collection's schema")
+	fmt.Println("    validate               - Check existing documents against the schema")
+	fmt.Println("    idgen none|ulid|uuid|sequence - Generate ids for documents inserted without one")
+	fmt.Println("    encrypt [<field> [deterministic]|remove <field>] - Show or change the fields stored")
+	fmt.Println("                           encrypted (see --field-key-file)")
 	fmt.Println("    commit                 - Commit pending changes to disk")
+	fmt.Println("    compact                - Rewrite the collection file, dropping old versions and")
+	fmt.Println("                           re-encrypting it with the current key")
 	fmt.Println("    count                  - Show memtable and indexed document counts")
 	fmt.Println("    stats                  - Show collection statistics")
 	fmt.Println("    export <file>          - Export entire collection to TOON file (.toon or .toon.gz)")
 	fmt.Println()
 	fmt.Println("  Advanced:")
+	fmt.Println("    backup <file> [since <prev>] - Write a consistent backup of all committed data,")
+	fmt.Println("                           or only what changed since a previous backup")
+	fmt.Println("    restore <file>... <dir> - Verify a full backup and any later incremental ones,")
+	fmt.Println("                           and restore them into a new data directory")
+	fmt.Println("    recover <file>... <dir> [to <seq|time>] - Restore backups, then replay this")
+	fmt.Println("                           database's mutation log up to a record or time")
+	fmt.Println("    replicate <addr>       - Serve replication to followers (flydb --follow <addr> <dir>)")
+	fmt.Println("    replication            - Show replication status")
+	fmt.Println("    cluster [add|remove <addr>] - Show cluster status, or change its members")
+	fmt.Println("                           (run on the leader; see flydb --cluster)")
 	fmt.Println("    compress on|off        - Enable/disable gzip compression")
+	fmt.Println("    codec [<name>[:<level>]|default] - Show or set the collection's compression codec")
+	fmt.Println("                           (none, gzip, zlib, flate; e.g. codec gzip:9)")
+	fmt.Println("    upgrade                - Rewrite collection files from older versions in the")
+	fmt.Println("                           current format (also: flydb upgrade <dir>)")
 	fmt.Println()
 	fmt.Println("  Query Language:")
 	fmt.Println("    field = value          - Exact match (e.g., name = Alice)")
@@ -171,6 +416,21 @@ func (s *Shell) showHelp() {
 	fmt.Println("    field >= value         - Greater or equal")
 	fmt.Println("    field <= value         - Less or equal")
 	fmt.Println("    field != value         - Not equal")
+	fmt.Println("    a AND b, a OR b, NOT a - Combine conditions, group with parentheses")
+	fmt.Println("    field IN (v1, v2)      - Matches any listed value")
+	fmt.Println("    field BETWEEN x AND y  - Inclusive range")
+	fmt.Println("    field EXISTS           - Field is present and not null")
+	fmt.Println("    field LIKE 'A%'        - Pattern match (% any text, _ one character)")
+	fmt.Println("    field PREFIX 'abc'     - Starts with")
+	fmt.Println("    field ~ '^[a-z]+$'     - Regular expression match")
+	fmt.Println("    Values: 'text' or \"text\", 42, 3.14, true, false, null")
+	fmt.Println()
+	fmt.Println("  Query Clauses (after the filter, which may be omitted):")
+	fmt.Println("    ORDER BY f [ASC|DESC], ... - Sort results (SORT BY also works)")
+	fmt.Println("    LIMIT n                - Return at most n documents")
+	fmt.Println("    OFFSET n               - Skip the first n documents (SKIP also works)")
+	fmt.Println("    FIELDS a, b | -a, -b   - Keep only, or drop, the listed fields")
+	fmt.Println("    LOOKUP [MANY] coll ON local = foreign [AS name] - Embed referenced documents")
 	fmt.Println()
 	fmt.Println("  General:")
 	fmt.Println("    help                   - Show this help message")
@@ -223,13 +483,42 @@ func (s *Shell) handleInsert(jsonStr string) {
 
 	id, err := s.current.Insert(doc)
 	if err != nil {
-		fmt.Printf("Error: %v\n", err)
+		printWriteError(err)
 		return
 	}
 
 	fmt.Printf("Inserted document with ID: %s (not yet committed)\n", id)
 }
 
+func (s *Shell) handlePatch(id, jsonStr string) {
+	var fields db.Document
+	if err := json.Unmarshal([]byte(jsonStr), &fields); err != nil {
+		fmt.Printf("Error: Invalid JSON: %v\n", err)
+		return
+	}
+
+	if err := s.current.Patch(id, fields); err != nil {
+		printWriteError(err)
+		return
+	}
+
+	fmt.Printf("Patched document %s (not yet committed)\n", id)
+}
+
+// printWriteError prints an error from a write, listing schema violations
+// one per line.
+func printWriteError(err error) {
+	var verr *schema.ValidationError
+	if !errors.As(err, &verr) {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	fmt.Println("Error: document does not match the schema:")
+	for _, v := range verr.Violations {
+		fmt.Printf("  %s\n", v)
+	}
+}
+
 func (s *Shell) handleFind(id string) {
 	doc, err := s.current.FindByID(id)
 	if err != nil {
@@ -246,6 +535,31 @@ func (s *Shell) handleFind(id string) {
 	fmt.Println(string(toonBytes))
 }
 
+// loadKeyFile reads hex-encoded AES keys, one per line, the first of which
+// encrypts new data.
+func loadKeyFile(path string) (*db.KeyRing, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var keys [][]byte
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, err := hex.DecodeString(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s: keys must be hex-encoded: %w", path, err)
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s holds no keys", path)
+	}
+	return db.NewKeyRing(keys[0], keys[1:]...)
+}
+
 func (s *Shell) handleCommit() {
 	size := s.current.Size()
 	if size == 0 {
@@ -289,6 +603,9 @@ func (s *Shell) handleStats() {
 		fmt.Printf("    Memtable:  %d documents\n", coll.MemtableSize)
 		fmt.Printf("    Indexed:   %d documents\n", coll.IndexSize)
 		fmt.Printf("    File:      %s\n", coll.FilePath)
+		if len(coll.Indexes) > 0 {
+			fmt.Printf("    Indexes:   %s\n", strings.Join(coll.Indexes, ", "))
+		}
 	}
 }
 
@@ -300,7 +617,7 @@ func (s *Shell) handleQuery(expr string) {
 		return
 	}
 
-	field, op, value, err := parseQuery(expr)
+	q, err := query.ParseQuery(expr)
 	if err != nil {
 		fmt.Printf("Error: %v\n", err)
 		return
@@ -316,19 +633,12 @@ func (s *Shell) handleQuery(expr string) {
 		return
 	}
 
-	allDocs, err := s.current.All()
+	results, err := s.current.FindWithOptions(q.Filter, q.Options)
 	if err != nil {
 		fmt.Printf("Error: %v\n", err)
 		return
 	}
 
-	var results []db.Document
-	for _, doc := range allDocs {
-		if matchesQuery(doc, field, op, value) {
-			results = append(results, doc)
-		}
-	}
-
 	if len(results) == 0 {
 		fmt.Println("No documents matched the query")
 		return
@@ -336,6 +646,19 @@ func (s *Shell) handleQuery(expr string) {
 
 	fmt.Printf("Found %d matching document(s):\n\n", len(results))
 
+	// TOON rows are flat, so embedded lookup documents are shown as JSON.
+	if len(q.Lookups) > 0 {
+		for _, doc := range results {
+			jsonBytes, err := json.Marshal(doc)
+			if err != nil {
+				fmt.Printf("Error formatting result: %v\n", err)
+				return
+			}
+			fmt.Println(string(jsonBytes))
+		}
+		return
+	}
+
 	toonBytes, err := toon.Encode(s.current.Name(), results)
 	if err != nil {
 		fmt.Printf("Error formatting results: %v\n", err)
@@ -345,64 +668,208 @@ func (s *Shell) handleQuery(expr string) {
 	fmt.Println(string(toonBytes))
 }
 
-func matchesQuery(doc db.Document, field, operator, value string) bool {
-	fieldVal, ok := doc[field]
-	if !ok {
-		return false
-	}
-
-	switch operator {
-	case "=":
-		return fmt.Sprint(fieldVal) == value
-	case "!=":
-		return fmt.Sprint(fieldVal) != value
-	case ">":
-		return compareValues(fieldVal, value) > 0
-	case "<":
-		return compareValues(fieldVal, value) < 0
-	case ">=":
-		return compareValues(fieldVal, value) >= 0
-	case "<=":
-		return compareValues(fieldVal, value) <= 0
+func (s *Shell) handleExplain(expr string) {
+	expr = strings.TrimPrefix(expr, "query ")
+	q, err := query.ParseQuery(expr)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+
+	plan, err := s.current.Explain(q)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+
+	fmt.Println(plan)
+}
+
+func (s *Shell) handleAggregate(spec string) {
+	if spec == "" {
+		fmt.Println("Error: Aggregation is required")
+		fmt.Println("Example: aggregate count(), avg(total) AS avg_total BY status WHERE total > 0")
+		return
+	}
+
+	agg, err := query.ParseAggregation(spec)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+
+	rows, err := s.current.Aggregate(agg)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+
+	columns := append([]string{}, agg.GroupBy...)
+	for _, acc := range agg.Accumulators {
+		columns = append(columns, acc.Name())
+	}
+
+	fmt.Println(strings.Join(columns, "\t"))
+	for _, row := range rows {
+		values := make([]string, len(columns))
+		for i, col := range columns {
+			values[i] = fmt.Sprint(row[col])
+			if row[col] == nil {
+				values[i] = "null"
+			}
+		}
+		fmt.Println(strings.Join(values, "\t"))
+	}
+	fmt.Printf("(%d group(s))\n", len(rows))
+}
+
+func (s *Shell) handleIndex(field string) {
+	if err := s.current.CreateIndex(field); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	fmt.Printf("✓ Index on '%s' ready\n", field)
+}
+
+func (s *Shell) handleSearch(field, text string) {
+	if !s.current.HasTextIndex(field) {
+		fmt.Printf("Building text index on '%s'...\n", field)
+		if err := s.current.CreateTextIndex(field); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+	}
+
+	results, err := s.current.Search(field, text)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+
+	if len(results) == 0 {
+		fmt.Println("No documents matched the search")
+		return
+	}
+
+	fmt.Printf("Found %d matching document(s):\n\n", len(results))
+	for _, r := range results {
+		fmt.Printf("  %-20s score=%.4f\n", r.ID, r.Score)
+	}
+}
+
+func (s *Shell) handleSchema(args string) {
+	switch {
+	case args == "":
+		current := s.current.Schema()
+		if current == nil {
+			fmt.Println("No schema set")
+			return
+		}
+		out, err := json.MarshalIndent(current, "", "  ")
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		fmt.Println(string(out))
+	case args == "clear":
+		if err := s.current.SetSchema(nil); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		fmt.Println("✓ Schema removed")
+	case strings.HasPrefix(args, "set "):
+		sch, err := schema.Parse([]byte(strings.TrimPrefix(args, "set ")))
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		if err := s.current.SetSchema(sch); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		fmt.Println("✓ Schema set (run 'validate' to check existing documents)")
 	default:
-		return false
+		fmt.Println("Usage: schema | schema set <json> | schema clear")
 	}
 }
 
-func compareValues(fieldVal interface{}, valueStr string) int {
-	switch v := fieldVal.(type) {
-	case int64:
-		if intVal, err := fmt.Sscanf(valueStr, "%d", new(int64)); err == nil && intVal == 1 {
-			var parsedInt int64
-			fmt.Sscanf(valueStr, "%d", &parsedInt)
-			if v > parsedInt {
-				return 1
-			} else if v < parsedInt {
-				return -1
+func (s *Shell) handleEncrypt(args []string) {
+	fields := s.current.EncryptedFields()
+	switch {
+	case len(args) == 0:
+		if len(fields) == 0 {
+			fmt.Println("No encrypted fields")
+			return
+		}
+		fmt.Println("Encrypted fields:")
+		for _, f := range fields {
+			mode := "randomized"
+			if f.Deterministic {
+				mode = "deterministic"
 			}
-			return 0
-		}
-	case float64:
-		if floatVal, err := fmt.Sscanf(valueStr, "%f", new(float64)); err == nil && floatVal == 1 {
-			var parsedFloat float64
-			fmt.Sscanf(valueStr, "%f", &parsedFloat)
-			if v > parsedFloat {
-				return 1
-			} else if v < parsedFloat {
-				return -1
+			fmt.Printf("  - %s (%s)\n", f.Field, mode)
+		}
+		return
+	case len(args) == 2 && args[0] == "remove":
+		kept := fields[:0]
+		for _, f := range fields {
+			if f.Field != args[1] {
+				kept = append(kept, f)
 			}
-			return 0
 		}
-	case string:
-		if v > valueStr {
-			return 1
-		} else if v < valueStr {
-			return -1
+		fields = kept
+	case len(args) == 1 || (len(args) == 2 && args[1] == "deterministic"):
+		kept := fields[:0]
+		for _, f := range fields {
+			if f.Field != args[0] {
+				kept = append(kept, f)
+			}
 		}
-		return 0
+		fields = append(kept, db.EncryptedField{Field: args[0], Deterministic: len(args) == 2})
+	default:
+		fmt.Println("Usage: encrypt | encrypt <field> [deterministic] | encrypt remove <field>")
+		return
+	}
+
+	if err := s.current.SetEncryptedFields(fields...); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	fmt.Println("✓ Encrypted fields updated (run 'compact' to apply them to existing documents)")
+}
+
+func (s *Shell) handleIDGen(name string) {
+	strategy, err := db.ParseIDStrategy(name)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	if err := s.current.SetIDStrategy(strategy); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	fmt.Printf("✓ ID generation set to %s\n", name)
+}
+
+func (s *Shell) handleValidate() {
+	if s.current.Schema() == nil {
+		fmt.Println("No schema set")
+		return
+	}
+
+	invalid, err := s.current.ValidateExisting()
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
 	}
 
-	return strings.Compare(fmt.Sprint(fieldVal), valueStr)
+	for _, doc := range invalid {
+		fmt.Printf("%s:\n", doc.ID)
+		for _, v := range doc.Violations {
+			fmt.Printf("  %s\n", v)
+		}
+	}
+	fmt.Printf("%d invalid document(s)\n", len(invalid))
 }
 
 func (s *Shell) handleCompress(mode string) {
@@ -435,8 +902,9 @@ func (s *Shell) handleExport(filename string) {
 	fmt.Printf("Exporting %d documents (memtable: %d, indexed: %d)...\n",
 		memSize+indexSize, memSize, indexSize)
 
-	// Retrieve all documents from the collection
-	allDocs, err := s.current.All()
+	// Retrieve all documents from the collection, keeping encrypted
+	// fields encrypted
+	allDocs, err := s.current.AllEncrypted()
 	if err != nil {
 		fmt.Printf("Error retrieving documents: %v\n", err)
 		return
@@ -516,40 +984,318 @@ func onOff(b bool) string {
 	return "OFF"
 }
 
-func parseQuery(expr string) (field, operator, value string, err error) {
-	operators := []string{">=", "<=", "!=", "=", ">", "<"}
+func main() {
+	follow := flag.String("follow", "", "replicate from the leader at this address, read-only")
+	cluster := flag.String("cluster", "", "run as the cluster member listening on this address")
+	peers := flag.String("peers", "", "comma-separated addresses of all founding cluster members; omit to join a running cluster")
+	keyFile := flag.String("key-file", "", "encrypt data with the hex-encoded AES key on the first line of this file; later lines hold old keys still needed to read")
+	fieldKeyFile := flag.String("field-key-file", "", "like --key-file, for the keys of fields set with 'encrypt'")
+	readOnly := flag.Bool("read-only", false, "open the data dir for reading only, alongside any process writing to it")
+	refresh := flag.Duration("refresh", time.Second, "with --read-only, how often to pick up what the writer commits (0 to never)")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [--key-file file] [--field-key-file file] [--read-only [--refresh interval] | --follow host:port | --cluster host:port [--peers a,b,c]] [data dir]\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "       %s [--key-file file] upgrade [data dir]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
 
-	for _, op := range operators {
-		if idx := strings.Index(expr, op); idx != -1 {
-			field = strings.TrimSpace(expr[:idx])
-			operator = op
-			value = strings.TrimSpace(expr[idx+len(op):])
+	args := flag.Args()
+	upgrade := len(args) > 0 && args[0] == "upgrade"
+	if upgrade {
+		args = args[1:]
+	}
+	dbPath := "./flydb-shell-data"
+	if len(args) > 0 {
+		dbPath = args[0]
+	}
 
-			if field == "" || value == "" {
-				err = fmt.Errorf("invalid query format")
-				return
-			}
+	config := db.Config{Compression: true, ReadOnly: *readOnly}
+	if *readOnly {
+		config.RefreshInterval = *refresh
+	}
+	if *keyFile != "" {
+		keys, err := loadKeyFile(*keyFile)
+		if err != nil {
+			fmt.Printf("Error reading key file: %v\n", err)
+			os.Exit(1)
+		}
+		config.KeyProvider = keys
+	}
+	if *fieldKeyFile != "" {
+		keys, err := loadKeyFile(*fieldKeyFile)
+		if err != nil {
+			fmt.Printf("Error reading field key file: %v\n", err)
+			os.Exit(1)
+		}
+		config.FieldKeyProvider = keys
+	}
 
-			value = strings.Trim(value, "\"'")
+	if upgrade {
+		if err := runUpgrade(dbPath, config); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	var shell *Shell
+	var err error
+	switch {
+	case *follow != "" && *cluster != "":
+		fmt.Println("Error: --follow and --cluster cannot be combined")
+		os.Exit(1)
+	case *readOnly && (*follow != "" || *cluster != ""):
+		fmt.Println("Error: --read-only cannot be combined with --follow or --cluster")
+		os.Exit(1)
+	case *follow != "":
+		shell, err = NewFollowerShell(dbPath, *follow, config)
+	case *cluster != "":
+		var members []string
+		if *peers != "" {
+			members = strings.Split(*peers, ",")
+		}
+		shell, err = NewClusterShell(dbPath, *cluster, members, config)
+	default:
+		shell, err = NewShell(dbPath, config)
+	}
+	if err != nil {
+		fmt.Printf("Error initializing shell: %v\n", err)
+		os.Exit(1)
+	}
+
+	shell.Run()
+}
+
+// runUpgrade rewrites the collection files in dir from older versions of
+// FlyDB in the current format, without starting the shell.
+func runUpgrade(dir string, config db.Config) error {
+	if _, err := os.Stat(dir); err != nil {
+		return err
+	}
+	database, err := db.NewDBWithConfig(dir, config)
+	if err != nil {
+		return err
+	}
+	upgraded, err := database.Upgrade()
+	if closeErr := database.Close(); err == nil {
+		err = closeErr
+	}
+	printUpgraded(upgraded)
+	return err
+}
+
+func printUpgraded(names []string) {
+	if len(names) == 0 {
+		fmt.Println("✓ All collections are in the current format")
+		return
+	}
+	for _, name := range names {
+		fmt.Printf("✓ Upgraded '%s' to format version %d\n", name, db.FormatVersion)
+	}
+}
+
+func (s *Shell) handleBackup(filename, since string) {
+	var parent *db.BackupManifest
+	if since != "" {
+		f, err := os.Open(since)
+		if err != nil {
+			fmt.Printf("Error opening file: %v\n", err)
+			return
+		}
+		parent, err = db.ReadManifest(f)
+		f.Close()
+		if err != nil {
+			fmt.Printf("Error reading %s: %v\n", since, err)
 			return
 		}
 	}
 
-	err = fmt.Errorf("no valid operator found (supported: =, !=, >, <, >=, <=)")
-	return
+	tmp := filename + ".partial"
+	f, err := os.Create(tmp)
+	if err != nil {
+		fmt.Printf("Error creating file: %v\n", err)
+		return
+	}
+
+	var manifest *db.BackupManifest
+	if parent != nil {
+		manifest, err = s.db.BackupIncremental(f, parent)
+	} else {
+		manifest, err = s.db.Backup(f)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, filename)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+
+	var total int64
+	for _, file := range manifest.Files {
+		total += file.Size
+	}
+	fmt.Printf("✓ Wrote %s backup of %d collection(s), %d bytes, to %s\n",
+		manifest.Kind, len(manifest.Collections), total, filename)
 }
 
-func main() {
-	dbPath := "./flydb-shell-data"
-	if len(os.Args) > 1 {
-		dbPath = os.Args[1]
+func (s *Shell) handleRestore(filenames []string, dir string) {
+	var archives []io.Reader
+	for _, name := range filenames {
+		f, err := os.Open(name)
+		if err != nil {
+			fmt.Printf("Error opening file: %v\n", err)
+			return
+		}
+		defer f.Close()
+		archives = append(archives, f)
 	}
 
-	shell, err := NewShell(dbPath)
+	manifest, err := db.RestoreChainWithConfig(dir, s.config, archives...)
 	if err != nil {
-		fmt.Printf("Error initializing shell: %v\n", err)
-		os.Exit(1)
+		fmt.Printf("Error: %v\n", err)
+		return
 	}
 
-	shell.Run()
+	fmt.Printf("✓ Restored %d collection(s) as of %s into %s\n",
+		len(manifest.Collections), manifest.Created.Format("2006-01-02 15:04:05 MST"), dir)
+	fmt.Printf("Start a shell on it with: flydb %s\n", dir)
+}
+
+func (s *Shell) handleRecover(filenames []string, dir, to string) {
+	var target db.RecoveryTarget
+	if to != "" {
+		if seq, err := strconv.ParseUint(to, 10, 64); err == nil {
+			target.Seq = seq
+		} else if t, err := parseRecoveryTime(to); err == nil {
+			target.Time = t
+		} else {
+			fmt.Printf("Error: %q is neither a log record number nor a time like 2006-01-02T15:04:05\n", to)
+			return
+		}
+	}
+
+	var archives []io.Reader
+	for _, name := range filenames {
+		f, err := os.Open(name)
+		if err != nil {
+			fmt.Printf("Error opening file: %v\n", err)
+			return
+		}
+		defer f.Close()
+		archives = append(archives, f)
+	}
+
+	logPath := filepath.Join(s.dbPath, db.MutationLogFileName)
+	result, err := db.RecoverWithConfig(dir, logPath, target, s.config, archives...)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+
+	fmt.Printf("✓ Restored backup of %s and replayed %d log record(s)\n",
+		result.Manifest.Created.Format("2006-01-02 15:04:05 MST"), result.Replayed)
+	fmt.Printf("  %s is as of log record %d, %s\n", dir, result.Seq, result.Time.Local().Format("2006-01-02 15:04:05 MST"))
+	fmt.Printf("Start a shell on it with: flydb %s\n", dir)
+}
+
+// parseRecoveryTime accepts RFC 3339 times, or local times without a zone.
+func parseRecoveryTime(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.ParseInLocation("2006-01-02T15:04:05", s, time.Local)
+}
+
+func (s *Shell) handleReplicate(addr string) {
+	if s.follower != nil {
+		fmt.Println("Error: a follower cannot serve replication")
+		return
+	}
+	if s.replication != nil {
+		fmt.Printf("Already serving replication on %s\n", s.replication.Addr())
+		return
+	}
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	s.replication = ln
+	go func() {
+		if err := s.db.ServeReplication(ln); err != nil {
+			fmt.Printf("Replication stopped: %v\n", err)
+		}
+	}()
+
+	fmt.Printf("✓ Serving replication on %s\n", ln.Addr())
+	fmt.Printf("Start a follower with: flydb --follow %s <dir>\n", ln.Addr())
+}
+
+func (s *Shell) handleReplicationStatus() {
+	switch {
+	case s.follower != nil:
+		st := s.follower.Status()
+		state := "disconnected"
+		if st.Connected {
+			state = "connected"
+		}
+		fmt.Printf("Following %s (%s)\n", st.Leader, state)
+		fmt.Printf("  Applied log record: %d of %d\n", st.Seq, st.LeaderSeq)
+		fmt.Printf("  Lag: %d record(s), %s\n", st.Lag, st.Delay.Round(time.Millisecond))
+		fmt.Printf("  Snapshots received: %d\n", st.Snapshots)
+		if st.LastError != nil {
+			fmt.Printf("  Last error: %v\n", st.LastError)
+		}
+	case s.replication != nil:
+		fmt.Printf("Serving replication on %s, at log record %d\n", s.replication.Addr(), s.db.LogSeq())
+	default:
+		fmt.Println("Replication is not running (see 'replicate <addr>' and 'flydb --follow')")
+	}
+}
+
+func (s *Shell) handleCluster(args []string) {
+	if s.cluster == nil {
+		fmt.Println("Not running as a cluster member (start with flydb --cluster <addr>)")
+		return
+	}
+
+	if len(args) == 2 && (args[0] == "add" || args[0] == "remove") {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		var err error
+		if args[0] == "add" {
+			err = s.cluster.AddMember(ctx, args[1])
+		} else {
+			err = s.cluster.RemoveMember(ctx, args[1])
+		}
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		fmt.Printf("✓ Members: %s\n", strings.Join(s.cluster.Status().Members, ", "))
+		return
+	}
+	if len(args) != 0 {
+		fmt.Println("Usage: cluster [add|remove <addr>]")
+		return
+	}
+
+	st := s.cluster.Status()
+	leader := st.Leader
+	if leader == "" {
+		leader = "unknown"
+	}
+	fmt.Printf("Member %s (%s, term %d)\n", st.ID, st.State, st.Term)
+	fmt.Printf("  Leader: %s\n", leader)
+	fmt.Printf("  Members: %s\n", strings.Join(st.Members, ", "))
+	fmt.Printf("  Log: %d entries, %d committed, %d applied\n", st.LastIndex, st.Commit, st.Applied)
 }
@@ -0,0 +1,66 @@
+package db
+
+import (
+	"fmt"
+
+	"github.com/Al3x-Myku/FlyDB/pkg/query"
+)
+
+// Aggregate groups the documents matching spec.Filter and computes the
+// requested accumulators for each group. Documents are streamed through the
+// aggregator one block at a time, so only the per-group state is held in
+// memory.
+func (c *Collection) Aggregate(spec *query.Aggregation) ([]Document, error) {
+	agg, err := query.NewAggregator(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	if len(c.meta.EncryptedFields) > 0 {
+		if agg, err = c.encryptAggregationInternal(spec); err != nil {
+			return nil, err
+		}
+	}
+
+	err = c.scanInternal(func(id string, doc Document) error {
+		agg.Add(doc)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	results := agg.Results()
+	if err := c.decryptAll(c.meta.EncryptedFields, results); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// encryptAggregationInternal returns an aggregator for spec that works on
+// ciphertext: the filter is rewritten, and only deterministic fields may be
+// grouped by or have their distinct values counted. Group keys are
+// decrypted in the results.
+func (c *Collection) encryptAggregationInternal(spec *query.Aggregation) (*query.Aggregator, error) {
+	for _, field := range spec.GroupBy {
+		if f, ok := c.encryptedFieldInternal(field); ok && !f.Deterministic {
+			return nil, fmt.Errorf("%w: cannot group by %s", ErrEncryptedField, field)
+		}
+	}
+	for _, acc := range spec.Accumulators {
+		f, ok := c.encryptedFieldInternal(acc.Field)
+		if ok && !(f.Deterministic && acc.Op == query.AccCountDistinct) {
+			return nil, fmt.Errorf("%w: %s(%s)", ErrEncryptedField, acc.Op, acc.Field)
+		}
+	}
+	filter, err := c.encryptQueryInternal(spec.Filter)
+	if err != nil {
+		return nil, err
+	}
+	rewritten := *spec
+	rewritten.Filter = filter
+	return query.NewAggregator(&rewritten)
+}
@@ -0,0 +1,709 @@
+package db
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+var ErrBadBackup = errors.New("invalid backup archive")
+
+const (
+	backupVersion    = 1
+	manifestFileName = "MANIFEST.json"
+
+	// tailCheckSize is how many bytes before a collection's recorded offset
+	// are hashed, so an increment can tell that the file it continues is
+	// still the same one.
+	tailCheckSize = 4096
+)
+
+const (
+	BackupFull        = "full"
+	BackupIncremental = "incremental"
+)
+
+// BackupManifest describes a backup archive. It is stored as the last entry
+// of the archive, so a truncated archive has no manifest and is rejected.
+//
+// An incremental backup names the backup it continues in Parent and, for
+// each collection, only holds the bytes from Base to Offset.
+type BackupManifest struct {
+	Version     int                `json:"version"`
+	ID          string             `json:"id,omitempty"`
+	Kind        string             `json:"kind,omitempty"`
+	Parent      string             `json:"parent,omitempty"`
+	Created     time.Time          `json:"created"`
+	Files       []BackupFile       `json:"files"`
+	Collections []BackupCollection `json:"collections,omitempty"`
+
+	// LogSeq is the last mutation log record the backup includes, if the
+	// database keeps a mutation log.
+	LogSeq uint64 `json:"log_seq,omitempty"`
+}
+
+type BackupFile struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// BackupCollection records how much of a collection's data file a backup
+// covers. Generation is the collection's compaction count; TailSHA256 is the
+// hash of up to 4 KiB of the file just before Offset.
+type BackupCollection struct {
+	Name       string `json:"name"`
+	Generation int64  `json:"generation"`
+	Base       int64  `json:"base"`
+	Offset     int64  `json:"offset"`
+	TailSHA256 string `json:"tail_sha256"`
+
+	// Deleted lists documents still present in the data file that were
+	// deleted. Deletes are not written to the file, so a restore removes
+	// them by compacting the collection.
+	Deleted []string `json:"deleted,omitempty"`
+
+	// SealedDeleted holds Deleted, encrypted, when the database encrypts
+	// its data, so that backups do not reveal document IDs.
+	SealedDeleted []byte `json:"sealed_deleted,omitempty"`
+}
+
+// collections returns the collection list, deriving it from the files for
+// manifests written before it was recorded.
+func (m *BackupManifest) collections() []BackupCollection {
+	if len(m.Collections) > 0 || len(m.Files) == 0 {
+		return m.Collections
+	}
+	var cols []BackupCollection
+	for _, f := range m.Files {
+		if name, ok := strings.CutSuffix(f.Name, ".toon"); ok {
+			cols = append(cols, BackupCollection{Name: name, Offset: f.Size})
+		}
+	}
+	return cols
+}
+
+// collectionSnapshot is what a backup captures of one collection: the
+// committed prefix of its data file, read through a separate handle, and
+// its metadata as of the same moment.
+type collectionSnapshot struct {
+	c          *Collection
+	file       File
+	size       int64
+	generation int64
+	meta       []byte
+	deleted    []string
+}
+
+// Backup writes a consistent, point-in-time tar archive of every collection
+// and its metadata to w. Documents still in a memtable are not included.
+//
+// Writers are only blocked while the file sizes of all collections are
+// recorded. Data files are append-only apart from Compact, so the recorded
+// prefix of each file stays intact while it is copied; compactions wait
+// until the backup has finished.
+func (db *DB) Backup(w io.Writer) (*BackupManifest, error) {
+	return db.backup(w, nil)
+}
+
+// BackupIncremental writes a backup holding only what changed since the
+// backup described by since, which may itself be incremental. A collection
+// is copied in full if it was compacted or replaced since then, or is new.
+func (db *DB) BackupIncremental(w io.Writer, since *BackupManifest) (*BackupManifest, error) {
+	if since == nil || since.ID == "" {
+		return nil, fmt.Errorf("%w: incremental backups need a parent with an id", ErrBadBackup)
+	}
+	return db.backup(w, since)
+}
+
+func (db *DB) backup(w io.Writer, since *BackupManifest) (*BackupManifest, error) {
+	snaps, logSeq, err := db.snapshot()
+	if err != nil {
+		return nil, err
+	}
+	defer releaseSnapshots(snaps)
+
+	manifest := &BackupManifest{
+		Version: backupVersion,
+		ID:      newULID(time.Now()),
+		Kind:    BackupFull,
+		Created: time.Now().UTC(),
+		LogSeq:  logSeq,
+	}
+	previous := make(map[string]BackupCollection)
+	if since != nil {
+		manifest.Kind = BackupIncremental
+		manifest.Parent = since.ID
+		for _, col := range since.collections() {
+			previous[col.Name] = col
+		}
+	}
+
+	tw := tar.NewWriter(w)
+	for _, s := range snaps {
+		col := BackupCollection{Name: s.c.name, Generation: s.generation, Offset: s.size}
+		if col.TailSHA256, err = tailHash(s.file, s.size); err != nil {
+			return nil, fmt.Errorf("backup %s: %w", s.c.name, err)
+		}
+		col.Deleted = s.deleted
+		if db.crypt != nil && len(col.Deleted) > 0 {
+			if col.SealedDeleted, err = sealDeleted(db.crypt, col); err != nil {
+				return nil, fmt.Errorf("backup %s: %w", s.c.name, err)
+			}
+			col.Deleted = nil
+		}
+
+		if prev, ok := previous[col.Name]; ok && prev.Generation == col.Generation && prev.Offset <= col.Offset {
+			tail, err := tailHash(s.file, prev.Offset)
+			if err != nil {
+				return nil, fmt.Errorf("backup %s: %w", s.c.name, err)
+			}
+			if tail == prev.TailSHA256 {
+				col.Base = prev.Offset
+			}
+		}
+
+		if col.Offset > col.Base {
+			entry, err := writeTarEntry(tw, col.Name+".toon", col.Offset-col.Base, io.NewSectionReader(s.file, col.Base, col.Offset-col.Base))
+			if err != nil {
+				return nil, err
+			}
+			manifest.Files = append(manifest.Files, entry)
+		}
+		manifest.Collections = append(manifest.Collections, col)
+
+		if s.meta != nil {
+			entry, err := writeTarEntry(tw, col.Name+metaSuffix, int64(len(s.meta)), bytes.NewReader(s.meta))
+			if err != nil {
+				return nil, err
+			}
+			manifest.Files = append(manifest.Files, entry)
+		}
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("could not encode manifest: %w", err)
+	}
+	if _, err := writeTarEntry(tw, manifestFileName, int64(len(data)), bytes.NewReader(data)); err != nil {
+		return nil, err
+	}
+	if err := tw.Close(); err != nil {
+		return nil, fmt.Errorf("could not finish backup: %w", err)
+	}
+
+	return manifest, nil
+}
+
+func tailHash(r io.ReaderAt, offset int64) (string, error) {
+	start := offset - tailCheckSize
+	if start < 0 {
+		start = 0
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, io.NewSectionReader(r, start, offset-start)); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// snapshot pins every collection against compaction and records the state
+// of all of them while holding all their read locks at once. It also returns
+// the mutation log position matching that state.
+func (db *DB) snapshot() ([]*collectionSnapshot, uint64, error) {
+	if err := db.LoadAllCollections(); err != nil {
+		return nil, 0, err
+	}
+
+	db.dbMutex.Lock()
+	names := make([]string, 0, len(db.collections))
+	for name := range db.collections {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	snaps := make([]*collectionSnapshot, len(names))
+	for i, name := range names {
+		snaps[i] = &collectionSnapshot{c: db.collections[name]}
+	}
+	db.dbMutex.Unlock()
+
+	for _, s := range snaps {
+		s.c.compactMutex.RLock()
+	}
+	for _, s := range snaps {
+		s.c.mutex.RLock()
+	}
+
+	var err error
+	for _, s := range snaps {
+		if err = s.capture(); err != nil {
+			break
+		}
+	}
+	var logSeq uint64
+	if db.log != nil {
+		logSeq = db.log.lastSeq()
+	}
+
+	for _, s := range snaps {
+		s.c.mutex.RUnlock()
+	}
+	if err != nil {
+		releaseSnapshots(snaps)
+		return nil, 0, err
+	}
+	return snaps, logSeq, nil
+}
+
+func (s *collectionSnapshot) capture() error {
+	c := s.c
+	if c.file == nil {
+		return fmt.Errorf("backup %s: %w", c.name, ErrCollectionClosed)
+	}
+
+	info, err := c.file.Stat()
+	if err != nil {
+		return fmt.Errorf("backup %s: %w", c.name, err)
+	}
+	s.size = info.Size()
+	s.generation = c.meta.Generation
+	// The collection tracks what was deleted since the file was last
+	// rewritten, so the file is not read for it.
+	for id := range c.deleted {
+		s.deleted = append(s.deleted, id)
+	}
+	sort.Strings(s.deleted)
+
+	s.file, err = c.storage.OpenFile(c.filePath, os.O_RDONLY, 0)
+	if err != nil {
+		return fmt.Errorf("backup %s: %w", c.name, err)
+	}
+
+	if !reflect.ValueOf(c.meta).IsZero() {
+		s.meta, err = json.MarshalIndent(c.meta, "", "  ")
+		if err != nil {
+			return fmt.Errorf("backup %s: %w", c.name, err)
+		}
+	}
+	return nil
+}
+
+func releaseSnapshots(snaps []*collectionSnapshot) {
+	for _, s := range snaps {
+		if s.file != nil {
+			s.file.Close()
+			s.file = nil
+		}
+		s.c.compactMutex.RUnlock()
+	}
+}
+
+func writeTarEntry(tw *tar.Writer, name string, size int64, r io.Reader) (BackupFile, error) {
+	hdr := &tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    size,
+		ModTime: time.Now(),
+		Format:  tar.FormatPAX,
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return BackupFile{}, fmt.Errorf("could not write %s to backup: %w", name, err)
+	}
+
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tw, h), r)
+	if err != nil {
+		return BackupFile{}, fmt.Errorf("could not write %s to backup: %w", name, err)
+	}
+	if n != size {
+		return BackupFile{}, fmt.Errorf("could not write %s to backup: copied %d of %d bytes", name, n, size)
+	}
+
+	return BackupFile{Name: name, Size: size, SHA256: hex.EncodeToString(h.Sum(nil))}, nil
+}
+
+// ReadManifest reads a whole backup archive, checks every file against the
+// manifest and returns the manifest. It is how a caller finds the parent for
+// BackupIncremental from an archive on disk.
+func ReadManifest(archive io.Reader) (*BackupManifest, error) {
+	return extractBackup(archive, "")
+}
+
+// Restore unpacks a full backup archive into dir. It is RestoreChain with a
+// single archive.
+func Restore(archive io.Reader, dir string) (*BackupManifest, error) {
+	return RestoreChain(dir, archive)
+}
+
+// RestoreChain restores a full backup followed by the incremental backups
+// taken after it, in order, into dir, which must not already hold any
+// collections. Everything is assembled and checked against the manifests'
+// sizes and checksums in a staging directory, and nothing is moved into dir
+// unless every archive applied cleanly. It returns the last manifest.
+func RestoreChain(dir string, archives ...io.Reader) (*BackupManifest, error) {
+	return RestoreChainWithConfig(dir, DefaultConfig, archives...)
+}
+
+// RestoreChainWithConfig is RestoreChain for backups of an encrypted
+// database, whose keys config must provide.
+func RestoreChainWithConfig(dir string, config Config, archives ...io.Reader) (*BackupManifest, error) {
+	crypt, err := newCrypter(config)
+	if err != nil {
+		return nil, err
+	}
+	if len(archives) == 0 {
+		return nil, fmt.Errorf("%w: no archives given", ErrBadBackup)
+	}
+
+	if err := prepareRestoreDir(dir); err != nil {
+		return nil, err
+	}
+
+	staging, err := os.MkdirTemp(dir, ".restore-")
+	if err != nil {
+		return nil, fmt.Errorf("could not create staging dir: %w", err)
+	}
+	defer os.RemoveAll(staging)
+
+	var manifest *BackupManifest
+	for i, archive := range archives {
+		part, err := os.MkdirTemp(staging, ".part-")
+		if err != nil {
+			return nil, fmt.Errorf("could not create staging dir: %w", err)
+		}
+
+		m, err := extractBackup(archive, part)
+		if err != nil {
+			return nil, fmt.Errorf("archive %d: %w", i+1, err)
+		}
+		switch {
+		case i == 0 && m.Kind == BackupIncremental:
+			return nil, fmt.Errorf("%w: the first archive must be a full backup", ErrBadBackup)
+		case i > 0 && (m.Kind != BackupIncremental || m.Parent != manifest.ID):
+			return nil, fmt.Errorf("%w: archive %d does not continue archive %d", ErrBadBackup, i+1, i)
+		}
+
+		if err := applyBackup(staging, part, m); err != nil {
+			return nil, fmt.Errorf("archive %d: %w", i+1, err)
+		}
+		if err := os.RemoveAll(part); err != nil {
+			return nil, err
+		}
+		manifest = m
+	}
+
+	for _, col := range manifest.collections() {
+		ids := col.Deleted
+		if col.SealedDeleted != nil {
+			if ids, err = openDeleted(crypt, col); err != nil {
+				return nil, fmt.Errorf("%s: %w", col.Name, err)
+			}
+		}
+		if len(ids) > 0 {
+			if err := purgeDeleted(filepath.Join(staging, col.Name+".toon"), ids, config, crypt); err != nil {
+				return nil, fmt.Errorf("%s: %w", col.Name, err)
+			}
+		}
+	}
+
+	if err := installFiles(staging, dir); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// prepareRestoreDir creates dir if needed and checks that it holds no
+// collections.
+func prepareRestoreDir(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("could not create data dir: %w", err)
+	}
+	existing, err := filepath.Glob(filepath.Join(dir, "*.toon"))
+	if err != nil {
+		return err
+	}
+	if len(existing) > 0 {
+		return fmt.Errorf("restore target %s already contains collections", dir)
+	}
+	return nil
+}
+
+// installFiles moves the files in staging into dir.
+func installFiles(staging, dir string) error {
+	files, err := os.ReadDir(staging)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		if err := os.Rename(filepath.Join(staging, f.Name()), filepath.Join(dir, f.Name())); err != nil {
+			return fmt.Errorf("could not install %s: %w", f.Name(), err)
+		}
+	}
+	return nil
+}
+
+// applyBackup brings the files in staging up to the state described by m,
+// using the files extracted from m's archive into part.
+func applyBackup(staging, part string, m *BackupManifest) error {
+	keep := make(map[string]bool)
+	for _, col := range m.collections() {
+		keep[col.Name+".toon"] = true
+		keep[col.Name+metaSuffix] = true
+
+		target := filepath.Join(staging, col.Name+".toon")
+		shipped := filepath.Join(part, col.Name+".toon")
+		if err := applyCollection(target, shipped, col); err != nil {
+			return fmt.Errorf("%s: %w", col.Name, err)
+		}
+
+		meta := col.Name + metaSuffix
+		err := os.Rename(filepath.Join(part, meta), filepath.Join(staging, meta))
+		if os.IsNotExist(err) {
+			err = os.Remove(filepath.Join(staging, meta))
+		}
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	// Collections missing from m were deleted after the previous backup.
+	files, err := os.ReadDir(staging)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if !f.IsDir() && !keep[f.Name()] {
+			if err := os.Remove(filepath.Join(staging, f.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func applyCollection(target, shipped string, col BackupCollection) error {
+	if col.Base == 0 {
+		err := os.Rename(shipped, target)
+		if os.IsNotExist(err) {
+			err = os.WriteFile(target, nil, 0644)
+		}
+		if err != nil {
+			return err
+		}
+	} else {
+		info, err := os.Stat(target)
+		if err != nil || info.Size() != col.Base {
+			return fmt.Errorf("%w: increment starts at offset %d, which the restored file does not end at", ErrBadBackup, col.Base)
+		}
+		if err := appendFile(target, shipped); err != nil {
+			return err
+		}
+	}
+
+	info, err := os.Stat(target)
+	if err != nil {
+		return err
+	}
+	if info.Size() != col.Offset {
+		return fmt.Errorf("%w: restored file is %d bytes, expected %d", ErrBadBackup, info.Size(), col.Offset)
+	}
+	f, err := os.Open(target)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	tail, err := tailHash(f, col.Offset)
+	if err != nil {
+		return err
+	}
+	if col.TailSHA256 != "" && tail != col.TailSHA256 {
+		return fmt.Errorf("%w: restored file does not match the backed up one", ErrBadBackup)
+	}
+	return nil
+}
+
+// purgeDeleted compacts the restored collection file at path without the
+// given documents, writing its blocks with the codec the restored database
+// is configured for, or the one the collection's metadata names.
+func purgeDeleted(path string, ids []string, config Config, crypt *crypter) error {
+	file, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	name := strings.TrimSuffix(filepath.Base(path), ".toon")
+	c := newCollection(OSStorage{}, name, path, file)
+	c.crypt = crypt
+	c.fieldCrypt = newFieldCrypter(config)
+	if err := c.useCodecInternal(configCodec(config)); err != nil {
+		c.Close()
+		return err
+	}
+	defer c.Close()
+
+	if err := c.loadIndex(); err != nil {
+		return err
+	}
+	if err := c.loadMeta(); err != nil {
+		return err
+	}
+	for _, id := range ids {
+		delete(c.index, id)
+	}
+	return c.compact()
+}
+
+func sealDeleted(crypt *crypter, col BackupCollection) ([]byte, error) {
+	data, err := json.Marshal(col.Deleted)
+	if err != nil {
+		return nil, err
+	}
+	return crypt.seal(data, col.Name+metaSuffix)
+}
+
+func openDeleted(crypt *crypter, col BackupCollection) ([]string, error) {
+	data, err := crypt.openAt(col.SealedDeleted, col.Name+metaSuffix, manifestFileName, 0)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	if err := json.Unmarshal(data, &ids); err != nil {
+		return nil, fmt.Errorf("%w: bad deleted list: %v", ErrBadBackup, err)
+	}
+	return ids, nil
+}
+
+func appendFile(target, shipped string) error {
+	src, err := os.Open(shipped)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(target, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := dst.Sync(); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
+
+// extractBackup writes the archive's files into dir and verifies them
+// against the manifest. With an empty dir the files are only verified.
+func extractBackup(archive io.Reader, dir string) (*BackupManifest, error) {
+	tr := tar.NewReader(archive)
+	sums := make(map[string]BackupFile)
+	var manifest *BackupManifest
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrBadBackup, err)
+		}
+		if manifest != nil {
+			return nil, fmt.Errorf("%w: %s follows the manifest", ErrBadBackup, hdr.Name)
+		}
+
+		if hdr.Name == manifestFileName {
+			manifest = &BackupManifest{}
+			if err := json.NewDecoder(tr).Decode(manifest); err != nil {
+				return nil, fmt.Errorf("%w: could not read manifest: %v", ErrBadBackup, err)
+			}
+			continue
+		}
+
+		name := hdr.Name
+		if hdr.Typeflag != tar.TypeReg || name != filepath.Base(name) || strings.HasPrefix(name, ".") ||
+			!(strings.HasSuffix(name, ".toon") || strings.HasSuffix(name, metaSuffix)) {
+			return nil, fmt.Errorf("%w: unexpected entry %q", ErrBadBackup, name)
+		}
+		if _, dup := sums[name]; dup {
+			return nil, fmt.Errorf("%w: duplicate entry %q", ErrBadBackup, name)
+		}
+
+		path := ""
+		if dir != "" {
+			path = filepath.Join(dir, name)
+		}
+		sum, err := extractFile(tr, name, path)
+		if err != nil {
+			return nil, err
+		}
+		sums[name] = sum
+	}
+
+	if manifest == nil {
+		return nil, fmt.Errorf("%w: missing manifest", ErrBadBackup)
+	}
+	if manifest.Version != backupVersion {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrBadBackup, manifest.Version)
+	}
+	if len(manifest.Files) != len(sums) {
+		return nil, fmt.Errorf("%w: manifest lists %d files, archive holds %d", ErrBadBackup, len(manifest.Files), len(sums))
+	}
+	for _, f := range manifest.Files {
+		got, ok := sums[f.Name]
+		if !ok {
+			return nil, fmt.Errorf("%w: %s is missing", ErrBadBackup, f.Name)
+		}
+		if got != f {
+			return nil, fmt.Errorf("%w: checksum mismatch for %s", ErrBadBackup, f.Name)
+		}
+	}
+
+	return manifest, nil
+}
+
+// extractFile copies r to path, or just hashes it if path is empty.
+func extractFile(r io.Reader, name, path string) (BackupFile, error) {
+	h := sha256.New()
+	if path == "" {
+		n, err := io.Copy(h, r)
+		if err != nil {
+			return BackupFile{}, fmt.Errorf("%w: could not read %s: %v", ErrBadBackup, name, err)
+		}
+		return BackupFile{Name: name, Size: n, SHA256: hex.EncodeToString(h.Sum(nil))}, nil
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return BackupFile{}, fmt.Errorf("could not extract %s: %w", name, err)
+	}
+	defer f.Close()
+
+	n, err := io.Copy(io.MultiWriter(f, h), r)
+	if err != nil {
+		return BackupFile{}, fmt.Errorf("%w: could not read %s: %v", ErrBadBackup, name, err)
+	}
+	if err := f.Sync(); err != nil {
+		return BackupFile{}, fmt.Errorf("could not extract %s: %w", name, err)
+	}
+
+	return BackupFile{Name: name, Size: n, SHA256: hex.EncodeToString(h.Sum(nil))}, nil
+}
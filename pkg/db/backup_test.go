@@ -0,0 +1,317 @@
+package db
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/Al3x-Myku/FlyDB/pkg/schema"
+)
+
+func TestBackupRestore(t *testing.T) {
+	dataDir := "./test-backup"
+	restoreDir := "./test-backup-restored"
+	defer os.RemoveAll(dataDir)
+	defer os.RemoveAll(restoreDir)
+
+	db, _ := NewDB(dataDir)
+	defer db.Close()
+
+	users, _ := db.GetCollection("users")
+	orders, _ := db.GetCollection("orders")
+	for i := 0; i < 100; i++ {
+		users.Insert(Document{"id": fmt.Sprintf("u%d", i), "n": i})
+		orders.Insert(Document{"id": fmt.Sprintf("o%d", i), "user": fmt.Sprintf("u%d", i)})
+	}
+	users.Commit()
+	orders.Commit()
+	s, _ := schema.Parse([]byte(`{"required": ["n"]}`))
+	users.SetSchema(s)
+	users.Delete("u99") // still in the data file, so the restore must drop it
+
+	// Writers and compactions keep going while the backup runs.
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			orders.Insert(Document{"id": fmt.Sprintf("late%d", i)})
+			orders.Commit()
+			if i%10 == 0 {
+				orders.Compact()
+			}
+		}
+	}()
+
+	var archive bytes.Buffer
+	manifest, err := db.Backup(&archive)
+	close(stop)
+	wg.Wait()
+	if err != nil {
+		t.Fatalf("Backup failed: %v", err)
+	}
+	if len(manifest.Files) != 3 {
+		t.Errorf("Expected 2 data files and 1 metadata file, got %+v", manifest.Files)
+	}
+
+	if _, err := Restore(bytes.NewReader(archive.Bytes()), restoreDir); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	if _, err := Restore(bytes.NewReader(archive.Bytes()), restoreDir); err == nil {
+		t.Errorf("Expected restore into a populated directory to fail")
+	}
+
+	restored, _ := NewDB(restoreDir)
+	defer restored.Close()
+	rusers, _ := restored.GetCollection("users")
+	rorders, _ := restored.GetCollection("orders")
+	all, _ := rusers.All()
+	if len(all) != 99 {
+		t.Errorf("Expected 99 users, got %d", len(all))
+	}
+	if rusers.Schema() == nil {
+		t.Errorf("Schema not restored")
+	}
+	if doc, err := rorders.FindByID("o42"); err != nil || doc["user"] != "u42" {
+		t.Errorf("Unexpected restored order: %v, %v", doc, err)
+	}
+
+	// Damaged archives are rejected before anything is installed.
+	corrupt := append([]byte(nil), archive.Bytes()...)
+	corrupt[1024] ^= 0xff
+	for name, data := range map[string][]byte{
+		"corrupt":   corrupt,
+		"truncated": archive.Bytes()[:archive.Len()/2],
+	} {
+		dir := "./test-backup-" + name
+		defer os.RemoveAll(dir)
+		if _, err := Restore(bytes.NewReader(data), dir); !errors.Is(err, ErrBadBackup) {
+			t.Errorf("%s: expected ErrBadBackup, got %v", name, err)
+		}
+		if names, _ := (&DB{dataDir: dir, storage: OSStorage{}}).ListCollections(); len(names) != 0 {
+			t.Errorf("%s: collections installed from a bad archive: %v", name, names)
+		}
+	}
+}
+
+func TestIncrementalBackup(t *testing.T) {
+	dataDir := "./test-incremental"
+	restoreDir := "./test-incremental-restored"
+	defer os.RemoveAll(dataDir)
+	defer os.RemoveAll(restoreDir)
+
+	db, _ := NewDBWithConfig(dataDir, Config{})
+	defer db.Close()
+
+	users, _ := db.GetCollection("users")
+	orders, _ := db.GetCollection("orders")
+	scratch, _ := db.GetCollection("scratch")
+	for i := 0; i < 50; i++ {
+		users.Insert(Document{"id": fmt.Sprintf("u%d", i), "name": "someone with a long name"})
+		orders.Insert(Document{"id": fmt.Sprintf("o%d", i), "total": i})
+	}
+	users.Commit()
+	orders.Commit()
+	scratch.Insert(Document{"id": "x"})
+	scratch.Commit()
+
+	var base bytes.Buffer
+	baseManifest, err := db.Backup(&base)
+	if err != nil {
+		t.Fatalf("Backup failed: %v", err)
+	}
+
+	// Only appended bytes are shipped for an unchanged collection.
+	users.Insert(Document{"id": "u50", "name": "new"})
+	users.Commit()
+	var inc1 bytes.Buffer
+	parent, err := ReadManifest(bytes.NewReader(base.Bytes()))
+	if err != nil || parent.ID != baseManifest.ID {
+		t.Fatalf("ReadManifest returned %+v, %v", parent, err)
+	}
+	m1, err := db.BackupIncremental(&inc1, parent)
+	if err != nil {
+		t.Fatalf("BackupIncremental failed: %v", err)
+	}
+	for _, f := range m1.Files {
+		if f.Name == "orders.toon" || f.Name == "scratch.toon" {
+			t.Errorf("Unchanged collection %s was shipped", f.Name)
+		}
+		if f.Name == "users.toon" && f.Size > 100 {
+			t.Errorf("Expected only the new block for users, got %d bytes", f.Size)
+		}
+	}
+
+	// A compacted collection is copied in full; deleted and new collections
+	// are carried over.
+	orders.Update("o1", Document{"total": 100})
+	orders.Commit()
+	orders.Compact()
+	db.DeleteCollection("scratch")
+	fresh, _ := db.GetCollection("fresh")
+	fresh.Insert(Document{"id": "f1"})
+	fresh.Commit()
+
+	var inc2 bytes.Buffer
+	m2, err := db.BackupIncremental(&inc2, m1)
+	if err != nil {
+		t.Fatalf("BackupIncremental failed: %v", err)
+	}
+	for _, col := range m2.Collections {
+		if col.Name == "orders" && col.Base != 0 {
+			t.Errorf("Expected a full copy of compacted orders, got base %d", col.Base)
+		}
+	}
+
+	if _, err := RestoreChain(restoreDir, bytes.NewReader(base.Bytes()), bytes.NewReader(inc2.Bytes())); !errors.Is(err, ErrBadBackup) {
+		t.Errorf("Expected a broken chain to be rejected, got %v", err)
+	}
+	if _, err := RestoreChain(restoreDir, bytes.NewReader(inc1.Bytes())); !errors.Is(err, ErrBadBackup) {
+		t.Errorf("Expected a chain starting with an increment to be rejected, got %v", err)
+	}
+
+	last, err := RestoreChain(restoreDir, &base, &inc1, &inc2)
+	if err != nil {
+		t.Fatalf("RestoreChain failed: %v", err)
+	}
+	if last.ID != m2.ID {
+		t.Errorf("Expected the last manifest to be returned")
+	}
+
+	restored, _ := NewDB(restoreDir)
+	defer restored.Close()
+	names, _ := restored.ListCollections()
+	if fmt.Sprint(names) != "[fresh orders users]" {
+		t.Errorf("Unexpected restored collections %v", names)
+	}
+	rusers, _ := restored.GetCollection("users")
+	rorders, _ := restored.GetCollection("orders")
+	if all, _ := rusers.All(); len(all) != 51 {
+		t.Errorf("Expected 51 users, got %d", len(all))
+	}
+	if doc, _ := rorders.FindByID("o1"); doc["total"] != int64(100) {
+		t.Errorf("Expected updated order, got %v", doc)
+	}
+}
+
+// readCountingStorage counts the bytes read from files opened read-only,
+// as a backup opens the files it copies.
+type readCountingStorage struct {
+	Storage
+	mu   sync.Mutex
+	read int64
+}
+
+type readCountingFile struct {
+	File
+	s *readCountingStorage
+}
+
+func (s *readCountingStorage) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	f, err := s.Storage.OpenFile(name, flag, perm)
+	if err != nil || flag != os.O_RDONLY {
+		return f, err
+	}
+	return readCountingFile{f, s}, nil
+}
+
+func (f readCountingFile) ReadAt(p []byte, off int64) (int, error) {
+	n, err := f.File.ReadAt(p, off)
+	f.s.mu.Lock()
+	f.s.read += int64(n)
+	f.s.mu.Unlock()
+	return n, err
+}
+
+// TestIncrementalBackupReadsTail checks that an incremental backup reads
+// the appended tail of a file, not the whole of it, while still recording
+// deletes.
+func TestIncrementalBackupReadsTail(t *testing.T) {
+	st := &readCountingStorage{Storage: NewMemoryStorage()}
+	db, err := NewDBWithConfig("data", Config{Storage: st})
+	if err != nil {
+		t.Fatalf("NewDB failed: %v", err)
+	}
+	defer db.Close()
+
+	users, _ := db.GetCollection("users")
+	for i := 0; i < 2000; i++ {
+		users.Insert(Document{"id": fmt.Sprintf("u%d", i), "name": "someone with a long name"})
+	}
+	users.Commit()
+	var base bytes.Buffer
+	parent, err := db.Backup(&base)
+	if err != nil {
+		t.Fatalf("Backup failed: %v", err)
+	}
+
+	users.Delete("u1")
+	users.Insert(Document{"id": "new"})
+	users.Commit()
+	st.read = 0
+	var inc bytes.Buffer
+	m, err := db.BackupIncremental(&inc, parent)
+	if err != nil {
+		t.Fatalf("BackupIncremental failed: %v", err)
+	}
+	if limit := int64(3 * tailCheckSize); st.read > limit {
+		t.Errorf("Incremental backup read %d bytes, expected at most %d", st.read, limit)
+	}
+	if len(m.Collections) != 1 || fmt.Sprint(m.Collections[0].Deleted) != "[u1]" {
+		t.Errorf("Expected u1 to be recorded as deleted, got %+v", m.Collections)
+	}
+}
+
+// TestRestoreKeepsCodec checks that the compaction dropping deleted
+// documents on restore writes blocks with the restore config's codec.
+func TestRestoreKeepsCodec(t *testing.T) {
+	dataDir := "./test-restore-codec"
+	restoreDir := "./test-restore-codec-restored"
+	defer os.RemoveAll(dataDir)
+	defer os.RemoveAll(restoreDir)
+
+	config := Config{Codec: "zlib"}
+	db, _ := NewDBWithConfig(dataDir, config)
+	defer db.Close()
+	users, _ := db.GetCollection("users")
+	for i := 0; i < 10; i++ {
+		users.Insert(Document{"id": fmt.Sprintf("u%d", i)})
+	}
+	users.Commit()
+	users.Delete("u0")
+	var archive bytes.Buffer
+	if _, err := db.Backup(&archive); err != nil {
+		t.Fatalf("Backup failed: %v", err)
+	}
+
+	if _, err := RestoreChainWithConfig(restoreDir, config, &archive); err != nil {
+		t.Fatalf("RestoreChainWithConfig failed: %v", err)
+	}
+	data, _ := os.ReadFile(filepath.Join(restoreDir, "users.toon"))
+	h, n, err := parseFileHeader(data)
+	if err != nil || h.features&FeatureCodecs == 0 {
+		t.Fatalf("Expected a header with codecs, got %+v, %v", h, err)
+	}
+	zlib := append(append([]byte(nil), codecMagic...), byte(len("zlib")))
+	zlib = append(zlib, "zlib"...)
+	blocks := 0
+	_, err = scanFileBlocks(data[n:], "users", nil, func(info BlockInfo, ids []string) {
+		if !bytes.HasPrefix(data[n+info.Offset:], zlib) {
+			t.Errorf("Block at %d is not zlib compressed", info.Offset)
+		}
+		blocks++
+	})
+	if err != nil || blocks == 0 {
+		t.Errorf("Scanning the restored file found %d blocks: %v", blocks, err)
+	}
+}
@@ -0,0 +1,319 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Al3x-Myku/FlyDB/pkg/raft"
+)
+
+// ErrNotLeader is returned by writes and linearizable reads on a cluster
+// node that is not the leader. The error names the leader when it is known.
+var ErrNotLeader = raft.ErrNotLeader
+
+const (
+	clusterDirName         = "raft"
+	clusterAppliedFileName = "applied"
+
+	defaultProposalTimeout = 10 * time.Second
+)
+
+type ClusterConfig struct {
+	// ID names this node. With raft.TCPTransport it is the address the
+	// transport listens on.
+	ID string
+
+	// Peers lists the founding members, including ID, and must be the same
+	// on all of them. A node joining a running cluster has none and is
+	// added with AddMember on the leader.
+	Peers []string
+
+	Transport raft.Transport
+
+	// ProposalTimeout bounds how long a write waits to be committed, for
+	// instance while the leader cannot reach a majority. Zero uses a
+	// default of 10s.
+	ProposalTimeout time.Duration
+
+	// TickInterval and ElectionTicks tune failure detection; see
+	// raft.Config.
+	TickInterval  time.Duration
+	ElectionTicks int
+}
+
+// ClusterNode is a database replicated with Raft. Commits, deletes of
+// committed documents and dropped collections go through the leader's log
+// and return once a majority has stored them and the local node has applied
+// them; every member applies the same changes in the same order. Inserts
+// and updates stay in the local memtable until Commit, so they must be made
+// on the leader too.
+//
+// Schemas, ID strategies and indexes are local to each node.
+type ClusterNode struct {
+	db      *DB
+	raft    *raft.Node
+	storage *raft.FileStorage
+	timeout time.Duration
+}
+
+// OpenCluster opens the database in dataDir as a member of a cluster. The
+// Raft log is kept in a subdirectory and replaces the mutation log, so
+// Config.MutationLog is ignored, as is Config.ReadOnly. Both are kept on
+// the local file system, so Config.Storage must be nil or OSStorage.
+func OpenCluster(dataDir string, config Config, cluster ClusterConfig) (*ClusterNode, error) {
+	if err := checkOSStorage(config, "cluster node"); err != nil {
+		return nil, err
+	}
+	config.MutationLog = false
+	config.ReadOnly = false
+	db, err := NewDBWithConfig(dataDir, config)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.LoadAllCollections(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	storage, err := raft.OpenFileStorage(filepath.Join(dataDir, clusterDirName))
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	applied, err := readApplied(dataDir)
+	if err != nil {
+		storage.Close()
+		db.Close()
+		return nil, err
+	}
+
+	n := &ClusterNode{db: db, storage: storage, timeout: cluster.ProposalTimeout}
+	if n.timeout <= 0 {
+		n.timeout = defaultProposalTimeout
+	}
+	db.cluster = n
+
+	n.raft, err = raft.NewNode(raft.Config{
+		ID:            cluster.ID,
+		Peers:         cluster.Peers,
+		Transport:     cluster.Transport,
+		Storage:       storage,
+		Apply:         n.apply,
+		Applied:       applied,
+		TickInterval:  cluster.TickInterval,
+		ElectionTicks: cluster.ElectionTicks,
+	})
+	if err != nil {
+		storage.Close()
+		db.Close()
+		return nil, err
+	}
+	return n, nil
+}
+
+func (n *ClusterNode) DB() *DB {
+	return n.db
+}
+
+// Step passes a message from the transport to the node.
+func (n *ClusterNode) Step(m raft.Message) {
+	n.raft.Step(m)
+}
+
+func (n *ClusterNode) Status() raft.Status {
+	return n.raft.Status()
+}
+
+func (n *ClusterNode) IsLeader() bool {
+	return n.raft.Status().State == raft.Leader
+}
+
+// ReadBarrier waits until the node has applied every write committed before
+// the call, so reads that follow are linearizable. It fails with
+// ErrNotLeader on followers.
+func (n *ClusterNode) ReadBarrier(ctx context.Context) error {
+	return n.notLeader(n.raft.ReadIndex(ctx))
+}
+
+// AddMember adds a node to the cluster. It must be called on the leader.
+// The new node should be running with no peers; it receives the whole
+// history from the leader.
+func (n *ClusterNode) AddMember(ctx context.Context, id string) error {
+	return n.notLeader(n.raft.AddMember(ctx, id))
+}
+
+// RemoveMember removes a node from the cluster. It must be called on the
+// leader, which may remove itself.
+func (n *ClusterNode) RemoveMember(ctx context.Context, id string) error {
+	return n.notLeader(n.raft.RemoveMember(ctx, id))
+}
+
+// Close stops the node and closes its database. The transport is left to
+// the caller.
+func (n *ClusterNode) Close() error {
+	n.raft.Stop()
+	err := n.storage.Close()
+	if cerr := n.db.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (n *ClusterNode) propose(rec logRecord) error {
+	rec.Time = time.Now().UTC()
+	rec, err := rec.seal(n.db.crypt)
+	if err != nil {
+		return fmt.Errorf("could not encrypt cluster entry: %w", err)
+	}
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("could not encode cluster entry: %w", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), n.timeout)
+	defer cancel()
+	return n.notLeader(n.raft.Propose(ctx, data))
+}
+
+func (n *ClusterNode) notLeader(err error) error {
+	if errors.Is(err, raft.ErrNotLeader) {
+		if leader := n.raft.Leader(); leader != "" {
+			return fmt.Errorf("%w; the leader is %s", ErrNotLeader, leader)
+		}
+	}
+	return err
+}
+
+// apply replays committed entries into the database. Deletes are not
+// written to data files, so collections that had any are compacted before
+// the batch counts as applied. Only committed documents are rewritten;
+// those in the memtable wait for their own commit through the log.
+func (n *ClusterNode) apply(entries []raft.Entry) error {
+	deleted := make(map[string]bool)
+	for _, e := range entries {
+		if e.Type != raft.EntryNormal {
+			continue
+		}
+		rec := &logRecord{}
+		dec := json.NewDecoder(bytes.NewReader(e.Data))
+		dec.UseNumber()
+		if err := dec.Decode(rec); err != nil {
+			return fmt.Errorf("%w: cluster entry %d: %v", ErrBadMutationLog, e.Index, err)
+		}
+		if err := rec.unseal(n.db.crypt, fmt.Sprintf("cluster entry %d", e.Index), 0); err != nil {
+			return err
+		}
+		rec.Seq = e.Index
+		if err := n.db.replay(rec, deleted); err != nil {
+			return fmt.Errorf("applying cluster entry %d: %w", e.Index, err)
+		}
+	}
+
+	for name := range deleted {
+		c, err := n.db.GetCollection(name)
+		if err != nil {
+			return err
+		}
+		if err := c.compactCommitted(); err != nil {
+			return fmt.Errorf("could not compact %s: %w", name, err)
+		}
+	}
+	return writeApplied(n.db.dataDir, entries[len(entries)-1].Index)
+}
+
+func readApplied(dataDir string) (uint64, error) {
+	data, err := os.ReadFile(filepath.Join(dataDir, clusterDirName, clusterAppliedFileName))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("could not read applied index: %w", err)
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+}
+
+func writeApplied(dataDir string, index uint64) error {
+	path := filepath.Join(dataDir, clusterDirName, clusterAppliedFileName)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strconv.FormatUint(index, 10)), 0644); err != nil {
+		return fmt.Errorf("could not save applied index: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("could not save applied index: %w", err)
+	}
+	return nil
+}
+
+// commitClustered commits the memtable through the cluster. The documents
+// stay in the memtable until they are applied, and only those are removed
+// afterwards, so changes made in the meantime are kept for the next commit.
+func (c *Collection) commitClustered() error {
+	c.mutex.RLock()
+	if c.file == nil {
+		c.mutex.RUnlock()
+		return ErrCollectionClosed
+	}
+	committed := append([]Document(nil), c.memtable...)
+	c.mutex.RUnlock()
+
+	if len(committed) == 0 {
+		return nil
+	}
+	if err := c.db.cluster.propose(logRecord{Op: logCommit, Collection: c.name, Documents: committed}); err != nil {
+		return err
+	}
+
+	proposed := make(map[uintptr]bool, len(committed))
+	for _, doc := range committed {
+		proposed[reflect.ValueOf(doc).Pointer()] = true
+	}
+
+	c.mutex.Lock()
+	kept := make([]Document, 0)
+	for _, doc := range c.memtable {
+		if !proposed[reflect.ValueOf(doc).Pointer()] {
+			kept = append(kept, doc)
+		}
+	}
+	c.memtable = kept
+	c.publish(ChangeCommit, "", nil)
+	c.mutex.Unlock()
+
+	c.runAfterCommit(committed)
+	return nil
+}
+
+// deleteClustered deletes a committed document through the cluster. A
+// document that is only in the memtable is deleted locally.
+func (c *Collection) deleteClustered(id string) error {
+	c.mutex.Lock()
+	if c.file == nil {
+		c.mutex.Unlock()
+		return ErrCollectionClosed
+	}
+	if _, ok := c.index[id]; !ok {
+		defer c.mutex.Unlock()
+		if !c.deleteInternal(id) {
+			return ErrNotFound
+		}
+		c.publish(ChangeDelete, id, nil)
+		return nil
+	}
+	c.mutex.Unlock()
+
+	if err := c.db.cluster.propose(logRecord{Op: logDelete, Collection: c.name, ID: id}); err != nil {
+		return err
+	}
+	c.mutex.Lock()
+	c.publish(ChangeDelete, id, nil)
+	c.mutex.Unlock()
+	return nil
+}
@@ -0,0 +1,229 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Al3x-Myku/FlyDB/pkg/raft"
+)
+
+type testCluster struct {
+	t       *testing.T
+	network *raft.Network
+	nodes   map[string]*ClusterNode
+}
+
+func (tc *testCluster) open(id string, peers []string) *ClusterNode {
+	tc.t.Helper()
+	node, err := OpenCluster("./test-cluster-"+id, DefaultConfig, ClusterConfig{
+		ID:            id,
+		Peers:         peers,
+		Transport:     tc.network,
+		TickInterval:  2 * time.Millisecond,
+		ElectionTicks: 10,
+	})
+	if err != nil {
+		tc.t.Fatalf("OpenCluster failed: %v", err)
+	}
+	tc.network.Attach(id, node.Step)
+	tc.nodes[id] = node
+	return node
+}
+
+func (tc *testCluster) close(id string) {
+	tc.network.Detach(id)
+	tc.nodes[id].Close()
+	delete(tc.nodes, id)
+}
+
+func (tc *testCluster) leader(ids ...string) *ClusterNode {
+	tc.t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, id := range ids {
+			if n := tc.nodes[id]; n.IsLeader() && n.ReadBarrier(context.Background()) == nil {
+				return n
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	tc.t.Fatalf("No leader elected among %v", ids)
+	return nil
+}
+
+// sync waits for the given nodes to apply everything the leader has.
+func (tc *testCluster) sync(leader *ClusterNode, ids ...string) {
+	tc.t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	commit := leader.Status().Commit
+	for _, id := range ids {
+		if err := tc.nodes[id].raft.WaitApplied(ctx, commit); err != nil {
+			tc.t.Fatalf("Node %s did not catch up: %v", id, err)
+		}
+	}
+}
+
+func (tc *testCluster) count(id string) int {
+	users, _ := tc.nodes[id].DB().GetCollection("users")
+	docs, _ := users.All()
+	return len(docs)
+}
+
+func TestCluster(t *testing.T) {
+	ids := []string{"a", "b", "c"}
+	tc := &testCluster{t: t, network: raft.NewNetwork(), nodes: make(map[string]*ClusterNode)}
+	for _, id := range append(ids, "d") {
+		defer os.RemoveAll("./test-cluster-" + id)
+	}
+	defer func() {
+		for id := range tc.nodes {
+			tc.close(id)
+		}
+	}()
+	for _, id := range ids {
+		tc.open(id, ids)
+	}
+
+	leader := tc.leader(ids...)
+	users, _ := leader.DB().GetCollection("users")
+	for i := 0; i < 10; i++ {
+		users.Insert(Document{"id": fmt.Sprintf("u%d", i), "n": i})
+	}
+	if err := users.Commit(); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	if users.Size() != 0 {
+		t.Errorf("Expected an empty memtable after commit, got %d", users.Size())
+	}
+	if err := users.Delete("u0"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	tc.sync(leader, ids...)
+	for _, id := range ids {
+		if n := tc.count(id); n != 9 {
+			t.Errorf("Node %s has %d documents, want 9", id, n)
+		}
+	}
+
+	// Followers refuse writes and linearizable reads.
+	var followers []string
+	for _, id := range ids {
+		if tc.nodes[id] != leader {
+			followers = append(followers, id)
+		}
+	}
+	replica, _ := tc.nodes[followers[0]].DB().GetCollection("users")
+	replica.Insert(Document{"id": "x"})
+	if err := replica.Commit(); !errors.Is(err, ErrNotLeader) {
+		t.Errorf("Expected ErrNotLeader on follower commit, got %v", err)
+	}
+	replica.Delete("x")
+	if err := tc.nodes[followers[0]].ReadBarrier(context.Background()); !errors.Is(err, ErrNotLeader) {
+		t.Errorf("Expected ErrNotLeader on follower read, got %v", err)
+	}
+
+	// When the leader is cut off, the others elect a new one and carry on.
+	oldID := leader.Status().ID
+	tc.network.Isolate(oldID)
+	leader = tc.leader(followers...)
+	users, _ = leader.DB().GetCollection("users")
+	users.Insert(Document{"id": "u10", "n": 10})
+	if err := users.Commit(); err != nil {
+		t.Fatalf("Commit on new leader failed: %v", err)
+	}
+	tc.network.Heal()
+	tc.sync(leader, ids...)
+	if n := tc.count(oldID); n != 10 {
+		t.Errorf("Old leader has %d documents after rejoining, want 10", n)
+	}
+
+	// A restarted node keeps its data, including deletes, and catches up.
+	tc.close(oldID)
+	users.Insert(Document{"id": "u11", "n": 11})
+	users.Commit()
+	tc.open(oldID, ids)
+	tc.sync(leader, ids...)
+	if n := tc.count(oldID); n != 11 {
+		t.Errorf("Restarted node has %d documents, want 11", n)
+	}
+	restarted, _ := tc.nodes[oldID].DB().GetCollection("users")
+	if _, err := restarted.FindByID("u0"); err != ErrNotFound {
+		t.Errorf("Expected delete to survive a restart, got %v", err)
+	}
+
+	// A new member receives the whole history.
+	tc.open("d", nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := leader.AddMember(ctx, "d"); err != nil {
+		t.Fatalf("AddMember failed: %v", err)
+	}
+	if err := leader.DB().DeleteCollection("users"); err != nil {
+		t.Fatalf("DeleteCollection failed: %v", err)
+	}
+	tc.sync(leader, "a", "b", "c", "d")
+	for id, n := range tc.nodes {
+		if names, _ := n.DB().ListCollections(); len(names) != 0 {
+			t.Errorf("Node %s still has collections %v", id, names)
+		}
+	}
+}
+
+// TestClusterDeleteKeepsMemtable checks that the compaction after a
+// replicated delete does not write the leader's uncommitted documents to
+// its data file, where the other nodes would never see them.
+func TestClusterDeleteKeepsMemtable(t *testing.T) {
+	ids := []string{"p", "q", "r"}
+	tc := &testCluster{t: t, network: raft.NewNetwork(), nodes: make(map[string]*ClusterNode)}
+	for _, id := range ids {
+		defer os.RemoveAll("./test-cluster-" + id)
+	}
+	defer func() {
+		for id := range tc.nodes {
+			tc.close(id)
+		}
+	}()
+	for _, id := range ids {
+		tc.open(id, ids)
+	}
+
+	leader := tc.leader(ids...)
+	users, _ := leader.DB().GetCollection("users")
+	users.Insert(Document{"id": "u1"})
+	if err := users.Commit(); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	users.Insert(Document{"id": "u2"})
+	if err := users.Delete("u1"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if err := users.Compact(); err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+	tc.sync(leader, ids...)
+
+	if users.Size() != 1 || users.IndexSize() != 0 {
+		t.Errorf("Expected u2 to stay uncommitted, memtable %d, index %d", users.Size(), users.IndexSize())
+	}
+	for _, id := range ids {
+		c, _ := tc.nodes[id].DB().GetCollection("users")
+		if c.IndexSize() != 0 {
+			t.Errorf("Node %s has %d committed documents, want 0", id, c.IndexSize())
+		}
+	}
+
+	if err := users.Commit(); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	tc.sync(leader, ids...)
+	for _, id := range ids {
+		if n := tc.count(id); n != 1 {
+			t.Errorf("Node %s has %d documents, want 1", id, n)
+		}
+	}
+}
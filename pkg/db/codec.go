@@ -0,0 +1,349 @@
+package db
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ErrUnknownCodec is returned for a codec name that has not been
+// registered, including when reading a block written with it.
+var ErrUnknownCodec = errors.New("unknown compression codec")
+
+// Codec compresses blocks. Every compressed block records the codec's ID,
+// so blocks written with different codecs can share a file, and a codec
+// must stay registered for as long as any block uses it.
+type Codec interface {
+	ID() string
+	Compress(src []byte) ([]byte, error)
+	Decompress(src []byte) ([]byte, error)
+}
+
+// LeveledCodec is a codec with a tunable compression level, chosen with a
+// name such as "gzip:9". The level only affects compression, so blocks are
+// decompressed with whichever level is registered.
+type LeveledCodec interface {
+	Codec
+	WithLevel(level int) (Codec, error)
+}
+
+var codecs = struct {
+	sync.RWMutex
+	byID map[string]Codec
+}{byID: map[string]Codec{
+	"none":  noCodec{},
+	"gzip":  GzipCodec{Level: gzip.DefaultCompression},
+	"zlib":  ZlibCodec{Level: zlib.DefaultCompression},
+	"flate": FlateCodec{Level: flate.DefaultCompression},
+}}
+
+// RegisterCodec makes a codec available to every database in the process,
+// for instance one for zstd or snappy supplied by the application. IDs are
+// at most 255 bytes and may not contain ':'.
+func RegisterCodec(c Codec) error {
+	id := c.ID()
+	if id == "" || len(id) > 255 || strings.Contains(id, ":") {
+		return fmt.Errorf("invalid codec ID %q", id)
+	}
+	codecs.Lock()
+	defer codecs.Unlock()
+	if _, ok := codecs.byID[id]; ok {
+		return fmt.Errorf("codec %q is already registered", id)
+	}
+	codecs.byID[id] = c
+	return nil
+}
+
+// Codecs returns the IDs of the registered codecs.
+func Codecs() []string {
+	codecs.RLock()
+	defer codecs.RUnlock()
+	ids := make([]string, 0, len(codecs.byID))
+	for id := range codecs.byID {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func lookupCodec(id string) (Codec, error) {
+	codecs.RLock()
+	defer codecs.RUnlock()
+	c, ok := codecs.byID[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownCodec, id)
+	}
+	return c, nil
+}
+
+// ParseCodec returns the codec named by name: a registered ID, optionally
+// followed by ":" and a level for a LeveledCodec, such as "gzip:9".
+func ParseCodec(name string) (Codec, error) {
+	id, levelStr, hasLevel := strings.Cut(name, ":")
+	c, err := lookupCodec(id)
+	if err != nil || !hasLevel {
+		return c, err
+	}
+	lc, ok := c.(LeveledCodec)
+	if !ok {
+		return nil, fmt.Errorf("codec %s has no compression levels", id)
+	}
+	level, err := strconv.Atoi(levelStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid level in codec %q", name)
+	}
+	return lc.WithLevel(level)
+}
+
+// configCodec returns the name of the codec for new blocks under config.
+func configCodec(config Config) string {
+	switch {
+	case config.Codec != "":
+		return config.Codec
+	case config.Compression:
+		return "gzip"
+	}
+	return "none"
+}
+
+// SetCodec chooses the codec for the collection's new blocks by a name
+// accepted by ParseCodec, and persists the choice in its metadata. Existing
+// blocks keep their codec until Compact rewrites them. An empty name goes
+// back to the database's codec.
+func (c *Collection) SetCodec(name string) error {
+	if err := c.checkWritable(); err != nil {
+		return err
+	}
+	if name != "" {
+		if _, err := ParseCodec(name); err != nil {
+			return err
+		}
+	}
+	use := name
+	if use == "" {
+		use = "none"
+		if c.db != nil {
+			use = c.db.defaultCodec()
+		}
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.file == nil {
+		return ErrCollectionClosed
+	}
+
+	previous := c.meta.Codec
+	c.meta.Codec = name
+	if err := c.saveMetaInternal(); err != nil {
+		c.meta.Codec = previous
+		return err
+	}
+	return c.useCodecInternal(use)
+}
+
+// Codec returns the name of the codec for new blocks.
+func (c *Collection) Codec() string {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.codecName
+}
+
+func (c *Collection) useCodecInternal(name string) error {
+	codec, err := ParseCodec(name)
+	if err != nil {
+		return err
+	}
+	c.codec = codec
+	c.codecName = name
+	return nil
+}
+
+type noCodec struct{}
+
+func (noCodec) ID() string                            { return "none" }
+func (noCodec) Compress(src []byte) ([]byte, error)   { return src, nil }
+func (noCodec) Decompress(src []byte) ([]byte, error) { return src, nil }
+
+// GzipCodec compresses with compress/gzip. Level is one of its constants,
+// such as gzip.BestSpeed.
+type GzipCodec struct{ Level int }
+
+func (GzipCodec) ID() string { return "gzip" }
+
+func (c GzipCodec) WithLevel(level int) (Codec, error) {
+	if _, err := gzip.NewWriterLevel(io.Discard, level); err != nil {
+		return nil, err
+	}
+	return GzipCodec{Level: level}, nil
+}
+
+func (c GzipCodec) Compress(src []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := gzip.NewWriterLevel(&buf, c.Level)
+	if err != nil {
+		return nil, err
+	}
+	return finishCompress(&buf, w, src)
+}
+
+func (GzipCodec) Decompress(src []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(src))
+	if err != nil {
+		return nil, err
+	}
+	return finishDecompress(r)
+}
+
+// ZlibCodec compresses with compress/zlib.
+type ZlibCodec struct{ Level int }
+
+func (ZlibCodec) ID() string { return "zlib" }
+
+func (c ZlibCodec) WithLevel(level int) (Codec, error) {
+	if _, err := zlib.NewWriterLevel(io.Discard, level); err != nil {
+		return nil, err
+	}
+	return ZlibCodec{Level: level}, nil
+}
+
+func (c ZlibCodec) Compress(src []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := zlib.NewWriterLevel(&buf, c.Level)
+	if err != nil {
+		return nil, err
+	}
+	return finishCompress(&buf, w, src)
+}
+
+func (ZlibCodec) Decompress(src []byte) ([]byte, error) {
+	r, err := zlib.NewReader(bytes.NewReader(src))
+	if err != nil {
+		return nil, err
+	}
+	return finishDecompress(r)
+}
+
+// FlateCodec writes raw DEFLATE with compress/flate, without the headers
+// and checksums of gzip and zlib.
+type FlateCodec struct{ Level int }
+
+func (FlateCodec) ID() string { return "flate" }
+
+func (c FlateCodec) WithLevel(level int) (Codec, error) {
+	if _, err := flate.NewWriter(io.Discard, level); err != nil {
+		return nil, err
+	}
+	return FlateCodec{Level: level}, nil
+}
+
+func (c FlateCodec) Compress(src []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, c.Level)
+	if err != nil {
+		return nil, err
+	}
+	return finishCompress(&buf, w, src)
+}
+
+func (FlateCodec) Decompress(src []byte) ([]byte, error) {
+	return finishDecompress(flate.NewReader(bytes.NewReader(src)))
+}
+
+func finishCompress(buf *bytes.Buffer, w io.WriteCloser, src []byte) ([]byte, error) {
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func finishDecompress(r io.ReadCloser) ([]byte, error) {
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// Compressed blocks are framed as
+//
+//	magic (4) | codec ID length (1) | codec ID | length (4) | payload
+//
+// Like sealed blocks, the magic starts with a byte that cannot begin TOON
+// text or a gzip stream. Uncompressed blocks are written as plain TOON, and
+// blocks from before codecs were recorded are bare gzip streams.
+var codecMagic = []byte{0xfe, 'F', 'C', 1}
+
+func isCodecFrame(data []byte) bool {
+	return bytes.HasPrefix(data, codecMagic)
+}
+
+// codecFrameLen returns the length of the codec frame at the start of data,
+// or false if data is too short to hold it.
+func codecFrameLen(data []byte) (int64, bool) {
+	header := len(codecMagic) + 1
+	if len(data) < header {
+		return 0, false
+	}
+	header += int(data[len(codecMagic)]) + 4
+	if len(data) < header {
+		return 0, false
+	}
+	total := int64(header) + int64(binary.BigEndian.Uint32(data[header-4:header]))
+	return total, int64(len(data)) >= total
+}
+
+// compressBlock compresses a TOON block with c and frames it.
+func compressBlock(c Codec, block []byte) ([]byte, error) {
+	if c.ID() == "none" {
+		return block, nil
+	}
+	payload, err := c.Compress(block)
+	if err != nil {
+		return nil, fmt.Errorf("could not compress block with %s: %w", c.ID(), err)
+	}
+	frame := append([]byte(nil), codecMagic...)
+	frame = append(frame, byte(len(c.ID())))
+	frame = append(frame, c.ID()...)
+	frame = binary.BigEndian.AppendUint32(frame, uint32(len(payload)))
+	return append(frame, payload...), nil
+}
+
+// decompressBlock returns the TOON text of a block, which is either the
+// text itself, a codec frame or a bare gzip stream.
+func decompressBlock(buf []byte) ([]byte, error) {
+	switch {
+	case isCodecFrame(buf):
+		n, ok := codecFrameLen(buf)
+		if !ok {
+			return nil, errors.New("truncated compressed block")
+		}
+		idEnd := len(codecMagic) + 1 + int(buf[len(codecMagic)])
+		c, err := lookupCodec(string(buf[len(codecMagic)+1 : idEnd]))
+		if err != nil {
+			return nil, err
+		}
+		block, err := c.Decompress(buf[idEnd+4 : n])
+		if err != nil {
+			return nil, fmt.Errorf("could not decompress block with %s: %w", c.ID(), err)
+		}
+		return block, nil
+	case len(buf) >= 2 && buf[0] == 0x1f && buf[1] == 0x8b:
+		block, err := GzipCodec{}.Decompress(buf)
+		if err != nil {
+			return nil, fmt.Errorf("could not decompress block: %w", err)
+		}
+		return block, nil
+	}
+	return buf, nil
+}
@@ -0,0 +1,116 @@
+package db
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/Al3x-Myku/FlyDB/pkg/toon"
+)
+
+// reverseCodec stands in for a third-party codec.
+type reverseCodec struct{}
+
+func (reverseCodec) ID() string { return "test-reverse" }
+
+func (reverseCodec) Compress(src []byte) ([]byte, error) {
+	out := slices.Clone(src)
+	slices.Reverse(out)
+	return out, nil
+}
+
+func (r reverseCodec) Decompress(src []byte) ([]byte, error) {
+	return r.Compress(src)
+}
+
+func TestCodecs(t *testing.T) {
+	dataDir := "./test-codecs"
+	defer os.RemoveAll(dataDir)
+
+	if err := RegisterCodec(reverseCodec{}); err != nil {
+		t.Fatalf("RegisterCodec failed: %v", err)
+	}
+	if err := RegisterCodec(reverseCodec{}); err == nil {
+		t.Errorf("Expected registering the same ID twice to fail")
+	}
+	if _, err := ParseCodec("zstd"); !errors.Is(err, ErrUnknownCodec) {
+		t.Errorf("Expected ErrUnknownCodec, got %v", err)
+	}
+	if _, err := ParseCodec("gzip:42"); err == nil {
+		t.Errorf("Expected an invalid gzip level to fail")
+	}
+
+	// A block from before codecs were recorded: a bare gzip stream.
+	os.MkdirAll(dataDir, 0755)
+	legacy, _ := toon.Encode("items", []Document{{"id": "legacy"}})
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	w.Write(legacy)
+	w.Close()
+	os.WriteFile(filepath.Join(dataDir, "items.toon"), gz.Bytes(), 0644)
+
+	db, err := NewDBWithConfig(dataDir, Config{Codec: "gzip:9"})
+	if err != nil {
+		t.Fatalf("NewDB failed: %v", err)
+	}
+	items, _ := db.GetCollection("items")
+	if items.Codec() != "gzip:9" {
+		t.Errorf("Expected the database's codec, got %s", items.Codec())
+	}
+
+	// One block per codec in the same file.
+	for i, codec := range []string{"gzip:9", "none", "zlib", "flate:1", "test-reverse"} {
+		if err := items.SetCodec(codec); err != nil {
+			t.Fatalf("SetCodec(%s) failed: %v", codec, err)
+		}
+		items.Insert(Document{"id": fmt.Sprintf("doc%d", i), "codec": codec})
+		if err := items.Commit(); err != nil {
+			t.Fatalf("Commit with %s failed: %v", codec, err)
+		}
+	}
+	db.Close()
+
+	db, _ = NewDB(dataDir)
+	items, err = db.GetCollection("items")
+	if err != nil {
+		t.Fatalf("GetCollection failed: %v", err)
+	}
+	if items.Codec() != "test-reverse" {
+		t.Errorf("Expected the collection's codec to persist, got %s", items.Codec())
+	}
+	if n := len(mustAll(t, items)); n != 6 {
+		t.Errorf("Expected 6 documents from mixed blocks, got %d", n)
+	}
+	for i := 0; i < 5; i++ {
+		if _, err := items.FindByID(fmt.Sprintf("doc%d", i)); err != nil {
+			t.Errorf("FindByID(doc%d) failed: %v", i, err)
+		}
+	}
+
+	// Compact migrates every block to the current codec.
+	items.SetCodec("none")
+	if err := items.Compact(); err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+	data, _ := os.ReadFile(filepath.Join(dataDir, "items.toon"))
+	if !bytes.HasPrefix(data[fileHeaderSize:], []byte("items[6]")) {
+		t.Errorf("Expected one uncompressed block after Compact, got %q", data[:min(len(data), 20)])
+	}
+	db.Close()
+
+	// A block written with a codec that is not registered fails to load
+	// rather than losing its documents.
+	frame, _ := compressBlock(reverseCodec{}, legacy)
+	frame[len(codecMagic)+1] = 'x'
+	os.WriteFile(filepath.Join(dataDir, "items.toon"), append(data, frame...), 0644)
+	db, _ = NewDB(dataDir)
+	defer db.Close()
+	if _, err := db.GetCollection("items"); !errors.Is(err, ErrUnknownCodec) {
+		t.Errorf("Expected ErrUnknownCodec, got %v", err)
+	}
+}
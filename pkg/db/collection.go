@@ -4,37 +4,74 @@ import (
 	"bufio"
 	"bytes"
 	"compress/gzip"
+	"errors"
 	"fmt"
 	"io"
 	"log"
-	"os"
+	"path/filepath"
+	"sort"
 	"sync"
 
 	"github.com/Al3x-Myku/FlyDB/pkg/toon"
 )
 
 type Collection struct {
-	name        string
-	filePath    string
-	file        *os.File
-	mutex       sync.RWMutex
-	memtable    []Document
-	index       map[string]BlockInfo
-	compression bool
+	db           *DB
+	name         string
+	filePath     string
+	storage      Storage
+	file         File
+	mutex        sync.RWMutex
+	compactMutex sync.RWMutex // held for reading by backups in progress
+	memtable     []Document
+	index        map[string]BlockInfo
+	deleted      map[string]bool // removed from index but still in the file
+	codec        Codec
+	codecName    string
+	crypt        *crypter // nil unless blocks are encrypted
+	fieldCrypt   *crypter // nil unless field keys are configured
+	textIndexes  map[string]*textIndex
+	fieldIndexes map[string]*fieldIndex
+	hooks        hooks
+	meta         collectionMeta
+	sequence     int64
+	format       fileHeader // version 0 for a legacy file
+	scanned      int64      // end of the last complete block in the file
+	unsyncedDir  bool       // the file's directory entry may not be durable
 }
 
-func newCollection(name, filePath string, file *os.File, compression bool) *Collection {
+func newCollection(storage Storage, name, filePath string, file File) *Collection {
 	return &Collection{
-		name:        name,
-		filePath:    filePath,
-		file:        file,
-		memtable:    make([]Document, 0),
-		index:       make(map[string]BlockInfo),
-		compression: compression,
+		name:         name,
+		filePath:     filePath,
+		storage:      storage,
+		file:         file,
+		memtable:     make([]Document, 0),
+		index:        make(map[string]BlockInfo),
+		deleted:      make(map[string]bool),
+		codec:        noCodec{},
+		codecName:    "none",
+		format:       fileHeader{version: FormatVersion},
+		textIndexes:  make(map[string]*textIndex),
+		fieldIndexes: make(map[string]*fieldIndex),
+		unsyncedDir:  true,
 	}
 }
 
+// Insert adds doc to the memtable and returns its id. A document without an
+// id gets one from the collection's IDStrategy, or is rejected with
+// ErrMissingID if there is none.
 func (c *Collection) Insert(doc Document) (string, error) {
+	if err := c.checkWritable(); err != nil {
+		return "", err
+	}
+	if err := c.assignID(doc); err != nil {
+		return "", err
+	}
+	if err := c.runBeforeInsert(doc); err != nil {
+		return "", err
+	}
+
 	idVal, ok := doc["id"]
 	if !ok {
 		return "", ErrMissingID
@@ -52,14 +89,32 @@ func (c *Collection) Insert(doc Document) (string, error) {
 	if c.file == nil {
 		return "", ErrCollectionClosed
 	}
+	if err := c.validateInternal(doc); err != nil {
+		return "", err
+	}
+	doc, err := c.encryptFieldsInternal(doc)
+	if err != nil {
+		return "", err
+	}
 
 	c.memtable = append(c.memtable, doc)
+	c.publish(ChangeInsert, id, doc)
 	return id, nil
 }
 
 // Delete removes a document from the memtable and index
 // Note: This is a logical delete that removes from memory and creates a tombstone
 func (c *Collection) Delete(id string) error {
+	if err := c.checkWritable(); err != nil {
+		return err
+	}
+	if err := c.runBeforeDelete(id); err != nil {
+		return err
+	}
+	if c.db != nil && c.db.cluster != nil {
+		return c.deleteClustered(id)
+	}
+
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
 
@@ -67,6 +122,25 @@ func (c *Collection) Delete(id string) error {
 		return ErrCollectionClosed
 	}
 
+	// Deleting a committed document takes effect at once, so it is logged
+	// now rather than at the next commit.
+	if _, ok := c.index[id]; ok {
+		if err := c.logMutation(logRecord{Op: logDelete, ID: id}); err != nil {
+			return err
+		}
+	}
+
+	if !c.deleteInternal(id) {
+		return ErrNotFound
+	}
+
+	c.publish(ChangeDelete, id, nil)
+	return nil
+}
+
+// deleteInternal removes id from the memtable and the indexes and reports
+// whether it was found in either.
+func (c *Collection) deleteInternal(id string) bool {
 	// Remove from memtable
 	found := false
 	for i := len(c.memtable) - 1; i >= 0; i-- {
@@ -80,26 +154,49 @@ func (c *Collection) Delete(id string) error {
 	// Remove from index (will be gone after commit)
 	if _, ok := c.index[id]; ok {
 		delete(c.index, id)
+		c.deleted[id] = true
+		for _, ti := range c.textIndexes {
+			ti.remove(id)
+		}
+		for _, fi := range c.fieldIndexes {
+			fi.remove(id)
+		}
 		found = true
 	}
 
-	if !found {
-		return ErrNotFound
-	}
-
-	return nil
+	return found
 }
 
 // Update modifies an existing document
 func (c *Collection) Update(id string, doc Document) error {
+	return c.update(id, doc, nil)
+}
+
+// update is Update that, for a patch, only checks the fields in patched
+// strictly against the schema; see validatePatchInternal.
+func (c *Collection) update(id string, doc Document, patched map[string]bool) error {
+	if err := c.checkWritable(); err != nil {
+		return err
+	}
+	doc["id"] = id
+	if err := c.runBeforeUpdate(doc); err != nil {
+		return err
+	}
+	doc["id"] = id
+
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
 
 	if c.file == nil {
 		return ErrCollectionClosed
 	}
-
-	doc["id"] = id
+	if err := c.validatePatchInternal(doc, patched); err != nil {
+		return err
+	}
+	doc, err := c.encryptFieldsInternal(doc)
+	if err != nil {
+		return err
+	}
 
 	inMemtable := false
 	for i := len(c.memtable) - 1; i >= 0; i-- {
@@ -111,17 +208,46 @@ func (c *Collection) Update(id string, doc Document) error {
 	}
 
 	if inMemtable {
+		c.publish(ChangeUpdate, id, doc)
 		return nil
 	}
 
 	if _, ok := c.index[id]; ok {
 		c.memtable = append(c.memtable, doc)
+		c.publish(ChangeUpdate, id, doc)
 		return nil
 	}
 
 	return ErrNotFound
 }
 
+// Patch merges fields into an existing document and stores the result as an
+// update: fields set to nil are removed, all others are added or replaced.
+// The id field cannot be changed. Patch reads and then writes the document,
+// so two concurrent patches of the same document may lose one's changes.
+func (c *Collection) Patch(id string, fields Document) error {
+	current, err := c.FindByID(id)
+	if err != nil {
+		return err
+	}
+
+	doc := make(Document, len(current)+len(fields))
+	for k, v := range current {
+		doc[k] = v
+	}
+	patched := make(map[string]bool, len(fields))
+	for k, v := range fields {
+		patched[k] = true
+		if v == nil {
+			delete(doc, k)
+		} else {
+			doc[k] = v
+		}
+	}
+
+	return c.update(id, doc, patched)
+}
+
 func (c *Collection) isInMemtable(id string) bool {
 	for i := len(c.memtable) - 1; i >= 0; i-- {
 		if fmt.Sprint(c.memtable[i]["id"]) == id {
@@ -132,62 +258,34 @@ func (c *Collection) isInMemtable(id string) bool {
 }
 
 func (c *Collection) Commit() error {
+	if err := c.checkWritable(); err != nil {
+		return err
+	}
+	if c.db != nil && c.db.cluster != nil {
+		return c.commitClustered()
+	}
+
 	c.mutex.Lock()
-	defer c.mutex.Unlock()
 
 	if c.file == nil {
+		c.mutex.Unlock()
 		return ErrCollectionClosed
 	}
 
-	if len(c.memtable) == 0 {
+	committed := c.memtable
+	if len(committed) == 0 {
+		c.mutex.Unlock()
 		return nil
 	}
-
-	toonBlock, err := toon.Encode(c.name, c.memtable)
-	if err != nil {
-		return fmt.Errorf("could not encode TOON block: %w", err)
-	}
-
-	dataToWrite := toonBlock
-	if c.compression {
-		var buf bytes.Buffer
-		gzipWriter := gzip.NewWriter(&buf)
-		if _, err := gzipWriter.Write(toonBlock); err != nil {
-			return fmt.Errorf("could not compress TOON block: %w", err)
-		}
-		if err := gzipWriter.Close(); err != nil {
-			return fmt.Errorf("could not close gzip writer: %w", err)
-		}
-		dataToWrite = buf.Bytes()
-	}
-
-	offset, err := c.file.Seek(0, io.SeekEnd)
-	if err != nil {
-		return fmt.Errorf("could not seek to end of file: %w", err)
-	}
-
-	n, err := c.file.Write(dataToWrite)
-	if err != nil {
-		return fmt.Errorf("could not write TOON block to file: %w", err)
-	}
-
-	// Flush to ensure data is written to disk
-	if err := c.file.Sync(); err != nil {
-		return fmt.Errorf("could not sync file: %w", err)
-	}
-
-	info := BlockInfo{
-		Offset: offset,
-		Length: int64(n),
-	}
-
-	for _, doc := range c.memtable {
-		id := fmt.Sprint(doc["id"])
-		c.index[id] = info
+	if err := c.logMutationWith(logRecord{Op: logCommit, Documents: committed}, c.commitInternal); err != nil {
+		c.mutex.Unlock()
+		return err
 	}
 
-	c.memtable = make([]Document, 0)
+	c.publish(ChangeCommit, "", nil)
+	c.mutex.Unlock()
 
+	c.runAfterCommit(committed)
 	return nil
 }
 
@@ -199,45 +297,36 @@ func (c *Collection) FindByID(id string) (Document, error) {
 		return nil, ErrCollectionClosed
 	}
 
+	encrypted := c.meta.EncryptedFields
 	for i := len(c.memtable) - 1; i >= 0; i-- {
 		doc := c.memtable[i]
 		if fmt.Sprint(doc["id"]) == id {
 			c.mutex.RUnlock()
-			return doc, nil
+			return c.decryptFields(encrypted, doc)
 		}
 	}
 
-	info, ok := c.index[id]
-
+	// The block is read under the lock, since a compaction or an upgrade
+	// replaces the file and moves every block.
+	doc, err := c.readDocInternal(id)
 	c.mutex.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+
+	return c.decryptFields(encrypted, doc)
+}
 
+// readDocInternal reads the committed version of a document from the file.
+func (c *Collection) readDocInternal(id string) (Document, error) {
+	info, ok := c.index[id]
 	if !ok {
 		return nil, ErrNotFound
 	}
 
-	buf := make([]byte, info.Length)
-
-	_, err := c.file.ReadAt(buf, info.Offset)
+	blockData, err := c.readBlock(info)
 	if err != nil {
-		return nil, fmt.Errorf("could not read block from disk: %w", err)
-	}
-
-	blockData := buf
-	isCompressed := len(buf) >= 2 && buf[0] == 0x1f && buf[1] == 0x8b
-	if isCompressed {
-		gzipReader, err := gzip.NewReader(bytes.NewReader(buf))
-		if err != nil {
-			return nil, fmt.Errorf("could not create gzip reader: %w", err)
-		}
-		defer func() {
-			_ = gzipReader.Close()
-		}()
-
-		decompressed, err := io.ReadAll(gzipReader)
-		if err != nil {
-			return nil, fmt.Errorf("could not decompress block: %w", err)
-		}
-		blockData = decompressed
+		return nil, err
 	}
 
 	doc, err := toon.Decode(blockData, id)
@@ -247,7 +336,6 @@ func (c *Collection) FindByID(id string) (Document, error) {
 	if doc == nil {
 		return nil, ErrNotFound
 	}
-
 	return doc, nil
 }
 
@@ -259,7 +347,7 @@ func (c *Collection) loadIndex() error {
 	}
 
 	if fileInfo.Size() == 0 {
-
+		c.scanned = 0
 		return nil
 	}
 
@@ -272,11 +360,111 @@ func (c *Collection) loadIndex() error {
 		return fmt.Errorf("could not read file: %w", err)
 	}
 
-	currentOffset := int64(0)
+	if _, err := c.indexBlocksInternal(data, 0); err != nil {
+		return err
+	}
+
+	if _, err := c.file.Seek(0, io.SeekEnd); err != nil {
+		return fmt.Errorf("could not seek to file end after index load: %w", err)
+	}
+
+	return nil
+}
+
+// indexBlocksInternal indexes the complete blocks in data, read from the
+// file at offset base, and returns them. A block cut short is left for
+// later, since another process may still be writing it.
+func (c *Collection) indexBlocksInternal(data []byte, base int64) ([]BlockInfo, error) {
+	if base == 0 {
+		var err error
+		if c.format, _, err = parseFileHeader(data); err != nil {
+			return nil, err
+		}
+	}
+
+	var blocks []BlockInfo
+	end, err := scanFileBlocks(data, c.name, c.crypt, func(info BlockInfo, ids []string) {
+		info.Offset += base
+		for _, id := range ids {
+			c.index[id] = info
+		}
+		blocks = append(blocks, info)
+	})
+	if err != nil {
+		return nil, err
+	}
+	c.scanned = base + end
+	return blocks, nil
+}
+
+// scanFileBlocks walks the blocks of a collection file's contents in order
+// and calls fn with each block's position and the IDs it holds. Blocks that
+// cannot be parsed are skipped with a warning, but an encrypted block that
+// cannot be decrypted is an error: skipping it would hide its documents.
+// Offsets count the file header, if there is one. It returns the offset
+// after the last complete block, where it stops at a block that is cut
+// short, such as one being written by another process.
+func scanFileBlocks(data []byte, name string, crypt *crypter, fn func(info BlockInfo, ids []string)) (int64, error) {
+	if partialHeader(data) {
+		return 0, nil
+	}
+	_, currentOffset, err := parseFileHeader(data)
+	if err != nil {
+		return 0, err
+	}
 
 	for currentOffset < int64(len(data)) {
 		blockStart := currentOffset
 
+		if isSealed(data[currentOffset:]) {
+			blockLen, ok := sealedLen(data[currentOffset:])
+			if !ok {
+				break
+			}
+			plain, err := crypt.openAt(data[currentOffset:currentOffset+blockLen], name, name+".toon", blockStart)
+			if err != nil {
+				return 0, err
+			}
+			block, err := decompressBlock(plain)
+			if err != nil {
+				return 0, fmt.Errorf("encrypted block at offset %d: %w", blockStart, err)
+			}
+
+			ids, err := toon.ExtractIDs(block)
+			if err != nil {
+				log.Printf("Warning: Could not extract IDs from encrypted block at offset %d: %v", blockStart, err)
+			} else {
+				fn(BlockInfo{Offset: blockStart, Length: blockLen}, ids)
+			}
+			currentOffset += blockLen
+			continue
+		}
+
+		if isCodecFrame(data[currentOffset:]) {
+			blockLen, ok := codecFrameLen(data[currentOffset:])
+			if !ok {
+				break
+			}
+			block, err := decompressBlock(data[currentOffset : currentOffset+blockLen])
+			if errors.Is(err, ErrUnknownCodec) {
+				return 0, fmt.Errorf("block at offset %d: %w", blockStart, err)
+			}
+			if err != nil {
+				log.Printf("Warning: Could not decompress block at offset %d: %v", blockStart, err)
+				currentOffset += blockLen
+				continue
+			}
+
+			ids, err := toon.ExtractIDs(block)
+			if err != nil {
+				log.Printf("Warning: Could not extract IDs from compressed block at offset %d: %v", blockStart, err)
+			} else {
+				fn(BlockInfo{Offset: blockStart, Length: blockLen}, ids)
+			}
+			currentOffset += blockLen
+			continue
+		}
+
 		isCompressed := false
 		if currentOffset+2 < int64(len(data)) && data[currentOffset] == 0x1f && data[currentOffset+1] == 0x8b {
 			isCompressed = true
@@ -286,6 +474,9 @@ func (c *Collection) loadIndex() error {
 			// Create a reader starting at currentOffset
 			reader := bytes.NewReader(data[currentOffset:])
 			gzipReader, err := gzip.NewReader(reader)
+			if errors.Is(err, io.ErrUnexpectedEOF) {
+				break
+			}
 			if err != nil {
 				log.Printf("Warning: Could not create gzip reader at offset %d: %v", blockStart, err)
 				currentOffset++
@@ -295,6 +486,9 @@ func (c *Collection) loadIndex() error {
 
 			decompressed, err := io.ReadAll(gzipReader)
 			gzipCloseErr := gzipReader.Close()
+			if errors.Is(err, io.ErrUnexpectedEOF) {
+				break
+			}
 			if err != nil {
 				log.Printf("Warning: Could not decompress block at offset %d: %v", blockStart, err)
 				currentOffset++
@@ -317,23 +511,22 @@ func (c *Collection) loadIndex() error {
 				continue
 			}
 
-			info := BlockInfo{
-				Offset: blockStart,
-				Length: blockLen,
-			}
-			for _, id := range ids {
-				c.index[id] = info
-			}
+			fn(BlockInfo{Offset: blockStart, Length: blockLen}, ids)
 
 			currentOffset += blockLen
 		} else {
 			scanner := bufio.NewScanner(bytes.NewReader(data[currentOffset:]))
+			// A long line must not pass for the end of the data.
+			scanner.Buffer(nil, len(data)-int(currentOffset)+1)
 
 			if !scanner.Scan() {
 				break
 			}
 			headerLine := scanner.Text() + "\n"
 			headerLen := len(headerLine)
+			if currentOffset+int64(headerLen) > int64(len(data)) {
+				break
+			}
 
 			count, _, _, err := toon.ParseHeader(headerLine)
 			if err != nil {
@@ -344,14 +537,15 @@ func (c *Collection) loadIndex() error {
 			}
 
 			blockData := headerLine
-			for i := 0; i < count; i++ {
-				if !scanner.Scan() {
-					break
-				}
+			lines := 0
+			for ; lines < count && scanner.Scan(); lines++ {
 				blockData += scanner.Text() + "\n"
 			}
 
 			blockLen := int64(len(blockData))
+			if lines < count || currentOffset+blockLen > int64(len(data)) {
+				break
+			}
 
 			ids, err := toon.ExtractIDs([]byte(blockData))
 			if err != nil {
@@ -360,23 +554,12 @@ func (c *Collection) loadIndex() error {
 				continue
 			}
 
-			info := BlockInfo{
-				Offset: blockStart,
-				Length: blockLen,
-			}
-			for _, id := range ids {
-				c.index[id] = info
-			}
+			fn(BlockInfo{Offset: blockStart, Length: blockLen}, ids)
 
 			currentOffset += blockLen
 		}
 	}
-
-	if _, err := c.file.Seek(0, io.SeekEnd); err != nil {
-		return fmt.Errorf("could not seek to file end after index load: %w", err)
-	}
-
-	return nil
+	return currentOffset, nil
 }
 
 func (c *Collection) Close() error {
@@ -403,17 +586,62 @@ func (c *Collection) IndexSize() int {
 	return len(c.index)
 }
 
+// checkWritable rejects writes by callers to a database that only changes
+// through replication.
+func (c *Collection) checkWritable() error {
+	if c.db != nil && c.db.readOnly {
+		return ErrReadOnly
+	}
+	return nil
+}
+
 func (c *Collection) Name() string {
 	return c.name
 }
 
+// SetCompression switches new blocks between gzip and no compression until
+// the collection is closed. SetCodec chooses any codec, persistently.
 func (c *Collection) SetCompression(enabled bool) {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
-	c.compression = enabled
+	name := "none"
+	if enabled {
+		name = "gzip"
+	}
+	// The built-in codecs are always registered.
+	c.codec, _ = lookupCodec(name)
+	c.codecName = name
 }
 
+// Compact rewrites the data file with only the latest version of each
+// document, committing the memtable too. On a cluster node, where commits
+// go through the leader's log, the memtable is left for the next Commit.
+// It waits for any backup in progress to finish first.
 func (c *Collection) Compact() error {
+	if err := c.checkWritable(); err != nil {
+		return err
+	}
+	if c.db != nil && c.db.cluster != nil {
+		return c.compactCommitted()
+	}
+	return c.compact()
+}
+
+// compact rewrites the data file with the memtable committed.
+func (c *Collection) compact() error {
+	return c.rewrite(true)
+}
+
+// compactCommitted rewrites the data file with only the committed
+// documents and leaves the memtable as it is.
+func (c *Collection) compactCommitted() error {
+	return c.rewrite(false)
+}
+
+func (c *Collection) rewrite(withMemtable bool) error {
+	c.compactMutex.Lock()
+	defer c.compactMutex.Unlock()
+
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
 
@@ -421,132 +649,274 @@ func (c *Collection) Compact() error {
 		return ErrCollectionClosed
 	}
 
-	allDocs, err := c.allInternal()
+	var docs, memtable []Document
+	var err error
+	if withMemtable {
+		docs, err = c.allInternal()
+		memtable = c.memtable
+	} else {
+		docs, err = c.committedInternal()
+	}
 	if err != nil {
 		return fmt.Errorf("could not get all documents: %w", err)
 	}
+	for i, doc := range docs {
+		if docs[i], err = c.reencryptInternal(doc); err != nil {
+			return err
+		}
+	}
 
-	if err := c.file.Truncate(0); err != nil {
-		return fmt.Errorf("could not truncate file: %w", err)
+	// Record the rewrite before it starts, so an incremental backup never
+	// mistakes the rewritten file for a continuation of the old one.
+	c.meta.Generation++
+	if err := c.saveMetaInternal(); err != nil {
+		c.meta.Generation--
+		return err
 	}
 
-	if _, err := c.file.Seek(0, io.SeekStart); err != nil {
-		return fmt.Errorf("could not seek to start: %w", err)
+	// The documents are written to a new file that replaces the old one,
+	// so a crash leaves one or the other.
+	dir := filepath.Dir(c.filePath)
+	tmp, tmpPath, err := createTemp(c.storage, dir, filepath.Base(c.filePath)+".compact*")
+	if err != nil {
+		return fmt.Errorf("could not create compacted file: %w", err)
 	}
 
+	file, index, format, scanned := c.file, c.index, c.format, c.scanned
+	c.file = tmp
 	c.index = make(map[string]BlockInfo)
-	c.memtable = allDocs
+	c.format = fileHeader{version: FormatVersion}
+	c.scanned = 0
 
-	if len(c.memtable) == 0 {
+	write := func() error {
+		if err := c.writeBlockInternal(docs); err != nil {
+			return err
+		}
+		if err := c.storage.Rename(tmpPath, c.filePath); err != nil {
+			return fmt.Errorf("could not replace file: %w", err)
+		}
 		return nil
 	}
+	// Committing the memtable is logged like Commit, for recovery and
+	// followers to replay.
+	if len(memtable) > 0 {
+		err = c.logMutationWith(logRecord{Op: logCommit, Documents: memtable}, write)
+	} else {
+		err = write()
+	}
+	if err != nil {
+		tmp.Close()
+		c.storage.Remove(tmpPath)
+		c.file, c.index, c.format, c.scanned = file, index, format, scanned
+		return err
+	}
+	file.Close()
+	c.deleted = make(map[string]bool)
+	if withMemtable {
+		c.memtable = make([]Document, 0)
+	}
 
-	return c.commitInternal()
+	c.unsyncedDir = true
+	return c.syncDirInternal()
+}
+
+// syncDirInternal makes the file's directory entry durable, if it may not
+// be yet: a new file's, or the one a rewrite renamed into place. Until then
+// a crash could lose the file, however well its contents were synced.
+func (c *Collection) syncDirInternal() error {
+	if !c.unsyncedDir {
+		return nil
+	}
+	if err := c.storage.SyncDir(filepath.Dir(c.filePath)); err != nil {
+		return err
+	}
+	c.unsyncedDir = false
+	return nil
 }
 
 func (c *Collection) commitInternal() error {
-	if len(c.memtable) == 0 {
+	if err := c.writeBlockInternal(c.memtable); err != nil {
+		return err
+	}
+	c.memtable = make([]Document, 0)
+	return nil
+}
+
+// writeBlockInternal appends docs to the file as one block and indexes them.
+func (c *Collection) writeBlockInternal(docs []Document) error {
+	if len(docs) == 0 {
 		return nil
 	}
 
-	toonBlock, err := toon.Encode(c.name, c.memtable)
+	toonBlock, err := toon.Encode(c.name, docs)
 	if err != nil {
 		return fmt.Errorf("could not encode TOON block: %w", err)
 	}
 
-	dataToWrite := toonBlock
-	if c.compression {
-		var buf bytes.Buffer
-		gzipWriter := gzip.NewWriter(&buf)
-		if _, err := gzipWriter.Write(toonBlock); err != nil {
-			return fmt.Errorf("could not compress TOON block: %w", err)
-		}
-		if err := gzipWriter.Close(); err != nil {
-			return fmt.Errorf("could not close gzip writer: %w", err)
+	dataToWrite, err := compressBlock(c.codec, toonBlock)
+	if err != nil {
+		return err
+	}
+	if c.crypt != nil {
+		dataToWrite, err = c.crypt.seal(dataToWrite, c.name)
+		if err != nil {
+			return fmt.Errorf("could not encrypt TOON block: %w", err)
 		}
-		dataToWrite = buf.Bytes()
 	}
 
-	offset, err := c.file.Seek(0, io.SeekEnd)
+	start, err := c.file.Seek(0, io.SeekEnd)
 	if err != nil {
 		return fmt.Errorf("could not seek to end of file: %w", err)
 	}
+	// What follows the last complete block was left by a crash or a failed
+	// write, and is replaced. Appending after it would hide the new block
+	// from the next loadIndex, which stops where a block is cut short.
+	if start > c.scanned {
+		if err := c.file.Truncate(c.scanned); err != nil {
+			return fmt.Errorf("could not truncate incomplete block: %w", err)
+		}
+		if start, err = c.file.Seek(c.scanned, io.SeekStart); err != nil {
+			return fmt.Errorf("could not seek to end of last block: %w", err)
+		}
+	}
+	offset := start
+
+	// A new or compacted file starts with a header for the features its
+	// first block needs; later blocks may add to them.
+	if offset == 0 && c.format.version != 0 {
+		c.format.features = c.blockFeatures()
+		dataToWrite = append(c.format.bytes(), dataToWrite...)
+		offset = fileHeaderSize
+	} else if err := c.addFeaturesInternal(c.blockFeatures()); err != nil {
+		return err
+	}
 
 	n, err := c.file.Write(dataToWrite)
 	if err != nil {
-		return fmt.Errorf("could not write TOON block to file: %w", err)
+		err = fmt.Errorf("could not write TOON block to file: %w", err)
+	} else if err = c.file.Sync(); err != nil {
+		err = fmt.Errorf("could not sync file: %w", err)
 	}
-
-	if err := c.file.Sync(); err != nil {
-		return fmt.Errorf("could not sync file: %w", err)
+	if err != nil {
+		// After a failed sync, the block can be read back but may never
+		// reach the disk, so it is cut off rather than left for this or
+		// another process to take for committed.
+		c.file.Truncate(start)
+		return err
+	}
+	if err := c.syncDirInternal(); err != nil {
+		return err
 	}
+	c.scanned = start + int64(n)
 
 	info := BlockInfo{
 		Offset: offset,
-		Length: int64(n),
+		Length: int64(n) - (offset - start),
 	}
 
-	for _, doc := range c.memtable {
+	for _, doc := range docs {
 		id := fmt.Sprint(doc["id"])
 		c.index[id] = info
+		delete(c.deleted, id)
+		for _, ti := range c.textIndexes {
+			ti.add(id, doc)
+		}
+		for _, fi := range c.fieldIndexes {
+			fi.add(id, doc)
+		}
 	}
 
-	c.memtable = make([]Document, 0)
-
 	return nil
 }
 
 func (c *Collection) allInternal() ([]Document, error) {
+	var allDocs []Document
+	err := c.scanInternal(func(id string, doc Document) error {
+		allDocs = append(allDocs, doc)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return allDocs, nil
+}
+
+// scanInternal calls fn once for the latest version of every document: first
+// those in the memtable, newest first, then the committed ones block by block.
+// Only one block is decoded at a time.
+func (c *Collection) scanInternal(fn func(id string, doc Document) error) error {
 	if c.file == nil {
-		return nil, ErrCollectionClosed
+		return ErrCollectionClosed
 	}
 
-	var allDocs []Document
 	seenIDs := make(map[string]bool)
 
-	for i := len(c.memtable) - 1; i >= 0; i-- {
-		doc := c.memtable[i]
-		id := fmt.Sprint(doc["id"])
-		if !seenIDs[id] {
-			allDocs = append(allDocs, doc)
-			seenIDs[id] = true
-		}
+	err := c.scanMemtable(func(id string, doc Document) error {
+		seenIDs[id] = true
+		return fn(id, doc)
+	})
+	if err != nil {
+		return err
 	}
 
-	processedBlocks := make(map[BlockInfo]bool)
-
-	for id, info := range c.index {
+	return c.scanBlocks(func(id string, doc Document) error {
 		if seenIDs[id] {
-			continue
+			return nil
 		}
+		return fn(id, doc)
+	})
+}
 
-		if processedBlocks[info] {
+// scanMemtable calls fn for the latest memtable version of each document,
+// newest first.
+func (c *Collection) scanMemtable(fn func(id string, doc Document) error) error {
+	seenIDs := make(map[string]bool)
+
+	for i := len(c.memtable) - 1; i >= 0; i-- {
+		doc := c.memtable[i]
+		id := fmt.Sprint(doc["id"])
+		if seenIDs[id] {
 			continue
 		}
-		processedBlocks[info] = true
-
-		buf := make([]byte, info.Length)
-		_, err := c.file.ReadAt(buf, info.Offset)
-		if err != nil {
-			return nil, fmt.Errorf("could not read block from disk: %w", err)
+		seenIDs[id] = true
+		if err := fn(id, doc); err != nil {
+			return err
 		}
+	}
 
-		blockData := buf
-		isCompressed := len(buf) >= 2 && buf[0] == 0x1f && buf[1] == 0x8b
-		if isCompressed {
-			gzipReader, err := gzip.NewReader(bytes.NewReader(buf))
-			if err != nil {
-				log.Printf("Warning: Could not create gzip reader: %v", err)
-				continue
-			}
+	return nil
+}
 
-			decompressed, err := io.ReadAll(gzipReader)
-			_ = gzipReader.Close()
-			if err != nil {
-				log.Printf("Warning: Could not decompress block: %v", err)
-				continue
-			}
-			blockData = decompressed
+// committedInternal returns the current on-disk version of every indexed
+// document, ignoring anything still sitting in the memtable.
+func (c *Collection) committedInternal() ([]Document, error) {
+	var docs []Document
+	err := c.scanBlocks(func(id string, doc Document) error {
+		docs = append(docs, doc)
+		return nil
+	})
+	return docs, err
+}
+
+// scanBlocks decodes every block referenced by the index, in file order, and
+// calls fn for each document whose index entry still points at that block.
+// Older versions of a document left behind in earlier blocks are skipped.
+func (c *Collection) scanBlocks(fn func(id string, doc Document) error) error {
+	_, err := c.scanBlocksCounted(fn)
+	return err
+}
+
+// scanBlocksCounted is scanBlocks that also reports how many blocks it read
+// before finishing or being stopped by fn.
+func (c *Collection) scanBlocksCounted(fn func(id string, doc Document) error) (int, error) {
+	blocks := c.blocks()
+	read := 0
+
+	for _, info := range blocks {
+		blockData, err := c.readBlock(info)
+		read++
+		if err != nil {
+			return read, err
 		}
 
 		docs, err := toon.DecodeAll(blockData)
@@ -556,20 +926,72 @@ func (c *Collection) allInternal() ([]Document, error) {
 		}
 
 		for _, doc := range docs {
-			docID := fmt.Sprint(doc["id"])
-			if !seenIDs[docID] {
-				allDocs = append(allDocs, doc)
-				seenIDs[docID] = true
+			id := fmt.Sprint(doc["id"])
+			if c.index[id] != info {
+				continue
+			}
+			if err := fn(id, doc); err != nil {
+				return read, err
 			}
 		}
 	}
 
-	return allDocs, nil
+	return read, nil
+}
+
+// blocks returns the distinct blocks referenced by the index in file order.
+func (c *Collection) blocks() []BlockInfo {
+	blocks := make([]BlockInfo, 0)
+	seen := make(map[BlockInfo]bool)
+	for _, info := range c.index {
+		if !seen[info] {
+			seen[info] = true
+			blocks = append(blocks, info)
+		}
+	}
+	sort.Slice(blocks, func(i, j int) bool {
+		return blocks[i].Offset < blocks[j].Offset
+	})
+	return blocks
+}
+
+// readBlock reads the block described by info and returns its TOON text,
+// decrypting and decompressing it first as needed.
+func (c *Collection) readBlock(info BlockInfo) ([]byte, error) {
+	buf := make([]byte, info.Length)
+	if _, err := c.file.ReadAt(buf, info.Offset); err != nil {
+		return nil, fmt.Errorf("could not read block from disk: %w", err)
+	}
+
+	if isSealed(buf) {
+		plain, err := c.crypt.openAt(buf, c.name, c.name+".toon", info.Offset)
+		if err != nil {
+			return nil, err
+		}
+		buf = plain
+	}
+	return decompressBlock(buf)
 }
 
 func (c *Collection) All() ([]Document, error) {
 	c.mutex.RLock()
 	defer c.mutex.RUnlock()
 
+	docs, err := c.allInternal()
+	if err != nil {
+		return nil, err
+	}
+	if err := c.decryptAll(c.meta.EncryptedFields, docs); err != nil {
+		return nil, err
+	}
+	return docs, nil
+}
+
+// AllEncrypted is All with encrypted fields left as they are stored, for
+// exports that must not reveal them.
+func (c *Collection) AllEncrypted() ([]Document, error) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
 	return c.allInternal()
 }
@@ -1,7 +1,9 @@
 package db
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"path/filepath"
@@ -14,30 +16,92 @@ type DB struct {
 	collections map[string]*Collection
 	dbMutex     sync.Mutex
 	config      Config
+	feed        *changeFeed
+	log         *mutationLog
+	readOnly    bool // set by Config.ReadOnly, and on followers, which only change through replication
+	cluster     *ClusterNode
+	crypt       *crypter
+	fieldCrypt  *crypter
+	storage     Storage
+	lock        io.Closer
+	stopRefresh context.CancelFunc
+	refreshDone chan struct{}
 }
 
 func NewDB(dataDir string) (*DB, error) {
 	return NewDBWithConfig(dataDir, DefaultConfig)
 }
 
+// OpenReadOnly opens the database in dataDir for reading only, with the
+// default configuration; see Config.ReadOnly.
+func OpenReadOnly(dataDir string) (*DB, error) {
+	config := DefaultConfig
+	config.ReadOnly = true
+	return NewDBWithConfig(dataDir, config)
+}
+
 func NewDBWithConfig(dataDir string, config Config) (*DB, error) {
-	if err := os.MkdirAll(dataDir, 0755); err != nil {
+	crypt, err := newCrypter(config)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := ParseCodec(configCodec(config)); err != nil {
+		return nil, err
+	}
+
+	storage := storageOf(config)
+	var lock io.Closer
+	if config.ReadOnly {
+		config.MutationLog = false
+		lock, err = shareDataDir(storage, dataDir)
+	} else if err = storage.MkdirAll(dataDir, 0755); err != nil {
 		return nil, fmt.Errorf("could not create data dir: %w", err)
+	} else {
+		lock, err = lockDataDir(storage, dataDir)
+	}
+	if err != nil {
+		return nil, err
 	}
 
 	db := &DB{
 		dataDir:     dataDir,
 		collections: make(map[string]*Collection),
 		config:      config,
+		feed:        newChangeFeed(config.ChangeHistory),
+		crypt:       crypt,
+		fieldCrypt:  newFieldCrypter(config),
+		storage:     storage,
+		lock:        lock,
+		readOnly:    config.ReadOnly,
+	}
+
+	if config.MutationLog {
+		ml, err := openMutationLog(storage, mutationLogPath(dataDir), config.ReplicationBacklog, crypt)
+		if err != nil {
+			lock.Close()
+			return nil, err
+		}
+		db.log = ml
+	}
+
+	if config.ReadOnly && config.RefreshInterval > 0 {
+		ctx, cancel := context.WithCancel(context.Background())
+		db.stopRefresh = cancel
+		db.refreshDone = make(chan struct{})
+		go db.refreshEvery(ctx, config.RefreshInterval, db.refreshDone)
 	}
 
 	return db, nil
 }
 
+// SetCompression switches between gzip and no compression for new blocks
+// in every collection, replacing Config.Codec. Collections opened later use
+// their own codec if they have one; see Collection.SetCodec.
 func (db *DB) SetCompression(enabled bool) {
 	db.dbMutex.Lock()
 	defer db.dbMutex.Unlock()
 	db.config.Compression = enabled
+	db.config.Codec = ""
 	for _, c := range db.collections {
 		c.SetCompression(enabled)
 	}
@@ -46,7 +110,15 @@ func (db *DB) SetCompression(enabled bool) {
 func (db *DB) IsCompressionEnabled() bool {
 	db.dbMutex.Lock()
 	defer db.dbMutex.Unlock()
-	return db.config.Compression
+	return configCodec(db.config) != "none"
+}
+
+// defaultCodec returns the name of the codec for collections that have not
+// chosen one.
+func (db *DB) defaultCodec() string {
+	db.dbMutex.Lock()
+	defer db.dbMutex.Unlock()
+	return configCodec(db.config)
 }
 
 func (db *DB) GetCollection(name string) (*Collection, error) {
@@ -59,17 +131,32 @@ func (db *DB) GetCollection(name string) (*Collection, error) {
 
 	filePath := filepath.Join(db.dataDir, name+".toon")
 
-	file, err := os.OpenFile(filePath, os.O_RDWR|os.O_CREATE, 0644)
+	flag := os.O_RDWR | os.O_CREATE
+	if db.config.ReadOnly {
+		flag = os.O_RDONLY
+	}
+	file, err := db.storage.OpenFile(filePath, flag, 0644)
 	if err != nil {
 		return nil, fmt.Errorf("could not open collection file: %w", err)
 	}
 
-	c := newCollection(name, filePath, file, db.config.Compression)
+	c := newCollection(db.storage, name, filePath, file)
+	c.db = db
+	c.crypt = db.crypt
+	c.fieldCrypt = db.fieldCrypt
+	if err := c.useCodecInternal(configCodec(db.config)); err != nil {
+		_ = file.Close()
+		return nil, err
+	}
 
 	if err := c.loadIndex(); err != nil {
 		_ = file.Close()
 		return nil, fmt.Errorf("could not load index for %s: %w", name, err)
 	}
+	if err := c.loadMeta(); err != nil {
+		_ = file.Close()
+		return nil, fmt.Errorf("could not load metadata for %s: %w", name, err)
+	}
 
 	db.collections[name] = c
 	return c, nil
@@ -77,16 +164,19 @@ func (db *DB) GetCollection(name string) (*Collection, error) {
 
 func (db *DB) ListCollections() ([]string, error) {
 
-	files, err := filepath.Glob(filepath.Join(db.dataDir, "*.toon"))
+	entries, err := db.storage.ReadDir(db.dataDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
 	if err != nil {
 		return nil, fmt.Errorf("could not scan data dir: %w", err)
 	}
 
-	names := make([]string, 0, len(files))
-	for _, fPath := range files {
-		baseName := filepath.Base(fPath)
-		name := strings.TrimSuffix(baseName, ".toon")
-		names = append(names, name)
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		if name, ok := strings.CutSuffix(e.Name(), ".toon"); ok && !e.IsDir() {
+			names = append(names, name)
+		}
 	}
 
 	return names, nil
@@ -108,9 +198,16 @@ func (db *DB) LoadAllCollections() error {
 }
 
 func (db *DB) Close() error {
+	if db.stopRefresh != nil {
+		db.stopRefresh()
+		<-db.refreshDone
+	}
+
 	db.dbMutex.Lock()
 	defer db.dbMutex.Unlock()
 
+	db.feed.close()
+
 	var firstErr error
 	for name, c := range db.collections {
 		if err := c.Close(); err != nil {
@@ -120,6 +217,17 @@ func (db *DB) Close() error {
 			}
 		}
 	}
+	if db.log != nil {
+		if err := db.log.close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if db.lock != nil {
+		if err := db.lock.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		db.lock = nil
+	}
 	return firstErr
 }
 
@@ -134,6 +242,7 @@ type CollectionStats struct {
 	MemtableSize int
 	IndexSize    int
 	FilePath     string
+	Indexes      []string
 }
 
 func (db *DB) GetStats() Stats {
@@ -152,6 +261,7 @@ func (db *DB) GetStats() Stats {
 			MemtableSize: c.Size(),
 			IndexSize:    c.IndexSize(),
 			FilePath:     c.filePath,
+			Indexes:      c.Indexes(),
 		}
 	}
 
@@ -160,6 +270,10 @@ func (db *DB) GetStats() Stats {
 
 // CreateCollection creates a new empty collection
 func (db *DB) CreateCollection(name string) error {
+	if db.readOnly {
+		return ErrReadOnly
+	}
+
 	db.dbMutex.Lock()
 	defer db.dbMutex.Unlock()
 
@@ -171,16 +285,23 @@ func (db *DB) CreateCollection(name string) error {
 	filePath := filepath.Join(db.dataDir, name+".toon")
 
 	// Check if file already exists on disk
-	if _, err := os.Stat(filePath); err == nil {
+	if _, err := db.storage.Stat(filePath); err == nil {
 		return fmt.Errorf("collection file %s already exists", name)
 	}
 
-	file, err := os.OpenFile(filePath, os.O_RDWR|os.O_CREATE, 0644)
+	file, err := db.storage.OpenFile(filePath, os.O_RDWR|os.O_CREATE, 0644)
 	if err != nil {
 		return fmt.Errorf("could not create collection file: %w", err)
 	}
 
-	c := newCollection(name, filePath, file, db.config.Compression)
+	c := newCollection(db.storage, name, filePath, file)
+	c.db = db
+	c.crypt = db.crypt
+	c.fieldCrypt = db.fieldCrypt
+	if err := c.useCodecInternal(configCodec(db.config)); err != nil {
+		_ = file.Close()
+		return err
+	}
 	db.collections[name] = c
 
 	return nil
@@ -188,21 +309,54 @@ func (db *DB) CreateCollection(name string) error {
 
 // DeleteCollection removes a collection from memory and deletes its file
 func (db *DB) DeleteCollection(name string) error {
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	if db.cluster != nil {
+		// The drop is applied through the cluster, which takes dbMutex.
+		if !db.collectionExists(name) {
+			return fmt.Errorf("collection %s does not exist", name)
+		}
+		return db.cluster.propose(logRecord{Op: logDrop, Collection: name})
+	}
+
 	db.dbMutex.Lock()
 	defer db.dbMutex.Unlock()
 
+	if db.log != nil {
+		if _, ok := db.collections[name]; !ok && !db.collectionExists(name) {
+			return fmt.Errorf("collection %s does not exist", name)
+		}
+		if err := db.log.append(logRecord{Op: logDrop, Collection: name}); err != nil {
+			return err
+		}
+	}
+
+	return db.deleteCollectionLocked(name)
+}
+
+// collectionExists reports whether name has a data file, whether or not it
+// has been loaded.
+func (db *DB) collectionExists(name string) bool {
+	_, err := db.storage.Stat(filepath.Join(db.dataDir, name+".toon"))
+	return err == nil
+}
+
+// deleteCollectionLocked is DeleteCollection without the checks and logging.
+// It must be called with db.dbMutex held.
+func (db *DB) deleteCollectionLocked(name string) error {
 	c, ok := db.collections[name]
 	if !ok {
 		// Collection not in memory, but check if file exists
 		filePath := filepath.Join(db.dataDir, name+".toon")
-		if _, err := os.Stat(filePath); os.IsNotExist(err) {
+		if _, err := db.storage.Stat(filePath); os.IsNotExist(err) {
 			return fmt.Errorf("collection %s does not exist", name)
 		}
 		// File exists, delete it
-		if err := os.Remove(filePath); err != nil {
+		if err := db.storage.Remove(filePath); err != nil {
 			return fmt.Errorf("could not delete collection file: %w", err)
 		}
-		return nil
+		return removeMeta(db.storage, filePath)
 	}
 
 	// Close the collection
@@ -211,9 +365,12 @@ func (db *DB) DeleteCollection(name string) error {
 	}
 
 	// Delete the file
-	if err := os.Remove(c.filePath); err != nil {
+	if err := db.storage.Remove(c.filePath); err != nil {
 		return fmt.Errorf("could not delete collection file: %w", err)
 	}
+	if err := removeMeta(db.storage, c.filePath); err != nil {
+		return err
+	}
 
 	// Remove from map
 	delete(db.collections, name)
@@ -1,8 +1,12 @@
 package db
 
 import (
+	"fmt"
 	"os"
+	"sync"
 	"testing"
+
+	"github.com/Al3x-Myku/FlyDB/pkg/query"
 )
 
 func TestBasicOperations(t *testing.T) {
@@ -156,3 +160,213 @@ func TestUpdate(t *testing.T) {
 		t.Errorf("Expected version=2, got %v", found["version"])
 	}
 }
+
+func TestFind(t *testing.T) {
+	dataDir := "./test-find"
+	defer os.RemoveAll(dataDir)
+
+	db, _ := NewDB(dataDir)
+	defer db.Close()
+
+	users, _ := db.GetCollection("users")
+	users.Insert(Document{"id": "1", "name": "Alice", "age": 30})
+	users.Insert(Document{"id": "2", "name": "Bob", "age": 17})
+	users.Commit()
+	users.Insert(Document{"id": "3", "name": "Carol", "age": 45})
+	users.Insert(Document{"id": "2", "name": "Bob", "age": 18})
+
+	q, err := query.Parse("age >= 18 AND name != Carol")
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+
+	results, err := users.Find(q)
+	if err != nil {
+		t.Fatalf("Find failed: %v", err)
+	}
+
+	ids := make(map[string]bool)
+	for _, doc := range results {
+		ids[fmt.Sprint(doc["id"])] = true
+	}
+	if len(results) != 2 || !ids["1"] || !ids["2"] {
+		t.Errorf("Expected ids 1 and 2, got %v", results)
+	}
+
+	all, _ := users.Find(nil)
+	if len(all) != 3 {
+		t.Errorf("Expected 3 documents for nil filter, got %d", len(all))
+	}
+}
+
+func TestFindWithOptions(t *testing.T) {
+	dataDir := "./test-find-options"
+	defer os.RemoveAll(dataDir)
+
+	db, _ := NewDB(dataDir)
+	defer db.Close()
+
+	products, _ := db.GetCollection("products")
+	for i := 0; i < 50; i++ {
+		products.Insert(Document{"id": fmt.Sprintf("p%02d", i), "price": (i * 7) % 50, "name": "Product"})
+		if i%10 == 9 {
+			products.Commit()
+		}
+	}
+	products.Insert(Document{"id": "p03", "price": 1000, "name": "Updated"})
+
+	opts := query.Options{
+		Sort:   []query.SortKey{{Field: "price", Desc: true}, {Field: "id"}},
+		Limit:  5,
+		Skip:   1,
+		Fields: query.Projection{Include: []string{"price"}},
+	}
+
+	scanned, err := products.FindWithOptions(query.Eq("name", "Product"), opts)
+	if err != nil {
+		t.Fatalf("FindWithOptions failed: %v", err)
+	}
+
+	if err := products.CreateIndex("price"); err != nil {
+		t.Fatalf("CreateIndex failed: %v", err)
+	}
+	indexed, err := products.FindWithOptions(query.Eq("name", "Product"), opts)
+	if err != nil {
+		t.Fatalf("FindWithOptions with index failed: %v", err)
+	}
+
+	if len(scanned) != 5 {
+		t.Fatalf("Expected 5 results, got %d", len(scanned))
+	}
+	for i := range scanned {
+		if fmt.Sprint(scanned[i]) != fmt.Sprint(indexed[i]) {
+			t.Errorf("Result %d differs: scan=%v index=%v", i, scanned[i], indexed[i])
+		}
+	}
+	if fmt.Sprint(scanned[0]["price"]) != "48" || len(scanned[0]) != 2 {
+		t.Errorf("Expected first result to be price 48 with id and price only, got %v", scanned[0])
+	}
+
+	top, _ := products.FindWithOptions(nil, query.Options{Sort: []query.SortKey{{Field: "price", Desc: true}}, Limit: 1})
+	if len(top) != 1 || fmt.Sprint(top[0]["id"]) != "p03" {
+		t.Errorf("Expected uncommitted update p03 to sort first, got %v", top)
+	}
+}
+
+func TestAggregate(t *testing.T) {
+	dataDir := "./test-aggregate"
+	defer os.RemoveAll(dataDir)
+
+	db, _ := NewDB(dataDir)
+	defer db.Close()
+
+	orders, _ := db.GetCollection("orders")
+	orders.Insert(Document{"id": "1", "status": "paid", "total": 10})
+	orders.Insert(Document{"id": "2", "status": "open", "total": 4})
+	orders.Commit()
+	orders.Insert(Document{"id": "3", "status": "paid", "total": 6})
+
+	agg, _ := query.ParseAggregation("count(), sum(total) BY status")
+	rows, err := orders.Aggregate(agg)
+	if err != nil {
+		t.Fatalf("Aggregate failed: %v", err)
+	}
+	if len(rows) != 2 || rows[1]["status"] != "paid" || rows[1]["count"] != int64(2) || rows[1]["sum_total"] != int64(16) {
+		t.Errorf("Unexpected aggregate rows: %v", rows)
+	}
+}
+
+// TestFindByIDDuringCompact reads documents while Compact replaces the
+// file under them; run it with -race.
+func TestFindByIDDuringCompact(t *testing.T) {
+	dataDir := "./test-concurrent-compact"
+	defer os.RemoveAll(dataDir)
+
+	db, err := NewDB(dataDir)
+	if err != nil {
+		t.Fatalf("NewDB failed: %v", err)
+	}
+	defer db.Close()
+	users, _ := db.GetCollection("users")
+	for i := 0; i < 10; i++ {
+		users.Insert(Document{"id": fmt.Sprint(i), "n": i})
+	}
+	users.Commit()
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				id := fmt.Sprint(i % 10)
+				doc, err := users.FindByID(id)
+				if err != nil || fmt.Sprint(doc["id"]) != id {
+					t.Errorf("FindByID(%s) = %v, %v", id, doc, err)
+					return
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < 50; i++ {
+		users.Update(fmt.Sprint(i%10), Document{"n": i})
+		if err := users.Commit(); err != nil {
+			t.Fatalf("Commit failed: %v", err)
+		}
+		if err := users.Compact(); err != nil {
+			t.Fatalf("Compact failed: %v", err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+}
+
+// TestFindByIDDuringClose checks that reads racing with Close fail with
+// ErrCollectionClosed rather than use the closed file.
+func TestFindByIDDuringClose(t *testing.T) {
+	dataDir := "./test-concurrent-close"
+	defer os.RemoveAll(dataDir)
+
+	for round := 0; round < 20; round++ {
+		db, err := NewDB(dataDir)
+		if err != nil {
+			t.Fatalf("NewDB failed: %v", err)
+		}
+		users, _ := db.GetCollection("users")
+		users.Insert(Document{"id": "a"})
+		users.Commit()
+
+		var wg, reading sync.WaitGroup
+		for r := 0; r < 4; r++ {
+			wg.Add(1)
+			reading.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; ; i++ {
+					_, err := users.FindByID("a")
+					if i == 0 {
+						reading.Done()
+					}
+					if err == ErrCollectionClosed {
+						return
+					}
+					if err != nil {
+						t.Errorf("FindByID failed: %v", err)
+						return
+					}
+				}
+			}()
+		}
+		reading.Wait()
+		users.Close()
+		wg.Wait()
+		db.Close()
+	}
+}
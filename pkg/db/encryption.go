@@ -0,0 +1,275 @@
+package db
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+var (
+	// ErrNoEncryptionKey is returned when encrypted data is read by a
+	// database configured without keys.
+	ErrNoEncryptionKey = errors.New("data is encrypted but no encryption key is configured")
+
+	// ErrUnknownKey is returned for data encrypted with a key the key
+	// provider does not have.
+	ErrUnknownKey = errors.New("encryption key not found")
+
+	// ErrAuthentication is returned when encrypted data fails its
+	// integrity check: it was modified, or the key is wrong.
+	ErrAuthentication = errors.New("encrypted data failed authentication")
+)
+
+// DecryptionError reports encrypted data that could not be read. Err is
+// ErrNoEncryptionKey, ErrUnknownKey, ErrAuthentication or a format error.
+type DecryptionError struct {
+	File   string
+	Offset int64
+	KeyID  string
+	Err    error
+}
+
+func (e *DecryptionError) Error() string {
+	if e.KeyID != "" {
+		return fmt.Sprintf("could not decrypt %s at offset %d (key %s): %v", e.File, e.Offset, e.KeyID, e.Err)
+	}
+	return fmt.Sprintf("could not decrypt %s at offset %d: %v", e.File, e.Offset, e.Err)
+}
+
+func (e *DecryptionError) Unwrap() error {
+	return e.Err
+}
+
+// KeyProvider supplies AES keys of 16, 24 or 32 bytes. New data is
+// encrypted with the current key, and every encrypted block records the ID
+// of its key, so older keys must stay available until Compact has rewritten
+// the collections that still use them.
+type KeyProvider interface {
+	CurrentKey() (id string, key []byte, err error)
+	Key(id string) ([]byte, error)
+}
+
+// KeyRing is a KeyProvider holding a fixed set of keys, identified by a
+// fingerprint of each key.
+type KeyRing struct {
+	current string
+	keys    map[string][]byte
+}
+
+// NewKeyRing returns a key ring that encrypts with current and can still
+// decrypt data written with any of the previous keys.
+func NewKeyRing(current []byte, previous ...[]byte) (*KeyRing, error) {
+	kr := &KeyRing{keys: make(map[string][]byte)}
+	for i, key := range append([][]byte{current}, previous...) {
+		switch len(key) {
+		case 16, 24, 32:
+		default:
+			return nil, fmt.Errorf("invalid encryption key: %d bytes, want 16, 24 or 32", len(key))
+		}
+		id := keyID(key)
+		kr.keys[id] = bytes.Clone(key)
+		if i == 0 {
+			kr.current = id
+		}
+	}
+	return kr, nil
+}
+
+func (kr *KeyRing) CurrentKey() (string, []byte, error) {
+	return kr.current, kr.keys[kr.current], nil
+}
+
+func (kr *KeyRing) Key(id string) ([]byte, error) {
+	key, ok := kr.keys[id]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	return key, nil
+}
+
+// keyID derives a short identifier from key that cannot be used to recover
+// it.
+func keyID(key []byte) string {
+	sum := sha256.Sum256(append([]byte("flydb key id\x00"), key...))
+	return hex.EncodeToString(sum[:8])
+}
+
+// Encrypted data is framed as
+//
+//	magic (4) | key ID length (1) | key ID | nonce (12) | length (4) | ciphertext
+//
+// The magic starts with a byte that is neither valid UTF-8 nor the start of
+// a gzip stream, so sealed blocks are told apart from TOON text and gzip
+// blocks. The header is authenticated along with the ciphertext, and so is
+// a context string naming what the data belongs to, so a block cannot be
+// moved into another collection unnoticed.
+var sealedMagic = []byte{0xff, 'F', 'E', 1}
+
+const sealedNonceSize = 12
+
+func isSealed(data []byte) bool {
+	return bytes.HasPrefix(data, sealedMagic)
+}
+
+// sealedLen returns the length of the sealed frame at the start of data, or
+// false if data is too short to hold it.
+func sealedLen(data []byte) (int64, bool) {
+	header := len(sealedMagic) + 1
+	if len(data) < header {
+		return 0, false
+	}
+	header += int(data[len(sealedMagic)]) + sealedNonceSize + 4
+	if len(data) < header {
+		return 0, false
+	}
+	total := int64(header) + int64(binary.BigEndian.Uint32(data[header-4:header]))
+	return total, int64(len(data)) >= total
+}
+
+// crypter encrypts and decrypts with the keys of a KeyProvider.
+type crypter struct {
+	keys  KeyProvider
+	mu    sync.Mutex
+	aeads map[string]cipher.AEAD
+}
+
+// newFieldCrypter returns the crypter for encrypted fields, or nil if
+// config has no field keys.
+func newFieldCrypter(config Config) *crypter {
+	if config.FieldKeyProvider == nil {
+		return nil
+	}
+	return &crypter{keys: config.FieldKeyProvider, aeads: make(map[string]cipher.AEAD)}
+}
+
+// newCrypter returns the crypter for config, or nil if it has no keys.
+func newCrypter(config Config) (*crypter, error) {
+	keys := config.KeyProvider
+	switch {
+	case keys != nil && config.EncryptionKey != nil:
+		return nil, errors.New("set either EncryptionKey or KeyProvider, not both")
+	case config.EncryptionKey != nil:
+		kr, err := NewKeyRing(config.EncryptionKey)
+		if err != nil {
+			return nil, err
+		}
+		keys = kr
+	case keys == nil:
+		return nil, nil
+	}
+	return &crypter{keys: keys, aeads: make(map[string]cipher.AEAD)}, nil
+}
+
+func (cr *crypter) aead(id string, key []byte) (cipher.AEAD, error) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	// Cache by key as well as ID, in case a provider reuses an ID.
+	cacheKey := id + "\x00" + string(key)
+	if a, ok := cr.aeads[cacheKey]; ok {
+		return a, nil
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid encryption key %s: %w", id, err)
+	}
+	a, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	cr.aeads[cacheKey] = a
+	return a, nil
+}
+
+// seal encrypts plain with the current key under a fresh random nonce.
+func (cr *crypter) seal(plain []byte, context string) ([]byte, error) {
+	return cr.sealWith(plain, context, func([]byte) ([]byte, error) {
+		nonce := make([]byte, sealedNonceSize)
+		if _, err := rand.Read(nonce); err != nil {
+			return nil, fmt.Errorf("could not generate nonce: %w", err)
+		}
+		return nonce, nil
+	})
+}
+
+// sealWith is seal with the nonce chosen by nonce, which is given the key.
+func (cr *crypter) sealWith(plain []byte, context string, nonce func(key []byte) ([]byte, error)) ([]byte, error) {
+	id, key, err := cr.keys.CurrentKey()
+	if err != nil {
+		return nil, fmt.Errorf("could not get encryption key: %w", err)
+	}
+	if len(id) > 255 {
+		return nil, fmt.Errorf("encryption key ID %q is longer than 255 bytes", id)
+	}
+	a, err := cr.aead(id, key)
+	if err != nil {
+		return nil, err
+	}
+
+	frame := append([]byte(nil), sealedMagic...)
+	frame = append(frame, byte(len(id)))
+	frame = append(frame, id...)
+	n, err := nonce(key)
+	if err != nil {
+		return nil, err
+	}
+	frame = append(frame, n...)
+	frame = binary.BigEndian.AppendUint32(frame, uint32(len(plain)+a.Overhead()))
+
+	aad := append(bytes.Clone(frame), context...)
+	return a.Seal(frame, n, plain, aad), nil
+}
+
+// open decrypts a frame written by seal with the same context. The key ID
+// is returned for error reporting even when decryption fails.
+func (cr *crypter) open(frame []byte, context string) (plain []byte, id string, err error) {
+	n, ok := sealedLen(frame)
+	if !isSealed(frame) || !ok {
+		return nil, "", errors.New("truncated encrypted data")
+	}
+	frame = frame[:n]
+
+	idEnd := len(sealedMagic) + 1 + int(frame[len(sealedMagic)])
+	id = string(frame[len(sealedMagic)+1 : idEnd])
+	nonce := frame[idEnd : idEnd+sealedNonceSize]
+	header := idEnd + sealedNonceSize + 4
+
+	if cr == nil {
+		return nil, id, ErrNoEncryptionKey
+	}
+	key, err := cr.keys.Key(id)
+	if err != nil {
+		if errors.Is(err, ErrUnknownKey) {
+			return nil, id, ErrUnknownKey
+		}
+		return nil, id, fmt.Errorf("could not get encryption key: %w", err)
+	}
+	a, err := cr.aead(id, key)
+	if err != nil {
+		return nil, id, err
+	}
+
+	aad := append(bytes.Clone(frame[:header]), context...)
+	plain, err = a.Open(nil, nonce, frame[header:], aad)
+	if err != nil {
+		return nil, id, ErrAuthentication
+	}
+	return plain, id, nil
+}
+
+// openAt is open for data read from file at offset, with failures reported
+// as a *DecryptionError.
+func (cr *crypter) openAt(frame []byte, context, file string, offset int64) ([]byte, error) {
+	plain, id, err := cr.open(frame, context)
+	if err != nil {
+		return nil, &DecryptionError{File: file, Offset: offset, KeyID: id, Err: err}
+	}
+	return plain, nil
+}
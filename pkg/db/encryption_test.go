@@ -0,0 +1,148 @@
+package db
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEncryption(t *testing.T) {
+	dataDir := "./test-encryption"
+	restoreDir := "./test-encryption-restore"
+	defer os.RemoveAll(dataDir)
+	defer os.RemoveAll(restoreDir)
+
+	oldKey := bytes.Repeat([]byte{1}, 32)
+	newKey := bytes.Repeat([]byte{2}, 32)
+
+	// Start unencrypted, then turn encryption on: old blocks stay readable.
+	db, _ := NewDB(dataDir)
+	users, _ := db.GetCollection("users")
+	users.Insert(Document{"id": "plain-user", "email": "plain@example.com"})
+	users.Commit()
+	db.Close()
+
+	config := DefaultConfig
+	config.EncryptionKey = oldKey
+	config.MutationLog = true
+	db, err := NewDBWithConfig(dataDir, config)
+	if err != nil {
+		t.Fatalf("NewDB failed: %v", err)
+	}
+	users, _ = db.GetCollection("users")
+	users.Insert(Document{"id": "secret-user", "email": "alice@example.com"})
+	users.Insert(Document{"id": "deleted-user", "email": "bob@example.com"})
+	users.Commit()
+	users.Delete("deleted-user")
+	var backup bytes.Buffer
+	if _, err := db.Backup(&backup); err != nil {
+		t.Fatalf("Backup failed: %v", err)
+	}
+	if err := users.Compact(); err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+	db.Close()
+
+	// Nothing written since is in cleartext: data, log or backup.
+	for _, path := range []string{"users.toon", MutationLogFileName} {
+		data, _ := os.ReadFile(filepath.Join(dataDir, path))
+		for _, secret := range []string{"secret-user", "alice@example.com", "plain-user", "deleted-user"} {
+			if bytes.Contains(data, []byte(secret)) {
+				t.Errorf("%s contains %q in cleartext", path, secret)
+			}
+		}
+	}
+	for _, secret := range []string{"secret-user", "alice@example.com", "deleted-user"} {
+		if bytes.Contains(backup.Bytes(), []byte(secret)) {
+			t.Errorf("Backup contains %q in cleartext", secret)
+		}
+	}
+
+	// Without the key, or with the wrong one, the collection cannot load.
+	plainDB, _ := NewDB(dataDir)
+	if _, err := plainDB.GetCollection("users"); !errors.Is(err, ErrNoEncryptionKey) {
+		t.Errorf("Expected ErrNoEncryptionKey, got %v", err)
+	}
+	plainDB.Close()
+	wrong := DefaultConfig
+	wrong.EncryptionKey = newKey
+	wrongDB, _ := NewDBWithConfig(dataDir, wrong)
+	if _, err := wrongDB.GetCollection("users"); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("Expected ErrUnknownKey, got %v", err)
+	}
+	wrongDB.Close()
+
+	// Rotation: the new key encrypts, the old one is kept to read until
+	// Compact has rewritten everything.
+	ring, err := NewKeyRing(newKey, oldKey)
+	if err != nil {
+		t.Fatalf("NewKeyRing failed: %v", err)
+	}
+	rotated := DefaultConfig
+	rotated.KeyProvider = ring
+	db, _ = NewDBWithConfig(dataDir, rotated)
+	users, err = db.GetCollection("users")
+	if err != nil {
+		t.Fatalf("GetCollection with rotated keys failed: %v", err)
+	}
+	if err := users.Compact(); err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+	db.Close()
+
+	db, _ = NewDBWithConfig(dataDir, wrong)
+	users, err = db.GetCollection("users")
+	if err != nil {
+		t.Fatalf("GetCollection with only the new key failed: %v", err)
+	}
+	doc, err := users.FindByID("secret-user")
+	if err != nil || doc["email"] != "alice@example.com" {
+		t.Errorf("Unexpected document after rotation: %v, %v", doc, err)
+	}
+	if n := len(mustAll(t, users)); n != 2 {
+		t.Errorf("Expected 2 documents, got %d", n)
+	}
+	db.Close()
+
+	// A modified block fails authentication and says where.
+	path := filepath.Join(dataDir, "users.toon")
+	data, _ := os.ReadFile(path)
+	data[len(data)-1] ^= 1
+	os.WriteFile(path, data, 0644)
+	db, _ = NewDBWithConfig(dataDir, wrong)
+	_, err = db.GetCollection("users")
+	var decErr *DecryptionError
+	if !errors.As(err, &decErr) || !errors.Is(err, ErrAuthentication) || decErr.File != "users.toon" {
+		t.Errorf("Expected an authentication DecryptionError, got %v", err)
+	}
+	db.Close()
+
+	// The backup restores with the key, without the deleted document.
+	if _, err := RestoreChain(restoreDir, bytes.NewReader(backup.Bytes())); !errors.Is(err, ErrNoEncryptionKey) {
+		t.Errorf("Expected restore without the key to fail, got %v", err)
+	}
+	os.RemoveAll(restoreDir)
+	if _, err := RestoreChainWithConfig(restoreDir, config, bytes.NewReader(backup.Bytes())); err != nil {
+		t.Fatalf("RestoreChainWithConfig failed: %v", err)
+	}
+	db, _ = NewDBWithConfig(restoreDir, config)
+	defer db.Close()
+	users, _ = db.GetCollection("users")
+	if _, err := users.FindByID("deleted-user"); err != ErrNotFound {
+		t.Errorf("Expected deleted document to stay deleted, got %v", err)
+	}
+	if n := len(mustAll(t, users)); n != 2 {
+		t.Errorf("Expected 2 restored documents, got %d", n)
+	}
+}
+
+func mustAll(t *testing.T, c *Collection) []Document {
+	t.Helper()
+	docs, err := c.All()
+	if err != nil {
+		t.Fatalf("All failed: %v", err)
+	}
+	return docs
+}
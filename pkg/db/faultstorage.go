@@ -0,0 +1,529 @@
+package db
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+)
+
+// ErrCrashed is returned by a FaultStorage that has crashed, until it is
+// restarted, and by files opened from it before the crash for good.
+var ErrCrashed = errors.New("storage crashed")
+
+// FaultStorage keeps databases in memory like MemoryStorage, but fails the
+// way a disk does when the process using it crashes, for testing what
+// survives. It tracks what has been made durable: the contents of a file as
+// of its last successful Sync, and the files in a directory as of its last
+// successful SyncDir. A crash keeps that, plus some of the changes made
+// since in the order they were made, the last one possibly torn. Files,
+// locks and contents not kept are gone, as they would be after a power cut.
+// A crashed storage fails every call until Restart, so that the process
+// that was using it gets no further.
+//
+// Faults are drawn from a random source seeded by NewFaultStorage, so a
+// failure can be reproduced from its seed.
+type FaultStorage struct {
+	mu      sync.Mutex
+	rng     *rand.Rand
+	live    *MemoryStorage
+	epoch   int // crashes so far; files from an earlier epoch are dead
+	down    bool
+	faults  Faults
+	calls   int
+	files   map[*memNode]*faultNode
+	durable map[string]*memNode // nil for a directory
+	pending []faultNSOp
+}
+
+// Faults says what a FaultStorage does wrong.
+type Faults struct {
+	// CrashAfter crashes the storage after that many calls to it and its
+	// files, counted from SetFaults; zero never crashes. The last call
+	// takes effect before the crash, and fails with ErrCrashed.
+	CrashAfter int
+
+	// WriteErrors is the chance that a write stops partway with ENOSPC.
+	WriteErrors float64
+
+	// SyncErrors is the chance that Sync or SyncDir fails with EIO. As
+	// with Linux, a file whose Sync fails may lose the writes it was
+	// syncing even if a later Sync succeeds.
+	SyncErrors float64
+}
+
+// faultNode is the durability state of a file: what a crash keeps for
+// sure, and the changes made since that it may keep.
+type faultNode struct {
+	durable []byte
+	pending []faultFileOp
+}
+
+// faultFileOp writes data at off, or truncates the file to size if data is
+// nil.
+type faultFileOp struct {
+	off  int64
+	data []byte
+	size int64
+}
+
+func (op faultFileOp) apply(data []byte) []byte {
+	if op.data == nil {
+		if op.size <= int64(len(data)) {
+			return data[:op.size]
+		}
+		return append(data, make([]byte, op.size-int64(len(data)))...)
+	}
+	if end := op.off + int64(len(op.data)); end > int64(len(data)) {
+		data = append(data, make([]byte, end-int64(len(data)))...)
+	}
+	copy(data[op.off:], op.data)
+	return data
+}
+
+// faultNSOp is a change to a directory: a created file or directory, a
+// rename or a removal.
+type faultNSOp struct {
+	kind    byte // 'c'reate, 'm'kdir, 'r'ename or 'd'elete
+	path    string
+	newpath string
+	node    *memNode
+}
+
+func (op faultNSOp) apply(ns map[string]*memNode) {
+	switch op.kind {
+	case 'c', 'm':
+		ns[op.path] = op.node
+	case 'r':
+		if node, ok := ns[op.path]; ok {
+			delete(ns, op.path)
+			ns[op.newpath] = node
+		}
+	case 'd':
+		delete(ns, op.path)
+	}
+}
+
+// NewFaultStorage returns an empty FaultStorage that draws its faults from
+// seed.
+func NewFaultStorage(seed int64) *FaultStorage {
+	return &FaultStorage{
+		rng:     rand.New(rand.NewSource(seed)),
+		live:    NewMemoryStorage(),
+		files:   make(map[*memNode]*faultNode),
+		durable: make(map[string]*memNode),
+	}
+}
+
+// SetFaults replaces the faults to inject and restarts the count for
+// Faults.CrashAfter.
+func (s *FaultStorage) SetFaults(f Faults) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = f
+	s.calls = 0
+}
+
+// Crashes returns how many times the storage has crashed.
+func (s *FaultStorage) Crashes() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.epoch
+}
+
+// Crash crashes the storage now.
+func (s *FaultStorage) Crash() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.crashLocked()
+}
+
+// Restart brings a crashed storage back up, with what survived the crash.
+func (s *FaultStorage) Restart() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.down = false
+}
+
+// crashLocked replaces the live contents with what survives a crash.
+func (s *FaultStorage) crashLocked() {
+	ns := make(map[string]*memNode, len(s.durable))
+	for path, node := range s.durable {
+		ns[path] = node
+	}
+	for _, op := range s.pending[:s.rng.Intn(len(s.pending)+1)] {
+		op.apply(ns)
+	}
+
+	paths := make([]string, 0, len(ns))
+	for path := range ns {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	live := NewMemoryStorage()
+	durable := make(map[string]*memNode, len(ns))
+	files := make(map[*memNode]*faultNode)
+	for _, path := range paths {
+		node := ns[path]
+		live.MkdirAll(filepath.Dir(path), 0755)
+		if node == nil {
+			live.MkdirAll(path, 0755)
+			durable[path] = nil
+			continue
+		}
+		data := s.survivingLocked(s.files[node])
+		f, _ := live.OpenFile(path, os.O_RDWR|os.O_CREATE, node.mode)
+		f.Write(data)
+		f.Close()
+		info, _ := live.Stat(path)
+		newNode := info.Sys().(*memNode)
+		durable[path] = newNode
+		files[newNode] = &faultNode{durable: data}
+	}
+
+	s.live = live
+	s.durable = durable
+	s.files = files
+	s.pending = nil
+	s.faults.CrashAfter = 0
+	s.epoch++
+	s.down = true
+}
+
+// survivingLocked returns what a crash keeps of a file: its durable
+// contents and some of the changes since, the last one possibly torn.
+func (s *FaultStorage) survivingLocked(n *faultNode) []byte {
+	if n == nil {
+		return nil
+	}
+	data := append([]byte(nil), n.durable...)
+	k := s.rng.Intn(len(n.pending) + 1)
+	for _, op := range n.pending[:k] {
+		data = op.apply(data)
+	}
+	if k < len(n.pending) && n.pending[k].data != nil && s.rng.Intn(2) == 0 {
+		torn := n.pending[k]
+		torn.data = torn.data[:s.rng.Intn(len(torn.data)+1)]
+		data = torn.apply(data)
+	}
+	return data
+}
+
+// beginLocked counts a call made by a file or storage of the given epoch.
+func (s *FaultStorage) beginLocked(epoch int) error {
+	if s.down || epoch != s.epoch {
+		return ErrCrashed
+	}
+	s.calls++
+	return nil
+}
+
+// endLocked crashes the storage if the call that just ended was the one
+// to crash after, and returns err otherwise.
+func (s *FaultStorage) endLocked(err error) error {
+	if s.faults.CrashAfter > 0 && s.calls >= s.faults.CrashAfter {
+		s.crashLocked()
+		return ErrCrashed
+	}
+	return err
+}
+
+func (s *FaultStorage) chance(p float64) bool {
+	return p > 0 && s.rng.Float64() < p
+}
+
+func (s *FaultStorage) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+	name = filepath.Clean(name)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.beginLocked(s.epoch); err != nil {
+		return nil, err
+	}
+
+	_, statErr := s.live.Stat(name)
+	f, err := s.live.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, s.endLocked(err)
+	}
+	node := f.(*memFile).node
+	if s.files[node] == nil {
+		s.files[node] = &faultNode{}
+	}
+	if statErr != nil && !node.dir {
+		s.pending = append(s.pending, faultNSOp{kind: 'c', path: name, node: node})
+	}
+	if flag&os.O_TRUNC != 0 && !node.dir {
+		s.files[node].pending = append(s.files[node].pending, faultFileOp{})
+	}
+	file := &faultFile{storage: s, file: f, node: node, epoch: s.epoch, path: name, append: flag&os.O_APPEND != 0}
+	if err := s.endLocked(nil); err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+func (s *FaultStorage) Stat(name string) (fs.FileInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.beginLocked(s.epoch); err != nil {
+		return nil, err
+	}
+	info, err := s.live.Stat(name)
+	return info, s.endLocked(err)
+}
+
+func (s *FaultStorage) ReadDir(name string) ([]fs.DirEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.beginLocked(s.epoch); err != nil {
+		return nil, err
+	}
+	entries, err := s.live.ReadDir(name)
+	return entries, s.endLocked(err)
+}
+
+func (s *FaultStorage) MkdirAll(path string, perm fs.FileMode) error {
+	path = filepath.Clean(path)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.beginLocked(s.epoch); err != nil {
+		return err
+	}
+	var created []string
+	for dir := path; ; dir = filepath.Dir(dir) {
+		if _, err := s.live.Stat(dir); err == nil {
+			break
+		}
+		created = append(created, dir)
+	}
+	err := s.live.MkdirAll(path, perm)
+	if err == nil {
+		for i := len(created) - 1; i >= 0; i-- {
+			s.pending = append(s.pending, faultNSOp{kind: 'm', path: created[i]})
+		}
+	}
+	return s.endLocked(err)
+}
+
+func (s *FaultStorage) Remove(name string) error {
+	name = filepath.Clean(name)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.beginLocked(s.epoch); err != nil {
+		return err
+	}
+	err := s.live.Remove(name)
+	if err == nil {
+		s.pending = append(s.pending, faultNSOp{kind: 'd', path: name})
+	}
+	return s.endLocked(err)
+}
+
+func (s *FaultStorage) Rename(oldpath, newpath string) error {
+	oldpath, newpath = filepath.Clean(oldpath), filepath.Clean(newpath)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.beginLocked(s.epoch); err != nil {
+		return err
+	}
+	err := s.live.Rename(oldpath, newpath)
+	if err == nil {
+		s.pending = append(s.pending, faultNSOp{kind: 'r', path: oldpath, newpath: newpath})
+	}
+	return s.endLocked(err)
+}
+
+// SyncDir makes every change to directories so far durable, not just those
+// to name, as a file system with a journal does.
+func (s *FaultStorage) SyncDir(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.beginLocked(s.epoch); err != nil {
+		return err
+	}
+	if _, err := s.live.Stat(name); err != nil {
+		return s.endLocked(err)
+	}
+	if s.chance(s.faults.SyncErrors) {
+		return s.endLocked(&fs.PathError{Op: "sync", Path: name, Err: syscall.EIO})
+	}
+	for _, op := range s.pending {
+		op.apply(s.durable)
+	}
+	s.pending = nil
+	return s.endLocked(nil)
+}
+
+func (s *FaultStorage) Lock(name string, shared bool) (io.Closer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.beginLocked(s.epoch); err != nil {
+		return nil, err
+	}
+	lock, err := s.live.Lock(name, shared)
+	if err != nil {
+		return nil, s.endLocked(err)
+	}
+	if err := s.endLocked(nil); err != nil {
+		return nil, err
+	}
+	return lock, nil
+}
+
+// faultFile is an open file of a FaultStorage.
+type faultFile struct {
+	storage *FaultStorage
+	file    File
+	node    *memNode
+	epoch   int
+	path    string
+	append  bool
+}
+
+func (f *faultFile) Read(p []byte) (int, error) {
+	s := f.storage
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.beginLocked(f.epoch); err != nil {
+		return 0, err
+	}
+	n, err := f.file.Read(p)
+	return n, s.endLocked(err)
+}
+
+func (f *faultFile) ReadAt(p []byte, off int64) (int, error) {
+	s := f.storage
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.beginLocked(f.epoch); err != nil {
+		return 0, err
+	}
+	n, err := f.file.ReadAt(p, off)
+	return n, s.endLocked(err)
+}
+
+func (f *faultFile) Write(p []byte) (int, error) {
+	s := f.storage
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.beginLocked(f.epoch); err != nil {
+		return 0, err
+	}
+	off, err := f.file.Seek(0, io.SeekCurrent)
+	if f.append {
+		off = int64(len(f.node.data))
+	}
+	if err != nil {
+		return 0, s.endLocked(err)
+	}
+	n, err := f.writeLocked(p, off, f.file.Write)
+	return n, s.endLocked(err)
+}
+
+func (f *faultFile) WriteAt(p []byte, off int64) (int, error) {
+	s := f.storage
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.beginLocked(f.epoch); err != nil {
+		return 0, err
+	}
+	n, err := f.writeLocked(p, off, func(p []byte) (int, error) { return f.file.WriteAt(p, off) })
+	return n, s.endLocked(err)
+}
+
+// writeLocked writes p at off with write, or only part of it if the write
+// is to fail, and records what it wrote.
+func (f *faultFile) writeLocked(p []byte, off int64, write func([]byte) (int, error)) (int, error) {
+	s := f.storage
+	var fault error
+	if s.chance(s.faults.WriteErrors) {
+		p = p[:s.rng.Intn(len(p)+1)]
+		fault = &fs.PathError{Op: "write", Path: f.path, Err: syscall.ENOSPC}
+	}
+	n, err := write(p)
+	if n > 0 {
+		node := s.files[f.node]
+		node.pending = append(node.pending, faultFileOp{off: off, data: append([]byte(nil), p[:n]...)})
+	}
+	if err == nil {
+		err = fault
+	}
+	return n, err
+}
+
+func (f *faultFile) Seek(offset int64, whence int) (int64, error) {
+	s := f.storage
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.beginLocked(f.epoch); err != nil {
+		return 0, err
+	}
+	pos, err := f.file.Seek(offset, whence)
+	return pos, s.endLocked(err)
+}
+
+func (f *faultFile) Stat() (fs.FileInfo, error) {
+	s := f.storage
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.beginLocked(f.epoch); err != nil {
+		return nil, err
+	}
+	info, err := f.file.Stat()
+	return info, s.endLocked(err)
+}
+
+func (f *faultFile) Sync() error {
+	s := f.storage
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.beginLocked(f.epoch); err != nil {
+		return err
+	}
+	if err := f.file.Sync(); err != nil {
+		return s.endLocked(err)
+	}
+	node := s.files[f.node]
+	if s.chance(s.faults.SyncErrors) {
+		// The writes are dropped from the page cache as if they had been
+		// written, but stay visible to reads.
+		node.pending = nil
+		return s.endLocked(&fs.PathError{Op: "sync", Path: f.path, Err: syscall.EIO})
+	}
+	for _, op := range node.pending {
+		node.durable = op.apply(node.durable)
+	}
+	node.pending = nil
+	return s.endLocked(nil)
+}
+
+func (f *faultFile) Truncate(size int64) error {
+	s := f.storage
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.beginLocked(f.epoch); err != nil {
+		return err
+	}
+	err := f.file.Truncate(size)
+	if err == nil {
+		node := s.files[f.node]
+		node.pending = append(node.pending, faultFileOp{size: size})
+	}
+	return s.endLocked(err)
+}
+
+func (f *faultFile) Close() error {
+	s := f.storage
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if f.epoch != s.epoch {
+		return nil
+	}
+	return f.file.Close()
+}
@@ -0,0 +1,402 @@
+package db
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"testing"
+)
+
+func TestFaultStorage(t *testing.T) {
+	st := NewFaultStorage(1)
+	st.MkdirAll("dir", 0755)
+	st.SyncDir(".")
+
+	// Synced contents and synced renames survive a crash.
+	f, _ := st.OpenFile("dir/a", os.O_RDWR|os.O_CREATE, 0644)
+	f.Write([]byte("synced"))
+	f.Sync()
+	st.SyncDir("dir")
+	st.Rename("dir/a", "dir/b")
+	st.SyncDir("dir")
+	f.Write([]byte(" and not"))
+
+	// Unsynced files do not.
+	g, _ := st.OpenFile("dir/c", os.O_RDWR|os.O_CREATE, 0644)
+	g.Write([]byte("lost"))
+	g.Sync()
+
+	st.Crash()
+	if _, err := st.Stat("dir"); !errors.Is(err, ErrCrashed) {
+		t.Errorf("Expected a crashed storage to fail, got %v", err)
+	}
+	st.Restart()
+	if _, err := f.Write([]byte("x")); !errors.Is(err, ErrCrashed) {
+		t.Errorf("Expected a file from before the crash to fail, got %v", err)
+	}
+	data, err := readFile(st, "dir/b")
+	if err != nil || len(data) < len("synced") || string(data[:6]) != "synced" || len(data) > len("synced and not") {
+		t.Errorf("Expected the synced contents to survive, got %q, %v", data, err)
+	}
+	if _, err := st.Stat("dir/a"); !os.IsNotExist(err) {
+		t.Errorf("Expected the rename to survive, got %v", err)
+	}
+
+	// The crash is counted in calls, and the last call happens.
+	st.SetFaults(Faults{CrashAfter: 2})
+	h, _ := st.OpenFile("dir/b", os.O_RDWR, 0)
+	if _, err := h.WriteAt([]byte("SYNCED"), 0); !errors.Is(err, ErrCrashed) {
+		t.Errorf("Expected the second call to crash, got %v", err)
+	}
+	if st.Crashes() != 2 {
+		t.Errorf("Expected 2 crashes, got %d", st.Crashes())
+	}
+	st.Restart()
+
+	// Writes fail partway, and failed syncs lose writes.
+	st.SetFaults(Faults{WriteErrors: 1})
+	h, _ = st.OpenFile("dir/b", os.O_RDWR|os.O_TRUNC, 0)
+	if n, err := h.Write([]byte("full")); !errors.Is(err, syscall.ENOSPC) || n == 4 {
+		t.Errorf("Expected a short write with ENOSPC, got %d, %v", n, err)
+	}
+	st.SetFaults(Faults{SyncErrors: 1})
+	if err := h.Sync(); !errors.Is(err, syscall.EIO) {
+		t.Errorf("Expected the sync to fail with EIO, got %v", err)
+	}
+	st.SetFaults(Faults{})
+	h.Sync()
+	st.Crash()
+	st.Restart()
+	if data, _ := readFile(st, "dir/b"); len(data) < 6 {
+		t.Errorf("Expected writes a failed sync dropped to be lost, got %q", data)
+	}
+}
+
+// crashModel tracks what a collection may hold after a crash. Deletes are
+// not written to the file until the next compaction, so until then a
+// crash brings deleted documents back, as reopening does.
+type crashModel struct {
+	live     map[string]int          // what the open collection holds
+	unsynced map[string]bool         // ids changed since the last commit
+	durable  map[string]map[int]bool // what each id may be after a crash; 0 is absent
+}
+
+func (m *crashModel) reset(docs map[string]int) {
+	m.live = docs
+	m.unsynced = make(map[string]bool)
+	m.durable = make(map[string]map[int]bool)
+	for id, v := range docs {
+		m.durable[id] = map[int]bool{v: true}
+	}
+}
+
+func (m *crashModel) maybe(id string, v int) {
+	if m.durable[id] == nil {
+		m.durable[id] = map[int]bool{0: true}
+	}
+	m.durable[id][v] = true
+}
+
+// TestCrashDurability runs random inserts, updates, deletes, commits and
+// compactions on a FaultStorage that crashes partway through them, tears
+// writes, runs out of space and fails syncs, and checks after each crash
+// that no committed document was lost, none appeared that was not written,
+// and the index agrees with the file.
+func TestCrashDurability(t *testing.T) {
+	seeds := 500
+	if testing.Short() {
+		seeds = 50
+	}
+	for seed := int64(1); seed <= int64(seeds); seed++ {
+		t.Run(fmt.Sprint(seed), func(t *testing.T) { runCrashTest(t, seed) })
+	}
+}
+
+func runCrashTest(t *testing.T, seed int64) {
+	rng := rand.New(rand.NewSource(seed))
+	st := NewFaultStorage(seed)
+	config := Config{Storage: st}
+	if seed%2 == 0 {
+		config = DefaultConfig
+		config.Storage = st
+	}
+	// The mutation log is written alongside the data, which must not
+	// change what survives.
+	config.MutationLog = seed%4 < 2
+	weather := Faults{}
+	if seed%3 != 0 {
+		weather = Faults{WriteErrors: 0.05, SyncErrors: 0.05}
+	}
+
+	var db *DB
+	var c *Collection
+	model := &crashModel{}
+	model.reset(map[string]int{})
+	version := 0
+
+	// open reopens the database, crashing while it loads now and then,
+	// and checks what it finds against the model. What a crash left is all
+	// durable; what a clean reopen finds may not be, as its writes may
+	// still be waiting for a sync, or have failed one.
+	open := func(crashed bool) {
+		before := st.Crashes()
+		var err error
+		for tries := 0; ; tries++ {
+			if tries == 20 {
+				t.Fatalf("Could not reopen after %d tries: %v", tries, err)
+			}
+			faults := weather
+			if rng.Intn(3) == 0 {
+				faults.CrashAfter = rng.Intn(20) + 1
+			}
+			st.Restart()
+			st.SetFaults(faults)
+			crashes := st.Crashes()
+			db, err = NewDBWithConfig("data", config)
+			if err == nil {
+				if c, err = db.GetCollection("docs"); err != nil && st.Crashes() == crashes {
+					db.Close()
+				}
+			}
+			if err == nil {
+				break
+			}
+		}
+		st.SetFaults(Faults{})
+		docs := checkCrashModel(t, c, model)
+		if crashed || st.Crashes() != before {
+			model.reset(docs)
+		} else {
+			model.live = docs
+			model.unsynced = make(map[string]bool)
+		}
+		st.SetFaults(weather)
+	}
+	open(false)
+
+	for step := 0; step < 80; step++ {
+		if rng.Intn(8) == 0 {
+			faults := weather
+			faults.CrashAfter = rng.Intn(30) + 1
+			st.SetFaults(faults)
+		}
+		crashes := st.Crashes()
+
+		var err error
+		ids := make([]string, 0, len(model.live))
+		for id := range model.live {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		op := rng.Intn(20)
+		switch {
+		case op < 7 || len(ids) == 0:
+			version++
+			id := fmt.Sprintf("doc%d", version)
+			if _, err = c.Insert(Document{"id": id, "v": version}); err == nil {
+				model.live[id] = version
+				model.unsynced[id] = true
+			}
+		case op < 11:
+			version++
+			id := ids[rng.Intn(len(ids))]
+			if err = c.Update(id, Document{"v": version}); err == nil {
+				model.live[id] = version
+				model.unsynced[id] = true
+			}
+		case op < 13:
+			id := ids[rng.Intn(len(ids))]
+			if err = c.Delete(id); err == nil {
+				delete(model.live, id)
+				delete(model.unsynced, id)
+			}
+		case op < 17:
+			if c.Size() == 0 {
+				break
+			}
+			if err = c.Commit(); err == nil {
+				for id := range model.unsynced {
+					if v, ok := model.live[id]; ok {
+						model.durable[id] = map[int]bool{v: true}
+					}
+				}
+				model.unsynced = make(map[string]bool)
+			} else {
+				for id := range model.unsynced {
+					if v, ok := model.live[id]; ok {
+						model.maybe(id, v)
+					}
+				}
+			}
+		case op < 19:
+			if err = c.Compact(); err == nil {
+				model.reset(model.live)
+			} else {
+				// The old file stays until the new one replaces it, so
+				// only documents deleted since may be gone.
+				for id := range model.durable {
+					if _, ok := model.live[id]; !ok {
+						model.maybe(id, 0)
+					}
+				}
+				for id, v := range model.live {
+					model.maybe(id, v)
+				}
+			}
+		default:
+			if err := db.Close(); err != nil {
+				t.Fatalf("Close failed: %v", err)
+			}
+			open(false)
+			continue
+		}
+
+		if st.Crashes() != crashes {
+			open(true)
+		} else if err != nil && !errors.Is(err, syscall.ENOSPC) && !errors.Is(err, syscall.EIO) {
+			t.Fatalf("Step %d failed: %v", step, err)
+		}
+	}
+
+	st.SetFaults(Faults{})
+	db.Close()
+	open(false)
+	db.Close()
+}
+
+// checkCrashModel checks a reopened collection against the model and its
+// index against its file, and returns what the collection holds.
+func checkCrashModel(t *testing.T, c *Collection, m *crashModel) map[string]int {
+	t.Helper()
+	docs := make(map[string]int)
+	all, err := c.All()
+	if err != nil {
+		t.Fatalf("All failed: %v", err)
+	}
+	for _, doc := range all {
+		id := fmt.Sprint(doc["id"])
+		var v int
+		fmt.Sscan(fmt.Sprint(doc["v"]), &v)
+		if _, dup := docs[id]; dup {
+			t.Fatalf("Document %s read twice", id)
+		}
+		docs[id] = v
+	}
+
+	for id, v := range docs {
+		if !m.durable[id][v] {
+			t.Fatalf("Phantom document %s with version %d, expected one of %v", id, v, m.durable[id])
+		}
+	}
+	for id, vs := range m.durable {
+		if _, ok := docs[id]; !ok && !vs[0] {
+			t.Fatalf("Committed document %s lost, expected one of %v", id, vs)
+		}
+	}
+
+	// The index holds every document in the file, and each points to a
+	// block that has it.
+	data, err := readFile(c.storage, c.filePath)
+	if err != nil {
+		t.Fatalf("Could not read %s: %v", filepath.Base(c.filePath), err)
+	}
+	inFile := make(map[string]BlockInfo)
+	if _, err := scanFileBlocks(data, c.name, c.crypt, func(info BlockInfo, ids []string) {
+		for _, id := range ids {
+			inFile[id] = info
+		}
+	}); err != nil {
+		t.Fatalf("Could not scan the file: %v", err)
+	}
+	if len(inFile) != len(c.index) || len(c.index) != len(docs) {
+		t.Fatalf("Index has %d documents, file %d, All %d", len(c.index), len(inFile), len(docs))
+	}
+	for id, info := range c.index {
+		if inFile[id] != info {
+			t.Fatalf("Index has %s at %v, file at %v", id, info, inFile[id])
+		}
+		if doc, err := c.FindByID(id); err != nil || fmt.Sprint(doc["v"]) != fmt.Sprint(docs[id]) {
+			t.Fatalf("FindByID(%s) = %v, %v, expected version %d", id, doc, err, docs[id])
+		}
+	}
+	return docs
+}
+
+// TestFailedCommitNotLogged checks that commits and compactions that fail
+// to write their data leave no record in the mutation log, which recovery
+// and followers would replay: the log holds exactly what the collection
+// does. A compaction whose directory sync fails has still replaced the
+// file, so it is logged.
+func TestFailedCommitNotLogged(t *testing.T) {
+	st := NewFaultStorage(1)
+	config := DefaultConfig
+	config.Storage = st
+	config.MutationLog = true
+	db, err := NewDBWithConfig("data", config)
+	if err != nil {
+		t.Fatalf("NewDB failed: %v", err)
+	}
+	defer db.Close()
+	c, _ := db.GetCollection("docs")
+
+	st.SetFaults(Faults{WriteErrors: 0.2, SyncErrors: 0.1})
+	failed := 0
+	for i := 0; i < 200; i++ {
+		id := fmt.Sprintf("doc%d", i)
+		if _, err := c.Insert(Document{"id": id}); err != nil {
+			t.Fatalf("Insert failed: %v", err)
+		}
+		if i%5 == 0 {
+			err = c.Compact()
+		} else {
+			err = c.Commit()
+		}
+		if err == nil {
+			continue
+		}
+		if !errors.Is(err, syscall.ENOSPC) && !errors.Is(err, syscall.EIO) {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		failed++
+		st.SetFaults(Faults{})
+		if err := c.Delete(id); err != nil {
+			t.Fatalf("Delete failed: %v", err)
+		}
+		st.SetFaults(Faults{WriteErrors: 0.2, SyncErrors: 0.1})
+	}
+	st.SetFaults(Faults{})
+	if failed == 0 {
+		t.Fatal("Expected some writes to fail")
+	}
+
+	data, err := readFile(st, mutationLogPath("data"))
+	if err != nil {
+		t.Fatalf("Could not read the log: %v", err)
+	}
+	logged := make(map[string]bool)
+	if _, err := scanMutationLog(bytes.NewReader(data), nil, func(rec *logRecord) error {
+		for _, doc := range rec.Documents {
+			logged[fmt.Sprint(doc["id"])] = true
+		}
+		if rec.Op == logDelete {
+			delete(logged, rec.ID)
+		}
+		return nil
+	}); err != nil {
+		t.Fatalf("Could not scan the log: %v", err)
+	}
+	all, _ := c.All()
+	if len(all) != len(logged) || len(all) == 0 {
+		t.Errorf("Log replays to %d documents, collection holds %d", len(logged), len(all))
+	}
+	for _, doc := range all {
+		if id := fmt.Sprint(doc["id"]); !logged[id] {
+			t.Errorf("Commit of %s was not logged", id)
+		}
+	}
+}
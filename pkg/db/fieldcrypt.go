@@ -0,0 +1,370 @@
+package db
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/Al3x-Myku/FlyDB/pkg/query"
+	"github.com/Al3x-Myku/FlyDB/pkg/toon"
+)
+
+// ErrEncryptedField is returned for queries, indexes and aggregations that
+// would need the plaintext of an encrypted field to be evaluated.
+var ErrEncryptedField = errors.New("not supported on an encrypted field")
+
+// EncryptedField names a field whose values are stored encrypted with the
+// database's field keys. Deterministic encryption gives equal values equal
+// ciphertexts, so the field can still be matched with =, != and IN, indexed
+// and grouped by, at the cost of revealing which documents share a value.
+type EncryptedField struct {
+	Field         string `json:"field"`
+	Deterministic bool   `json:"deterministic,omitempty"`
+}
+
+// An encrypted value is a string holding encryptedPrefix and the sealed
+// frame in unpadded base64url, which TOON stores without escaping. The
+// plaintext is the value as TOON would write it, and it is decrypted with
+// TOON's type inference, so it reads back as it would from a data file.
+const encryptedPrefix = "enc:"
+
+var fieldNonceLabel = []byte("flydb field nonce")
+
+// SetEncryptedFields replaces the collection's encrypted fields and persists
+// them in its metadata. Every later Insert, Update and Patch encrypts these
+// fields; documents already stored are encrypted by the next Compact, which
+// also re-encrypts values written under an older key or mode. No fields
+// turns encryption off for new writes.
+//
+// Reads return plaintext when the database has Config.FieldKeyProvider and
+// the stored ciphertext otherwise. Values that are already ciphertext are
+// stored as they are, so documents exported without the key can be
+// imported again. Change events carry the stored ciphertext.
+func (c *Collection) SetEncryptedFields(fields ...EncryptedField) error {
+	if err := c.checkWritable(); err != nil {
+		return err
+	}
+	seen := make(map[string]bool, len(fields))
+	for _, f := range fields {
+		if f.Field == "" || f.Field == "id" {
+			return fmt.Errorf("cannot encrypt field %q", f.Field)
+		}
+		if seen[f.Field] {
+			return fmt.Errorf("field %s is listed twice", f.Field)
+		}
+		seen[f.Field] = true
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.file == nil {
+		return ErrCollectionClosed
+	}
+	for _, f := range fields {
+		if _, ok := c.textIndexes[f.Field]; ok {
+			return fmt.Errorf("%w: %s has a text index", ErrEncryptedField, f.Field)
+		}
+	}
+
+	previous := c.meta.EncryptedFields
+	c.meta.EncryptedFields = nil
+	if len(fields) > 0 {
+		c.meta.EncryptedFields = slices.Clone(fields)
+	}
+	if err := c.saveMetaInternal(); err != nil {
+		c.meta.EncryptedFields = previous
+		return err
+	}
+	return nil
+}
+
+func (c *Collection) EncryptedFields() []EncryptedField {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return slices.Clone(c.meta.EncryptedFields)
+}
+
+func (c *Collection) encryptedFieldInternal(field string) (EncryptedField, bool) {
+	for _, f := range c.meta.EncryptedFields {
+		if f.Field == field {
+			return f, true
+		}
+	}
+	return EncryptedField{}, false
+}
+
+// fieldContext binds a ciphertext to its collection and field, so it cannot
+// be copied into another one unnoticed.
+func (c *Collection) fieldContext(field string) string {
+	return c.name + "\x00" + field
+}
+
+// parseEncrypted returns the sealed frame held by an encrypted value.
+func parseEncrypted(v any) ([]byte, bool) {
+	s, ok := v.(string)
+	if !ok || !strings.HasPrefix(s, encryptedPrefix) {
+		return nil, false
+	}
+	frame, err := base64.RawURLEncoding.DecodeString(s[len(encryptedPrefix):])
+	if err != nil || !isSealed(frame) {
+		return nil, false
+	}
+	n, ok := sealedLen(frame)
+	return frame, ok && n == int64(len(frame))
+}
+
+// deterministicNonce derives the nonce from the plaintext, with a MAC key
+// separate from the encryption key, so equal values in the same field
+// encrypt equally and different ones never share a nonce.
+func deterministicNonce(key []byte, context string, plain []byte) []byte {
+	sub := hmac.New(sha256.New, key)
+	sub.Write(fieldNonceLabel)
+	mac := hmac.New(sha256.New, sub.Sum(nil))
+	mac.Write([]byte(context))
+	mac.Write([]byte{0})
+	mac.Write(plain)
+	return mac.Sum(nil)[:sealedNonceSize]
+}
+
+// encryptValue encrypts v for field f. Nil and values that are already
+// encrypted are returned as they are.
+func (c *Collection) encryptValue(f EncryptedField, v any) (any, error) {
+	if v == nil {
+		return nil, nil
+	}
+	if _, ok := parseEncrypted(v); ok {
+		return v, nil
+	}
+	if c.fieldCrypt == nil {
+		return nil, fmt.Errorf("cannot encrypt field %s: %w", f.Field, ErrNoEncryptionKey)
+	}
+
+	plain := []byte(fmt.Sprint(v))
+	context := c.fieldContext(f.Field)
+	var frame []byte
+	var err error
+	if f.Deterministic {
+		// Canonicalize so that 5, int64(5) and "5.0" all encrypt the same,
+		// as they compare equal in queries.
+		plain = []byte(fmt.Sprint(toon.InferType(string(plain))))
+		frame, err = c.fieldCrypt.sealWith(plain, context, func(key []byte) ([]byte, error) {
+			return deterministicNonce(key, context, plain), nil
+		})
+	} else {
+		frame, err = c.fieldCrypt.seal(plain, context)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not encrypt field %s: %w", f.Field, err)
+	}
+	return encryptedPrefix + base64.RawURLEncoding.EncodeToString(frame), nil
+}
+
+// decryptValue returns the plaintext of an encrypted value. Values that are
+// not encrypted, such as those stored before the field was, are returned
+// as they are.
+func (c *Collection) decryptValue(field string, v any) (any, error) {
+	frame, ok := parseEncrypted(v)
+	if !ok {
+		return v, nil
+	}
+	plain, id, err := c.fieldCrypt.open(frame, c.fieldContext(field))
+	if err != nil {
+		return nil, fmt.Errorf("could not decrypt field %s (key %s): %w", field, id, err)
+	}
+	return toon.InferType(string(plain)), nil
+}
+
+// encryptFieldsInternal returns doc with its encrypted fields encrypted. The
+// caller's document is left alone; a copy is made if anything changes.
+func (c *Collection) encryptFieldsInternal(doc Document) (Document, error) {
+	if len(c.meta.EncryptedFields) == 0 {
+		return doc, nil
+	}
+	var out Document
+	for _, f := range c.meta.EncryptedFields {
+		v, ok := doc[f.Field]
+		if _, sealed := parseEncrypted(v); !ok || v == nil || sealed {
+			continue
+		}
+		enc, err := c.encryptValue(f, v)
+		if err != nil {
+			return nil, err
+		}
+		if out == nil {
+			out = make(Document, len(doc))
+			for k, v := range doc {
+				out[k] = v
+			}
+		}
+		out[f.Field] = enc
+	}
+	if out == nil {
+		return doc, nil
+	}
+	return out, nil
+}
+
+// reencryptInternal decrypts and encrypts again every encrypted field of
+// doc, so it uses the current key and mode, and encrypts values stored
+// before the field was. Without field keys the document is kept as is.
+func (c *Collection) reencryptInternal(doc Document) (Document, error) {
+	if c.fieldCrypt == nil || len(c.meta.EncryptedFields) == 0 {
+		return doc, nil
+	}
+	out := make(Document, len(doc))
+	for k, v := range doc {
+		out[k] = v
+	}
+	for _, f := range c.meta.EncryptedFields {
+		v, ok := out[f.Field]
+		if !ok || v == nil {
+			continue
+		}
+		plain, err := c.decryptValue(f.Field, v)
+		if err != nil {
+			return nil, fmt.Errorf("document %v: %w", doc["id"], err)
+		}
+		if out[f.Field], err = c.encryptValue(f, plain); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// decryptFields returns a copy of doc with fields decrypted, or doc itself
+// if there are no field keys or nothing to decrypt. fields is taken by the
+// caller under the collection lock.
+func (c *Collection) decryptFields(fields []EncryptedField, doc Document) (Document, error) {
+	if c.fieldCrypt == nil || doc == nil {
+		return doc, nil
+	}
+	var out Document
+	for _, f := range fields {
+		v, ok := doc[f.Field]
+		if _, sealed := parseEncrypted(v); !ok || !sealed {
+			continue
+		}
+		plain, err := c.decryptValue(f.Field, v)
+		if err != nil {
+			return nil, fmt.Errorf("document %v: %w", doc["id"], err)
+		}
+		if out == nil {
+			out = make(Document, len(doc))
+			for k, v := range doc {
+				out[k] = v
+			}
+		}
+		out[f.Field] = plain
+	}
+	if out == nil {
+		return doc, nil
+	}
+	return out, nil
+}
+
+// decryptAll decrypts docs in place.
+func (c *Collection) decryptAll(fields []EncryptedField, docs []Document) error {
+	for i, doc := range docs {
+		plain, err := c.decryptFields(fields, doc)
+		if err != nil {
+			return err
+		}
+		docs[i] = plain
+	}
+	return nil
+}
+
+// encryptQueryInternal rewrites q to compare deterministic fields with
+// encrypted literals. Predicates that need the plaintext of an encrypted
+// field fail with ErrEncryptedField.
+func (c *Collection) encryptQueryInternal(q query.Expr) (query.Expr, error) {
+	if len(c.meta.EncryptedFields) == 0 || q == nil {
+		return q, nil
+	}
+
+	terms := func(in []query.Expr) ([]query.Expr, error) {
+		out := make([]query.Expr, len(in))
+		for i, t := range in {
+			var err error
+			if out[i], err = c.encryptQueryInternal(t); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+	}
+
+	switch x := q.(type) {
+	case *query.AndExpr:
+		t, err := terms(x.Terms)
+		if err != nil {
+			return nil, err
+		}
+		return &query.AndExpr{Terms: t}, nil
+	case *query.OrExpr:
+		t, err := terms(x.Terms)
+		if err != nil {
+			return nil, err
+		}
+		return &query.OrExpr{Terms: t}, nil
+	case *query.NotExpr:
+		e, err := c.encryptQueryInternal(x.Expr)
+		if err != nil {
+			return nil, err
+		}
+		return &query.NotExpr{Expr: e}, nil
+	case *query.CompareExpr:
+		f, ok := c.encryptedFieldInternal(x.Field)
+		if !ok || x.Value == nil {
+			return x, nil
+		}
+		if !f.Deterministic || (x.Op != query.OpEq && x.Op != query.OpNe) {
+			return nil, fmt.Errorf("%w: %s", ErrEncryptedField, x)
+		}
+		v, err := c.encryptValue(f, x.Value)
+		if err != nil {
+			return nil, err
+		}
+		return &query.CompareExpr{Field: x.Field, Op: x.Op, Value: v}, nil
+	case *query.InExpr:
+		f, ok := c.encryptedFieldInternal(x.Field)
+		if !ok {
+			return x, nil
+		}
+		if !f.Deterministic {
+			return nil, fmt.Errorf("%w: %s", ErrEncryptedField, x)
+		}
+		values := make([]any, len(x.Values))
+		for i, v := range x.Values {
+			var err error
+			if values[i], err = c.encryptValue(f, v); err != nil {
+				return nil, err
+			}
+		}
+		return &query.InExpr{Field: x.Field, Values: values}, nil
+	case *query.ExistsExpr:
+		return x, nil
+	}
+
+	if field, _, ok := predicateField(q); ok {
+		if _, enc := c.encryptedFieldInternal(field); enc {
+			return nil, fmt.Errorf("%w: %s", ErrEncryptedField, q)
+		}
+	}
+	return q, nil
+}
+
+// checkSortInternal rejects sorting by an encrypted field, whose ciphertext
+// order says nothing about the values.
+func (c *Collection) checkSortInternal(opts query.Options) error {
+	for _, k := range opts.Sort {
+		if _, ok := c.encryptedFieldInternal(k.Field); ok {
+			return fmt.Errorf("%w: cannot sort by %s", ErrEncryptedField, k.Field)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+package db
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Al3x-Myku/FlyDB/pkg/query"
+	"github.com/Al3x-Myku/FlyDB/pkg/toon"
+)
+
+func TestFieldEncryption(t *testing.T) {
+	dataDir := "./test-fieldcrypt"
+	importDir := "./test-fieldcrypt-import"
+	defer os.RemoveAll(dataDir)
+	defer os.RemoveAll(importDir)
+
+	key := bytes.Repeat([]byte{3}, 32)
+	ring, _ := NewKeyRing(key)
+	// Uncompressed, so the data file can be checked for cleartext.
+	config := Config{FieldKeyProvider: ring}
+
+	// A document stored before the fields were encrypted.
+	db, _ := NewDBWithConfig(dataDir, config)
+	people, _ := db.GetCollection("people")
+	people.Insert(Document{"id": "p0", "name": "Old", "ssn": "000-00-0000", "card_number": "4000000000000000"})
+	people.Commit()
+
+	fields := []EncryptedField{{Field: "ssn"}, {Field: "card_number", Deterministic: true}}
+	if err := people.SetEncryptedFields(fields...); err != nil {
+		t.Fatalf("SetEncryptedFields failed: %v", err)
+	}
+	people.Insert(Document{"id": "p1", "name": "Alice", "ssn": "123-45-6789", "card_number": "4111111111111111"})
+	people.Insert(Document{"id": "p2", "name": "Bob", "ssn": "987-65-4321", "card_number": "4111111111111111"})
+
+	// Equality on a deterministic field works before and after commit.
+	cardQuery, _ := query.Parse("card_number = '4111111111111111'")
+	for _, stage := range []string{"memtable", "committed"} {
+		docs, err := people.Find(cardQuery)
+		if err != nil || len(docs) != 2 {
+			t.Fatalf("%s: card lookup returned %d documents, %v", stage, len(docs), err)
+		}
+		if docs[0]["ssn"] != "123-45-6789" && docs[0]["ssn"] != "987-65-4321" {
+			t.Errorf("%s: ssn not decrypted: %v", stage, docs[0]["ssn"])
+		}
+		people.Commit()
+	}
+	if err := people.Compact(); err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+
+	data, _ := os.ReadFile(filepath.Join(dataDir, "people.toon"))
+	for _, secret := range []string{"000-00-0000", "123-45-6789", "4111111111111111", "4000000000000000"} {
+		if bytes.Contains(data, []byte(secret)) {
+			t.Errorf("Data file contains %q in cleartext", secret)
+		}
+	}
+	if !bytes.Contains(data, []byte("Alice")) {
+		t.Errorf("Unencrypted fields should be stored as they are")
+	}
+
+	// Other fields stay queryable; encrypted ones only by deterministic
+	// equality.
+	nameQuery, _ := query.Parse("name = 'Alice'")
+	if docs, err := people.Find(nameQuery); err != nil || len(docs) != 1 || docs[0]["ssn"] != "123-45-6789" {
+		t.Errorf("Unexpected result for name query: %v, %v", docs, err)
+	}
+	for _, q := range []string{"ssn = '123-45-6789'", "card_number > 4", "card_number PREFIX '4111'"} {
+		expr, _ := query.Parse(q)
+		if _, err := people.Find(expr); !errors.Is(err, ErrEncryptedField) {
+			t.Errorf("%s: expected ErrEncryptedField, got %v", q, err)
+		}
+	}
+	sorted := query.Options{Sort: []query.SortKey{{Field: "ssn"}}}
+	if _, err := people.FindWithOptions(nil, sorted); !errors.Is(err, ErrEncryptedField) {
+		t.Errorf("Expected sorting by an encrypted field to fail, got %v", err)
+	}
+	agg, _ := query.ParseAggregation("count() BY card_number")
+	rows, err := people.Aggregate(agg)
+	if err != nil || len(rows) != 2 {
+		t.Errorf("Unexpected aggregation: %v, %v", rows, err)
+	}
+	for _, row := range rows {
+		if row["card_number"] == int64(4111111111111111) && row["count"] != int64(2) {
+			t.Errorf("Unexpected group: %v", row)
+		}
+	}
+	if err := people.CreateTextIndex("ssn"); !errors.Is(err, ErrEncryptedField) {
+		t.Errorf("Expected ErrEncryptedField for a text index, got %v", err)
+	}
+
+	// Export: the stored form survives TOON and can be imported by a
+	// database without the key.
+	stored, _ := people.AllEncrypted()
+	export, err := toon.Encode("people", stored)
+	if err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+	if bytes.Contains(export, []byte("123-45-6789")) {
+		t.Errorf("Export contains the ssn in cleartext")
+	}
+	db.Close()
+
+	imported, err := toon.DecodeAll(export)
+	if err != nil {
+		t.Fatalf("DecodeAll failed: %v", err)
+	}
+	plainDB, _ := NewDB(importDir)
+	target, _ := plainDB.GetCollection("people")
+	target.SetEncryptedFields(fields...)
+	for _, doc := range imported {
+		if _, err := target.Insert(doc); err != nil {
+			t.Fatalf("Importing ciphertext failed: %v", err)
+		}
+	}
+	target.Commit()
+	doc, _ := target.FindByID("p1")
+	if s, _ := doc["ssn"].(string); !strings.HasPrefix(s, encryptedPrefix) {
+		t.Errorf("Expected ciphertext without the key, got %v", doc["ssn"])
+	}
+	if _, err := target.Insert(Document{"id": "p3", "ssn": "111-11-1111"}); !errors.Is(err, ErrNoEncryptionKey) {
+		t.Errorf("Expected ErrNoEncryptionKey for a plaintext value, got %v", err)
+	}
+	plainDB.Close()
+
+	keyed, _ := NewDBWithConfig(importDir, config)
+	defer keyed.Close()
+	target, _ = keyed.GetCollection("people")
+	doc, err = target.FindByID("p1")
+	if err != nil || doc["ssn"] != "123-45-6789" || doc["name"] != "Alice" {
+		t.Errorf("Unexpected imported document: %v, %v", doc, err)
+	}
+
+	// Another key cannot read the fields.
+	other, _ := NewKeyRing(bytes.Repeat([]byte{4}, 32))
+	wrong := DefaultConfig
+	wrong.FieldKeyProvider = other
+	wrongDB, _ := NewDBWithConfig(dataDir, wrong)
+	defer wrongDB.Close()
+	people, _ = wrongDB.GetCollection("people")
+	if _, err := people.FindByID("p1"); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("Expected ErrUnknownKey, got %v", err)
+	}
+}
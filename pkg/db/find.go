@@ -0,0 +1,140 @@
+package db
+
+import (
+	"errors"
+
+	"github.com/Al3x-Myku/FlyDB/pkg/query"
+)
+
+// errStopScan ends a scan early once a collector has everything it needs.
+var errStopScan = errors.New("stop scan")
+
+// Find returns every document matching q, including uncommitted ones in the
+// memtable. A nil q matches all documents.
+func (c *Collection) Find(q query.Expr) ([]Document, error) {
+	return c.FindWithOptions(q, query.Options{})
+}
+
+// FindWithOptions returns the documents matching q, sorted, paged and
+// projected according to opts. The planner chooses how documents are found
+// (see Plan); sorting with a limit keeps only the best Skip+Limit documents
+// in a bounded heap.
+func (c *Collection) FindWithOptions(q query.Expr, opts query.Options) ([]Document, error) {
+	if err := opts.Fields.Validate(); err != nil {
+		return nil, err
+	}
+
+	page, _, err := c.findPage(q, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	projection := opts.Fields
+	if len(opts.Lookups) > 0 {
+		if page, err = c.applyLookups(page, opts.Lookups); err != nil {
+			return nil, err
+		}
+		if len(projection.Include) > 0 {
+			projection.Include = append([]string{}, projection.Include...)
+			for _, l := range opts.Lookups {
+				projection.Include = append(projection.Include, l.As)
+			}
+		}
+	}
+
+	for i, doc := range page {
+		page[i] = projection.Apply(doc)
+	}
+	return page, nil
+}
+
+// findPage plans and runs the filter, sort and paging steps under the read
+// lock and returns the unprojected page. Lookups and projection happen
+// afterwards so that a lookup may read from any collection, including this
+// one.
+func (c *Collection) findPage(q query.Expr, opts query.Options) ([]Document, *Plan, error) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	if c.file == nil {
+		return nil, nil, ErrCollectionClosed
+	}
+
+	if err := c.checkSortInternal(opts); err != nil {
+		return nil, nil, err
+	}
+	q, err := c.encryptQueryInternal(q)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	plan := c.planInternal(q, opts)
+	collector := query.NewCollector(opts)
+	if err := c.execute(plan, q, opts, collector); err != nil {
+		return nil, nil, err
+	}
+
+	page := collector.Page()
+	if err := c.decryptAll(c.meta.EncryptedFields, page); err != nil {
+		return nil, nil, err
+	}
+	return page, plan, nil
+}
+
+func (c *Collection) sortIndex(opts query.Options) *fieldIndex {
+	if len(opts.Sort) == 0 || opts.Limit <= 0 {
+		return nil
+	}
+	return c.fieldIndexes[opts.Sort[0].Field]
+}
+
+// findIndexed feeds the collector in the order of the leading sort key: the
+// memtable's documents first, since the index only covers committed ones,
+// then the committed documents as the index walk reaches them.
+func (c *Collection) findIndexed(plan *Plan, q query.Expr, opts query.Options, collector *query.Collector) error {
+	fi := plan.index
+	inMemtable := make(map[string]bool)
+	err := c.scanMemtable(func(id string, doc Document) error {
+		inMemtable[id] = true
+		plan.Examined++
+		if query.Match(q, doc) {
+			collector.Add(doc)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	cache := newBlockCache(c, 8)
+	defer func() {
+		plan.BlocksRead = cache.reads
+	}()
+
+	desc := opts.Sort[0].Desc
+	n := len(fi.entries)
+	for i := 0; i < n; i++ {
+		e := fi.entries[i]
+		if desc {
+			e = fi.entries[n-1-i]
+		}
+
+		if collector.Saturated(e.value) {
+			break
+		}
+		if inMemtable[e.id] {
+			continue
+		}
+
+		doc, err := cache.get(e.id)
+		if err != nil {
+			return err
+		}
+		plan.Examined++
+		if doc != nil && query.Match(q, doc) {
+			collector.Add(doc)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,242 @@
+package db
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// ErrUnsupportedFormat is returned for a collection file written by a newer
+// version of FlyDB, or with features this version does not know.
+var ErrUnsupportedFormat = errors.New("unsupported collection file format")
+
+// FormatVersion is the version of the collection file format written by
+// this version of FlyDB. Files from before the format was versioned have no
+// header and count as version 0.
+const FormatVersion = 1
+
+// Features record what the blocks of a file may use, so that a version of
+// FlyDB that does not support one refuses the file instead of misreading
+// it. Readers reject any feature they do not know.
+const (
+	FeatureCodecs     uint16 = 1 << iota // blocks framed with a codec ID
+	FeatureEncryption                    // sealed blocks
+
+	knownFeatures = FeatureCodecs | FeatureEncryption
+)
+
+// A versioned file starts with
+//
+//	magic (4) | version (2) | features (2)
+//
+// followed by its blocks. The magic starts with a byte that cannot begin
+// TOON text, a gzip stream, or a codec or sealed frame.
+var fileMagic = []byte{0xfd, 'F', 'D', 'B'}
+
+const fileHeaderSize = 8
+
+type fileHeader struct {
+	version  uint16
+	features uint16
+}
+
+func (h fileHeader) bytes() []byte {
+	b := append([]byte(nil), fileMagic...)
+	b = binary.BigEndian.AppendUint16(b, h.version)
+	return binary.BigEndian.AppendUint16(b, h.features)
+}
+
+// parseFileHeader returns the header at the start of a collection file's
+// contents and its length, which is zero for a legacy file and for a header
+// cut short.
+func parseFileHeader(data []byte) (fileHeader, int64, error) {
+	if partialHeader(data) {
+		return fileHeader{version: FormatVersion}, 0, nil
+	}
+	if !bytes.HasPrefix(data, fileMagic) {
+		return fileHeader{}, 0, nil
+	}
+	h := fileHeader{
+		version:  binary.BigEndian.Uint16(data[4:6]),
+		features: binary.BigEndian.Uint16(data[6:8]),
+	}
+	if h.version == 0 || h.version > FormatVersion {
+		return h, 0, fmt.Errorf("%w: version %d, this version of FlyDB reads up to %d", ErrUnsupportedFormat, h.version, FormatVersion)
+	}
+	if unknown := h.features &^ knownFeatures; unknown != 0 {
+		return h, 0, fmt.Errorf("%w: unknown features %#x", ErrUnsupportedFormat, unknown)
+	}
+	return h, fileHeaderSize, nil
+}
+
+// partialHeader reports whether data is the start of a file header and
+// nothing more, as a crash during the first write to a file, or a writer
+// still making it, leaves it. Such a file holds no blocks yet.
+func partialHeader(data []byte) bool {
+	n := min(len(data), len(fileMagic))
+	return len(data) > 0 && len(data) < fileHeaderSize && bytes.Equal(data[:n], fileMagic[:n])
+}
+
+// blockFeatures returns the features a block written now needs.
+func (c *Collection) blockFeatures() uint16 {
+	var f uint16
+	if c.codec.ID() != "none" {
+		f |= FeatureCodecs
+	}
+	if c.crypt != nil {
+		f |= FeatureEncryption
+	}
+	return f
+}
+
+// addFeaturesInternal records features in the header before the first block
+// that uses them is written. Changing the header counts as a rewrite for
+// incremental backups, which only copy what was appended. Legacy files are
+// left alone until they are upgraded.
+func (c *Collection) addFeaturesInternal(features uint16) error {
+	if c.format.version == 0 || features&^c.format.features == 0 {
+		return nil
+	}
+	c.meta.Generation++
+	if err := c.saveMetaInternal(); err != nil {
+		c.meta.Generation--
+		return err
+	}
+	h := fileHeader{version: c.format.version, features: c.format.features | features}
+	if _, err := c.file.WriteAt(h.bytes(), 0); err != nil {
+		return fmt.Errorf("could not write file header: %w", err)
+	}
+	c.format = h
+	return nil
+}
+
+// FormatVersion returns the format version of the collection's file, which
+// is 0 for files from before the format was versioned.
+func (c *Collection) FormatVersion() int {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return int(c.format.version)
+}
+
+// Upgrade rewrites a legacy collection file in the current format and
+// reports whether it had to. The blocks are copied as they are, behind a new
+// header, into a temporary file that replaces the original only once it is
+// safely on disk, so a crash leaves one or the other. It fails with
+// ErrLocked while another process has the database open read-only, since
+// that process would go on reading the old file. Compact upgrades a file
+// too, while rewriting its blocks.
+func (c *Collection) Upgrade() (bool, error) {
+	if err := c.checkWritable(); err != nil {
+		return false, err
+	}
+
+	c.compactMutex.Lock()
+	defer c.compactMutex.Unlock()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.file == nil {
+		return false, ErrCollectionClosed
+	}
+	if c.format.version == FormatVersion {
+		return false, nil
+	}
+	lock, err := excludeReaders(c.storage, filepath.Dir(c.filePath))
+	if err != nil {
+		return false, err
+	}
+	defer lock.Close()
+
+	info, err := c.file.Stat()
+	if err != nil {
+		return false, fmt.Errorf("could not stat file: %w", err)
+	}
+	data := make([]byte, info.Size())
+	if _, err := c.file.ReadAt(data, 0); err != nil && err != io.EOF {
+		return false, fmt.Errorf("could not read file: %w", err)
+	}
+
+	h := fileHeader{version: FormatVersion}
+	_, err = scanFileBlocks(data, c.name, c.crypt, func(info BlockInfo, ids []string) {
+		switch block := data[info.Offset:]; {
+		case isSealed(block):
+			h.features |= FeatureEncryption
+		case isCodecFrame(block):
+			h.features |= FeatureCodecs
+		}
+	})
+	if err != nil {
+		return false, err
+	}
+
+	c.meta.Generation++
+	if err := c.saveMetaInternal(); err != nil {
+		c.meta.Generation--
+		return false, err
+	}
+
+	tmp, tmpPath, err := createTemp(c.storage, filepath.Dir(c.filePath), filepath.Base(c.filePath)+".upgrade*")
+	if err != nil {
+		return false, fmt.Errorf("could not create upgraded file: %w", err)
+	}
+	defer c.storage.Remove(tmpPath)
+	_, err = tmp.Write(append(h.bytes(), data...))
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return false, fmt.Errorf("could not write upgraded file: %w", err)
+	}
+
+	if err := c.storage.Rename(tmpPath, c.filePath); err != nil {
+		return false, fmt.Errorf("could not replace file: %w", err)
+	}
+	if err := c.storage.SyncDir(filepath.Dir(c.filePath)); err != nil {
+		return false, err
+	}
+
+	file, err := c.storage.OpenFile(c.filePath, os.O_RDWR, 0644)
+	if err != nil {
+		return false, fmt.Errorf("could not reopen upgraded file: %w", err)
+	}
+	c.file.Close()
+	c.file = file
+	c.format = h
+	c.scanned += fileHeaderSize
+	for id, info := range c.index {
+		info.Offset += fileHeaderSize
+		c.index[id] = info
+	}
+	return true, nil
+}
+
+// Upgrade rewrites every legacy collection file in the current format, see
+// Collection.Upgrade, and returns the names of those it upgraded.
+func (db *DB) Upgrade() ([]string, error) {
+	names, err := db.ListCollections()
+	if err != nil {
+		return nil, err
+	}
+	var upgraded []string
+	for _, name := range names {
+		c, err := db.GetCollection(name)
+		if err != nil {
+			return upgraded, fmt.Errorf("%s: %w", name, err)
+		}
+		ok, err := c.Upgrade()
+		if err != nil {
+			return upgraded, fmt.Errorf("%s: %w", name, err)
+		}
+		if ok {
+			upgraded = append(upgraded, name)
+		}
+	}
+	return upgraded, nil
+}
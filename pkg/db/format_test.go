@@ -0,0 +1,154 @@
+package db
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/Al3x-Myku/FlyDB/pkg/toon"
+)
+
+func TestFileFormat(t *testing.T) {
+	dataDir := "./test-format"
+	defer os.RemoveAll(dataDir)
+
+	// A file from before the format was versioned.
+	os.MkdirAll(dataDir, 0755)
+	legacy, _ := toon.Encode("items", []Document{{"id": "a"}, {"id": "b"}})
+	legacyPath := filepath.Join(dataDir, "items.toon")
+	os.WriteFile(legacyPath, legacy, 0644)
+
+	db, err := NewDBWithConfig(dataDir, Config{Codec: "zlib"})
+	if err != nil {
+		t.Fatalf("NewDB failed: %v", err)
+	}
+	items, err := db.GetCollection("items")
+	if err != nil {
+		t.Fatalf("GetCollection failed: %v", err)
+	}
+	if v := items.FormatVersion(); v != 0 {
+		t.Errorf("Expected a legacy file to be version 0, got %d", v)
+	}
+	items.Insert(Document{"id": "c"})
+	if err := items.Commit(); err != nil {
+		t.Fatalf("Commit to a legacy file failed: %v", err)
+	}
+
+	// New collections get a header with the features they use.
+	db.CreateCollection("fresh")
+	fresh, _ := db.GetCollection("fresh")
+	fresh.Insert(Document{"id": "x"})
+	fresh.Commit()
+	data, _ := os.ReadFile(filepath.Join(dataDir, "fresh.toon"))
+	h, n, err := parseFileHeader(data)
+	if err != nil || n != fileHeaderSize || h.version != FormatVersion || h.features != FeatureCodecs {
+		t.Errorf("Unexpected header for a new file: %+v, %d, %v", h, n, err)
+	}
+
+	upgraded, err := db.Upgrade()
+	if err != nil {
+		t.Fatalf("Upgrade failed: %v", err)
+	}
+	if len(upgraded) != 1 || upgraded[0] != "items" {
+		t.Errorf("Expected only items to be upgraded, got %v", upgraded)
+	}
+	if ok, err := items.Upgrade(); ok || err != nil {
+		t.Errorf("Expected a second upgrade to do nothing, got %v, %v", ok, err)
+	}
+	if doc, err := items.FindByID("b"); err != nil || doc["id"] != "b" {
+		t.Errorf("FindByID after Upgrade failed: %v, %v", doc, err)
+	}
+	items.Insert(Document{"id": "d"})
+	items.Commit()
+	db.Close()
+
+	data, _ = os.ReadFile(legacyPath)
+	if !bytes.HasPrefix(data[fileHeaderSize:], legacy) {
+		t.Errorf("Expected the legacy blocks to be kept behind the header")
+	}
+	if matches, _ := filepath.Glob(filepath.Join(dataDir, "*.upgrade*")); len(matches) != 0 {
+		t.Errorf("Temporary files left behind: %v", matches)
+	}
+
+	db, _ = NewDB(dataDir)
+	items, _ = db.GetCollection("items")
+	if v := items.FormatVersion(); v != FormatVersion {
+		t.Errorf("Expected version %d after Upgrade, got %d", FormatVersion, v)
+	}
+	if n := len(mustAll(t, items)); n != 4 {
+		t.Errorf("Expected 4 documents after Upgrade, got %d", n)
+	}
+	db.Close()
+
+	// A file from a newer version is refused rather than misread.
+	binary.BigEndian.PutUint16(data[4:6], FormatVersion+1)
+	os.WriteFile(legacyPath, data, 0644)
+	db, _ = NewDB(dataDir)
+	defer db.Close()
+	if _, err := db.GetCollection("items"); !errors.Is(err, ErrUnsupportedFormat) {
+		t.Errorf("Expected ErrUnsupportedFormat, got %v", err)
+	}
+}
+
+// TestFindByIDDuringUpgrade reads documents while Upgrade replaces the file
+// and moves every block behind the header; run it with -race.
+func TestFindByIDDuringUpgrade(t *testing.T) {
+	dataDir := "./test-upgrade-concurrent"
+	defer os.RemoveAll(dataDir)
+
+	docs := make([]Document, 20)
+	for i := range docs {
+		docs[i] = Document{"id": fmt.Sprint(i), "n": i}
+	}
+	legacy, _ := toon.Encode("items", docs)
+
+	for round := 0; round < 20; round++ {
+		os.RemoveAll(dataDir)
+		os.MkdirAll(dataDir, 0755)
+		os.WriteFile(filepath.Join(dataDir, "items.toon"), legacy, 0644)
+		db, err := NewDB(dataDir)
+		if err != nil {
+			t.Fatalf("NewDB failed: %v", err)
+		}
+		items, _ := db.GetCollection("items")
+
+		// Upgrade starts once every reader has read a document.
+		stop := make(chan struct{})
+		var wg, reading sync.WaitGroup
+		for r := 0; r < 4; r++ {
+			wg.Add(1)
+			reading.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; ; i++ {
+					id := fmt.Sprint(i % len(docs))
+					doc, err := items.FindByID(id)
+					if i == 0 {
+						reading.Done()
+					}
+					if err != nil || fmt.Sprint(doc["id"]) != id {
+						t.Errorf("FindByID(%s) = %v, %v", id, doc, err)
+						return
+					}
+					select {
+					case <-stop:
+						return
+					default:
+					}
+				}
+			}()
+		}
+		reading.Wait()
+		if ok, err := items.Upgrade(); err != nil || !ok {
+			t.Errorf("Upgrade = %v, %v", ok, err)
+		}
+		close(stop)
+		wg.Wait()
+		db.Close()
+	}
+}
@@ -0,0 +1,100 @@
+package db
+
+import (
+	"fmt"
+	"sync"
+)
+
+// DocumentHook runs before a document is inserted or updated. It may modify
+// doc in place; returning an error aborts the write and the error is passed
+// back to the caller.
+type DocumentHook func(doc Document) error
+
+// DeleteHook runs before a document is deleted. Returning an error aborts
+// the delete.
+type DeleteHook func(id string) error
+
+// CommitHook runs after a commit has been written and synced, with the
+// documents that were committed. It runs without the collection lock held,
+// so it may read from or write to the collection.
+type CommitHook func(docs []Document)
+
+type hooks struct {
+	mu           sync.RWMutex
+	beforeInsert []DocumentHook
+	beforeUpdate []DocumentHook
+	beforeDelete []DeleteHook
+	afterCommit  []CommitHook
+}
+
+// BeforeInsert registers a hook run on every Insert. Hooks run in the order
+// they were registered.
+func (c *Collection) BeforeInsert(h DocumentHook) {
+	c.hooks.mu.Lock()
+	defer c.hooks.mu.Unlock()
+	c.hooks.beforeInsert = append(c.hooks.beforeInsert, h)
+}
+
+// BeforeUpdate registers a hook run on every Update. The document's id is
+// already set when the hook runs.
+func (c *Collection) BeforeUpdate(h DocumentHook) {
+	c.hooks.mu.Lock()
+	defer c.hooks.mu.Unlock()
+	c.hooks.beforeUpdate = append(c.hooks.beforeUpdate, h)
+}
+
+func (c *Collection) BeforeDelete(h DeleteHook) {
+	c.hooks.mu.Lock()
+	defer c.hooks.mu.Unlock()
+	c.hooks.beforeDelete = append(c.hooks.beforeDelete, h)
+}
+
+func (c *Collection) AfterCommit(h CommitHook) {
+	c.hooks.mu.Lock()
+	defer c.hooks.mu.Unlock()
+	c.hooks.afterCommit = append(c.hooks.afterCommit, h)
+}
+
+func runDocumentHooks(stage string, hs []DocumentHook, doc Document) error {
+	for _, h := range hs {
+		if err := h(doc); err != nil {
+			return fmt.Errorf("%s hook: %w", stage, err)
+		}
+	}
+	return nil
+}
+
+func (c *Collection) runBeforeInsert(doc Document) error {
+	c.hooks.mu.RLock()
+	hs := c.hooks.beforeInsert
+	c.hooks.mu.RUnlock()
+	return runDocumentHooks("before insert", hs, doc)
+}
+
+func (c *Collection) runBeforeUpdate(doc Document) error {
+	c.hooks.mu.RLock()
+	hs := c.hooks.beforeUpdate
+	c.hooks.mu.RUnlock()
+	return runDocumentHooks("before update", hs, doc)
+}
+
+func (c *Collection) runBeforeDelete(id string) error {
+	c.hooks.mu.RLock()
+	hs := c.hooks.beforeDelete
+	c.hooks.mu.RUnlock()
+	for _, h := range hs {
+		if err := h(id); err != nil {
+			return fmt.Errorf("before delete hook: %w", err)
+		}
+	}
+	return nil
+}
+
+func (c *Collection) runAfterCommit(docs []Document) {
+	c.hooks.mu.RLock()
+	hs := c.hooks.afterCommit
+	c.hooks.mu.RUnlock()
+	for _, h := range hs {
+		h(docs)
+	}
+}
@@ -0,0 +1,87 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestHooks(t *testing.T) {
+	dataDir := "./test-hooks"
+	defer os.RemoveAll(dataDir)
+
+	db, _ := NewDB(dataDir)
+	defer db.Close()
+
+	users, _ := db.GetCollection("users")
+
+	errNoEmail := errors.New("email is required")
+	normalize := func(doc Document) error {
+		email, ok := doc["email"].(string)
+		if !ok {
+			return errNoEmail
+		}
+		doc["email"] = strings.ToLower(email)
+		doc["domain"] = email[strings.Index(email, "@")+1:]
+		return nil
+	}
+	users.BeforeInsert(normalize)
+	users.BeforeUpdate(normalize)
+	users.BeforeDelete(func(id string) error {
+		if id == "admin" {
+			return fmt.Errorf("cannot delete %s", id)
+		}
+		return nil
+	})
+
+	var committed []string
+	users.AfterCommit(func(docs []Document) {
+		for _, doc := range docs {
+			committed = append(committed, fmt.Sprint(doc["id"]))
+		}
+		// The collection is unlocked, so hooks may read it.
+		if _, err := users.FindByID("admin"); err != nil {
+			t.Errorf("FindByID inside AfterCommit failed: %v", err)
+		}
+	})
+
+	if _, err := users.Insert(Document{"id": "admin", "email": "Root@Example.COM"}); err != nil {
+		t.Fatalf("Insert failed: %v", err)
+	}
+	if _, err := users.Insert(Document{"id": "bob"}); !errors.Is(err, errNoEmail) {
+		t.Errorf("Expected the hook's error, got %v", err)
+	}
+	if err := users.Update("admin", Document{"email": "ADMIN@example.com"}); err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+	if err := users.Update("admin", Document{}); !errors.Is(err, errNoEmail) {
+		t.Errorf("Expected the hook's error on update, got %v", err)
+	}
+
+	if err := users.Commit(); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	if len(committed) != 1 || committed[0] != "admin" {
+		t.Errorf("Expected AfterCommit to see [admin], got %v", committed)
+	}
+
+	doc, err := users.FindByID("admin")
+	if err != nil {
+		t.Fatalf("FindByID failed: %v", err)
+	}
+	if doc["email"] != "admin@example.com" || doc["domain"] != "example.com" {
+		t.Errorf("Hook changes not stored: %v", doc)
+	}
+	if _, err := users.FindByID("bob"); err != ErrNotFound {
+		t.Errorf("Rejected insert was stored")
+	}
+
+	if err := users.Delete("admin"); err == nil {
+		t.Errorf("Expected BeforeDelete to reject the delete")
+	}
+	if _, err := users.FindByID("admin"); err != nil {
+		t.Errorf("Rejected delete removed the document")
+	}
+}
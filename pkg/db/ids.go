@@ -0,0 +1,187 @@
+package db
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// IDStrategy decides how Insert fills in the id of a document that has none.
+type IDStrategy string
+
+const (
+	// IDNone rejects documents without an id with ErrMissingID.
+	IDNone IDStrategy = ""
+	// IDULID generates 26-character, lexicographically time-sortable IDs.
+	IDULID IDStrategy = "ulid"
+	// IDUUID generates random version 4 UUIDs.
+	IDUUID IDStrategy = "uuid"
+	// IDSequence numbers documents 1, 2, 3, ... per collection. Numbers are
+	// reserved on disk in batches, so a restart may skip some but never
+	// reuses one.
+	IDSequence IDStrategy = "sequence"
+)
+
+const sequenceBatch = 100
+
+func ParseIDStrategy(s string) (IDStrategy, error) {
+	switch IDStrategy(s) {
+	case IDNone, IDULID, IDUUID, IDSequence:
+		return IDStrategy(s), nil
+	case "none":
+		return IDNone, nil
+	}
+	return "", fmt.Errorf("unknown id strategy %q", s)
+}
+
+// SetIDStrategy overrides the database's Config.IDStrategy for this
+// collection. The choice is persisted in the collection's metadata.
+func (c *Collection) SetIDStrategy(s IDStrategy) error {
+	if err := c.checkWritable(); err != nil {
+		return err
+	}
+	if _, err := ParseIDStrategy(string(s)); err != nil {
+		return err
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.file == nil {
+		return ErrCollectionClosed
+	}
+
+	previous := c.meta.IDStrategy
+	c.meta.IDStrategy = &s
+	if err := c.saveMetaInternal(); err != nil {
+		c.meta.IDStrategy = previous
+		return err
+	}
+	return nil
+}
+
+// IDStrategy returns the strategy Insert uses for documents without an id.
+func (c *Collection) IDStrategy() IDStrategy {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.idStrategyInternal()
+}
+
+func (c *Collection) idStrategyInternal() IDStrategy {
+	if c.meta.IDStrategy != nil {
+		return *c.meta.IDStrategy
+	}
+	if c.db != nil {
+		return c.db.config.IDStrategy
+	}
+	return IDNone
+}
+
+// assignID gives doc a generated id if its id is missing or empty and the
+// collection has an ID strategy. Without a strategy doc is left as it is.
+func (c *Collection) assignID(doc Document) error {
+	if v, ok := doc["id"]; ok && v != nil && v != "" {
+		return nil
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.file == nil {
+		return ErrCollectionClosed
+	}
+
+	switch c.idStrategyInternal() {
+	case IDULID:
+		doc["id"] = newULID(time.Now())
+	case IDUUID:
+		doc["id"] = newUUID()
+	case IDSequence:
+		n, err := c.nextSequenceInternal()
+		if err != nil {
+			return err
+		}
+		doc["id"] = strconv.FormatInt(n, 10)
+	}
+	return nil
+}
+
+func (c *Collection) nextSequenceInternal() (int64, error) {
+	if c.sequence == 0 {
+		c.sequence = c.meta.SequenceReserved
+	}
+	if c.sequence >= c.meta.SequenceReserved {
+		c.meta.SequenceReserved = c.sequence + sequenceBatch
+		if err := c.saveMetaInternal(); err != nil {
+			c.meta.SequenceReserved = c.sequence
+			return 0, fmt.Errorf("could not reserve sequence numbers: %w", err)
+		}
+	}
+	c.sequence++
+	return c.sequence, nil
+}
+
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+var ulidState struct {
+	sync.Mutex
+	ms   uint64
+	rand [10]byte
+}
+
+// newULID returns a ULID: a 48-bit millisecond timestamp followed by 80
+// random bits, in Crockford base32. IDs made in the same millisecond
+// increment the random part, so they still sort in creation order.
+func newULID(now time.Time) string {
+	ms := uint64(now.UnixMilli())
+
+	ulidState.Lock()
+	if ms > ulidState.ms {
+		ulidState.ms = ms
+		if _, err := rand.Read(ulidState.rand[:]); err != nil {
+			panic(err)
+		}
+	} else {
+		ms = ulidState.ms
+		for i := len(ulidState.rand) - 1; i >= 0; i-- {
+			ulidState.rand[i]++
+			if ulidState.rand[i] != 0 {
+				break
+			}
+		}
+	}
+	entropy := ulidState.rand
+	ulidState.Unlock()
+
+	return encodeULID(ms, entropy)
+}
+
+func encodeULID(ms uint64, entropy [10]byte) string {
+	var b [16]byte
+	binary.BigEndian.PutUint64(b[:8], ms<<16)
+	copy(b[6:], entropy[:])
+
+	// 128 bits as 26 base32 digits, the first holding only 3 bits.
+	hi := binary.BigEndian.Uint64(b[:8])
+	lo := binary.BigEndian.Uint64(b[8:])
+	var out [26]byte
+	for i := 25; i >= 0; i-- {
+		out[i] = crockford[lo&31]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(out[:])
+}
+
+func newUUID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
@@ -0,0 +1,86 @@
+package db
+
+import (
+	"os"
+	"regexp"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestIDGeneration(t *testing.T) {
+	dataDir := "./test-ids"
+	defer os.RemoveAll(dataDir)
+
+	db, _ := NewDBWithConfig(dataDir, Config{IDStrategy: IDULID})
+	events, _ := db.GetCollection("events")
+
+	var ids []string
+	for i := 0; i < 50; i++ {
+		id, err := events.Insert(Document{"n": i})
+		if err != nil {
+			t.Fatalf("Insert failed: %v", err)
+		}
+		ids = append(ids, id)
+	}
+	if !sort.StringsAreSorted(ids) || len(ids[0]) != 26 {
+		t.Errorf("Expected sorted 26-character ULIDs, got %v", ids[:3])
+	}
+	if id, _ := events.Insert(Document{"id": "given"}); id != "given" {
+		t.Errorf("Existing id was replaced with %s", id)
+	}
+
+	tokens, _ := db.GetCollection("tokens")
+	tokens.SetIDStrategy(IDUUID)
+	id, _ := tokens.Insert(Document{"id": ""})
+	if !regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`).MatchString(id) {
+		t.Errorf("Expected a v4 UUID, got %s", id)
+	}
+
+	orders, _ := db.GetCollection("orders")
+	orders.SetIDStrategy(IDSequence)
+	for want := 1; want <= 3; want++ {
+		doc := Document{"total": want}
+		id, _ := orders.Insert(doc)
+		if id != string(rune('0'+want)) || doc["id"] != id {
+			t.Errorf("Expected id %d, got %s", want, id)
+		}
+	}
+	orders.Commit()
+
+	none, _ := db.GetCollection("plain")
+	none.SetIDStrategy(IDNone)
+	if _, err := none.Insert(Document{"x": 1}); err != ErrMissingID {
+		t.Errorf("Expected ErrMissingID, got %v", err)
+	}
+
+	// The sequence and per-collection strategies survive a restart, and
+	// sequence numbers are never reused.
+	db.Close()
+	db, _ = NewDB(dataDir)
+	defer db.Close()
+	orders, _ = db.GetCollection("orders")
+	if orders.IDStrategy() != IDSequence {
+		t.Errorf("Expected sequence strategy after restart, got %q", orders.IDStrategy())
+	}
+	id, _ = orders.Insert(Document{"total": 4})
+	if id == "1" || id == "2" || id == "3" {
+		t.Errorf("Sequence number %s reused after restart", id)
+	}
+}
+
+func TestULIDEncoding(t *testing.T) {
+	if got := encodeULID(1469918176385, [10]byte{}); got != "01ARYZ6S410000000000000000" {
+		t.Errorf("Unexpected encoding %s", got)
+	}
+	max := [10]byte{255, 255, 255, 255, 255, 255, 255, 255, 255, 255}
+	if got := encodeULID(1<<48-1, max); got != "7ZZZZZZZZZZZZZZZZZZZZZZZZZ" {
+		t.Errorf("Unexpected encoding %s", got)
+	}
+
+	a := newULID(time.Now())
+	b := newULID(time.Now().Add(-time.Hour))
+	if a >= b {
+		t.Errorf("Expected IDs to keep increasing when the clock goes back: %s, %s", a, b)
+	}
+}
@@ -0,0 +1,188 @@
+package db
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/Al3x-Myku/FlyDB/pkg/query"
+	"github.com/Al3x-Myku/FlyDB/pkg/toon"
+)
+
+type indexEntry struct {
+	value any
+	id    string
+}
+
+// fieldIndex is an ordered secondary index over one field of the committed
+// documents. Entries are kept sorted by (value, id) using query.Order, so a
+// walk over the slice visits documents in sort order. Documents that lack
+// the field are indexed under nil and sort first.
+type fieldIndex struct {
+	field   string
+	entries []indexEntry
+	values  map[string]any
+}
+
+func newFieldIndex(field string) *fieldIndex {
+	return &fieldIndex{
+		field:  field,
+		values: make(map[string]any),
+	}
+}
+
+func compareEntries(a, b indexEntry) int {
+	if c := query.Order(a.value, b.value); c != 0 {
+		return c
+	}
+	switch {
+	case a.id < b.id:
+		return -1
+	case a.id > b.id:
+		return 1
+	}
+	return 0
+}
+
+func (fi *fieldIndex) search(e indexEntry) int {
+	return sort.Search(len(fi.entries), func(i int) bool {
+		return compareEntries(fi.entries[i], e) >= 0
+	})
+}
+
+func (fi *fieldIndex) add(id string, doc Document) {
+	fi.remove(id)
+
+	e := indexEntry{value: query.Normalize(doc[fi.field]), id: id}
+	i := fi.search(e)
+	fi.entries = append(fi.entries, indexEntry{})
+	copy(fi.entries[i+1:], fi.entries[i:])
+	fi.entries[i] = e
+	fi.values[id] = e.value
+}
+
+func (fi *fieldIndex) remove(id string) {
+	value, ok := fi.values[id]
+	if !ok {
+		return
+	}
+	i := fi.search(indexEntry{value: value, id: id})
+	if i < len(fi.entries) && fi.entries[i].id == id {
+		fi.entries = append(fi.entries[:i], fi.entries[i+1:]...)
+	}
+	delete(fi.values, id)
+}
+
+// lookup returns the IDs of the documents whose field equals value.
+func (fi *fieldIndex) lookup(value any) []string {
+	v := query.Normalize(value)
+	i := sort.Search(len(fi.entries), func(i int) bool {
+		return query.Order(fi.entries[i].value, v) >= 0
+	})
+
+	var ids []string
+	for ; i < len(fi.entries) && query.Order(fi.entries[i].value, v) == 0; i++ {
+		ids = append(ids, fi.entries[i].id)
+	}
+	return ids
+}
+
+// CreateIndex builds an ordered secondary index over field from the committed
+// documents and keeps it up to date on every commit. Sorted queries with a
+// limit whose first sort key is an indexed field walk the index instead of
+// scanning the whole collection.
+func (c *Collection) CreateIndex(field string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.file == nil {
+		return ErrCollectionClosed
+	}
+
+	if _, ok := c.fieldIndexes[field]; ok {
+		return nil
+	}
+
+	fi := newFieldIndex(field)
+	err := c.scanBlocks(func(id string, doc Document) error {
+		fi.add(id, doc)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("could not build index on %s: %w", field, err)
+	}
+	c.fieldIndexes[field] = fi
+
+	return nil
+}
+
+func (c *Collection) DropIndex(field string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.fieldIndexes, field)
+}
+
+func (c *Collection) Indexes() []string {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	fields := make([]string, 0, len(c.fieldIndexes))
+	for f := range c.fieldIndexes {
+		fields = append(fields, f)
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+// blockCache keeps the last few decoded blocks of a query that fetches
+// documents one by one, such as an index walk, so that neighbouring IDs in
+// the same block do not each pay for a decode.
+type blockCache struct {
+	c     *Collection
+	order []BlockInfo
+	docs  map[BlockInfo]map[string]Document
+	size  int
+	reads int
+}
+
+func newBlockCache(c *Collection, size int) *blockCache {
+	return &blockCache{
+		c:    c,
+		docs: make(map[BlockInfo]map[string]Document),
+		size: size,
+	}
+}
+
+func (bc *blockCache) get(id string) (Document, error) {
+	info, ok := bc.c.index[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	if docs, ok := bc.docs[info]; ok {
+		return docs[id], nil
+	}
+
+	blockData, err := bc.c.readBlock(info)
+	if err != nil {
+		return nil, err
+	}
+	decoded, err := toon.DecodeAll(blockData)
+	if err != nil {
+		return nil, err
+	}
+	bc.reads++
+
+	docs := make(map[string]Document, len(decoded))
+	for _, doc := range decoded {
+		docs[fmt.Sprint(doc["id"])] = doc
+	}
+
+	if len(bc.order) >= bc.size {
+		delete(bc.docs, bc.order[0])
+		bc.order = bc.order[1:]
+	}
+	bc.order = append(bc.order, info)
+	bc.docs[info] = docs
+
+	return docs[id], nil
+}
@@ -0,0 +1,86 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ErrLocked is returned when another process has the data directory open
+// in a way that conflicts with this one.
+var ErrLocked = errors.New("data directory is locked")
+
+// lockFileName is the file in the data directory that writers lock to keep
+// two of them from appending to the same collection files, which would
+// corrupt the offsets in each other's index.
+const lockFileName = "flydb.lock"
+
+// Processes lock the data directory in two ways, neither of which waits:
+//
+//   - a writer locks lockFileName exclusively, and records its PID in it for
+//     the error the next writer gets;
+//   - a read-only open takes a shared lock on the directory itself, which
+//     creates nothing and does not conflict with the writer's lock. Rewrites
+//     that replace files, such as Upgrade, lock the directory exclusively
+//     for their duration, so they do not leave readers on the old files.
+//
+// With OSStorage, locks go with the process, so one that crashes does not
+// leave the directory locked.
+
+// lockDataDir takes the writer lock on dir.
+func lockDataDir(st Storage, dir string) (io.Closer, error) {
+	path := filepath.Join(dir, lockFileName)
+	file, err := st.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("could not open lock file: %w", err)
+	}
+	defer file.Close()
+
+	lock, err := st.Lock(path, false)
+	if errors.Is(err, ErrLocked) {
+		return nil, lockedError(st, dir, path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := file.Truncate(0); err == nil {
+		file.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+	return lock, nil
+}
+
+// lockedError names the process holding the writer lock on dir, if it
+// recorded itself in the lock file.
+func lockedError(st Storage, dir, path string) error {
+	data, _ := readFile(st, path)
+	if pid, err := strconv.Atoi(strings.TrimSpace(string(data))); err == nil {
+		return fmt.Errorf("%w: %s is in use by process %d", ErrLocked, dir, pid)
+	}
+	return fmt.Errorf("%w: %s is in use by another process", ErrLocked, dir)
+}
+
+// shareDataDir takes the shared lock on dir held by read-only opens.
+func shareDataDir(st Storage, dir string) (io.Closer, error) {
+	return lockDir(st, dir, true, "is being rewritten by another process")
+}
+
+// excludeReaders locks dir against read-only opens, for a rewrite that
+// replaces files.
+func excludeReaders(st Storage, dir string) (io.Closer, error) {
+	return lockDir(st, dir, false, "is open read-only by another process")
+}
+
+func lockDir(st Storage, dir string, shared bool, conflict string) (io.Closer, error) {
+	lock, err := st.Lock(dir, shared)
+	if errors.Is(err, ErrLocked) {
+		return nil, fmt.Errorf("%w: %s %s", ErrLocked, dir, conflict)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not open data dir: %w", err)
+	}
+	return lock, nil
+}
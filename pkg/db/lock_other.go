@@ -0,0 +1,15 @@
+//go:build !unix
+
+package db
+
+import (
+	"errors"
+	"os"
+)
+
+var errWouldBlock = errors.New("lock is held")
+
+// Data directories are not locked on platforms without flock.
+func lockFile(f *os.File, shared bool) error { return nil }
+
+func unlockFile(f *os.File) error { return nil }
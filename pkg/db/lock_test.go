@@ -0,0 +1,42 @@
+//go:build unix
+
+package db
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestDataDirLock(t *testing.T) {
+	dataDir := "./test-lock"
+	defer os.RemoveAll(dataDir)
+
+	db, err := NewDB(dataDir)
+	if err != nil {
+		t.Fatalf("NewDB failed: %v", err)
+	}
+	_, err = NewDB(dataDir)
+	if !errors.Is(err, ErrLocked) {
+		t.Fatalf("Expected ErrLocked for a second writer, got %v", err)
+	}
+	if pid := fmt.Sprint(os.Getpid()); !strings.Contains(err.Error(), pid) {
+		t.Errorf("Expected the error to name process %s, got %v", pid, err)
+	}
+
+	// Collection files are not mistaken for the lock file.
+	if names, _ := db.ListCollections(); len(names) != 0 {
+		t.Errorf("Expected no collections, got %v", names)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	db, err = NewDB(dataDir)
+	if err != nil {
+		t.Fatalf("Expected Close to release the lock, got %v", err)
+	}
+	db.Close()
+}
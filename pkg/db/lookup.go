@@ -0,0 +1,264 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/Al3x-Myku/FlyDB/pkg/query"
+	"github.com/Al3x-Myku/FlyDB/pkg/toon"
+)
+
+var ErrNoDatabase = errors.New("collection is not attached to a database")
+
+// FindByIDs fetches several documents at once. IDs that are not found are
+// simply absent from the result. Committed documents are grouped by block,
+// so each block is read and decoded at most once no matter how many of the
+// requested IDs it holds.
+func (c *Collection) FindByIDs(ids []string) (map[string]Document, error) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	if c.file == nil {
+		return nil, ErrCollectionClosed
+	}
+
+	found, err := c.findByIDsInternal(ids)
+	if err != nil {
+		return nil, err
+	}
+	for id, doc := range found {
+		if found[id], err = c.decryptFields(c.meta.EncryptedFields, doc); err != nil {
+			return nil, err
+		}
+	}
+	return found, nil
+}
+
+func (c *Collection) findByIDsInternal(ids []string) (map[string]Document, error) {
+	found := make(map[string]Document, len(ids))
+	wanted := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		wanted[id] = true
+	}
+
+	err := c.scanMemtable(func(id string, doc Document) error {
+		if wanted[id] {
+			found[id] = doc
+			delete(wanted, id)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	remaining := make([]string, 0, len(wanted))
+	for id := range wanted {
+		remaining = append(remaining, id)
+	}
+	_, err = c.fetchCommitted(remaining, func(id string, doc Document) error {
+		found[id] = doc
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return found, nil
+}
+
+// fetchCommitted reads the committed version of each ID, grouping the IDs by
+// block and visiting blocks in file order, and returns how many blocks were
+// read. Memtable versions are not consulted.
+func (c *Collection) fetchCommitted(ids []string, fn func(id string, doc Document) error) (int, error) {
+	byBlock := make(map[BlockInfo]map[string]bool)
+	for _, id := range ids {
+		info, ok := c.index[id]
+		if !ok {
+			continue
+		}
+		if byBlock[info] == nil {
+			byBlock[info] = make(map[string]bool)
+		}
+		byBlock[info][id] = true
+	}
+
+	blocks := make([]BlockInfo, 0, len(byBlock))
+	for info := range byBlock {
+		blocks = append(blocks, info)
+	}
+	sort.Slice(blocks, func(i, j int) bool {
+		return blocks[i].Offset < blocks[j].Offset
+	})
+
+	for i, info := range blocks {
+		blockData, err := c.readBlock(info)
+		if err != nil {
+			return i + 1, err
+		}
+		docs, err := toon.DecodeAll(blockData)
+		if err != nil {
+			return i + 1, fmt.Errorf("could not decode TOON block: %w", err)
+		}
+		for _, doc := range docs {
+			id := fmt.Sprint(doc["id"])
+			if byBlock[info][id] && c.index[id] == info {
+				if err := fn(id, doc); err != nil {
+					return i + 1, err
+				}
+			}
+		}
+	}
+
+	return len(blocks), nil
+}
+
+func lookupKey(v any) string {
+	n := query.Normalize(v)
+	return fmt.Sprintf("%T:%v", n, n)
+}
+
+// matchAll returns, for each of the given values, the documents whose field
+// equals it, keyed by lookupKey. It uses the cheapest access path available:
+// the primary index for "id", a secondary index if the field has one, and a
+// single scan of the collection otherwise.
+func (c *Collection) matchAll(field string, values []any) (map[string][]Document, error) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	if c.file == nil {
+		return nil, ErrCollectionClosed
+	}
+
+	if _, ok := c.encryptedFieldInternal(field); ok {
+		return nil, fmt.Errorf("%w: cannot look up by %s", ErrEncryptedField, field)
+	}
+
+	matches := make(map[string][]Document)
+
+	if field == "id" {
+		ids := make([]string, 0, len(values))
+		for _, v := range values {
+			ids = append(ids, fmt.Sprint(v))
+		}
+		docs, err := c.findByIDsInternal(ids)
+		if err != nil {
+			return nil, err
+		}
+		for _, doc := range docs {
+			k := lookupKey(doc["id"])
+			matches[k] = append(matches[k], doc)
+		}
+		return matches, nil
+	}
+
+	wanted := make(map[string]bool, len(values))
+	for _, v := range values {
+		wanted[lookupKey(v)] = true
+	}
+
+	collect := func(id string, doc Document) error {
+		if k := lookupKey(doc[field]); wanted[k] {
+			matches[k] = append(matches[k], doc)
+		}
+		return nil
+	}
+
+	fi, ok := c.fieldIndexes[field]
+	if !ok {
+		return matches, c.scanInternal(collect)
+	}
+
+	if err := c.scanMemtable(collect); err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, v := range values {
+		for _, id := range fi.lookup(v) {
+			if !c.isInMemtable(id) {
+				ids = append(ids, id)
+			}
+		}
+	}
+	docs, err := c.findByIDsInternal(ids)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		if doc, ok := docs[id]; ok {
+			collect(id, doc)
+			delete(docs, id)
+		}
+	}
+	return matches, nil
+}
+
+// applyLookups embeds the referenced documents into each result. All local
+// values of a lookup are gathered first so the foreign collection is queried
+// once per lookup rather than once per result.
+func (c *Collection) applyLookups(docs []Document, lookups []query.Lookup) ([]Document, error) {
+	if c.db == nil {
+		return nil, ErrNoDatabase
+	}
+
+	out := make([]Document, len(docs))
+	for i, doc := range docs {
+		cp := make(Document, len(doc)+len(lookups))
+		for k, v := range doc {
+			cp[k] = v
+		}
+		out[i] = cp
+	}
+
+	for _, l := range lookups {
+		from, err := c.db.GetCollection(l.From)
+		if err != nil {
+			return nil, fmt.Errorf("lookup %s: %w", l.From, err)
+		}
+
+		var values []any
+		seen := make(map[string]bool)
+		for _, doc := range out {
+			v, ok := doc[l.LocalField]
+			if !ok || v == nil {
+				continue
+			}
+			if k := lookupKey(v); !seen[k] {
+				seen[k] = true
+				values = append(values, v)
+			}
+		}
+
+		matches, err := from.matchAll(l.Foreign(), values)
+		if err != nil {
+			return nil, fmt.Errorf("lookup %s: %w", l.From, err)
+		}
+		encrypted := from.EncryptedFields()
+		for _, found := range matches {
+			if err := from.decryptAll(encrypted, found); err != nil {
+				return nil, fmt.Errorf("lookup %s: %w", l.From, err)
+			}
+		}
+
+		for _, doc := range out {
+			var found []Document
+			if v, ok := doc[l.LocalField]; ok && v != nil {
+				found = matches[lookupKey(v)]
+			}
+			switch {
+			case l.Many:
+				if found == nil {
+					found = []Document{}
+				}
+				doc[l.As] = found
+			case len(found) > 0:
+				doc[l.As] = found[0]
+			default:
+				doc[l.As] = nil
+			}
+		}
+	}
+
+	return out, nil
+}
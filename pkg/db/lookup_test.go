@@ -0,0 +1,80 @@
+package db
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/Al3x-Myku/FlyDB/pkg/query"
+)
+
+func TestLookup(t *testing.T) {
+	dataDir := "./test-lookup"
+	defer os.RemoveAll(dataDir)
+
+	db, _ := NewDB(dataDir)
+	defer db.Close()
+
+	users, _ := db.GetCollection("users")
+	users.Insert(Document{"id": "u1", "name": "Alice"})
+	users.Insert(Document{"id": "u2", "name": "Bob"})
+	users.Commit()
+	users.Insert(Document{"id": "u3", "name": "Carol"})
+
+	orders, _ := db.GetCollection("orders")
+	orders.Insert(Document{"id": "o1", "user_id": "u1", "total": 10})
+	orders.Insert(Document{"id": "o2", "user_id": "u3", "total": 20})
+	orders.Insert(Document{"id": "o3", "user_id": "u9", "total": 30})
+	orders.Insert(Document{"id": "o4", "user_id": "u1", "total": 40})
+	orders.Commit()
+
+	q, err := query.ParseQuery("ORDER BY id LOOKUP users ON user_id = id AS user FIELDS total")
+	if err != nil {
+		t.Fatalf("ParseQuery failed: %v", err)
+	}
+	results, err := orders.FindWithOptions(q.Filter, q.Options)
+	if err != nil {
+		t.Fatalf("FindWithOptions failed: %v", err)
+	}
+
+	expected := []any{"Alice", "Carol", nil, "Alice"}
+	for i, doc := range results {
+		user, _ := doc["user"].(Document)
+		var name any
+		if user != nil {
+			name = user["name"]
+		}
+		if name != expected[i] {
+			t.Errorf("Order %v: expected user %v, got %v", doc["id"], expected[i], doc["user"])
+		}
+		if _, ok := doc["user_id"]; ok {
+			t.Errorf("Expected projection to drop user_id, got %v", doc)
+		}
+	}
+
+	if err := orders.CreateIndex("user_id"); err != nil {
+		t.Fatalf("CreateIndex failed: %v", err)
+	}
+	withOrders, err := users.FindWithOptions(query.Eq("id", "u1"), query.Options{
+		Lookups: []query.Lookup{{From: "orders", LocalField: "id", ForeignField: "user_id", As: "orders", Many: true}},
+	})
+	if err != nil {
+		t.Fatalf("FindWithOptions failed: %v", err)
+	}
+	if len(withOrders) != 1 || len(withOrders[0]["orders"].([]Document)) != 2 {
+		t.Errorf("Expected u1 with 2 orders, got %v", withOrders)
+	}
+
+	raw, _ := orders.FindByID("o1")
+	if _, ok := raw["user"]; ok {
+		t.Errorf("Lookup must not modify stored documents, got %v", raw)
+	}
+
+	found, err := users.FindByIDs([]string{"u1", "u3", "missing"})
+	if err != nil {
+		t.Fatalf("FindByIDs failed: %v", err)
+	}
+	if len(found) != 2 || fmt.Sprint(found["u3"]["name"]) != "Carol" {
+		t.Errorf("Unexpected FindByIDs result: %v", found)
+	}
+}
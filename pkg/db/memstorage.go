@@ -0,0 +1,405 @@
+package db
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryStorage keeps databases in memory, for tests and caches that
+// should not touch the disk. Its contents last as long as it does, so a
+// database closed and opened again on the same MemoryStorage finds its
+// data. Locks are held against other databases on the same MemoryStorage.
+type MemoryStorage struct {
+	mu    sync.Mutex
+	nodes map[string]*memNode
+	locks map[string]*memLock
+}
+
+type memNode struct {
+	name    string
+	dir     bool
+	mode    fs.FileMode
+	modTime time.Time
+	data    []byte
+}
+
+type memLock struct {
+	exclusive bool
+	shared    int
+}
+
+// NewMemoryStorage returns an empty MemoryStorage.
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{
+		nodes: make(map[string]*memNode),
+		locks: make(map[string]*memLock),
+	}
+}
+
+// lookupLocked returns the node at a cleaned path. The root of relative and
+// absolute paths always exists.
+func (m *MemoryStorage) lookupLocked(name string) (*memNode, bool) {
+	if n, ok := m.nodes[name]; ok {
+		return n, true
+	}
+	if name == "." || name == string(filepath.Separator) {
+		return &memNode{name: name, dir: true, mode: fs.ModeDir | 0755}, true
+	}
+	return nil, false
+}
+
+func (m *MemoryStorage) parentLocked(op, name string) error {
+	parent, ok := m.lookupLocked(filepath.Dir(name))
+	if !ok {
+		return &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	if !parent.dir {
+		return &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	return nil
+}
+
+func (m *MemoryStorage) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+	name = filepath.Clean(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	n, ok := m.lookupLocked(name)
+	switch {
+	case ok && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrExist}
+	case ok && n.dir && flag&(os.O_WRONLY|os.O_RDWR) != 0:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	case !ok && flag&os.O_CREATE == 0:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	case !ok:
+		if err := m.parentLocked("open", name); err != nil {
+			return nil, err
+		}
+		n = &memNode{name: filepath.Base(name), mode: perm, modTime: time.Now()}
+		m.nodes[name] = n
+	}
+	if flag&os.O_TRUNC != 0 && !n.dir {
+		n.data = nil
+	}
+	return &memFile{
+		storage:  m,
+		node:     n,
+		readable: flag&os.O_WRONLY == 0,
+		writable: flag&(os.O_WRONLY|os.O_RDWR) != 0,
+		append:   flag&os.O_APPEND != 0,
+	}, nil
+}
+
+func (m *MemoryStorage) Stat(name string) (fs.FileInfo, error) {
+	name = filepath.Clean(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n, ok := m.lookupLocked(name)
+	if !ok {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	return n.infoLocked(), nil
+}
+
+func (m *MemoryStorage) ReadDir(name string) ([]fs.DirEntry, error) {
+	name = filepath.Clean(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n, ok := m.lookupLocked(name)
+	if !ok {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+	if !n.dir {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+	var entries []fs.DirEntry
+	for path, child := range m.nodes {
+		if path != name && filepath.Dir(path) == name {
+			entries = append(entries, fs.FileInfoToDirEntry(child.infoLocked()))
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+func (m *MemoryStorage) MkdirAll(path string, perm fs.FileMode) error {
+	path = filepath.Clean(path)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for dir := path; ; dir = filepath.Dir(dir) {
+		if n, ok := m.lookupLocked(dir); ok {
+			if !n.dir {
+				return &fs.PathError{Op: "mkdir", Path: dir, Err: fs.ErrExist}
+			}
+			break
+		}
+		m.nodes[dir] = &memNode{name: filepath.Base(dir), dir: true, mode: fs.ModeDir | perm, modTime: time.Now()}
+	}
+	return nil
+}
+
+func (m *MemoryStorage) Remove(name string) error {
+	name = filepath.Clean(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n, ok := m.nodes[name]
+	if !ok {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+	if n.dir {
+		for path := range m.nodes {
+			if filepath.Dir(path) == name {
+				return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrExist}
+			}
+		}
+	}
+	delete(m.nodes, name)
+	return nil
+}
+
+func (m *MemoryStorage) Rename(oldpath, newpath string) error {
+	oldpath, newpath = filepath.Clean(oldpath), filepath.Clean(newpath)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n, ok := m.nodes[oldpath]
+	if !ok {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: fs.ErrNotExist}
+	}
+	if err := m.parentLocked("rename", newpath); err != nil {
+		return err
+	}
+	if n.dir {
+		prefix := oldpath + string(filepath.Separator)
+		for path, child := range m.nodes {
+			if strings.HasPrefix(path, prefix) {
+				delete(m.nodes, path)
+				m.nodes[filepath.Join(newpath, path[len(prefix):])] = child
+			}
+		}
+	}
+	delete(m.nodes, oldpath)
+	n.name = filepath.Base(newpath)
+	m.nodes[newpath] = n
+	return nil
+}
+
+func (m *MemoryStorage) SyncDir(name string) error {
+	_, err := m.Stat(name)
+	return err
+}
+
+func (m *MemoryStorage) Lock(name string, shared bool) (io.Closer, error) {
+	name = filepath.Clean(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.lookupLocked(name); !ok {
+		return nil, &fs.PathError{Op: "lock", Path: name, Err: fs.ErrNotExist}
+	}
+	l := m.locks[name]
+	if l == nil {
+		l = &memLock{}
+		m.locks[name] = l
+	}
+	if l.exclusive || !shared && l.shared > 0 {
+		return nil, ErrLocked
+	}
+	if shared {
+		l.shared++
+	} else {
+		l.exclusive = true
+	}
+	return &memUnlocker{storage: m, name: name, shared: shared}, nil
+}
+
+type memUnlocker struct {
+	storage *MemoryStorage
+	name    string
+	shared  bool
+	once    sync.Once
+}
+
+func (u *memUnlocker) Close() error {
+	u.once.Do(func() {
+		m := u.storage
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		l := m.locks[u.name]
+		if u.shared {
+			l.shared--
+		} else {
+			l.exclusive = false
+		}
+		if !l.exclusive && l.shared == 0 {
+			delete(m.locks, u.name)
+		}
+	})
+	return nil
+}
+
+func (n *memNode) infoLocked() fs.FileInfo {
+	return memFileInfo{name: n.name, size: int64(len(n.data)), mode: n.mode, modTime: n.modTime, node: n}
+}
+
+type memFileInfo struct {
+	name    string
+	size    int64
+	mode    fs.FileMode
+	modTime time.Time
+	node    *memNode
+}
+
+func (fi memFileInfo) Name() string       { return fi.name }
+func (fi memFileInfo) Size() int64        { return fi.size }
+func (fi memFileInfo) Mode() fs.FileMode  { return fi.mode }
+func (fi memFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi memFileInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi memFileInfo) Sys() any           { return fi.node }
+
+// memFile is an open file of a MemoryStorage. Like an open file on disk,
+// it keeps referring to the same contents after a rename or removal.
+type memFile struct {
+	storage  *MemoryStorage
+	node     *memNode
+	offset   int64
+	readable bool
+	writable bool
+	append   bool
+	closed   bool
+}
+
+func (f *memFile) check(op string, write bool) error {
+	switch {
+	case f.closed:
+		return &fs.PathError{Op: op, Path: f.node.name, Err: fs.ErrClosed}
+	case write && !f.writable, !write && !f.readable:
+		return &fs.PathError{Op: op, Path: f.node.name, Err: fs.ErrPermission}
+	}
+	return nil
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	f.storage.mu.Lock()
+	defer f.storage.mu.Unlock()
+	n, err := f.readAtLocked(p, f.offset)
+	f.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	f.storage.mu.Lock()
+	defer f.storage.mu.Unlock()
+	return f.readAtLocked(p, off)
+}
+
+func (f *memFile) readAtLocked(p []byte, off int64) (int, error) {
+	if err := f.check("read", false); err != nil {
+		return 0, err
+	}
+	if off >= int64(len(f.node.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.node.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	f.storage.mu.Lock()
+	defer f.storage.mu.Unlock()
+	if f.append {
+		f.offset = int64(len(f.node.data))
+	}
+	n, err := f.writeAtLocked(p, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *memFile) WriteAt(p []byte, off int64) (int, error) {
+	f.storage.mu.Lock()
+	defer f.storage.mu.Unlock()
+	return f.writeAtLocked(p, off)
+}
+
+func (f *memFile) writeAtLocked(p []byte, off int64) (int, error) {
+	if err := f.check("write", true); err != nil {
+		return 0, err
+	}
+	if end := off + int64(len(p)); end > int64(len(f.node.data)) {
+		data := make([]byte, end)
+		copy(data, f.node.data)
+		f.node.data = data
+	}
+	copy(f.node.data[off:], p)
+	f.node.modTime = time.Now()
+	return len(p), nil
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	f.storage.mu.Lock()
+	defer f.storage.mu.Unlock()
+	if f.closed {
+		return 0, &fs.PathError{Op: "seek", Path: f.node.name, Err: fs.ErrClosed}
+	}
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += int64(len(f.node.data))
+	}
+	if offset < 0 {
+		return 0, &fs.PathError{Op: "seek", Path: f.node.name, Err: fs.ErrInvalid}
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *memFile) Stat() (fs.FileInfo, error) {
+	f.storage.mu.Lock()
+	defer f.storage.mu.Unlock()
+	if f.closed {
+		return nil, &fs.PathError{Op: "stat", Path: f.node.name, Err: fs.ErrClosed}
+	}
+	return f.node.infoLocked(), nil
+}
+
+func (f *memFile) Sync() error {
+	f.storage.mu.Lock()
+	defer f.storage.mu.Unlock()
+	return f.check("sync", true)
+}
+
+func (f *memFile) Truncate(size int64) error {
+	f.storage.mu.Lock()
+	defer f.storage.mu.Unlock()
+	if err := f.check("truncate", true); err != nil {
+		return err
+	}
+	if size < int64(len(f.node.data)) {
+		f.node.data = f.node.data[:size:size]
+	} else {
+		f.node.data = append(f.node.data, make([]byte, size-int64(len(f.node.data)))...)
+	}
+	return nil
+}
+
+func (f *memFile) Close() error {
+	f.storage.mu.Lock()
+	defer f.storage.mu.Unlock()
+	if f.closed {
+		return &fs.PathError{Op: "close", Path: f.node.name, Err: fs.ErrClosed}
+	}
+	f.closed = true
+	return nil
+}
@@ -0,0 +1,84 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/Al3x-Myku/FlyDB/pkg/schema"
+)
+
+const metaSuffix = ".meta.json"
+
+// collectionMeta is the per-collection state kept next to the data file in
+// <name>.meta.json.
+type collectionMeta struct {
+	Schema           *schema.Schema `json:"schema,omitempty"`
+	IDStrategy       *IDStrategy    `json:"id_strategy,omitempty"`
+	SequenceReserved int64          `json:"sequence_reserved,omitempty"`
+
+	EncryptedFields []EncryptedField `json:"encrypted_fields,omitempty"`
+
+	// Codec overrides the database's codec for new blocks.
+	Codec string `json:"codec,omitempty"`
+
+	// Generation counts compactions. Incremental backups use it to notice
+	// that a data file was rewritten rather than appended to.
+	Generation int64 `json:"generation,omitempty"`
+}
+
+func metaPath(filePath string) string {
+	return strings.TrimSuffix(filePath, ".toon") + metaSuffix
+}
+
+// loadMeta reads the collection's metadata file. A missing file means the
+// collection has no metadata yet.
+func (c *Collection) loadMeta() error {
+	data, err := readFile(c.storage, metaPath(c.filePath))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("could not read metadata: %w", err)
+	}
+
+	var meta collectionMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return fmt.Errorf("could not parse metadata: %w", err)
+	}
+	if meta.Schema != nil {
+		if err := meta.Schema.Compile(); err != nil {
+			return fmt.Errorf("invalid schema in metadata: %w", err)
+		}
+	}
+	if meta.Codec != "" {
+		if err := c.useCodecInternal(meta.Codec); err != nil {
+			return fmt.Errorf("invalid codec in metadata: %w", err)
+		}
+	}
+
+	c.meta = meta
+	return nil
+}
+
+// saveMetaInternal writes the metadata to a temporary file and renames it
+// into place, so a crash leaves either the old or the new version.
+func (c *Collection) saveMetaInternal() error {
+	data, err := json.MarshalIndent(c.meta, "", "  ")
+	if err != nil {
+		return fmt.Errorf("could not encode metadata: %w", err)
+	}
+
+	if err := writeFileAtomic(c.storage, metaPath(c.filePath), data); err != nil {
+		return fmt.Errorf("could not write metadata: %w", err)
+	}
+	return nil
+}
+
+func removeMeta(st Storage, filePath string) error {
+	if err := st.Remove(metaPath(filePath)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("could not delete collection metadata: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,315 @@
+package db
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// MutationLogFileName is the name of the mutation log inside a data
+// directory when Config.MutationLog is enabled.
+const MutationLogFileName = "mutations.log"
+
+var ErrBadMutationLog = errors.New("invalid mutation log")
+
+const (
+	logCommit = "commit"
+	logDelete = "delete"
+	logDrop   = "drop"
+)
+
+// logRecord is one line of the mutation log: the documents written by a
+// commit, a document deleted from the committed data, or a dropped
+// collection. Seq numbers records from 1 without gaps.
+type logRecord struct {
+	Seq        uint64     `json:"seq"`
+	Time       time.Time  `json:"time"`
+	Op         string     `json:"op"`
+	Collection string     `json:"collection"`
+	ID         string     `json:"id,omitempty"`
+	Documents  []Document `json:"documents,omitempty"`
+
+	// Sealed replaces every field but Seq and Time in the logs of an
+	// encrypted database: it holds the rest of the record, encrypted.
+	Sealed []byte `json:"sealed,omitempty"`
+}
+
+// sealedRecordContext is authenticated with every sealed record.
+const sealedRecordContext = "mutation log"
+
+// seal returns rec with its contents encrypted, if crypt is set.
+func (rec logRecord) seal(crypt *crypter) (logRecord, error) {
+	if crypt == nil {
+		return rec, nil
+	}
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return rec, err
+	}
+	sealed, err := crypt.seal(data, sealedRecordContext)
+	if err != nil {
+		return rec, err
+	}
+	return logRecord{Seq: rec.Seq, Time: rec.Time, Sealed: sealed}, nil
+}
+
+// unseal decrypts the contents of a sealed record in place.
+func (rec *logRecord) unseal(crypt *crypter, file string, offset int64) error {
+	if rec.Sealed == nil {
+		return nil
+	}
+	data, err := crypt.openAt(rec.Sealed, sealedRecordContext, file, offset)
+	if err != nil {
+		return err
+	}
+	seq, t := rec.Seq, rec.Time
+	*rec = logRecord{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(rec); err != nil {
+		return fmt.Errorf("%w: sealed record %d: %v", ErrBadMutationLog, seq, err)
+	}
+	rec.Seq, rec.Time = seq, t
+	return nil
+}
+
+const defaultReplicationBacklog = 4096
+
+// mutationLog appends a JSON line per committed change to a file that is
+// never rewritten, so it can be replayed on top of a backup to recover the
+// database as of any later moment. The most recent records are also kept in
+// memory, as written, for replication to stream to followers.
+type mutationLog struct {
+	mu      sync.Mutex
+	file    File
+	seq     uint64
+	recent  []logRecord
+	retain  int
+	changed chan struct{} // closed and replaced by every append
+	crypt   *crypter
+}
+
+// openMutationLog opens the log at path, creating it if needed, and keeps
+// up to retain records in memory. Records are encrypted with crypt if it is
+// set. A record left half written by a crash is cut off before new ones are
+// appended.
+func openMutationLog(st Storage, path string, retain int, crypt *crypter) (*mutationLog, error) {
+	f, err := st.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("could not open mutation log: %w", err)
+	}
+
+	var last uint64
+	end, err := scanMutationLog(f, crypt, func(rec *logRecord) error {
+		last = rec.Seq
+		return nil
+	})
+	if err == nil {
+		err = f.Truncate(end)
+	}
+	if err == nil {
+		_, err = f.Seek(end, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("could not open mutation log: %w", err)
+	}
+
+	if retain <= 0 {
+		retain = defaultReplicationBacklog
+	}
+	return &mutationLog{file: f, seq: last, retain: retain, changed: make(chan struct{}), crypt: crypt}, nil
+}
+
+// append writes a record and syncs it before returning, so a change is
+// logged before it reaches the data file.
+func (l *mutationLog) append(rec logRecord) error {
+	return l.appendWith(rec, nil)
+}
+
+// appendWith is append that also calls apply, if it is set, once the record
+// is synced, to make the change it logs. If apply fails the record is cut
+// off again before followers are told of it, so neither they nor recovery
+// replay a change its caller was told failed. The next append's sync makes
+// the cut durable.
+func (l *mutationLog) appendWith(rec logRecord, apply func() error) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file == nil {
+		return errors.New("mutation log is closed")
+	}
+
+	rec.Seq = l.seq + 1
+	rec.Time = time.Now().UTC()
+	stored, err := rec.seal(l.crypt)
+	if err != nil {
+		return fmt.Errorf("could not encrypt mutation log record: %w", err)
+	}
+	data, err := json.Marshal(stored)
+	if err != nil {
+		return fmt.Errorf("could not encode mutation log record: %w", err)
+	}
+	data = append(data, '\n')
+
+	start, err := l.file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return fmt.Errorf("could not write mutation log: %w", err)
+	}
+	if _, err := l.file.Write(data); err != nil {
+		return l.cutLocked(start, fmt.Errorf("could not write mutation log: %w", err))
+	}
+	if err := l.file.Sync(); err != nil {
+		return l.cutLocked(start, fmt.Errorf("could not sync mutation log: %w", err))
+	}
+	if apply != nil {
+		if err := apply(); err != nil {
+			return l.cutLocked(start, err)
+		}
+	}
+	l.seq = rec.Seq
+
+	// Records are kept sealed, so they leave an encrypted database that way.
+	l.recent = append(l.recent, stored)
+	if len(l.recent) > l.retain {
+		// Copy rather than reslice so the dropped records can be collected.
+		l.recent = append([]logRecord(nil), l.recent[len(l.recent)-l.retain:]...)
+	}
+	close(l.changed)
+	l.changed = make(chan struct{})
+	return nil
+}
+
+// cutLocked removes a record that failed, written from offset start, and
+// returns cause. If that fails the log is closed, since records appended
+// after a partial one could not be read back.
+func (l *mutationLog) cutLocked(start int64, cause error) error {
+	err := l.file.Truncate(start)
+	if err == nil {
+		_, err = l.file.Seek(start, io.SeekStart)
+	}
+	if err != nil {
+		l.file.Close()
+		l.file = nil
+		close(l.changed)
+		return fmt.Errorf("%w; mutation log closed after failing to remove the record: %v", cause, err)
+	}
+	return cause
+}
+
+// changes returns a channel that is closed by the next append or when the
+// log is closed, and whether the log is still open. Call it before since to
+// be sure not to miss a record appended in between.
+func (l *mutationLog) changes() (<-chan struct{}, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.changed, l.file != nil
+}
+
+// since returns the records after seq held in memory, sealed if the log is
+// encrypted, or ok=false if some of them are no longer held or seq is ahead
+// of the log.
+func (l *mutationLog) since(seq uint64) (records []logRecord, ok bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	switch {
+	case seq == l.seq:
+		return nil, true
+	case seq > l.seq:
+		return nil, false
+	case len(l.recent) == 0 || l.recent[0].Seq > seq+1:
+		return nil, false
+	}
+	start := int(seq + 1 - l.recent[0].Seq)
+	return append([]logRecord(nil), l.recent[start:]...), true
+}
+
+func (l *mutationLog) lastSeq() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.seq
+}
+
+func (l *mutationLog) close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	close(l.changed)
+	return err
+}
+
+// scanMutationLog calls fn for every complete record in r, in order,
+// decrypted with crypt if they are sealed, and returns the offset just past
+// the last one. An unterminated final line is what a crash during an append
+// leaves behind and is ignored.
+func scanMutationLog(r io.Reader, crypt *crypter, fn func(*logRecord) error) (int64, error) {
+	br := bufio.NewReader(r)
+	var offset int64
+	var seq uint64
+
+	for {
+		line, err := br.ReadBytes('\n')
+		if err == io.EOF {
+			return offset, nil
+		}
+		if err != nil {
+			return offset, err
+		}
+
+		rec := &logRecord{}
+		dec := json.NewDecoder(bytes.NewReader(line))
+		dec.UseNumber()
+		if err := dec.Decode(rec); err != nil {
+			return offset, fmt.Errorf("%w: record at offset %d: %v", ErrBadMutationLog, offset, err)
+		}
+		if seq != 0 && rec.Seq != seq+1 {
+			return offset, fmt.Errorf("%w: record %d follows record %d", ErrBadMutationLog, rec.Seq, seq)
+		}
+		seq = rec.Seq
+		if err := rec.unseal(crypt, MutationLogFileName, offset); err != nil {
+			return offset, err
+		}
+
+		if err := fn(rec); err != nil {
+			return offset, err
+		}
+		offset += int64(len(line))
+	}
+}
+
+// logMutation records a change if the collection's database keeps a
+// mutation log.
+func (c *Collection) logMutation(rec logRecord) error {
+	if c.db == nil || c.db.log == nil {
+		return nil
+	}
+	rec.Collection = c.name
+	return c.db.log.append(rec)
+}
+
+// logMutationWith records a change like logMutation and makes it with
+// apply, which is only logged if it succeeds.
+func (c *Collection) logMutationWith(rec logRecord, apply func() error) error {
+	if c.db == nil || c.db.log == nil {
+		return apply()
+	}
+	rec.Collection = c.name
+	return c.db.log.appendWith(rec, apply)
+}
+
+func mutationLogPath(dataDir string) string {
+	return filepath.Join(dataDir, MutationLogFileName)
+}
@@ -0,0 +1,300 @@
+package db
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Al3x-Myku/FlyDB/pkg/query"
+	"github.com/Al3x-Myku/FlyDB/pkg/toon"
+)
+
+type PlanType string
+
+const (
+	PlanIDLookup    PlanType = "id_lookup"
+	PlanIDScan      PlanType = "id_scan"
+	PlanIndexLookup PlanType = "index_lookup"
+	PlanIndexScan   PlanType = "index_scan"
+	PlanIndexOrder  PlanType = "index_order"
+	PlanFullScan    PlanType = "full_scan"
+)
+
+// Plan describes how a query is executed. The estimate is made before any
+// block is read; the Actual, Examined and BlocksRead counters are filled in
+// while the query runs.
+//
+// The access paths are:
+//   - id_lookup: id = x or id IN (...), answered from the primary index
+//   - id_scan: a range, prefix or other predicate on id, evaluated against
+//     the primary index keys alone
+//   - index_lookup: field = x or field IN (...) on a secondary index
+//   - index_scan: a range, prefix or other predicate evaluated against a
+//     secondary index's keys
+//   - index_order: no usable predicate, but the first sort key is indexed
+//     and a limit is set, so the index is walked in sort order
+//   - full_scan: every block is read
+//
+// In every case the memtable is scanned in full and the whole filter is
+// re-checked against each fetched document.
+type Plan struct {
+	Type          PlanType
+	Index         string
+	Predicate     string
+	EstimatedRows int
+	ActualRows    int
+	Examined      int
+	BlocksRead    int
+	TotalBlocks   int
+	TotalDocs     int
+
+	candidates []string
+	index      *fieldIndex
+}
+
+func (p *Plan) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "plan:           %s\n", p.Type)
+	if p.Index != "" {
+		fmt.Fprintf(&b, "index:          %s\n", p.Index)
+	}
+	if p.Predicate != "" {
+		fmt.Fprintf(&b, "predicate:      %s\n", p.Predicate)
+	}
+	fmt.Fprintf(&b, "estimated rows: %d\n", p.EstimatedRows)
+	fmt.Fprintf(&b, "actual rows:    %d\n", p.ActualRows)
+	fmt.Fprintf(&b, "docs examined:  %d of %d\n", p.Examined, p.TotalDocs)
+	fmt.Fprintf(&b, "blocks read:    %d of %d", p.BlocksRead, p.TotalBlocks)
+	return b.String()
+}
+
+// Explain runs q and returns the plan it used, with both the planner's
+// estimate and the actual row and block counts.
+func (c *Collection) Explain(q *query.Query) (*Plan, error) {
+	if err := q.Fields.Validate(); err != nil {
+		return nil, err
+	}
+
+	page, plan, err := c.findPage(q.Filter, q.Options)
+	if err != nil {
+		return nil, err
+	}
+	plan.ActualRows = len(page)
+
+	return plan, nil
+}
+
+// conjuncts splits a filter into the terms that must all hold.
+func conjuncts(e query.Expr) []query.Expr {
+	switch x := e.(type) {
+	case nil:
+		return nil
+	case *query.AndExpr:
+		var terms []query.Expr
+		for _, t := range x.Terms {
+			terms = append(terms, conjuncts(t)...)
+		}
+		return terms
+	}
+	return []query.Expr{e}
+}
+
+// predicateField returns the field a predicate constrains, and whether the
+// predicate is an equality (=, IN) that can be answered by exact lookups.
+// Predicates that can be true for a document lacking the field, such as
+// negations or "= null", are not usable because indexes and the primary
+// index only say something about documents that have a value.
+func predicateField(e query.Expr) (field string, equality bool, ok bool) {
+	switch x := e.(type) {
+	case *query.CompareExpr:
+		if x.Value == nil || x.Op == query.OpNe {
+			return "", false, false
+		}
+		return x.Field, x.Op == query.OpEq, true
+	case *query.InExpr:
+		for _, v := range x.Values {
+			if v == nil {
+				return "", false, false
+			}
+		}
+		return x.Field, true, true
+	case *query.BetweenExpr:
+		return x.Field, false, true
+	case *query.PrefixExpr:
+		return x.Field, false, true
+	case *query.LikeExpr:
+		return x.Field, false, true
+	case *query.RegexExpr:
+		return x.Field, false, true
+	case *query.ExistsExpr:
+		return x.Field, false, true
+	}
+	return "", false, false
+}
+
+func equalityValues(e query.Expr) []any {
+	switch x := e.(type) {
+	case *query.CompareExpr:
+		return []any{x.Value}
+	case *query.InExpr:
+		return x.Values
+	}
+	return nil
+}
+
+// planInternal picks the access path with the fewest candidate documents.
+// The statistics it uses are exact counts read off the in-memory indexes,
+// which are cheap to compute compared with reading any block.
+func (c *Collection) planInternal(filter query.Expr, opts query.Options) *Plan {
+	total := len(c.index)
+	plan := &Plan{
+		Type:          PlanFullScan,
+		EstimatedRows: total + len(c.memtable),
+		TotalBlocks:   len(c.blocks()),
+		TotalDocs:     total + len(c.memtable),
+	}
+
+	best := -1
+	for _, term := range conjuncts(filter) {
+		field, equality, ok := predicateField(term)
+		if !ok {
+			continue
+		}
+
+		var candidates []string
+		var typ PlanType
+		var fi *fieldIndex
+
+		switch {
+		case field == "id" && equality:
+			typ = PlanIDLookup
+			for _, v := range equalityValues(term) {
+				id := fmt.Sprint(v)
+				if _, ok := c.index[id]; ok {
+					candidates = append(candidates, id)
+				}
+			}
+		case field == "id":
+			typ = PlanIDScan
+			for id := range c.index {
+				if term.Match(toon.Document{"id": toon.InferType(id)}) {
+					candidates = append(candidates, id)
+				}
+			}
+		case c.fieldIndexes[field] != nil && equality:
+			typ = PlanIndexLookup
+			fi = c.fieldIndexes[field]
+			for _, v := range equalityValues(term) {
+				candidates = append(candidates, fi.lookup(v)...)
+			}
+		case c.fieldIndexes[field] != nil:
+			typ = PlanIndexScan
+			fi = c.fieldIndexes[field]
+			for _, e := range fi.entries {
+				if term.Match(toon.Document{field: e.value}) {
+					candidates = append(candidates, e.id)
+				}
+			}
+		default:
+			continue
+		}
+
+		if best == -1 || len(candidates) < best {
+			best = len(candidates)
+			plan.Type = typ
+			plan.Predicate = term.String()
+			plan.EstimatedRows = len(candidates) + len(c.memtable)
+			plan.candidates = candidates
+			plan.Index = ""
+			if fi != nil {
+				plan.Index = fi.field
+			}
+		}
+	}
+
+	if best >= 0 {
+		return plan
+	}
+
+	if fi := c.sortIndex(opts); fi != nil {
+		plan.Type = PlanIndexOrder
+		plan.Index = fi.field
+		plan.index = fi
+		if n := opts.Skip + opts.Limit; n < plan.EstimatedRows {
+			plan.EstimatedRows = n
+		}
+	}
+
+	return plan
+}
+
+// execute runs plan, feeding every matching document into the collector.
+func (c *Collection) execute(plan *Plan, q query.Expr, opts query.Options, collector *query.Collector) error {
+	switch plan.Type {
+	case PlanFullScan:
+		seen := make(map[string]bool)
+		err := c.scanMemtable(func(id string, doc Document) error {
+			seen[id] = true
+			plan.Examined++
+			if query.Match(q, doc) && !collector.Add(doc) {
+				return errStopScan
+			}
+			return nil
+		})
+		if err != nil {
+			if err == errStopScan {
+				return nil
+			}
+			return err
+		}
+
+		plan.BlocksRead, err = c.scanBlocksCounted(func(id string, doc Document) error {
+			if seen[id] {
+				return nil
+			}
+			plan.Examined++
+			if query.Match(q, doc) && !collector.Add(doc) {
+				return errStopScan
+			}
+			return nil
+		})
+		if err != nil && err != errStopScan {
+			return err
+		}
+		return nil
+
+	case PlanIndexOrder:
+		return c.findIndexed(plan, q, opts, collector)
+	}
+
+	inMemtable := make(map[string]bool)
+	err := c.scanMemtable(func(id string, doc Document) error {
+		inMemtable[id] = true
+		plan.Examined++
+		if query.Match(q, doc) {
+			collector.Add(doc)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	ids := make([]string, 0, len(plan.candidates))
+	for _, id := range plan.candidates {
+		if !inMemtable[id] {
+			ids = append(ids, id)
+		}
+	}
+
+	plan.BlocksRead, err = c.fetchCommitted(ids, func(id string, doc Document) error {
+		plan.Examined++
+		if query.Match(q, doc) && !collector.Add(doc) {
+			return errStopScan
+		}
+		return nil
+	})
+	if err != nil && err != errStopScan {
+		return err
+	}
+	return nil
+}
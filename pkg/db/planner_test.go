@@ -0,0 +1,94 @@
+package db
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"testing"
+
+	"github.com/Al3x-Myku/FlyDB/pkg/query"
+)
+
+func TestPlanner(t *testing.T) {
+	dataDir := "./test-planner"
+	defer os.RemoveAll(dataDir)
+
+	db, _ := NewDB(dataDir)
+	defer db.Close()
+
+	items, _ := db.GetCollection("items")
+	for i := 0; i < 100; i++ {
+		items.Insert(Document{"id": fmt.Sprintf("item%03d", i), "category": fmt.Sprintf("c%d", i%10), "price": i})
+		if i%20 == 19 {
+			items.Commit()
+		}
+	}
+	items.Insert(Document{"id": "item005", "category": "c9", "price": 5})
+	items.CreateIndex("category")
+	items.CreateIndex("price")
+
+	tests := []struct {
+		query  string
+		plan   PlanType
+		rows   int
+		blocks int
+	}{
+		{"id = item042", PlanIDLookup, 1, 1},
+		{"id IN ('item001', 'item099', 'nope')", PlanIDLookup, 2, 2},
+		{"id PREFIX 'item01'", PlanIDScan, 10, 1},
+		{"category = c3 AND price > 50", PlanIndexLookup, 5, 5},
+		{"category IN (c1, c2) AND price < 10", PlanIndexScan, 2, 1},
+		{"category = c3", PlanIndexLookup, 10, 5},
+		{"category = c9", PlanIndexLookup, 11, 5},
+		{"price BETWEEN 10 AND 14", PlanIndexScan, 5, 1},
+		{"name = x OR price = 3", PlanFullScan, 1, 5},
+		{"ORDER BY price DESC LIMIT 3", PlanIndexOrder, 3, 1},
+		{"category != c1", PlanFullScan, 90, 5},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			q, err := query.ParseQuery(tt.query)
+			if err != nil {
+				t.Fatalf("ParseQuery failed: %v", err)
+			}
+
+			plan, err := items.Explain(q)
+			if err != nil {
+				t.Fatalf("Explain failed: %v", err)
+			}
+			if plan.Type != tt.plan || plan.ActualRows != tt.rows || plan.BlocksRead != tt.blocks {
+				t.Errorf("Expected %s with %d rows and %d blocks, got:\n%s", tt.plan, tt.rows, tt.blocks, plan)
+			}
+
+			planned, _ := items.FindWithOptions(q.Filter, q.Options)
+			scanned := bruteForce(t, items, q)
+			if fmt.Sprint(sortedIDs(planned)) != fmt.Sprint(sortedIDs(scanned)) {
+				t.Errorf("Planned results %v differ from a full scan %v", sortedIDs(planned), sortedIDs(scanned))
+			}
+		})
+	}
+}
+
+func bruteForce(t *testing.T, c *Collection, q *query.Query) []Document {
+	all, err := c.All()
+	if err != nil {
+		t.Fatalf("All failed: %v", err)
+	}
+	collector := query.NewCollector(q.Options)
+	for _, doc := range all {
+		if query.Match(q.Filter, doc) {
+			collector.Add(doc)
+		}
+	}
+	return collector.Results()
+}
+
+func sortedIDs(docs []Document) []string {
+	ids := make([]string, len(docs))
+	for i, doc := range docs {
+		ids[i] = fmt.Sprint(doc["id"])
+	}
+	sort.Strings(ids)
+	return ids
+}
@@ -0,0 +1,91 @@
+//go:build unix
+
+package db
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/Al3x-Myku/FlyDB/pkg/toon"
+)
+
+func TestReadOnly(t *testing.T) {
+	dataDir := "./test-readonly"
+	defer os.RemoveAll(dataDir)
+
+	if _, err := OpenReadOnly(dataDir); err == nil {
+		t.Fatalf("Expected opening a missing data dir read-only to fail")
+	}
+	if _, err := os.Stat(dataDir); !os.IsNotExist(err) {
+		t.Fatalf("Read-only open created the data dir")
+	}
+
+	// A legacy file, for Upgrade below.
+	os.MkdirAll(dataDir, 0755)
+	legacy, _ := toon.Encode("items", []Document{{"id": "a", "n": 1}})
+	os.WriteFile(filepath.Join(dataDir, "items.toon"), legacy, 0644)
+
+	writer, err := NewDBWithConfig(dataDir, Config{MutationLog: true})
+	if err != nil {
+		t.Fatalf("NewDB failed: %v", err)
+	}
+	defer writer.Close()
+	items, _ := writer.GetCollection("items")
+	items.Insert(Document{"id": "b", "n": 2})
+	items.Commit()
+
+	before, _ := os.ReadDir(dataDir)
+	reader, err := OpenReadOnly(dataDir)
+	if err != nil {
+		t.Fatalf("Expected a reader to open alongside the writer, got %v", err)
+	}
+	second, err := OpenReadOnly(dataDir)
+	if err != nil {
+		t.Fatalf("Expected readers to share the data dir, got %v", err)
+	}
+	second.Close()
+
+	ro, err := reader.GetCollection("items")
+	if err != nil {
+		t.Fatalf("GetCollection failed: %v", err)
+	}
+	if doc, err := ro.FindByID("b"); err != nil || doc["n"] != int64(2) {
+		t.Errorf("Unexpected document: %v, %v", doc, err)
+	}
+	if _, err := reader.GetCollection("missing"); err == nil {
+		t.Errorf("Expected a missing collection to fail rather than be created")
+	}
+
+	writes := map[string]func() error{
+		"Insert":           func() error { _, err := ro.Insert(Document{"id": "c"}); return err },
+		"Update":           func() error { return ro.Update("a", Document{"id": "a"}) },
+		"Delete":           func() error { return ro.Delete("a") },
+		"Commit":           func() error { return ro.Commit() },
+		"Compact":          func() error { return ro.Compact() },
+		"CreateCollection": func() error { return reader.CreateCollection("other") },
+	}
+	for name, write := range writes {
+		if err := write(); !errors.Is(err, ErrReadOnly) {
+			t.Errorf("%s: expected ErrReadOnly, got %v", name, err)
+		}
+	}
+
+	// Upgrading would replace the file the reader has open.
+	if _, err := writer.Upgrade(); !errors.Is(err, ErrLocked) {
+		t.Errorf("Expected Upgrade to fail while a reader is open, got %v", err)
+	}
+	if err := reader.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	after, _ := os.ReadDir(dataDir)
+	if !slices.EqualFunc(before, after, func(a, b os.DirEntry) bool { return a.Name() == b.Name() }) {
+		t.Errorf("Read-only open changed the data dir: %v, then %v", before, after)
+	}
+	if upgraded, err := writer.Upgrade(); err != nil || len(upgraded) != 1 {
+		t.Errorf("Expected Upgrade to succeed once the reader closed, got %v, %v", upgraded, err)
+	}
+}
@@ -0,0 +1,180 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var ErrRecoveryTarget = errors.New("recovery target is before the base backup")
+
+// RecoveryTarget is the point Recover stops replaying at: the last record
+// with a sequence number of at most Seq, or committed no later than Time.
+// If both are set the earlier one wins; if neither is, the whole log is
+// replayed.
+type RecoveryTarget struct {
+	Seq  uint64
+	Time time.Time
+}
+
+type RecoveryResult struct {
+	// Manifest is the last backup of the restored chain.
+	Manifest *BackupManifest
+	// Seq and Time identify the last replayed record, or the backup's
+	// position in the log if nothing was replayed.
+	Seq      uint64
+	Time     time.Time
+	Replayed int
+}
+
+var errRecoveryDone = errors.New("recovery target reached")
+
+// Recover restores a full backup and the incremental backups taken after it,
+// like RestoreChain, then replays the mutation log at logPath from where the
+// last backup left off up to target. The result is written to dir, which
+// must not hold any collections, and can be opened with NewDB.
+//
+// Only documents are recovered from the log: schemas, ID strategies and
+// indexes are as they were in the backup.
+func Recover(dir, logPath string, target RecoveryTarget, archives ...io.Reader) (*RecoveryResult, error) {
+	return RecoverWithConfig(dir, logPath, target, DefaultConfig, archives...)
+}
+
+// RecoverWithConfig is Recover for an encrypted database, whose keys config
+// must provide. The recovered data is encrypted with its current key.
+// Recovery writes to the local file system, so Config.Storage must be nil
+// or OSStorage.
+func RecoverWithConfig(dir, logPath string, target RecoveryTarget, config Config, archives ...io.Reader) (*RecoveryResult, error) {
+	if err := checkOSStorage(config, "recovery"); err != nil {
+		return nil, err
+	}
+	if err := prepareRestoreDir(dir); err != nil {
+		return nil, err
+	}
+
+	logFile, err := os.Open(logPath)
+	if err != nil {
+		return nil, fmt.Errorf("could not open mutation log: %w", err)
+	}
+	defer logFile.Close()
+
+	staging, err := os.MkdirTemp(dir, ".recover-")
+	if err != nil {
+		return nil, fmt.Errorf("could not create staging dir: %w", err)
+	}
+	defer os.RemoveAll(staging)
+
+	manifest, err := RestoreChainWithConfig(staging, config, archives...)
+	if err != nil {
+		return nil, err
+	}
+	if target.Seq != 0 && target.Seq < manifest.LogSeq ||
+		!target.Time.IsZero() && target.Time.Before(manifest.Created) {
+		return nil, fmt.Errorf("%w taken at %s (log record %d)", ErrRecoveryTarget,
+			manifest.Created.Format(time.RFC3339), manifest.LogSeq)
+	}
+
+	result := &RecoveryResult{Manifest: manifest, Seq: manifest.LogSeq, Time: manifest.Created}
+	if err := replayLog(staging, logFile, target, config, result); err != nil {
+		return nil, err
+	}
+
+	if err := installFiles(staging, dir); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// replayLog applies the log records after result.Seq up to target to the
+// data directory dir, opened with config.
+func replayLog(dir string, log io.Reader, target RecoveryTarget, config Config, result *RecoveryResult) error {
+	config.MutationLog = false
+	config.ReadOnly = false
+	db, err := NewDBWithConfig(dir, config)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var last uint64
+	deleted := make(map[string]bool)
+	_, err = scanMutationLog(log, db.crypt, func(rec *logRecord) error {
+		last = rec.Seq
+		if rec.Seq <= result.Seq {
+			return nil
+		}
+		if rec.Seq != result.Seq+1 {
+			return fmt.Errorf("%w: log starts at record %d, but the backup ends at record %d", ErrBadMutationLog, rec.Seq, result.Seq)
+		}
+		if target.Seq != 0 && rec.Seq > target.Seq ||
+			!target.Time.IsZero() && rec.Time.After(target.Time) {
+			return errRecoveryDone
+		}
+
+		if err := db.replay(rec, deleted); err != nil {
+			return fmt.Errorf("replaying log record %d: %w", rec.Seq, err)
+		}
+		result.Seq = rec.Seq
+		result.Time = rec.Time
+		result.Replayed++
+		return nil
+	})
+	if err != nil && err != errRecoveryDone {
+		return err
+	}
+	if last < result.Seq {
+		return fmt.Errorf("%w: log ends at record %d, before the backup's record %d", ErrBadMutationLog, last, result.Seq)
+	}
+
+	// Deletes are not written to data files, so collections that had any
+	// are rewritten without the deleted documents.
+	for name := range deleted {
+		c, err := db.GetCollection(name)
+		if err != nil {
+			return err
+		}
+		if err := c.compact(); err != nil {
+			return fmt.Errorf("could not compact %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func (db *DB) replay(rec *logRecord, deleted map[string]bool) error {
+	switch rec.Op {
+	case logCommit:
+		c, err := db.GetCollection(rec.Collection)
+		if err != nil {
+			return err
+		}
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		return c.writeBlockInternal(rec.Documents)
+
+	case logDelete:
+		c, err := db.GetCollection(rec.Collection)
+		if err != nil {
+			return err
+		}
+		c.mutex.Lock()
+		c.deleteInternal(rec.ID)
+		c.mutex.Unlock()
+		deleted[rec.Collection] = true
+
+	case logDrop:
+		delete(deleted, rec.Collection)
+		if _, err := db.storage.Stat(filepath.Join(db.dataDir, rec.Collection+".toon")); os.IsNotExist(err) {
+			return nil
+		}
+		db.dbMutex.Lock()
+		defer db.dbMutex.Unlock()
+		return db.deleteCollectionLocked(rec.Collection)
+
+	default:
+		return fmt.Errorf("%w: unknown operation %q", ErrBadMutationLog, rec.Op)
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package db
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPointInTimeRecovery(t *testing.T) {
+	dataDir := "./test-pitr"
+	defer os.RemoveAll(dataDir)
+	defer os.RemoveAll("./test-pitr-restored")
+
+	config := DefaultConfig
+	config.MutationLog = true
+	db, err := NewDBWithConfig(dataDir, config)
+	if err != nil {
+		t.Fatalf("NewDB failed: %v", err)
+	}
+
+	users, _ := db.GetCollection("users")
+	users.Insert(Document{"id": "a", "n": 1})
+	users.Insert(Document{"id": "b", "n": 1})
+	users.Commit()
+
+	var archive bytes.Buffer
+	manifest, err := db.Backup(&archive)
+	if err != nil {
+		t.Fatalf("Backup failed: %v", err)
+	}
+	if manifest.LogSeq != 1 {
+		t.Errorf("Expected backup at log record 1, got %d", manifest.LogSeq)
+	}
+
+	users.Insert(Document{"id": "c", "n": 1})
+	users.Commit() // record 2
+	time.Sleep(10 * time.Millisecond)
+	beforeDelete := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	users.Delete("a") // record 3
+	users.Update("b", Document{"n": 2})
+	users.Commit() // record 4
+	tmp, _ := db.GetCollection("tmp")
+	tmp.Insert(Document{"id": "x"})
+	tmp.Commit()               // record 5
+	db.DeleteCollection("tmp") // record 6
+	db.Close()
+
+	// A crash in the middle of an append leaves a partial line, which is
+	// dropped when the log is reopened.
+	logPath := filepath.Join(dataDir, MutationLogFileName)
+	f, _ := os.OpenFile(logPath, os.O_WRONLY|os.O_APPEND, 0644)
+	f.WriteString(`{"seq":7,"op":"com`)
+	f.Close()
+	db, err = NewDBWithConfig(dataDir, config)
+	if err != nil {
+		t.Fatalf("Reopen failed: %v", err)
+	}
+	users, _ = db.GetCollection("users")
+	users.Insert(Document{"id": "d"})
+	users.Commit() // record 7
+	db.Close()
+
+	recoverTo := func(name string, target RecoveryTarget) (*RecoveryResult, map[string]Document) {
+		t.Helper()
+		dir := filepath.Join("./test-pitr-restored", name)
+		result, err := Recover(dir, logPath, target, bytes.NewReader(archive.Bytes()))
+		if err != nil {
+			t.Fatalf("Recover to %s failed: %v", name, err)
+		}
+		restored, _ := NewDB(dir)
+		defer restored.Close()
+		c, _ := restored.GetCollection("users")
+		all, _ := c.All()
+		docs := make(map[string]Document)
+		for _, doc := range all {
+			docs[doc["id"].(string)] = doc
+		}
+		return result, docs
+	}
+
+	result, docs := recoverTo("seq2", RecoveryTarget{Seq: 2})
+	if result.Seq != 2 || result.Replayed != 1 || len(docs) != 3 || docs["a"] == nil {
+		t.Errorf("Unexpected state at record 2: %+v %v", result, docs)
+	}
+
+	result, docs = recoverTo("time", RecoveryTarget{Time: beforeDelete})
+	if result.Seq != 2 || len(docs) != 3 {
+		t.Errorf("Unexpected state before the delete: %+v %v", result, docs)
+	}
+
+	result, docs = recoverTo("all", RecoveryTarget{})
+	if result.Seq != 7 || len(docs) != 3 || docs["a"] != nil || docs["b"]["n"] != int64(2) || docs["d"] == nil {
+		t.Errorf("Unexpected state at the end of the log: %+v %v", result, docs)
+	}
+	if _, err := os.Stat("./test-pitr-restored/all/tmp.toon"); !os.IsNotExist(err) {
+		t.Errorf("Expected dropped collection to stay dropped, got %v", err)
+	}
+
+	_, err = Recover("./test-pitr-restored/early", logPath, RecoveryTarget{Time: manifest.Created.Add(-time.Hour)}, bytes.NewReader(archive.Bytes()))
+	if !errors.Is(err, ErrRecoveryTarget) {
+		t.Errorf("Expected ErrRecoveryTarget, got %v", err)
+	}
+	if _, err := Recover("./test-pitr-restored/all", logPath, RecoveryTarget{}, bytes.NewReader(archive.Bytes())); err == nil {
+		t.Error("Expected recovery into a used directory to fail")
+	}
+}
+
+func TestRecoverCompactedMemtable(t *testing.T) {
+	dataDir := "./test-pitr-compact"
+	defer os.RemoveAll(dataDir)
+	defer os.RemoveAll("./test-pitr-compact-restored")
+
+	config := DefaultConfig
+	config.MutationLog = true
+	db, err := NewDBWithConfig(dataDir, config)
+	if err != nil {
+		t.Fatalf("NewDB failed: %v", err)
+	}
+
+	users, _ := db.GetCollection("users")
+	var archive bytes.Buffer
+	if _, err := db.Backup(&archive); err != nil {
+		t.Fatalf("Backup failed: %v", err)
+	}
+
+	// Compact commits the memtable without a call to Commit.
+	users.Insert(Document{"id": "a"})
+	if err := users.Compact(); err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+	if db.LogSeq() != 1 {
+		t.Errorf("Expected Compact to log a commit, log is at record %d", db.LogSeq())
+	}
+	db.Close()
+
+	dir := "./test-pitr-compact-restored"
+	logPath := filepath.Join(dataDir, MutationLogFileName)
+	if _, err := Recover(dir, logPath, RecoveryTarget{}, bytes.NewReader(archive.Bytes())); err != nil {
+		t.Fatalf("Recover failed: %v", err)
+	}
+	restored, _ := NewDB(dir)
+	defer restored.Close()
+	c, _ := restored.GetCollection("users")
+	if _, err := c.FindByID("a"); err != nil {
+		t.Errorf("Document committed by Compact was not recovered: %v", err)
+	}
+}
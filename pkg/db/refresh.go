@@ -0,0 +1,138 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/Al3x-Myku/FlyDB/pkg/toon"
+)
+
+// Refresh picks up what another process has committed to the collection
+// since it was opened or last refreshed, and reports whether anything
+// changed. Blocks appended to the file are indexed on their own; a file
+// that was compacted, upgraded or restored is reloaded from scratch. A
+// block still being written is left for the next refresh.
+//
+// Only a read-only database can refresh, since a writer has the data
+// directory to itself; on other databases Refresh does nothing. See also
+// Config.RefreshInterval.
+func (c *Collection) Refresh() (bool, error) {
+	if c.db == nil || !c.db.config.ReadOnly {
+		return false, nil
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.file == nil {
+		return false, ErrCollectionClosed
+	}
+
+	// Compact and other rewrites bump the generation in the metadata
+	// before touching the file, so it is checked on both sides of reading
+	// the file.
+	generation := c.meta.Generation
+	if err := c.loadMeta(); err != nil {
+		return false, err
+	}
+	opened, err := c.file.Stat()
+	if err != nil {
+		return false, fmt.Errorf("could not stat file: %w", err)
+	}
+	onDisk, err := c.storage.Stat(c.filePath)
+	if os.IsNotExist(err) {
+		// Dropped by the writer; keep serving what was read.
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if c.meta.Generation != generation || !sameFile(opened, onDisk) || onDisk.Size() < c.scanned {
+		return true, c.reloadInternal()
+	}
+	if onDisk.Size() == c.scanned {
+		return false, nil
+	}
+
+	data := make([]byte, onDisk.Size()-c.scanned)
+	if _, err := c.file.ReadAt(data, c.scanned); err != nil {
+		return false, fmt.Errorf("could not read file: %w", err)
+	}
+	if err := c.loadMeta(); err != nil {
+		return false, err
+	}
+	if c.meta.Generation != generation {
+		return true, c.reloadInternal()
+	}
+
+	blocks, err := c.indexBlocksInternal(data, c.scanned)
+	if err != nil {
+		return false, err
+	}
+	if len(c.fieldIndexes) > 0 || len(c.textIndexes) > 0 {
+		for _, info := range blocks {
+			if err := c.indexBlockDocsInternal(info); err != nil {
+				return true, err
+			}
+		}
+	}
+	return len(blocks) > 0, nil
+}
+
+// indexBlockDocsInternal adds the documents of a block read by Refresh to
+// the secondary indexes.
+func (c *Collection) indexBlockDocsInternal(info BlockInfo) error {
+	blockData, err := c.readBlock(info)
+	if err != nil {
+		return err
+	}
+	docs, err := toon.DecodeAll(blockData)
+	if err != nil {
+		return fmt.Errorf("could not decode block at offset %d: %w", info.Offset, err)
+	}
+	for _, doc := range docs {
+		id := fmt.Sprint(doc["id"])
+		if c.index[id] != info {
+			continue
+		}
+		for _, ti := range c.textIndexes {
+			ti.add(id, doc)
+		}
+		for _, fi := range c.fieldIndexes {
+			fi.add(id, doc)
+		}
+	}
+	return nil
+}
+
+// refreshEvery refreshes the open collections every interval until ctx is
+// done, then closes done.
+func (db *DB) refreshEvery(ctx context.Context, interval time.Duration, done chan<- struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		db.dbMutex.Lock()
+		collections := make([]*Collection, 0, len(db.collections))
+		for _, c := range db.collections {
+			collections = append(collections, c)
+		}
+		db.dbMutex.Unlock()
+
+		for _, c := range collections {
+			if _, err := c.Refresh(); err != nil && err != ErrCollectionClosed {
+				log.Printf("Warning: Could not refresh collection %s: %v", c.name, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,109 @@
+//go:build unix
+
+package db
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Al3x-Myku/FlyDB/pkg/query"
+	"github.com/Al3x-Myku/FlyDB/pkg/toon"
+)
+
+func TestRefresh(t *testing.T) {
+	dataDir := "./test-refresh"
+	defer os.RemoveAll(dataDir)
+
+	writer, err := NewDBWithConfig(dataDir, Config{})
+	if err != nil {
+		t.Fatalf("NewDB failed: %v", err)
+	}
+	defer writer.Close()
+	items, _ := writer.GetCollection("items")
+	items.Insert(Document{"id": "a", "n": 1})
+	items.Commit()
+
+	reader, err := OpenReadOnly(dataDir)
+	if err != nil {
+		t.Fatalf("OpenReadOnly failed: %v", err)
+	}
+	defer reader.Close()
+	ro, _ := reader.GetCollection("items")
+	if err := ro.CreateIndex("n"); err != nil {
+		t.Fatalf("CreateIndex failed: %v", err)
+	}
+	if changed, err := ro.Refresh(); changed || err != nil {
+		t.Errorf("Expected nothing to refresh, got %v, %v", changed, err)
+	}
+
+	// Blocks appended by the writer are picked up, secondary indexes too.
+	items.Insert(Document{"id": "b", "n": 2})
+	items.Commit()
+	items.Update("a", Document{"id": "a", "n": 10})
+	items.Commit()
+	if changed, err := ro.Refresh(); !changed || err != nil {
+		t.Fatalf("Expected new blocks, got %v, %v", changed, err)
+	}
+	if doc, err := ro.FindByID("a"); err != nil || doc["n"] != int64(10) {
+		t.Errorf("Expected the updated document, got %v, %v", doc, err)
+	}
+	q, _ := query.Parse("n = 2")
+	if docs, err := ro.Find(q); err != nil || len(docs) != 1 {
+		t.Errorf("Expected the index to find b, got %v, %v", docs, err)
+	}
+
+	// Compact rewrites the file, so the reader starts over.
+	items.Delete("b")
+	if err := items.Compact(); err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+	if changed, err := ro.Refresh(); !changed || err != nil {
+		t.Fatalf("Expected a reload after Compact, got %v, %v", changed, err)
+	}
+	if n := len(mustAll(t, ro)); n != 1 {
+		t.Errorf("Expected 1 document after Compact, got %d", n)
+	}
+	if docs, _ := ro.Find(q); len(docs) != 0 {
+		t.Errorf("Expected the index to be rebuilt, got %v", docs)
+	}
+
+	// A block still being written is left for the next refresh.
+	block, _ := toon.Encode("items", []Document{{"id": "c", "n": 3}, {"id": "d", "n": 4}})
+	f, _ := os.OpenFile(filepath.Join(dataDir, "items.toon"), os.O_WRONLY|os.O_APPEND, 0644)
+	defer f.Close()
+	for _, cut := range []int{5, len(block) - 3, len(block) - 1} {
+		f.Write(block[:cut])
+		if changed, err := ro.Refresh(); changed || err != nil {
+			t.Errorf("Expected a partial block to be skipped, got %v, %v", changed, err)
+		}
+		f.Write(block[cut:])
+		if changed, err := ro.Refresh(); !changed || err != nil {
+			t.Errorf("Expected the finished block, got %v, %v", changed, err)
+		}
+	}
+	if _, err := ro.FindByID("d"); err != nil {
+		t.Errorf("FindByID after a finished block failed: %v", err)
+	}
+
+	// With RefreshInterval, readers keep up on their own.
+	config := DefaultConfig
+	config.ReadOnly = true
+	config.RefreshInterval = 10 * time.Millisecond
+	polling, _ := NewDBWithConfig(dataDir, config)
+	defer polling.Close()
+	live, _ := polling.GetCollection("items")
+	items.Insert(Document{"id": "e", "n": 5})
+	items.Commit()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := live.FindByID("e"); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Reader did not pick up the commit")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
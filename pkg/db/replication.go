@@ -0,0 +1,658 @@
+package db
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrNoMutationLog = errors.New("database does not keep a mutation log")
+
+const (
+	replicaStateFileName = "replica.json"
+
+	replicationHeartbeat = time.Second
+	replicationTimeout   = 5 * time.Second
+	maxReconnectDelay    = 5 * time.Second
+)
+
+// Replication frames are a type byte and a big-endian payload length
+// followed by the payload.
+const (
+	frameFollow    byte = 'F' // follower -> leader: replHello
+	frameSnapshot  byte = 'S' // leader -> follower: backup archive
+	frameRecord    byte = 'R' // leader -> follower: logRecord
+	frameHeartbeat byte = 'H' // leader -> follower: replHeartbeat
+)
+
+type replHello struct {
+	After uint64 `json:"after"`
+}
+
+type replHeartbeat struct {
+	Seq  uint64    `json:"seq"`
+	Time time.Time `json:"time"`
+}
+
+// LogSeq returns the sequence number of the last mutation log record, or
+// zero if the database keeps no log.
+func (db *DB) LogSeq() uint64 {
+	if db.log == nil {
+		return 0
+	}
+	return db.log.lastSeq()
+}
+
+// ServeReplication streams the mutation log to followers that connect to
+// ln, until ln is closed. A follower that is new, or too far behind for the
+// records still held in memory (Config.ReplicationBacklog), is first sent a
+// snapshot of the whole database. The database must keep a mutation log.
+func (db *DB) ServeReplication(ln net.Listener) error {
+	if db.log == nil {
+		return ErrNoMutationLog
+	}
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go func() {
+			if err := db.serveFollower(conn); err != nil {
+				log.Printf("Replication to %s stopped: %v", conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+func (db *DB) serveFollower(conn net.Conn) error {
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(replicationTimeout))
+	var hello replHello
+	if err := readJSONFrame(conn, frameFollow, &hello); err != nil {
+		return err
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	// The follower sends nothing more; a read returning means it hung up.
+	gone := make(chan struct{})
+	go func() {
+		io.Copy(io.Discard, conn)
+		close(gone)
+	}()
+
+	w := bufio.NewWriter(conn)
+	flush := func() error {
+		conn.SetWriteDeadline(time.Now().Add(replicationTimeout))
+		return w.Flush()
+	}
+
+	heartbeat := time.NewTicker(replicationHeartbeat)
+	defer heartbeat.Stop()
+
+	seq := hello.After
+	needSnapshot := seq == 0
+	for {
+		changed, open := db.log.changes()
+		if !open {
+			return nil
+		}
+
+		records, ok := db.log.since(seq)
+		if needSnapshot || !ok {
+			var err error
+			if seq, err = db.sendSnapshot(w); err != nil {
+				return err
+			}
+			if err := flush(); err != nil {
+				return err
+			}
+			needSnapshot = false
+			continue
+		}
+
+		for _, rec := range records {
+			if err := writeJSONFrame(w, frameRecord, rec); err != nil {
+				return err
+			}
+			seq = rec.Seq
+		}
+		if len(records) > 0 {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+
+		select {
+		case <-changed:
+		case <-gone:
+			return nil
+		case <-heartbeat.C:
+			hb := replHeartbeat{Seq: db.log.lastSeq(), Time: time.Now().UTC()}
+			if err := writeJSONFrame(w, frameHeartbeat, hb); err != nil {
+				return err
+			}
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// sendSnapshot writes a full backup to w and returns the log position it
+// was taken at. The backup goes through a temporary file in the data
+// directory, kept in the database's storage, because a frame needs its
+// length up front.
+func (db *DB) sendSnapshot(w io.Writer) (uint64, error) {
+	tmp, tmpPath, err := createTemp(db.storage, db.dataDir, ".snapshot-*.tmp")
+	if err != nil {
+		return 0, err
+	}
+	defer db.storage.Remove(tmpPath)
+	defer tmp.Close()
+
+	manifest, err := db.Backup(tmp)
+	if err != nil {
+		return 0, fmt.Errorf("could not take snapshot: %w", err)
+	}
+	size, err := tmp.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	if err := writeFrameHeader(w, frameSnapshot, size); err != nil {
+		return 0, err
+	}
+	if _, err := io.CopyN(w, tmp, size); err != nil {
+		return 0, err
+	}
+	return manifest.LogSeq, nil
+}
+
+// ReplicationStatus describes a follower's progress. Lag is how many log
+// records the follower is behind the leader as of the leader's last report,
+// and Delay how long ago the newest record applied was committed while
+// there is any lag.
+type ReplicationStatus struct {
+	Leader    string
+	Connected bool
+	Seq       uint64
+	LeaderSeq uint64
+	Lag       uint64
+	Delay     time.Duration
+	Snapshots int
+	LastError error
+}
+
+// Follower keeps a read-only copy of a leader's database up to date. Its
+// data directory can be read through DB like any other, but writes to it
+// fail with ErrReadOnly.
+type Follower struct {
+	db     *DB
+	leader string
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	mu        sync.Mutex
+	status    ReplicationStatus
+	applied   time.Time
+	changed   chan struct{} // closed and replaced whenever status changes
+	persisted uint64
+}
+
+type replicaState struct {
+	Leader string `json:"leader"`
+	Seq    uint64 `json:"seq"`
+}
+
+// Follow opens dataDir as a follower of the leader at the TCP address
+// leader and keeps replicating from it, reconnecting as needed, until
+// Close. It resumes from where it left off in an earlier run. A follower
+// is always read-only to callers, so Config.ReadOnly is ignored. It keeps
+// its files on the local file system, so Config.Storage must be nil or
+// OSStorage.
+func Follow(dataDir, leader string, config Config) (*Follower, error) {
+	if err := checkOSStorage(config, "follower"); err != nil {
+		return nil, err
+	}
+	config.MutationLog = false
+	config.ReadOnly = false
+	db, err := NewDBWithConfig(dataDir, config)
+	if err != nil {
+		return nil, err
+	}
+	db.readOnly = true
+	if err := db.LoadAllCollections(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	var state replicaState
+	data, err := os.ReadFile(filepath.Join(dataDir, replicaStateFileName))
+	if err == nil {
+		err = json.Unmarshal(data, &state)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		db.Close()
+		return nil, fmt.Errorf("could not read replication state: %w", err)
+	}
+	if state.Leader != leader {
+		// A different leader numbers its log differently.
+		state.Seq = 0
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	f := &Follower{
+		db:        db,
+		leader:    leader,
+		cancel:    cancel,
+		done:      make(chan struct{}),
+		changed:   make(chan struct{}),
+		persisted: state.Seq,
+	}
+	f.status.Leader = leader
+	f.status.Seq = state.Seq
+
+	go f.run(ctx)
+	return f, nil
+}
+
+// DB returns the follower's database for reading.
+func (f *Follower) DB() *DB {
+	return f.db
+}
+
+func (f *Follower) Status() ReplicationStatus {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	s := f.status
+	if s.LeaderSeq > s.Seq {
+		s.Lag = s.LeaderSeq - s.Seq
+		if !f.applied.IsZero() {
+			s.Delay = time.Since(f.applied)
+		}
+	}
+	return s
+}
+
+// WaitFor blocks until the follower has applied the log record seq or ctx
+// is done.
+func (f *Follower) WaitFor(ctx context.Context, seq uint64) error {
+	for {
+		f.mu.Lock()
+		reached := f.status.Seq >= seq
+		changed := f.changed
+		f.mu.Unlock()
+		if reached {
+			return nil
+		}
+
+		select {
+		case <-changed:
+		case <-f.done:
+			return ErrCollectionClosed
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Close stops replicating and closes the follower's database.
+func (f *Follower) Close() error {
+	f.cancel()
+	<-f.done
+	return f.db.Close()
+}
+
+func (f *Follower) update(fn func(s *ReplicationStatus)) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	fn(&f.status)
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+func (f *Follower) run(ctx context.Context) {
+	defer close(f.done)
+
+	delay := 100 * time.Millisecond
+	for ctx.Err() == nil {
+		err := f.session(ctx)
+		if f.Status().Connected {
+			delay = 100 * time.Millisecond
+		}
+		f.update(func(s *ReplicationStatus) {
+			s.Connected = false
+			if ctx.Err() == nil {
+				s.LastError = err
+			}
+		})
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(delay):
+		}
+		delay = min(delay*2, maxReconnectDelay)
+	}
+}
+
+// session replicates over one connection until it fails or ctx is done.
+func (f *Follower) session(ctx context.Context) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", f.leader)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	seq := f.Status().Seq
+	conn.SetWriteDeadline(time.Now().Add(replicationTimeout))
+	if err := writeJSONFrame(conn, frameFollow, replHello{After: seq}); err != nil {
+		return err
+	}
+	f.update(func(s *ReplicationStatus) {
+		s.Connected = true
+		s.LastError = nil
+	})
+
+	r := bufio.NewReader(&deadlineReader{conn: conn})
+	deleted := make(map[string]bool)
+	for {
+		typ, size, err := readFrameHeader(r)
+		if err != nil {
+			return err
+		}
+		payload := io.LimitReader(r, size)
+
+		switch typ {
+		case frameSnapshot:
+			if seq, err = f.applySnapshot(payload); err != nil {
+				return err
+			}
+			clear(deleted)
+
+		case frameRecord:
+			var rec logRecord
+			dec := json.NewDecoder(payload)
+			dec.UseNumber()
+			if err := dec.Decode(&rec); err != nil {
+				return fmt.Errorf("bad replication record: %w", err)
+			}
+			if rec.Seq != seq+1 {
+				return fmt.Errorf("leader sent record %d after %d", rec.Seq, seq)
+			}
+			if err := rec.unseal(f.db.crypt, fmt.Sprintf("replication record %d", rec.Seq), 0); err != nil {
+				return err
+			}
+			if err := f.db.replay(&rec, deleted); err != nil {
+				return fmt.Errorf("could not apply record %d: %w", rec.Seq, err)
+			}
+			seq = rec.Seq
+			f.mu.Lock()
+			f.applied = rec.Time
+			f.mu.Unlock()
+			f.update(func(s *ReplicationStatus) {
+				s.Seq = seq
+				s.LeaderSeq = max(s.LeaderSeq, seq)
+			})
+
+		case frameHeartbeat:
+			var hb replHeartbeat
+			if err := json.NewDecoder(payload).Decode(&hb); err != nil {
+				return fmt.Errorf("bad replication heartbeat: %w", err)
+			}
+			f.update(func(s *ReplicationStatus) { s.LeaderSeq = hb.Seq })
+
+		default:
+			return fmt.Errorf("unknown replication frame %q", typ)
+		}
+
+		if _, err := io.Copy(io.Discard, payload); err != nil {
+			return err
+		}
+		// Persist the position once caught up with what has arrived.
+		if r.Buffered() == 0 {
+			if err := f.checkpoint(seq, deleted); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// checkpoint makes the applied records durable and records the position.
+// Deletes never reach the data files, so collections with any are compacted
+// first; a crash before the position is saved replays them again.
+func (f *Follower) checkpoint(seq uint64, deleted map[string]bool) error {
+	for name := range deleted {
+		c, err := f.db.GetCollection(name)
+		if err != nil {
+			return err
+		}
+		if err := c.compact(); err != nil {
+			return fmt.Errorf("could not compact %s: %w", name, err)
+		}
+		delete(deleted, name)
+	}
+	if seq == f.persisted {
+		return nil
+	}
+	if err := f.saveState(seq); err != nil {
+		return err
+	}
+	f.persisted = seq
+	return nil
+}
+
+func (f *Follower) saveState(seq uint64) error {
+	data, err := json.Marshal(replicaState{Leader: f.leader, Seq: seq})
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(f.db.dataDir, replicaStateFileName)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("could not save replication state: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("could not save replication state: %w", err)
+	}
+	return nil
+}
+
+// applySnapshot restores the archive in r into a staging directory and then
+// swaps it in for the follower's data, returning the snapshot's log position.
+func (f *Follower) applySnapshot(r io.Reader) (uint64, error) {
+	staging, err := os.MkdirTemp(f.db.dataDir, ".snapshot-")
+	if err != nil {
+		return 0, err
+	}
+	defer os.RemoveAll(staging)
+
+	manifest, err := RestoreChainWithConfig(staging, f.db.config, r)
+	if err != nil {
+		return 0, fmt.Errorf("could not restore snapshot: %w", err)
+	}
+
+	// If the swap is interrupted the data is a mix of old and new, so the
+	// next run must start over with another snapshot.
+	if err := f.saveState(0); err != nil {
+		return 0, err
+	}
+	f.persisted = 0
+	if err := f.db.replaceData(staging); err != nil {
+		return 0, err
+	}
+
+	f.update(func(s *ReplicationStatus) {
+		s.Seq = manifest.LogSeq
+		s.LeaderSeq = max(s.LeaderSeq, manifest.LogSeq)
+		s.Snapshots++
+	})
+	return manifest.LogSeq, f.checkpoint(manifest.LogSeq, nil)
+}
+
+// replaceData replaces every collection with the files in staging. Open
+// collections are reloaded in place, so existing handles stay usable;
+// those not in staging are closed.
+func (db *DB) replaceData(staging string) error {
+	db.dbMutex.Lock()
+	defer db.dbMutex.Unlock()
+
+	for _, c := range db.collections {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		if c.file != nil {
+			c.file.Close()
+			c.file = nil
+		}
+	}
+
+	old, err := os.ReadDir(db.dataDir)
+	if err != nil {
+		return err
+	}
+	for _, e := range old {
+		name := e.Name()
+		if !e.IsDir() && (strings.HasSuffix(name, ".toon") || strings.HasSuffix(name, metaSuffix)) {
+			if err := os.Remove(filepath.Join(db.dataDir, name)); err != nil {
+				return err
+			}
+		}
+	}
+	if err := installFiles(staging, db.dataDir); err != nil {
+		return err
+	}
+
+	for name, c := range db.collections {
+		if _, err := os.Stat(c.filePath); os.IsNotExist(err) {
+			delete(db.collections, name)
+			continue
+		}
+		if err := c.reloadInternal(); err != nil {
+			return fmt.Errorf("could not reload %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// reloadInternal reopens the collection's files and rebuilds its in-memory
+// state from them, including any secondary indexes.
+func (c *Collection) reloadInternal() error {
+	flag := os.O_RDWR
+	if c.db != nil && c.db.config.ReadOnly {
+		flag = os.O_RDONLY
+	}
+	file, err := c.storage.OpenFile(c.filePath, flag, 0644)
+	if err != nil {
+		return err
+	}
+	if c.file != nil {
+		c.file.Close()
+	}
+	c.file = file
+	c.memtable = make([]Document, 0)
+	c.index = make(map[string]BlockInfo)
+	c.deleted = make(map[string]bool)
+	c.meta = collectionMeta{}
+	c.sequence = 0
+	c.format = fileHeader{version: FormatVersion}
+
+	if err := c.loadIndex(); err != nil {
+		return err
+	}
+	if err := c.loadMeta(); err != nil {
+		return err
+	}
+
+	for field := range c.fieldIndexes {
+		fi := newFieldIndex(field)
+		if err := c.scanBlocks(func(id string, doc Document) error {
+			fi.add(id, doc)
+			return nil
+		}); err != nil {
+			return err
+		}
+		c.fieldIndexes[field] = fi
+	}
+	for field := range c.textIndexes {
+		ti := newTextIndex(field)
+		if err := c.scanBlocks(func(id string, doc Document) error {
+			ti.add(id, doc)
+			return nil
+		}); err != nil {
+			return err
+		}
+		c.textIndexes[field] = ti
+	}
+	return nil
+}
+
+// deadlineReader extends the connection's read deadline before every read,
+// so a leader that goes silent, without even heartbeats, is noticed.
+type deadlineReader struct {
+	conn net.Conn
+}
+
+func (d *deadlineReader) Read(p []byte) (int, error) {
+	d.conn.SetReadDeadline(time.Now().Add(replicationTimeout))
+	return d.conn.Read(p)
+}
+
+func writeFrameHeader(w io.Writer, typ byte, size int64) error {
+	var hdr [9]byte
+	hdr[0] = typ
+	binary.BigEndian.PutUint64(hdr[1:], uint64(size))
+	_, err := w.Write(hdr[:])
+	return err
+}
+
+func readFrameHeader(r io.Reader) (byte, int64, error) {
+	var hdr [9]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, 0, err
+	}
+	return hdr[0], int64(binary.BigEndian.Uint64(hdr[1:])), nil
+}
+
+func writeJSONFrame(w io.Writer, typ byte, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if err := writeFrameHeader(w, typ, int64(len(data))); err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+func readJSONFrame(r io.Reader, want byte, v any) error {
+	typ, size, err := readFrameHeader(r)
+	if err != nil {
+		return err
+	}
+	if typ != want {
+		return fmt.Errorf("unexpected replication frame %q", typ)
+	}
+	return json.NewDecoder(io.LimitReader(r, size)).Decode(v)
+}
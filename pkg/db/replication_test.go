@@ -0,0 +1,284 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Al3x-Myku/FlyDB/pkg/query"
+)
+
+func TestReplication(t *testing.T) {
+	leaderDir := "./test-repl-leader"
+	followerDir := "./test-repl-follower"
+	defer os.RemoveAll(leaderDir)
+	defer os.RemoveAll(followerDir)
+
+	config := DefaultConfig
+	config.MutationLog = true
+	config.ReplicationBacklog = 5
+	leader, err := NewDBWithConfig(leaderDir, config)
+	if err != nil {
+		t.Fatalf("NewDB failed: %v", err)
+	}
+	defer leader.Close()
+
+	users, _ := leader.GetCollection("users")
+	users.CreateIndex("n")
+	users.Insert(Document{"id": "before", "n": 0})
+	users.Commit()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer ln.Close()
+	go leader.ServeReplication(ln)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// A new follower starts from a snapshot, then streams records.
+	follower, err := Follow(followerDir, ln.Addr().String(), DefaultConfig)
+	if err != nil {
+		t.Fatalf("Follow failed: %v", err)
+	}
+	if err := follower.WaitFor(ctx, leader.LogSeq()); err != nil {
+		t.Fatalf("WaitFor failed: %v", err)
+	}
+	replica, _ := follower.DB().GetCollection("users")
+	replica.CreateIndex("n")
+
+	users.Insert(Document{"id": "a", "n": 1})
+	users.Insert(Document{"id": "b", "n": 2})
+	users.Commit()
+	users.Delete("before")
+	if err := follower.WaitFor(ctx, leader.LogSeq()); err != nil {
+		t.Fatalf("WaitFor failed: %v", err)
+	}
+
+	docs, _ := replica.All()
+	if len(docs) != 2 {
+		t.Errorf("Expected 2 replicated documents, got %v", docs)
+	}
+	if _, err := replica.FindByID("before"); err != ErrNotFound {
+		t.Errorf("Expected delete to be replicated, got %v", err)
+	}
+	q, _ := query.ParseQuery("n = 2")
+	plan, _ := replica.Explain(q)
+	if plan.Type != PlanIndexLookup || plan.ActualRows != 1 {
+		t.Errorf("Expected follower index to be maintained, got %+v", plan)
+	}
+
+	status := follower.Status()
+	if !status.Connected || status.Seq != leader.LogSeq() || status.Lag != 0 || status.Snapshots != 1 {
+		t.Errorf("Unexpected status: %+v", status)
+	}
+
+	if _, err := replica.Insert(Document{"id": "x"}); err != ErrReadOnly {
+		t.Errorf("Expected ErrReadOnly on follower insert, got %v", err)
+	}
+	if err := follower.DB().DeleteCollection("users"); err != ErrReadOnly {
+		t.Errorf("Expected ErrReadOnly on follower drop, got %v", err)
+	}
+
+	// A follower that restarts within the backlog resumes from its position.
+	follower.Close()
+	users.Insert(Document{"id": "c", "n": 3})
+	users.Commit()
+	follower, err = Follow(followerDir, ln.Addr().String(), DefaultConfig)
+	if err != nil {
+		t.Fatalf("Follow failed: %v", err)
+	}
+	if err := follower.WaitFor(ctx, leader.LogSeq()); err != nil {
+		t.Fatalf("WaitFor failed: %v", err)
+	}
+	if s := follower.Status(); s.Snapshots != 0 {
+		t.Errorf("Expected resume without a snapshot, got %+v", s)
+	}
+	replica, _ = follower.DB().GetCollection("users")
+	if _, err := replica.FindByID("before"); err != ErrNotFound {
+		t.Errorf("Expected delete to survive a follower restart, got %v", err)
+	}
+
+	// One that falls further behind gets a new snapshot.
+	follower.Close()
+	for i := 0; i < 10; i++ {
+		users.Insert(Document{"id": fmt.Sprintf("late%d", i), "n": 10 + i})
+		users.Commit()
+	}
+	follower, err = Follow(followerDir, ln.Addr().String(), DefaultConfig)
+	if err != nil {
+		t.Fatalf("Follow failed: %v", err)
+	}
+	defer follower.Close()
+	if err := follower.WaitFor(ctx, leader.LogSeq()); err != nil {
+		t.Fatalf("WaitFor failed: %v", err)
+	}
+	if s := follower.Status(); s.Snapshots != 1 {
+		t.Errorf("Expected catch-up by snapshot, got %+v", s)
+	}
+	replica, _ = follower.DB().GetCollection("users")
+	docs, _ = replica.All()
+	if len(docs) != 13 {
+		t.Errorf("Expected 13 documents after catching up, got %d", len(docs))
+	}
+}
+
+func TestReplicationCompactedMemtable(t *testing.T) {
+	leaderDir := "./test-repl-compact-leader"
+	followerDir := "./test-repl-compact-follower"
+	defer os.RemoveAll(leaderDir)
+	defer os.RemoveAll(followerDir)
+
+	config := DefaultConfig
+	config.MutationLog = true
+	leader, err := NewDBWithConfig(leaderDir, config)
+	if err != nil {
+		t.Fatalf("NewDB failed: %v", err)
+	}
+	defer leader.Close()
+	users, _ := leader.GetCollection("users")
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer ln.Close()
+	go leader.ServeReplication(ln)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	follower, err := Follow(followerDir, ln.Addr().String(), DefaultConfig)
+	if err != nil {
+		t.Fatalf("Follow failed: %v", err)
+	}
+	defer follower.Close()
+	if err := follower.WaitFor(ctx, leader.LogSeq()); err != nil {
+		t.Fatalf("WaitFor failed: %v", err)
+	}
+
+	// Compact commits the memtable without a call to Commit.
+	users.Insert(Document{"id": "a"})
+	if err := users.Compact(); err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+	if leader.LogSeq() == 0 {
+		t.Fatal("Expected Compact to log a commit")
+	}
+	if err := follower.WaitFor(ctx, leader.LogSeq()); err != nil {
+		t.Fatalf("WaitFor failed: %v", err)
+	}
+
+	replica, _ := follower.DB().GetCollection("users")
+	if _, err := replica.FindByID("a"); err != nil {
+		t.Errorf("Document committed by Compact was not replicated: %v", err)
+	}
+}
+
+// TestReplicationEncrypted checks that an encrypted leader streams records
+// sealed, by listening in on the connection through a proxy.
+func TestReplicationEncrypted(t *testing.T) {
+	leaderDir := "./test-repl-enc-leader"
+	followerDir := "./test-repl-enc-follower"
+	defer os.RemoveAll(leaderDir)
+	defer os.RemoveAll(followerDir)
+
+	config := DefaultConfig
+	config.EncryptionKey = bytes.Repeat([]byte{1}, 32)
+	config.MutationLog = true
+	leader, err := NewDBWithConfig(leaderDir, config)
+	if err != nil {
+		t.Fatalf("NewDB failed: %v", err)
+	}
+	defer leader.Close()
+	users, _ := leader.GetCollection("users")
+	// The follower starts from a snapshot of this, so what follows is
+	// streamed as records.
+	users.Insert(Document{"id": "before"})
+	users.Commit()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer ln.Close()
+	go leader.ServeReplication(ln)
+
+	// The proxy copies what the leader sends into sniffed.
+	proxy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer proxy.Close()
+	var mu sync.Mutex
+	var sniffed bytes.Buffer
+	go func() {
+		for {
+			client, err := proxy.Accept()
+			if err != nil {
+				return
+			}
+			upstream, err := net.Dial("tcp", ln.Addr().String())
+			if err != nil {
+				client.Close()
+				return
+			}
+			go io.Copy(upstream, client)
+			go func() {
+				buf := make([]byte, 4096)
+				for {
+					n, err := upstream.Read(buf)
+					mu.Lock()
+					sniffed.Write(buf[:n])
+					mu.Unlock()
+					if _, werr := client.Write(buf[:n]); err != nil || werr != nil {
+						client.Close()
+						upstream.Close()
+						return
+					}
+				}
+			}()
+		}
+	}()
+
+	follower, err := Follow(followerDir, proxy.Addr().String(), config)
+	if err != nil {
+		t.Fatalf("Follow failed: %v", err)
+	}
+	defer follower.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := follower.WaitFor(ctx, leader.LogSeq()); err != nil {
+		t.Fatalf("WaitFor failed: %v", err)
+	}
+
+	users.Insert(Document{"id": "secret-user", "email": "alice@example.com"})
+	users.Commit()
+	users.Delete("secret-user")
+	if err := follower.WaitFor(ctx, leader.LogSeq()); err != nil {
+		t.Fatalf("WaitFor failed: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, secret := range []string{"secret-user", "alice@example.com"} {
+		if bytes.Contains(sniffed.Bytes(), []byte(secret)) {
+			t.Errorf("Replication sent %q in cleartext", secret)
+		}
+	}
+	replica, _ := follower.DB().GetCollection("users")
+	if _, err := replica.FindByID("secret-user"); err != ErrNotFound {
+		t.Errorf("Expected the delete to be replicated, got %v", err)
+	}
+	if s := follower.Status(); s.Seq != 3 || s.Snapshots != 1 {
+		t.Errorf("Expected the follower to stream two records, got %+v", s)
+	}
+}
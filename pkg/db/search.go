@@ -0,0 +1,363 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// BM25 tuning parameters. These are the commonly used defaults.
+const (
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+var ErrNoTextIndex = errors.New("no text index on field")
+
+type SearchResult struct {
+	ID    string
+	Score float64
+}
+
+// textIndex is an inverted index over a single string field. Postings keep
+// term positions so that phrase queries can be answered without re-reading
+// the documents.
+type textIndex struct {
+	field    string
+	postings map[string]map[string][]int
+	docTerms map[string][]string
+	docLen   map[string]int
+	totalLen int
+}
+
+func newTextIndex(field string) *textIndex {
+	return &textIndex{
+		field:    field,
+		postings: make(map[string]map[string][]int),
+		docTerms: make(map[string][]string),
+		docLen:   make(map[string]int),
+	}
+}
+
+func (ti *textIndex) add(id string, doc Document) {
+	ti.remove(id)
+
+	val, ok := doc[ti.field]
+	if !ok || val == nil {
+		return
+	}
+
+	tokens := tokenize(fmt.Sprint(val))
+	if len(tokens) == 0 {
+		return
+	}
+
+	terms := make([]string, 0, len(tokens))
+	for pos, tok := range tokens {
+		plist, ok := ti.postings[tok]
+		if !ok {
+			plist = make(map[string][]int)
+			ti.postings[tok] = plist
+		}
+		if _, seen := plist[id]; !seen {
+			terms = append(terms, tok)
+		}
+		plist[id] = append(plist[id], pos)
+	}
+
+	ti.docTerms[id] = terms
+	ti.docLen[id] = len(tokens)
+	ti.totalLen += len(tokens)
+}
+
+func (ti *textIndex) remove(id string) {
+	terms, ok := ti.docTerms[id]
+	if !ok {
+		return
+	}
+	for _, term := range terms {
+		plist := ti.postings[term]
+		delete(plist, id)
+		if len(plist) == 0 {
+			delete(ti.postings, term)
+		}
+	}
+	ti.totalLen -= ti.docLen[id]
+	delete(ti.docTerms, id)
+	delete(ti.docLen, id)
+}
+
+func (ti *textIndex) search(query string) []SearchResult {
+	clauses := parseSearchQuery(query)
+	if len(clauses) == 0 || len(ti.docLen) == 0 {
+		return nil
+	}
+
+	scores := make(map[string]float64)
+	for _, cl := range clauses {
+		switch {
+		case cl.prefix:
+			for term, plist := range ti.postings {
+				if strings.HasPrefix(term, cl.terms[0]) {
+					ti.scoreTerm(scores, plist, termFreqs(plist))
+				}
+			}
+		case len(cl.terms) > 1:
+			ti.scorePhrase(scores, cl.terms)
+		default:
+			if plist, ok := ti.postings[cl.terms[0]]; ok {
+				ti.scoreTerm(scores, plist, termFreqs(plist))
+			}
+		}
+	}
+
+	results := make([]SearchResult, 0, len(scores))
+	for id, score := range scores {
+		results = append(results, SearchResult{ID: id, Score: score})
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].ID < results[j].ID
+	})
+	return results
+}
+
+// scoreTerm adds the BM25 contribution of a single term to every document
+// listed in freqs. plist is only used to compute the document frequency.
+func (ti *textIndex) scoreTerm(scores map[string]float64, plist map[string][]int, freqs map[string]int) {
+	n := float64(len(ti.docLen))
+	df := float64(len(plist))
+	idf := math.Log(1 + (n-df+0.5)/(df+0.5))
+	avgLen := float64(ti.totalLen) / n
+
+	for id, tf := range freqs {
+		f := float64(tf)
+		dl := float64(ti.docLen[id])
+		scores[id] += idf * (f * (bm25K1 + 1)) / (f + bm25K1*(1-bm25B+bm25B*dl/avgLen))
+	}
+}
+
+// scorePhrase scores a phrase as if it were one term whose frequency is the
+// number of times the whole phrase occurs and whose document frequency is
+// the number of documents containing it.
+func (ti *textIndex) scorePhrase(scores map[string]float64, terms []string) {
+	first, ok := ti.postings[terms[0]]
+	if !ok {
+		return
+	}
+
+	freqs := make(map[string]int)
+	for id, positions := range first {
+		count := 0
+		for _, start := range positions {
+			if ti.phraseAt(id, terms, start) {
+				count++
+			}
+		}
+		if count > 0 {
+			freqs[id] = count
+		}
+	}
+	if len(freqs) == 0 {
+		return
+	}
+
+	matched := make(map[string][]int, len(freqs))
+	for id := range freqs {
+		matched[id] = nil
+	}
+	ti.scoreTerm(scores, matched, freqs)
+}
+
+func (ti *textIndex) phraseAt(id string, terms []string, start int) bool {
+	for i := 1; i < len(terms); i++ {
+		plist, ok := ti.postings[terms[i]]
+		if !ok {
+			return false
+		}
+		if !containsInt(plist[id], start+i) {
+			return false
+		}
+	}
+	return true
+}
+
+func containsInt(list []int, v int) bool {
+	for _, x := range list {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
+
+func termFreqs(plist map[string][]int) map[string]int {
+	freqs := make(map[string]int, len(plist))
+	for id, positions := range plist {
+		freqs[id] = len(positions)
+	}
+	return freqs
+}
+
+type searchClause struct {
+	terms  []string
+	prefix bool
+}
+
+// parseSearchQuery splits a query into plain terms, "quoted phrases" and
+// prefix terms ending in '*'. Terms go through the same tokenizer as indexed
+// text, except prefixes, which are only lowercased so that a partial word is
+// not stemmed into something it was never a prefix of.
+func parseSearchQuery(query string) []searchClause {
+	var clauses []searchClause
+
+	for len(query) > 0 {
+		query = strings.TrimLeftFunc(query, unicode.IsSpace)
+		if query == "" {
+			break
+		}
+
+		if query[0] == '"' {
+			end := strings.IndexByte(query[1:], '"')
+			var phrase string
+			if end == -1 {
+				phrase, query = query[1:], ""
+			} else {
+				phrase, query = query[1:end+1], query[end+2:]
+			}
+			if terms := tokenize(phrase); len(terms) > 0 {
+				clauses = append(clauses, searchClause{terms: terms})
+			}
+			continue
+		}
+
+		end := strings.IndexFunc(query, unicode.IsSpace)
+		var word string
+		if end == -1 {
+			word, query = query, ""
+		} else {
+			word, query = query[:end], query[end:]
+		}
+
+		if strings.HasSuffix(word, "*") {
+			prefix := strings.ToLower(strings.TrimRight(word, "*"))
+			if prefix != "" {
+				clauses = append(clauses, searchClause{terms: []string{prefix}, prefix: true})
+			}
+			continue
+		}
+
+		for _, term := range tokenize(word) {
+			clauses = append(clauses, searchClause{terms: []string{term}})
+		}
+	}
+
+	return clauses
+}
+
+// tokenize splits text on anything that is not a letter or digit, lowercases
+// the pieces and applies a light suffix-stripping stemmer.
+func tokenize(text string) []string {
+	words := strings.FieldsFunc(text, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+
+	tokens := make([]string, 0, len(words))
+	for _, w := range words {
+		tokens = append(tokens, stem(strings.ToLower(w)))
+	}
+	return tokens
+}
+
+var stemSuffixes = []string{"ies", "ing", "ed", "es", "ly", "s"}
+
+// stem strips a handful of common English suffixes. It is deliberately
+// simple: it only has to map inflections of the same word onto one term, not
+// produce real roots.
+func stem(word string) string {
+	for _, suffix := range stemSuffixes {
+		if !strings.HasSuffix(word, suffix) {
+			continue
+		}
+		root := strings.TrimSuffix(word, suffix)
+		if len([]rune(root)) < 3 {
+			continue
+		}
+		if suffix == "s" && strings.HasSuffix(root, "s") {
+			continue
+		}
+		if suffix == "ies" {
+			return root + "y"
+		}
+		return root
+	}
+	return word
+}
+
+// CreateTextIndex builds a full-text index over field from the committed
+// documents. From then on the index is kept up to date on every commit.
+func (c *Collection) CreateTextIndex(field string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.file == nil {
+		return ErrCollectionClosed
+	}
+
+	if _, ok := c.textIndexes[field]; ok {
+		return nil
+	}
+	if _, ok := c.encryptedFieldInternal(field); ok {
+		return fmt.Errorf("%w: cannot build a text index on %s", ErrEncryptedField, field)
+	}
+
+	docs, err := c.committedInternal()
+	if err != nil {
+		return fmt.Errorf("could not read documents for text index: %w", err)
+	}
+
+	ti := newTextIndex(field)
+	for _, doc := range docs {
+		ti.add(fmt.Sprint(doc["id"]), doc)
+	}
+	c.textIndexes[field] = ti
+
+	return nil
+}
+
+func (c *Collection) DropTextIndex(field string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.textIndexes, field)
+}
+
+func (c *Collection) HasTextIndex(field string) bool {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	_, ok := c.textIndexes[field]
+	return ok
+}
+
+// Search runs a full-text query against the text index on field and returns
+// the matching IDs ordered by BM25 relevance. Only committed documents are
+// searchable.
+func (c *Collection) Search(field, query string) ([]SearchResult, error) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	if c.file == nil {
+		return nil, ErrCollectionClosed
+	}
+
+	ti, ok := c.textIndexes[field]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrNoTextIndex, field)
+	}
+
+	return ti.search(query), nil
+}
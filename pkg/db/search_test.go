@@ -0,0 +1,67 @@
+package db
+
+import (
+	"os"
+	"testing"
+)
+
+func TestSearch(t *testing.T) {
+	dataDir := "./test-search"
+	defer os.RemoveAll(dataDir)
+
+	db, _ := NewDB(dataDir)
+	defer db.Close()
+
+	notes, _ := db.GetCollection("notes")
+	notes.Insert(Document{"id": "1", "body": "The quick brown fox jumps over the lazy dog"})
+	notes.Insert(Document{"id": "2", "body": "Foxes are quick; a fox is quicker than most dogs"})
+	notes.Insert(Document{"id": "3", "body": "Databases store documents"})
+	notes.Commit()
+
+	if err := notes.CreateTextIndex("body"); err != nil {
+		t.Fatalf("CreateTextIndex failed: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		query    string
+		expected []string
+	}{
+		{"stemmed term", "foxes", []string{"2", "1"}},
+		{"phrase", `"brown fox"`, []string{"1"}},
+		{"prefix", "datab*", []string{"3"}},
+		{"no match", "elephant", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			results, err := notes.Search("body", tt.query)
+			if err != nil {
+				t.Fatalf("Search failed: %v", err)
+			}
+			if len(results) != len(tt.expected) {
+				t.Fatalf("Expected %d results, got %v", len(tt.expected), results)
+			}
+			for i, id := range tt.expected {
+				if results[i].ID != id {
+					t.Errorf("Result %d: expected id=%s, got %s", i, id, results[i].ID)
+				}
+			}
+		})
+	}
+
+	notes.Insert(Document{"id": "4", "body": "An elephant never forgets"})
+	notes.Commit()
+	notes.Delete("3")
+
+	if results, _ := notes.Search("body", "elephant"); len(results) != 1 || results[0].ID != "4" {
+		t.Errorf("Expected committed doc 4 to be searchable, got %v", results)
+	}
+	if results, _ := notes.Search("body", "databases"); len(results) != 0 {
+		t.Errorf("Expected deleted doc 3 to be gone from the index, got %v", results)
+	}
+
+	if _, err := notes.Search("title", "fox"); err == nil {
+		t.Error("Expected error when searching a field without a text index")
+	}
+}
@@ -0,0 +1,207 @@
+package db
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+)
+
+// Storage is the file system a database keeps its data directory in. The
+// DB and its collections do all their I/O through it, so a database can
+// live in memory, see NewMemoryStorage, or on a backend supplied by the
+// application. Paths are the data directory joined with file names by
+// filepath.Join. Errors for missing files must satisfy os.IsNotExist.
+//
+// Restores and point-in-time recovery write to directories on the local
+// file system, and followers and cluster members need OSStorage.
+type Storage interface {
+	// OpenFile opens a file like os.OpenFile, with the flags O_RDONLY,
+	// O_WRONLY, O_RDWR, O_CREATE, O_EXCL and O_APPEND.
+	OpenFile(name string, flag int, perm fs.FileMode) (File, error)
+	Stat(name string) (fs.FileInfo, error)
+	// ReadDir returns the entries of a directory sorted by name.
+	ReadDir(name string) ([]fs.DirEntry, error)
+	MkdirAll(path string, perm fs.FileMode) error
+	// Remove removes a file or an empty directory.
+	Remove(name string) error
+	// Rename replaces newpath with oldpath atomically, so that a crash
+	// leaves one or the other.
+	Rename(oldpath, newpath string) error
+	// SyncDir makes the renames and removals in a directory durable.
+	SyncDir(name string) error
+	// Lock locks a file or directory without waiting for it, exclusively
+	// or shared with other shared locks, until the returned Closer is
+	// closed. It fails with ErrLocked if the lock is held in a way that
+	// conflicts.
+	Lock(name string, shared bool) (io.Closer, error)
+}
+
+// File is an open file of a Storage.
+type File interface {
+	io.Reader
+	io.ReaderAt
+	io.Writer
+	io.WriterAt
+	io.Seeker
+	io.Closer
+	Stat() (fs.FileInfo, error)
+	Sync() error
+	Truncate(size int64) error
+}
+
+// OSStorage keeps databases on the local file system.
+type OSStorage struct{}
+
+func (OSStorage) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+	f, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		// Avoid a non-nil File holding a nil *os.File.
+		return nil, err
+	}
+	return f, nil
+}
+
+func (OSStorage) Stat(name string) (fs.FileInfo, error)      { return os.Stat(name) }
+func (OSStorage) ReadDir(name string) ([]fs.DirEntry, error) { return os.ReadDir(name) }
+func (OSStorage) MkdirAll(path string, perm fs.FileMode) error {
+	return os.MkdirAll(path, perm)
+}
+func (OSStorage) Remove(name string) error             { return os.Remove(name) }
+func (OSStorage) Rename(oldpath, newpath string) error { return os.Rename(oldpath, newpath) }
+
+func (OSStorage) SyncDir(name string) error {
+	d, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("could not sync %s: %w", name, err)
+	}
+	return nil
+}
+
+func (OSStorage) Lock(name string, shared bool) (io.Closer, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(f, shared); err != nil {
+		f.Close()
+		if errors.Is(err, errWouldBlock) {
+			return nil, ErrLocked
+		}
+		return nil, fmt.Errorf("could not lock %s: %w", name, err)
+	}
+	return osLock{f}, nil
+}
+
+type osLock struct {
+	file *os.File
+}
+
+func (l osLock) Close() error {
+	unlockFile(l.file)
+	return l.file.Close()
+}
+
+// ErrUnsupportedStorage is returned by what keeps its files on the local
+// file system, such as followers, when Config.Storage is another storage.
+var ErrUnsupportedStorage = errors.New("only OSStorage is supported")
+
+// checkOSStorage returns ErrUnsupportedStorage, naming what needs it, if
+// config asks for a storage other than OSStorage.
+func checkOSStorage(config Config, what string) error {
+	if config.Storage != nil && !isOSStorage(config.Storage) {
+		return fmt.Errorf("%s: %w", what, ErrUnsupportedStorage)
+	}
+	return nil
+}
+
+// storageOf returns the storage config asks for.
+func storageOf(config Config) Storage {
+	if config.Storage == nil {
+		return OSStorage{}
+	}
+	return config.Storage
+}
+
+func isOSStorage(st Storage) bool {
+	_, ok := st.(OSStorage)
+	return ok
+}
+
+func readFile(st Storage, name string) ([]byte, error) {
+	f, err := st.OpenFile(name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+// createTemp creates a new file in dir whose name is pattern with its last
+// '*' replaced by a random string, like os.CreateTemp, and returns it with
+// its path.
+func createTemp(st Storage, dir, pattern string) (File, string, error) {
+	prefix, suffix := pattern, ""
+	if i := strings.LastIndex(pattern, "*"); i >= 0 {
+		prefix, suffix = pattern[:i], pattern[i+1:]
+	}
+	for try := 0; ; try++ {
+		var random [6]byte
+		if _, err := rand.Read(random[:]); err != nil {
+			return nil, "", err
+		}
+		path := filepath.Join(dir, prefix+hex.EncodeToString(random[:])+suffix)
+		f, err := st.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+		if errors.Is(err, fs.ErrExist) && try < 10 {
+			continue
+		}
+		return f, path, err
+	}
+}
+
+// writeFileAtomic replaces the file at path with data by writing it to a
+// temporary file and renaming that into place, so a crash leaves either
+// the old or the new contents.
+func writeFileAtomic(st Storage, path string, data []byte) error {
+	tmp, tmpPath, err := createTemp(st, filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer st.Remove(tmpPath)
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return st.Rename(tmpPath, path)
+}
+
+// sameFile reports whether two FileInfos describe the same file, as
+// os.SameFile does for OSStorage. Other storages identify a file by the
+// value of FileInfo.Sys.
+func sameFile(a, b fs.FileInfo) bool {
+	if os.SameFile(a, b) {
+		return true
+	}
+	sa, sb := a.Sys(), b.Sys()
+	if sa == nil || !reflect.TypeOf(sa).Comparable() {
+		return false
+	}
+	return sa == sb
+}
@@ -0,0 +1,183 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Al3x-Myku/FlyDB/pkg/toon"
+)
+
+func TestMemoryStorage(t *testing.T) {
+	dataDir := "./test-memory"
+	storage := NewMemoryStorage()
+	config := DefaultConfig
+	config.Storage = storage
+
+	db, err := NewDBWithConfig(dataDir, config)
+	if err != nil {
+		t.Fatalf("NewDB failed: %v", err)
+	}
+	items, _ := db.GetCollection("items")
+	for _, id := range []string{"a", "b", "c"} {
+		items.Insert(Document{"id": id, "n": 1})
+	}
+	items.Commit()
+	items.Update("a", Document{"id": "a", "n": 2})
+	items.Delete("b")
+	if err := items.Compact(); err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+	scratch, _ := db.GetCollection("scratch")
+	scratch.Insert(Document{"id": "x"})
+	scratch.Commit()
+	if err := db.DeleteCollection("scratch"); err != nil {
+		t.Fatalf("DeleteCollection failed: %v", err)
+	}
+
+	// The data directory is locked on the storage, as it is on disk.
+	if _, err := NewDBWithConfig(dataDir, config); !errors.Is(err, ErrLocked) {
+		t.Errorf("Expected a second writer to fail with ErrLocked, got %v", err)
+	}
+	readConfig := config
+	readConfig.ReadOnly = true
+	reader, err := NewDBWithConfig(dataDir, readConfig)
+	if err != nil {
+		t.Fatalf("Read-only open failed: %v", err)
+	}
+	ro, _ := reader.GetCollection("items")
+	items.Insert(Document{"id": "d", "n": 3})
+	items.Commit()
+	if changed, err := ro.Refresh(); !changed || err != nil {
+		t.Errorf("Expected the reader to see the commit, got %v, %v", changed, err)
+	}
+	if n := len(mustAll(t, ro)); n != 3 {
+		t.Errorf("Expected 3 documents in the reader, got %d", n)
+	}
+	reader.Close()
+
+	var archive bytes.Buffer
+	if _, err := db.Backup(&archive); err != nil {
+		t.Fatalf("Backup failed: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	// The storage outlives the database.
+	db, err = NewDBWithConfig(dataDir, config)
+	if err != nil {
+		t.Fatalf("Reopen failed: %v", err)
+	}
+	defer db.Close()
+	names, _ := db.ListCollections()
+	if len(names) != 1 || names[0] != "items" {
+		t.Errorf("Expected only items after reopening, got %v", names)
+	}
+	items, _ = db.GetCollection("items")
+	if doc, err := items.FindByID("a"); err != nil || doc["n"] != int64(2) {
+		t.Errorf("Expected the updated document, got %v, %v", doc, err)
+	}
+	if _, err := items.FindByID("b"); err == nil {
+		t.Errorf("Expected the deleted document to stay deleted")
+	}
+	if n := len(mustAll(t, items)); n != 3 {
+		t.Errorf("Expected 3 documents after reopening, got %d", n)
+	}
+
+	// Legacy files are upgraded in place.
+	legacy, _ := toon.Encode("old", []Document{{"id": "a"}})
+	f, _ := storage.OpenFile(filepath.Join(dataDir, "old.toon"), os.O_WRONLY|os.O_CREATE, 0644)
+	f.Write(legacy)
+	f.Close()
+	if upgraded, err := db.Upgrade(); err != nil || len(upgraded) != 1 {
+		t.Errorf("Expected old to be upgraded, got %v, %v", upgraded, err)
+	}
+	old, _ := db.GetCollection("old")
+	if _, err := old.FindByID("a"); err != nil {
+		t.Errorf("FindByID after Upgrade failed: %v", err)
+	}
+
+	if _, err := os.Stat(dataDir); !os.IsNotExist(err) {
+		t.Errorf("Memory storage created the data dir on disk")
+	}
+	if archive.Len() == 0 {
+		t.Errorf("Expected a backup of the memory database")
+	}
+}
+
+func TestMemoryStorageLeader(t *testing.T) {
+	followerDir := "./test-memory-follower"
+	defer os.RemoveAll(followerDir)
+
+	storage := NewMemoryStorage()
+	config := DefaultConfig
+	config.Storage = storage
+	config.MutationLog = true
+	leader, err := NewDBWithConfig("./test-memory-leader", config)
+	if err != nil {
+		t.Fatalf("NewDB failed: %v", err)
+	}
+	defer leader.Close()
+	items, _ := leader.GetCollection("items")
+	items.Insert(Document{"id": "a"})
+	items.Commit()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer ln.Close()
+	go leader.ServeReplication(ln)
+
+	// The snapshot a new follower starts from is buffered in the storage.
+	follower, err := Follow(followerDir, ln.Addr().String(), DefaultConfig)
+	if err != nil {
+		t.Fatalf("Follow failed: %v", err)
+	}
+	defer follower.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := follower.WaitFor(ctx, leader.LogSeq()); err != nil {
+		t.Fatalf("WaitFor failed: %v", err)
+	}
+	replica, _ := follower.DB().GetCollection("items")
+	if _, err := replica.FindByID("a"); err != nil {
+		t.Errorf("Expected the snapshot to reach the follower: %v", err)
+	}
+
+	entries, _ := storage.ReadDir("./test-memory-leader")
+	for _, e := range entries {
+		if strings.HasSuffix(e.Name(), ".tmp") {
+			t.Errorf("Snapshot file %s was left behind", e.Name())
+		}
+	}
+	if _, err := os.Stat("./test-memory-leader"); !os.IsNotExist(err) {
+		t.Errorf("Memory storage created the data dir on disk")
+	}
+}
+
+func TestLocalOnlyRejectStorage(t *testing.T) {
+	config := DefaultConfig
+	config.Storage = NewMemoryStorage()
+	defer os.RemoveAll("./test-memory-local")
+
+	if _, err := Follow("./test-memory-local", "127.0.0.1:1", config); !errors.Is(err, ErrUnsupportedStorage) {
+		t.Errorf("Expected Follow to fail with ErrUnsupportedStorage, got %v", err)
+	}
+	if _, err := OpenCluster("./test-memory-local", config, ClusterConfig{ID: "a"}); !errors.Is(err, ErrUnsupportedStorage) {
+		t.Errorf("Expected OpenCluster to fail with ErrUnsupportedStorage, got %v", err)
+	}
+	if _, err := RecoverWithConfig("./test-memory-local", "mutations.log", RecoveryTarget{}, config); !errors.Is(err, ErrUnsupportedStorage) {
+		t.Errorf("Expected RecoverWithConfig to fail with ErrUnsupportedStorage, got %v", err)
+	}
+	if _, err := os.Stat("./test-memory-local"); !os.IsNotExist(err) {
+		t.Errorf("Expected nothing to be written to disk")
+	}
+}
@@ -0,0 +1,394 @@
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Al3x-Myku/FlyDB/pkg/query"
+)
+
+var ErrNoIDField = errors.New("struct has no id field")
+
+// TypedCollection stores values of a struct type T in a collection. Fields
+// are mapped with `toon` struct tags, which work like encoding/json's:
+//
+//	type User struct {
+//		ID      string    `toon:"id"`
+//		Name    string    `toon:"name"`
+//		Age     int       `toon:"age,omitempty"`
+//		Created time.Time `toon:"created"`
+//		Secret  string    `toon:"-"`
+//	}
+//
+// The field stored as "id" holds the document ID; a field can also be marked
+// with the id option (`toon:"user_id,id"`), and an untagged field named ID
+// is used if nothing else is. Untagged fields keep their Go name.
+//
+// Values read back from disk are converted to the field's type: numbers to
+// any integer or float kind (failing on overflow or a fractional integer),
+// time.Time from RFC 3339 text, and strings from whatever the stored text
+// was inferred as (so "0123" or "3.10" in a string field read back as "123"
+// and "3.1"). Slices, maps and nested structs are stored as JSON text.
+type TypedCollection[T any] struct {
+	c     *Collection
+	codec *structCodec
+}
+
+// NewTypedCollection wraps c for values of type T, which must be a struct
+// with an id field.
+func NewTypedCollection[T any](c *Collection) (*TypedCollection[T], error) {
+	codec, err := newStructCodec(reflect.TypeOf((*T)(nil)).Elem())
+	if err != nil {
+		return nil, err
+	}
+	return &TypedCollection[T]{c: c, codec: codec}, nil
+}
+
+// Typed opens the named collection of db as a TypedCollection.
+func Typed[T any](db *DB, name string) (*TypedCollection[T], error) {
+	c, err := db.GetCollection(name)
+	if err != nil {
+		return nil, err
+	}
+	return NewTypedCollection[T](c)
+}
+
+// Collection returns the underlying untyped collection.
+func (t *TypedCollection[T]) Collection() *Collection {
+	return t.c
+}
+
+// Insert stores v and returns its ID. If v's ID field is empty, the
+// collection's IDStrategy generates one.
+func (t *TypedCollection[T]) Insert(v T) (string, error) {
+	doc, err := t.codec.encode(reflect.ValueOf(v))
+	if err != nil {
+		return "", err
+	}
+	return t.c.Insert(doc)
+}
+
+// Update replaces the stored document with the ID held by v.
+func (t *TypedCollection[T]) Update(v T) error {
+	doc, err := t.codec.encode(reflect.ValueOf(v))
+	if err != nil {
+		return err
+	}
+	id, ok := doc["id"]
+	if !ok {
+		return ErrMissingID
+	}
+	return t.c.Update(fmt.Sprint(id), doc)
+}
+
+func (t *TypedCollection[T]) Delete(id string) error {
+	return t.c.Delete(id)
+}
+
+func (t *TypedCollection[T]) Commit() error {
+	return t.c.Commit()
+}
+
+func (t *TypedCollection[T]) FindByID(id string) (T, error) {
+	var v T
+	doc, err := t.c.FindByID(id)
+	if err != nil {
+		return v, err
+	}
+	err = t.codec.decode(doc, reflect.ValueOf(&v).Elem())
+	return v, err
+}
+
+func (t *TypedCollection[T]) All() ([]T, error) {
+	docs, err := t.c.All()
+	if err != nil {
+		return nil, err
+	}
+	return t.decodeAll(docs)
+}
+
+// Find returns the values whose documents match q. Filters refer to the
+// stored field names, not the Go field names.
+func (t *TypedCollection[T]) Find(q query.Expr) ([]T, error) {
+	return t.FindWithOptions(q, query.Options{})
+}
+
+func (t *TypedCollection[T]) FindWithOptions(q query.Expr, opts query.Options) ([]T, error) {
+	docs, err := t.c.FindWithOptions(q, opts)
+	if err != nil {
+		return nil, err
+	}
+	return t.decodeAll(docs)
+}
+
+func (t *TypedCollection[T]) decodeAll(docs []Document) ([]T, error) {
+	out := make([]T, len(docs))
+	for i, doc := range docs {
+		if err := t.codec.decode(doc, reflect.ValueOf(&out[i]).Elem()); err != nil {
+			return nil, fmt.Errorf("document %v: %w", doc["id"], err)
+		}
+	}
+	return out, nil
+}
+
+type structField struct {
+	name      string
+	index     []int
+	omitEmpty bool
+}
+
+type structCodec struct {
+	typ    reflect.Type
+	fields []structField
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+func newStructCodec(typ reflect.Type) (*structCodec, error) {
+	if typ.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("typed collection needs a struct type, got %s", typ)
+	}
+
+	codec := &structCodec{typ: typ}
+	idField := -1
+	fallbackID := -1
+	seen := make(map[string]bool)
+
+	for _, f := range reflect.VisibleFields(typ) {
+		if !f.IsExported() || f.Anonymous {
+			continue
+		}
+		tag := f.Tag.Get("toon")
+		if tag == "-" {
+			continue
+		}
+
+		name, opts, _ := strings.Cut(tag, ",")
+		if name == "" {
+			name = f.Name
+		}
+		field := structField{name: name, index: f.Index}
+		for _, opt := range strings.Split(opts, ",") {
+			switch opt {
+			case "omitempty":
+				field.omitEmpty = true
+			case "id":
+				field.name = "id"
+			}
+		}
+
+		if seen[field.name] {
+			return nil, fmt.Errorf("%s: field name %q used twice", typ, field.name)
+		}
+		seen[field.name] = true
+
+		switch {
+		case field.name == "id":
+			idField = len(codec.fields)
+		case tag == "" && f.Name == "ID":
+			fallbackID = len(codec.fields)
+		}
+		codec.fields = append(codec.fields, field)
+	}
+
+	if idField < 0 {
+		if fallbackID < 0 {
+			return nil, fmt.Errorf("%s: %w", typ, ErrNoIDField)
+		}
+		idField = fallbackID
+		codec.fields[idField].name = "id"
+	}
+	codec.fields[idField].omitEmpty = true
+
+	return codec, nil
+}
+
+func (sc *structCodec) encode(v reflect.Value) (Document, error) {
+	doc := make(Document, len(sc.fields))
+	for _, f := range sc.fields {
+		fv := v.FieldByIndex(f.index)
+		if f.omitEmpty && fv.IsZero() {
+			continue
+		}
+		val, err := encodeValue(fv)
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %w", f.name, err)
+		}
+		if val != nil {
+			doc[f.name] = val
+		}
+	}
+	return doc, nil
+}
+
+func encodeValue(v reflect.Value) (any, error) {
+	for v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return nil, nil
+		}
+		v = v.Elem()
+	}
+
+	if v.Type() == timeType {
+		return v.Interface().(time.Time).Format(time.RFC3339Nano), nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		return v.String(), nil
+	case reflect.Bool:
+		return v.Bool(), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int(), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint(), nil
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), nil
+	case reflect.Slice, reflect.Map, reflect.Array, reflect.Struct:
+		data, err := json.Marshal(v.Interface())
+		if err != nil {
+			return nil, err
+		}
+		return string(data), nil
+	}
+	return nil, fmt.Errorf("unsupported type %s", v.Type())
+}
+
+func (sc *structCodec) decode(doc Document, v reflect.Value) error {
+	for _, f := range sc.fields {
+		raw, ok := doc[f.name]
+		if !ok || raw == nil {
+			continue
+		}
+		if err := decodeValue(raw, v.FieldByIndex(f.index)); err != nil {
+			return fmt.Errorf("field %s: %w", f.name, err)
+		}
+	}
+	return nil
+}
+
+func decodeValue(raw any, v reflect.Value) error {
+	if v.Kind() == reflect.Pointer {
+		elem := reflect.New(v.Type().Elem())
+		if err := decodeValue(raw, elem.Elem()); err != nil {
+			return err
+		}
+		v.Set(elem)
+		return nil
+	}
+
+	if v.Type() == timeType {
+		s, ok := raw.(string)
+		if !ok {
+			return conversionError(raw, v.Type())
+		}
+		t, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(t))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Interface:
+		v.Set(reflect.ValueOf(raw))
+	case reflect.String:
+		switch x := raw.(type) {
+		case string:
+			v.SetString(x)
+		case float64:
+			v.SetString(strconv.FormatFloat(x, 'f', -1, 64))
+		default:
+			v.SetString(fmt.Sprint(raw))
+		}
+	case reflect.Bool:
+		switch x := raw.(type) {
+		case bool:
+			v.SetBool(x)
+		case string:
+			b, err := strconv.ParseBool(x)
+			if err != nil {
+				return conversionError(raw, v.Type())
+			}
+			v.SetBool(b)
+		default:
+			return conversionError(raw, v.Type())
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, ok := toInt(raw)
+		if !ok || v.OverflowInt(n) {
+			return conversionError(raw, v.Type())
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		n, ok := toUint(raw)
+		if !ok || v.OverflowUint(n) {
+			return conversionError(raw, v.Type())
+		}
+		v.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		f, ok := toNumber(raw)
+		if !ok || v.OverflowFloat(f) {
+			return conversionError(raw, v.Type())
+		}
+		v.SetFloat(f)
+	case reflect.Slice, reflect.Map, reflect.Array, reflect.Struct:
+		s, ok := raw.(string)
+		if !ok {
+			return conversionError(raw, v.Type())
+		}
+		if err := json.Unmarshal([]byte(s), v.Addr().Interface()); err != nil {
+			return fmt.Errorf("cannot decode %s: %w", v.Type(), err)
+		}
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+	return nil
+}
+
+// toNumber accepts both stored numbers and the values a caller may still
+// hold in the memtable, normalized the same way a commit would.
+func toNumber(raw any) (float64, bool) {
+	switch x := query.Normalize(raw).(type) {
+	case int64:
+		return float64(x), true
+	case float64:
+		return x, true
+	}
+	return 0, false
+}
+
+func toInt(raw any) (int64, bool) {
+	switch x := query.Normalize(raw).(type) {
+	case int64:
+		return x, true
+	case float64:
+		if x == math.Trunc(x) && x >= math.MinInt64 && x < math.MaxInt64 {
+			return int64(x), true
+		}
+	}
+	return 0, false
+}
+
+func toUint(raw any) (uint64, bool) {
+	switch x := query.Normalize(raw).(type) {
+	case int64:
+		return uint64(x), x >= 0
+	case float64:
+		if x == math.Trunc(x) && x >= 0 && x < math.MaxUint64 {
+			return uint64(x), true
+		}
+	}
+	return 0, false
+}
+
+func conversionError(raw any, typ reflect.Type) error {
+	return fmt.Errorf("cannot convert %v (%T) to %s", raw, raw, typ)
+}
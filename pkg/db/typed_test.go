@@ -0,0 +1,123 @@
+package db
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Al3x-Myku/FlyDB/pkg/query"
+)
+
+type typedAddress struct {
+	City string `json:"city"`
+}
+
+type typedUser struct {
+	UserID  string        `toon:"user_id,id"`
+	Name    string        `toon:"name"`
+	Age     int8          `toon:"age"`
+	Score   float32       `toon:"score,omitempty"`
+	Visits  uint          `toon:"visits"`
+	Admin   bool          `toon:"admin"`
+	Zip     string        `toon:"zip"`
+	Joined  time.Time     `toon:"joined"`
+	Tags    []string      `toon:"tags,omitempty"`
+	Address *typedAddress `toon:"address,omitempty"`
+	Nick    *string       `toon:"nick,omitempty"`
+	Secret  string        `toon:"-"`
+}
+
+func TestTypedCollection(t *testing.T) {
+	dataDir := "./test-typed"
+	defer os.RemoveAll(dataDir)
+
+	db, _ := NewDB(dataDir)
+	defer db.Close()
+
+	users, err := Typed[typedUser](db, "users")
+	if err != nil {
+		t.Fatalf("Typed failed: %v", err)
+	}
+
+	joined := time.Date(2024, 5, 1, 12, 30, 0, 123, time.UTC)
+	alice := typedUser{
+		UserID: "alice", Name: "Alice", Age: 30, Score: 1.5, Visits: 7, Admin: true,
+		Zip: "10115", Joined: joined, Tags: []string{"a", "b"},
+		Address: &typedAddress{City: "Oslo"}, Secret: "hidden",
+	}
+	bob := typedUser{UserID: "bob", Name: "Bob", Age: 25, Zip: "90210", Joined: joined}
+
+	for _, u := range []typedUser{alice, bob} {
+		if _, err := users.Insert(u); err != nil {
+			t.Fatalf("Insert failed: %v", err)
+		}
+	}
+	if _, err := users.Insert(typedUser{Name: "NoID"}); err != ErrMissingID {
+		t.Errorf("Expected ErrMissingID, got %v", err)
+	}
+
+	raw, _ := users.Collection().FindByID("alice")
+	if _, ok := raw["Secret"]; ok {
+		t.Errorf("Skipped field was stored: %v", raw)
+	}
+
+	// Check both the memtable and the committed copies.
+	for _, stage := range []string{"memtable", "committed"} {
+		if stage == "committed" {
+			users.Commit()
+		}
+
+		got, err := users.FindByID("alice")
+		if err != nil {
+			t.Fatalf("%s: FindByID failed: %v", stage, err)
+		}
+		want := alice
+		want.Secret = ""
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: expected %+v, got %+v", stage, want, got)
+		}
+
+		found, err := users.FindWithOptions(query.Eq("admin", false), query.Options{})
+		if err != nil || len(found) != 1 || found[0].Name != "Bob" || found[0].Zip != "90210" {
+			t.Errorf("%s: unexpected Find result %+v, %v", stage, found, err)
+		}
+	}
+
+	bob.Age = 26
+	if err := users.Update(bob); err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+	all, err := users.All()
+	if err != nil || len(all) != 2 {
+		t.Fatalf("All returned %v, %v", all, err)
+	}
+
+	users.Collection().Insert(Document{"id": "carol", "age": 300})
+	if _, err := users.FindByID("carol"); err == nil {
+		t.Errorf("Expected an overflow error for age 300")
+	}
+}
+
+func TestTypedCollectionNeedsID(t *testing.T) {
+	type noID struct {
+		Name string `toon:"name"`
+	}
+	if _, err := NewTypedCollection[noID](nil); !errors.Is(err, ErrNoIDField) {
+		t.Errorf("Expected ErrNoIDField, got %v", err)
+	}
+
+	type plainID struct {
+		ID   int
+		Name string
+	}
+	codec, err := newStructCodec(reflect.TypeOf(plainID{}))
+	if err != nil {
+		t.Fatalf("newStructCodec failed: %v", err)
+	}
+	doc, _ := codec.encode(reflect.ValueOf(plainID{ID: 4, Name: "x"}))
+	if doc["id"] != int64(4) || doc["Name"] != "x" {
+		t.Errorf("Unexpected encoding %v", doc)
+	}
+}
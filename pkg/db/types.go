@@ -2,6 +2,7 @@ package db
 
 import (
 	"errors"
+	"time"
 
 	"github.com/Al3x-Myku/FlyDB/pkg/toon"
 )
@@ -14,7 +15,57 @@ type BlockInfo struct {
 }
 
 type Config struct {
+	// Compression gzips new blocks. Codec chooses another codec by name,
+	// such as "zlib" or "gzip:9", and takes precedence.
 	Compression bool
+	Codec       string
+
+	// ChangeHistory is how many change events are kept in memory for
+	// change streams to resume from. Zero uses a default of 4096.
+	ChangeHistory int
+
+	// IDStrategy fills in the id of inserted documents that lack one.
+	// Collections can override it with SetIDStrategy.
+	IDStrategy IDStrategy
+
+	// MutationLog keeps a log of every committed change in the data
+	// directory, so Recover can rebuild the database as of any moment
+	// after a backup. The log is never trimmed.
+	MutationLog bool
+
+	// ReplicationBacklog is how many mutation log records are kept in
+	// memory for followers to catch up from. A follower further behind
+	// is sent a snapshot instead. Zero uses a default of 4096.
+	ReplicationBacklog int
+
+	// EncryptionKey turns on AES-GCM encryption of every block written,
+	// with a 16, 24 or 32 byte key. KeyProvider does the same with keys
+	// that can be rotated; set one or the other. The mutation log, the
+	// cluster log and backup manifests are encrypted with the same keys.
+	// Collection metadata, such as schemas, is not.
+	EncryptionKey []byte
+	KeyProvider   KeyProvider
+
+	// FieldKeyProvider supplies the keys for the fields each collection
+	// lists with SetEncryptedFields. It is independent of the keys above:
+	// without it, encrypted fields are read as ciphertext and plaintext
+	// values for them are rejected.
+	FieldKeyProvider KeyProvider
+
+	// ReadOnly opens the database for reading only: collection files are
+	// opened read-only, nothing is created in the data directory, and
+	// writes fail with ErrReadOnly. Unlike a writer, it can open a data
+	// directory another process is writing to. MutationLog is ignored.
+	ReadOnly bool
+
+	// RefreshInterval makes a read-only database check its open
+	// collections this often for what the writer has committed since, as
+	// Collection.Refresh does. Zero leaves them as they were when opened.
+	RefreshInterval time.Duration
+
+	// Storage is where the data directory is kept. Nil uses OSStorage;
+	// NewMemoryStorage keeps the database in memory.
+	Storage Storage
 }
 
 var DefaultConfig = Config{
@@ -27,4 +78,6 @@ var (
 	ErrMissingID = toon.ErrMissingID
 
 	ErrCollectionClosed = errors.New("collection is closed")
+
+	ErrReadOnly = errors.New("database is read-only")
 )
@@ -0,0 +1,127 @@
+package db
+
+import (
+	"errors"
+
+	"github.com/Al3x-Myku/FlyDB/pkg/schema"
+)
+
+// InvalidDocument is a stored document that does not satisfy the
+// collection's schema.
+type InvalidDocument struct {
+	ID         string
+	Violations []schema.Violation
+}
+
+// SetSchema attaches a schema to the collection and persists it in the
+// collection's metadata. Every later Insert, Update and Patch is checked
+// against it; documents already stored are not, see ValidateExisting. A nil
+// schema removes validation.
+func (c *Collection) SetSchema(s *schema.Schema) error {
+	if err := c.checkWritable(); err != nil {
+		return err
+	}
+	if s != nil {
+		if err := s.Compile(); err != nil {
+			return err
+		}
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.file == nil {
+		return ErrCollectionClosed
+	}
+
+	previous := c.meta.Schema
+	c.meta.Schema = s
+	if err := c.saveMetaInternal(); err != nil {
+		c.meta.Schema = previous
+		return err
+	}
+	return nil
+}
+
+func (c *Collection) Schema() *schema.Schema {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.meta.Schema
+}
+
+func (c *Collection) validateInternal(doc Document) error {
+	if c.meta.Schema == nil {
+		return nil
+	}
+	return c.meta.Schema.Validate(doc)
+}
+
+// validatePatchInternal checks a document made by Patch. Its other fields
+// were read back from disk, where a string such as "02134" may come back
+// as a number, so only the patched ones are checked strictly. A nil
+// patched checks the whole document as validateInternal does.
+func (c *Collection) validatePatchInternal(doc Document, patched map[string]bool) error {
+	if c.meta.Schema == nil {
+		return nil
+	}
+	if patched == nil {
+		return c.meta.Schema.Validate(doc)
+	}
+	return c.meta.Schema.ValidatePatch(doc, patched)
+}
+
+// ValidateExisting checks every document in the collection against its
+// schema and returns those that fail, in scan order. Committed documents are
+// checked with schema.ValidateStored.
+func (c *Collection) ValidateExisting() ([]InvalidDocument, error) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	if c.file == nil {
+		return nil, ErrCollectionClosed
+	}
+
+	s := c.meta.Schema
+	if s == nil {
+		return nil, nil
+	}
+
+	var invalid []InvalidDocument
+	record := func(id string, err error) error {
+		var verr *schema.ValidationError
+		if errors.As(err, &verr) {
+			invalid = append(invalid, InvalidDocument{ID: id, Violations: verr.Violations})
+			return nil
+		}
+		return err
+	}
+
+	seen := make(map[string]bool)
+	err := c.scanMemtable(func(id string, doc Document) error {
+		seen[id] = true
+		doc, err := c.decryptFields(c.meta.EncryptedFields, doc)
+		if err != nil {
+			return err
+		}
+		return record(id, s.Validate(doc))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.scanBlocks(func(id string, doc Document) error {
+		if seen[id] {
+			return nil
+		}
+		doc, err := c.decryptFields(c.meta.EncryptedFields, doc)
+		if err != nil {
+			return err
+		}
+		return record(id, s.ValidateStored(doc))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return invalid, nil
+}
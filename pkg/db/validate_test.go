@@ -0,0 +1,108 @@
+package db
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/Al3x-Myku/FlyDB/pkg/schema"
+)
+
+func TestSchemaValidation(t *testing.T) {
+	dataDir := "./test-schema"
+	defer os.RemoveAll(dataDir)
+
+	db, _ := NewDB(dataDir)
+	users, _ := db.GetCollection("users")
+
+	users.Insert(Document{"id": "legacy", "name": "Old"})
+	users.Commit()
+
+	s, err := schema.Parse([]byte(`{
+		"properties": {
+			"email": {"type": "string", "pattern": "@"},
+			"age":   {"type": "integer", "minimum": 0}
+		},
+		"required": ["email"]
+	}`))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if err := users.SetSchema(s); err != nil {
+		t.Fatalf("SetSchema failed: %v", err)
+	}
+
+	var verr *schema.ValidationError
+	if _, err := users.Insert(Document{"id": "bad", "age": -1}); !errors.As(err, &verr) || len(verr.Violations) != 2 {
+		t.Errorf("Expected two violations on insert, got %v", err)
+	}
+	if _, err := users.Insert(Document{"id": "u1", "email": "a@b.c", "age": 3}); err != nil {
+		t.Fatalf("Insert failed: %v", err)
+	}
+	if err := users.Update("u1", Document{"email": "none"}); !errors.As(err, &verr) {
+		t.Errorf("Expected update to be rejected, got %v", err)
+	}
+	users.Commit()
+
+	if err := users.Patch("u1", Document{"age": "old"}); !errors.As(err, &verr) {
+		t.Errorf("Expected patch to be rejected, got %v", err)
+	}
+	if err := users.Patch("u1", Document{"age": nil, "name": "Al"}); err != nil {
+		t.Fatalf("Patch failed: %v", err)
+	}
+	doc, _ := users.FindByID("u1")
+	if _, ok := doc["age"]; ok || doc["name"] != "Al" || doc["email"] != "a@b.c" {
+		t.Errorf("Unexpected document after patch: %v", doc)
+	}
+	if err := users.Patch("missing", Document{"a": 1}); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+
+	invalid, err := users.ValidateExisting()
+	if err != nil {
+		t.Fatalf("ValidateExisting failed: %v", err)
+	}
+	if len(invalid) != 1 || invalid[0].ID != "legacy" || invalid[0].Violations[0].Path != "email" {
+		t.Errorf("Expected only legacy to be invalid, got %+v", invalid)
+	}
+
+	// The schema survives a restart.
+	db.Close()
+	db, _ = NewDB(dataDir)
+	defer db.Close()
+	users, _ = db.GetCollection("users")
+	if users.Schema() == nil {
+		t.Fatal("Schema not persisted")
+	}
+	if _, err := users.Insert(Document{"id": "u2"}); !errors.As(err, &verr) {
+		t.Errorf("Expected reloaded schema to be enforced, got %v", err)
+	}
+}
+
+// TestPatchStoredString checks that Patch accepts a committed string field
+// that reads back as a number, while still checking the patched fields.
+func TestPatchStoredString(t *testing.T) {
+	dataDir := "./test-schema-patch"
+	defer os.RemoveAll(dataDir)
+
+	db, _ := NewDB(dataDir)
+	defer db.Close()
+	users, _ := db.GetCollection("users")
+
+	s, _ := schema.Parse([]byte(`{"properties": {"zip": {"type": "string"}, "name": {"type": "string"}}}`))
+	if err := users.SetSchema(s); err != nil {
+		t.Fatalf("SetSchema failed: %v", err)
+	}
+	if _, err := users.Insert(Document{"id": "1", "zip": "02134"}); err != nil {
+		t.Fatalf("Insert failed: %v", err)
+	}
+	users.Commit()
+
+	if err := users.Patch("1", Document{"name": "b"}); err != nil {
+		t.Errorf("Patch of another field failed: %v", err)
+	}
+	var verr *schema.ValidationError
+	if err := users.Patch("1", Document{"name": 3}); !errors.As(err, &verr) {
+		t.Errorf("Expected the patched field to be checked, got %v", err)
+	}
+}
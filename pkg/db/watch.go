@@ -0,0 +1,249 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/Al3x-Myku/FlyDB/pkg/query"
+)
+
+var (
+	// ErrSeqUnavailable is returned when resuming from a sequence number
+	// that is no longer retained, or that this process never issued.
+	ErrSeqUnavailable = errors.New("change sequence no longer available")
+
+	// ErrChangesLost ends a change stream whose consumer fell so far behind
+	// that events it had not yet received were dropped from the history.
+	ErrChangesLost = errors.New("change stream fell behind and lost events")
+)
+
+const (
+	defaultChangeHistory = 4096
+	defaultWatchBuffer   = 64
+)
+
+type ChangeType string
+
+const (
+	ChangeInsert ChangeType = "insert"
+	ChangeUpdate ChangeType = "update"
+	ChangeDelete ChangeType = "delete"
+	ChangeCommit ChangeType = "commit"
+)
+
+// ChangeEvent describes one write. Document is the new version for inserts
+// and updates, and nil for deletes and commits; a commit event has no ID.
+// Events share the document with the collection, so consumers must not
+// modify it.
+type ChangeEvent struct {
+	Seq        uint64
+	Type       ChangeType
+	Collection string
+	ID         string
+	Document   Document
+	Time       time.Time
+}
+
+// WatchOptions configures a change stream. ResumeAfter delivers the retained
+// events with a greater sequence number before any new ones; zero starts
+// with the next write. Buffer is the size of the stream's channel.
+type WatchOptions struct {
+	ResumeAfter uint64
+	Buffer      int
+}
+
+// ChangeStream delivers change events on C until its context is cancelled,
+// the database is closed or the consumer falls too far behind. Once C is
+// closed, Err reports why.
+type ChangeStream struct {
+	C <-chan ChangeEvent
+
+	mu  sync.Mutex
+	err error
+}
+
+func (s *ChangeStream) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// changeFeed numbers every write in the database and keeps the most recent
+// events in memory. Writers only append to the history and never wait for
+// consumers: each stream has its own goroutine that copies events from the
+// history into the stream's buffered channel, so a slow consumer holds up
+// nobody but itself until it drops out of the retained window.
+type changeFeed struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	seq     uint64
+	history []ChangeEvent
+	retain  int
+	closed  bool
+}
+
+func newChangeFeed(retain int) *changeFeed {
+	if retain <= 0 {
+		retain = defaultChangeHistory
+	}
+	f := &changeFeed{retain: retain}
+	f.cond = sync.NewCond(&f.mu)
+	return f
+}
+
+func (f *changeFeed) publish(typ ChangeType, collection, id string, doc Document) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return
+	}
+
+	f.seq++
+	f.history = append(f.history, ChangeEvent{
+		Seq:        f.seq,
+		Type:       typ,
+		Collection: collection,
+		ID:         id,
+		Document:   doc,
+		Time:       time.Now(),
+	})
+	if len(f.history) > f.retain {
+		// Copy rather than reslice so the dropped events can be collected.
+		f.history = append([]ChangeEvent(nil), f.history[len(f.history)-f.retain:]...)
+	}
+	f.cond.Broadcast()
+}
+
+func (f *changeFeed) close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = true
+	f.cond.Broadcast()
+}
+
+// since returns the retained events after seq, or ok=false if some of them
+// have already been dropped. It must be called with f.mu held.
+func (f *changeFeed) since(seq uint64) (events []ChangeEvent, ok bool) {
+	if seq >= f.seq {
+		return nil, true
+	}
+	if len(f.history) == 0 || f.history[0].Seq > seq+1 {
+		return nil, false
+	}
+	start := int(seq + 1 - f.history[0].Seq)
+	return append([]ChangeEvent(nil), f.history[start:]...), true
+}
+
+func (f *changeFeed) watch(ctx context.Context, match func(ChangeEvent) bool, opts WatchOptions) (*ChangeStream, error) {
+	f.mu.Lock()
+	if f.closed {
+		f.mu.Unlock()
+		return nil, ErrCollectionClosed
+	}
+	next := f.seq
+	if opts.ResumeAfter > 0 {
+		if _, ok := f.since(opts.ResumeAfter); !ok || opts.ResumeAfter > f.seq {
+			f.mu.Unlock()
+			return nil, ErrSeqUnavailable
+		}
+		next = opts.ResumeAfter
+	}
+	f.mu.Unlock()
+
+	buffer := opts.Buffer
+	if buffer <= 0 {
+		buffer = defaultWatchBuffer
+	}
+	ch := make(chan ChangeEvent, buffer)
+	stream := &ChangeStream{C: ch}
+
+	// Wake the goroutine below if it is waiting for writes when ctx ends.
+	stop := context.AfterFunc(ctx, func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		f.cond.Broadcast()
+	})
+
+	go func() {
+		defer close(ch)
+		defer stop()
+
+		finish := func(err error) {
+			stream.mu.Lock()
+			stream.err = err
+			stream.mu.Unlock()
+		}
+
+		for {
+			f.mu.Lock()
+			for next >= f.seq && !f.closed && ctx.Err() == nil {
+				f.cond.Wait()
+			}
+			events, ok := f.since(next)
+			closed := f.closed
+			f.mu.Unlock()
+
+			if ctx.Err() != nil {
+				finish(ctx.Err())
+				return
+			}
+			if !ok {
+				finish(ErrChangesLost)
+				return
+			}
+
+			for _, ev := range events {
+				next = ev.Seq
+				if !match(ev) {
+					continue
+				}
+				select {
+				case ch <- ev:
+				case <-ctx.Done():
+					finish(ctx.Err())
+					return
+				}
+			}
+
+			if closed && len(events) == 0 {
+				return
+			}
+		}
+	}()
+
+	return stream, nil
+}
+
+// Watch streams every change in the database. Inserts and updates are only
+// delivered if their document matches filter; deletes and commits are always
+// delivered. Sequence numbers are kept in memory and restart after the
+// database is reopened.
+func (db *DB) Watch(ctx context.Context, filter query.Expr, opts WatchOptions) (*ChangeStream, error) {
+	return db.feed.watch(ctx, func(ev ChangeEvent) bool {
+		return ev.Document == nil || query.Match(filter, ev.Document)
+	}, opts)
+}
+
+// Watch streams the changes to this collection. See DB.Watch.
+func (c *Collection) Watch(ctx context.Context, filter query.Expr, opts WatchOptions) (*ChangeStream, error) {
+	if c.db == nil {
+		return nil, ErrNoDatabase
+	}
+	return c.db.feed.watch(ctx, func(ev ChangeEvent) bool {
+		if ev.Collection != c.name {
+			return false
+		}
+		return ev.Document == nil || query.Match(filter, ev.Document)
+	}, opts)
+}
+
+// publish records a change to this collection. It is a no-op for
+// collections that are not attached to a database.
+func (c *Collection) publish(typ ChangeType, id string, doc Document) {
+	if c.db != nil {
+		c.db.feed.publish(typ, c.name, id, doc)
+	}
+}
@@ -0,0 +1,110 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Al3x-Myku/FlyDB/pkg/query"
+)
+
+func nextEvent(t *testing.T, s *ChangeStream) ChangeEvent {
+	t.Helper()
+	select {
+	case ev, ok := <-s.C:
+		if !ok {
+			t.Fatalf("Stream closed unexpectedly: %v", s.Err())
+		}
+		return ev
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timed out waiting for a change event")
+	}
+	return ChangeEvent{}
+}
+
+func TestWatch(t *testing.T) {
+	dataDir := "./test-watch"
+	defer os.RemoveAll(dataDir)
+
+	db, _ := NewDBWithConfig(dataDir, Config{ChangeHistory: 8})
+	defer db.Close()
+
+	users, _ := db.GetCollection("users")
+	orders, _ := db.GetCollection("orders")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stream, err := users.Watch(ctx, query.Eq("active", true), WatchOptions{})
+	if err != nil {
+		t.Fatalf("Watch failed: %v", err)
+	}
+
+	users.Insert(Document{"id": "u1", "active": true})
+	users.Insert(Document{"id": "u2", "active": false})
+	orders.Insert(Document{"id": "o1", "active": true})
+	users.Update("u2", Document{"active": true})
+	users.Commit()
+	users.Delete("u1")
+
+	want := []struct {
+		typ ChangeType
+		id  string
+	}{
+		{ChangeInsert, "u1"},
+		{ChangeUpdate, "u2"},
+		{ChangeCommit, ""},
+		{ChangeDelete, "u1"},
+	}
+	var last uint64
+	for _, w := range want {
+		ev := nextEvent(t, stream)
+		if ev.Type != w.typ || ev.ID != w.id || ev.Collection != "users" {
+			t.Fatalf("Expected %s %q, got %+v", w.typ, w.id, ev)
+		}
+		if ev.Seq <= last {
+			t.Errorf("Sequence numbers not increasing: %d after %d", ev.Seq, last)
+		}
+		last = ev.Seq
+	}
+
+	// Resuming replays everything after the given sequence number.
+	all, err := db.Watch(ctx, nil, WatchOptions{ResumeAfter: 2})
+	if err != nil {
+		t.Fatalf("Resume failed: %v", err)
+	}
+	for _, id := range []string{"o1", "u2", "", "u1"} {
+		if ev := nextEvent(t, all); ev.ID != id {
+			t.Fatalf("Expected %q on resume, got %+v", id, ev)
+		}
+	}
+
+	if _, err := db.Watch(ctx, nil, WatchOptions{ResumeAfter: 100}); !errors.Is(err, ErrSeqUnavailable) {
+		t.Errorf("Expected ErrSeqUnavailable for a future sequence, got %v", err)
+	}
+
+	cancel()
+	for range stream.C {
+	}
+	if !errors.Is(stream.Err(), context.Canceled) {
+		t.Errorf("Expected context.Canceled, got %v", stream.Err())
+	}
+
+	// A consumer that stops reading loses its place once the history moves
+	// past it, without blocking writers.
+	slow, _ := users.Watch(context.Background(), nil, WatchOptions{Buffer: 1})
+	for i := 0; i < 20; i++ {
+		users.Insert(Document{"id": fmt.Sprintf("bulk%d", i)})
+	}
+	if _, err := db.Watch(context.Background(), nil, WatchOptions{ResumeAfter: 1}); !errors.Is(err, ErrSeqUnavailable) {
+		t.Errorf("Expected ErrSeqUnavailable for a dropped sequence, got %v", err)
+	}
+	for range slow.C {
+	}
+	if !errors.Is(slow.Err(), ErrChangesLost) {
+		t.Errorf("Expected ErrChangesLost, got %v", slow.Err())
+	}
+}
@@ -0,0 +1,378 @@
+package query
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/Al3x-Myku/FlyDB/pkg/toon"
+)
+
+type AccumulatorOp string
+
+const (
+	AccCount         AccumulatorOp = "count"
+	AccSum           AccumulatorOp = "sum"
+	AccAvg           AccumulatorOp = "avg"
+	AccMin           AccumulatorOp = "min"
+	AccMax           AccumulatorOp = "max"
+	AccCountDistinct AccumulatorOp = "count_distinct"
+	AccFirst         AccumulatorOp = "first"
+	AccLast          AccumulatorOp = "last"
+)
+
+// Accumulator computes one output field per group. Field may be empty only
+// for count, in which case every document in the group is counted; otherwise
+// documents where Field is missing or null are ignored. As names the output
+// field and defaults to op_field (or just "count").
+type Accumulator struct {
+	Op    AccumulatorOp
+	Field string
+	As    string
+}
+
+func (a Accumulator) Name() string {
+	if a.As != "" {
+		return a.As
+	}
+	if a.Field == "" {
+		return string(a.Op)
+	}
+	return string(a.Op) + "_" + a.Field
+}
+
+func (a Accumulator) String() string {
+	s := fmt.Sprintf("%s(%s)", a.Op, a.Field)
+	if a.As != "" {
+		s += " AS " + a.As
+	}
+	return s
+}
+
+// Aggregation groups the documents matching Filter by the GroupBy fields and
+// computes the accumulators for each group. With no GroupBy fields the whole
+// result set forms a single group.
+type Aggregation struct {
+	Filter       Expr
+	GroupBy      []string
+	Accumulators []Accumulator
+}
+
+func (a *Aggregation) Validate() error {
+	if len(a.Accumulators) == 0 {
+		return fmt.Errorf("aggregation needs at least one accumulator")
+	}
+
+	names := make(map[string]bool)
+	for _, f := range a.GroupBy {
+		names[f] = true
+	}
+	for _, acc := range a.Accumulators {
+		switch acc.Op {
+		case AccCount:
+		case AccSum, AccAvg, AccMin, AccMax, AccCountDistinct, AccFirst, AccLast:
+			if acc.Field == "" {
+				return fmt.Errorf("%s requires a field", acc.Op)
+			}
+		default:
+			return fmt.Errorf("unknown accumulator %q", acc.Op)
+		}
+		if names[acc.Name()] {
+			return fmt.Errorf("duplicate output field %q", acc.Name())
+		}
+		names[acc.Name()] = true
+	}
+	return nil
+}
+
+type accState struct {
+	count    int64
+	intSum   int64
+	floatSum float64
+	isFloat  bool
+	best     any
+	seen     bool
+	distinct map[string]bool
+	first    any
+	last     any
+}
+
+type group struct {
+	keys   []any
+	states []*accState
+}
+
+// Aggregator consumes documents one at a time and keeps only per-group
+// state, so the caller never has to hold the matching documents in memory.
+type Aggregator struct {
+	spec   *Aggregation
+	groups map[string]*group
+}
+
+func NewAggregator(spec *Aggregation) (*Aggregator, error) {
+	if err := spec.Validate(); err != nil {
+		return nil, err
+	}
+	return &Aggregator{spec: spec, groups: make(map[string]*group)}, nil
+}
+
+// Add folds doc into its group. Documents not matching the filter are
+// ignored.
+func (ag *Aggregator) Add(doc toon.Document) {
+	if !Match(ag.spec.Filter, doc) {
+		return
+	}
+
+	keys := make([]any, len(ag.spec.GroupBy))
+	for i, f := range ag.spec.GroupBy {
+		keys[i] = Normalize(doc[f])
+	}
+	k := groupKey(keys)
+
+	g, ok := ag.groups[k]
+	if !ok {
+		g = &group{keys: keys, states: make([]*accState, len(ag.spec.Accumulators))}
+		for i := range g.states {
+			g.states[i] = &accState{}
+		}
+		ag.groups[k] = g
+	}
+
+	for i, acc := range ag.spec.Accumulators {
+		accumulate(acc, g.states[i], doc)
+	}
+}
+
+func groupKey(keys []any) string {
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		parts[i] = fmt.Sprintf("%T:%v", k, k)
+	}
+	return strings.Join(parts, "\x00")
+}
+
+func accumulate(acc Accumulator, st *accState, doc toon.Document) {
+	if acc.Field == "" {
+		st.count++
+		return
+	}
+
+	raw, ok := doc[acc.Field]
+	if !ok || raw == nil {
+		return
+	}
+	v := Normalize(raw)
+
+	switch acc.Op {
+	case AccCount:
+		st.count++
+	case AccSum, AccAvg:
+		f, ok := toFloat(v)
+		if !ok {
+			return
+		}
+		st.count++
+		if n, isInt := v.(int64); isInt && !st.isFloat {
+			st.intSum += n
+		} else {
+			if !st.isFloat {
+				st.floatSum = float64(st.intSum)
+				st.isFloat = true
+			}
+			st.floatSum += f
+		}
+	case AccMin:
+		if !st.seen || Order(v, st.best) < 0 {
+			st.best = v
+		}
+		st.seen = true
+	case AccMax:
+		if !st.seen || Order(v, st.best) > 0 {
+			st.best = v
+		}
+		st.seen = true
+	case AccCountDistinct:
+		if st.distinct == nil {
+			st.distinct = make(map[string]bool)
+		}
+		st.distinct[fmt.Sprintf("%T:%v", v, v)] = true
+	case AccFirst:
+		if !st.seen {
+			st.first = v
+			st.seen = true
+		}
+	case AccLast:
+		st.last = v
+	}
+}
+
+func (st *accState) result(op AccumulatorOp) any {
+	switch op {
+	case AccCount:
+		return st.count
+	case AccSum:
+		if st.isFloat {
+			return st.floatSum
+		}
+		return st.intSum
+	case AccAvg:
+		if st.count == 0 {
+			return nil
+		}
+		sum := st.floatSum
+		if !st.isFloat {
+			sum = float64(st.intSum)
+		}
+		avg := sum / float64(st.count)
+		if math.IsNaN(avg) {
+			return nil
+		}
+		return avg
+	case AccMin, AccMax:
+		return st.best
+	case AccCountDistinct:
+		return int64(len(st.distinct))
+	case AccFirst:
+		return st.first
+	case AccLast:
+		return st.last
+	}
+	return nil
+}
+
+// Results returns one document per group, ordered by the group key. A
+// query without GroupBy over no documents still yields a single row, so that
+// count() reports 0 rather than nothing.
+func (ag *Aggregator) Results() []toon.Document {
+	groups := make([]*group, 0, len(ag.groups))
+	for _, g := range ag.groups {
+		groups = append(groups, g)
+	}
+	if len(groups) == 0 && len(ag.spec.GroupBy) == 0 {
+		g := &group{states: make([]*accState, len(ag.spec.Accumulators))}
+		for i := range g.states {
+			g.states[i] = &accState{}
+		}
+		groups = append(groups, g)
+	}
+
+	sort.Slice(groups, func(i, j int) bool {
+		for k := range groups[i].keys {
+			if c := Order(groups[i].keys[k], groups[j].keys[k]); c != 0 {
+				return c < 0
+			}
+		}
+		return false
+	})
+
+	results := make([]toon.Document, len(groups))
+	for i, g := range groups {
+		doc := make(toon.Document, len(ag.spec.GroupBy)+len(ag.spec.Accumulators))
+		for k, f := range ag.spec.GroupBy {
+			doc[f] = g.keys[k]
+		}
+		for k, acc := range ag.spec.Accumulators {
+			doc[acc.Name()] = g.states[k].result(acc.Op)
+		}
+		results[i] = doc
+	}
+	return results
+}
+
+// ParseAggregation parses an aggregation of the form
+//
+//	count(), sum(total) AS revenue, avg(total) BY status, region WHERE total > 10
+//
+// The BY (or GROUP BY) and WHERE parts are optional. count_distinct may also
+// be written as distinct, and count(*) is the same as count().
+func ParseAggregation(input string) (*Aggregation, error) {
+	p, err := newParser(input)
+	if err != nil {
+		return nil, err
+	}
+
+	agg := &Aggregation{}
+	for {
+		acc, err := p.parseAccumulator()
+		if err != nil {
+			return nil, err
+		}
+		agg.Accumulators = append(agg.Accumulators, acc)
+		if p.peek().kind != tokComma {
+			break
+		}
+		p.next()
+	}
+
+	grouped := p.acceptKeyword("BY")
+	if !grouped && p.acceptKeyword("GROUP") {
+		if !p.acceptKeyword("BY") {
+			tok := p.peek()
+			return nil, fmt.Errorf("expected BY after GROUP at position %d, got %s", tok.pos, tok)
+		}
+		grouped = true
+	}
+	if grouped {
+		for {
+			tok, err := p.expect(tokWord, "group field")
+			if err != nil {
+				return nil, err
+			}
+			agg.GroupBy = append(agg.GroupBy, tok.text)
+			if p.peek().kind != tokComma {
+				break
+			}
+			p.next()
+		}
+	}
+
+	if p.acceptKeyword("WHERE") {
+		agg.Filter, err = p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if tok := p.peek(); tok.kind != tokEOF {
+		return nil, p.unexpected(tok)
+	}
+
+	return agg, agg.Validate()
+}
+
+func (p *parser) parseAccumulator() (Accumulator, error) {
+	tok, err := p.expect(tokWord, "accumulator such as count() or sum(field)")
+	if err != nil {
+		return Accumulator{}, err
+	}
+
+	op := AccumulatorOp(strings.ToLower(tok.text))
+	if op == "distinct" {
+		op = AccCountDistinct
+	}
+	acc := Accumulator{Op: op}
+
+	if _, err := p.expect(tokLParen, fmt.Sprintf("'(' after %s", tok.text)); err != nil {
+		return acc, err
+	}
+	if p.peek().kind == tokWord {
+		acc.Field = p.next().text
+		if acc.Field == "*" {
+			acc.Field = ""
+		}
+	}
+	if _, err := p.expect(tokRParen, "')'"); err != nil {
+		return acc, err
+	}
+
+	if p.acceptKeyword("AS") {
+		name, err := p.expect(tokWord, "output field name")
+		if err != nil {
+			return acc, err
+		}
+		acc.As = name.text
+	}
+
+	return acc, nil
+}
@@ -0,0 +1,297 @@
+package query
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/Al3x-Myku/FlyDB/pkg/toon"
+)
+
+// Expr is a node of a parsed filter. Match reports whether a document
+// satisfies the expression.
+type Expr interface {
+	Match(doc toon.Document) bool
+	String() string
+}
+
+type Op string
+
+const (
+	OpEq Op = "="
+	OpNe Op = "!="
+	OpLt Op = "<"
+	OpLe Op = "<="
+	OpGt Op = ">"
+	OpGe Op = ">="
+)
+
+type AndExpr struct {
+	Terms []Expr
+}
+
+func (e *AndExpr) Match(doc toon.Document) bool {
+	for _, t := range e.Terms {
+		if !t.Match(doc) {
+			return false
+		}
+	}
+	return true
+}
+
+func (e *AndExpr) String() string {
+	return joinTerms(e.Terms, " AND ")
+}
+
+type OrExpr struct {
+	Terms []Expr
+}
+
+func (e *OrExpr) Match(doc toon.Document) bool {
+	for _, t := range e.Terms {
+		if t.Match(doc) {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *OrExpr) String() string {
+	return joinTerms(e.Terms, " OR ")
+}
+
+type NotExpr struct {
+	Expr Expr
+}
+
+func (e *NotExpr) Match(doc toon.Document) bool {
+	return !e.Expr.Match(doc)
+}
+
+func (e *NotExpr) String() string {
+	return "NOT " + e.Expr.String()
+}
+
+// CompareExpr compares a field with a literal. A document that lacks the
+// field never matches, except for "= null".
+type CompareExpr struct {
+	Field string
+	Op    Op
+	Value any
+}
+
+func (e *CompareExpr) Match(doc toon.Document) bool {
+	v, ok := doc[e.Field]
+	if e.Value == nil {
+		isNull := !ok || v == nil
+		switch e.Op {
+		case OpEq:
+			return isNull
+		case OpNe:
+			return !isNull
+		}
+		return false
+	}
+	if !ok || v == nil {
+		return false
+	}
+
+	switch e.Op {
+	case OpEq:
+		return Equal(v, e.Value)
+	case OpNe:
+		return !Equal(v, e.Value)
+	case OpLt:
+		return CompareValues(v, e.Value) < 0
+	case OpLe:
+		return CompareValues(v, e.Value) <= 0
+	case OpGt:
+		return CompareValues(v, e.Value) > 0
+	case OpGe:
+		return CompareValues(v, e.Value) >= 0
+	}
+	return false
+}
+
+func (e *CompareExpr) String() string {
+	return fmt.Sprintf("%s %s %s", e.Field, e.Op, formatLiteral(e.Value))
+}
+
+type InExpr struct {
+	Field  string
+	Values []any
+}
+
+func (e *InExpr) Match(doc toon.Document) bool {
+	v, ok := doc[e.Field]
+	if !ok {
+		return false
+	}
+	for _, want := range e.Values {
+		if Equal(v, want) {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *InExpr) String() string {
+	parts := make([]string, len(e.Values))
+	for i, v := range e.Values {
+		parts[i] = formatLiteral(v)
+	}
+	return fmt.Sprintf("%s IN (%s)", e.Field, strings.Join(parts, ", "))
+}
+
+// BetweenExpr matches Low <= field <= High.
+type BetweenExpr struct {
+	Field string
+	Low   any
+	High  any
+}
+
+func (e *BetweenExpr) Match(doc toon.Document) bool {
+	v, ok := doc[e.Field]
+	if !ok || v == nil {
+		return false
+	}
+	return CompareValues(v, e.Low) >= 0 && CompareValues(v, e.High) <= 0
+}
+
+func (e *BetweenExpr) String() string {
+	return fmt.Sprintf("%s BETWEEN %s AND %s", e.Field, formatLiteral(e.Low), formatLiteral(e.High))
+}
+
+type ExistsExpr struct {
+	Field string
+}
+
+func (e *ExistsExpr) Match(doc toon.Document) bool {
+	v, ok := doc[e.Field]
+	return ok && v != nil
+}
+
+func (e *ExistsExpr) String() string {
+	return e.Field + " EXISTS"
+}
+
+// LikeExpr matches a SQL-style pattern where % matches any run of characters
+// and _ matches exactly one.
+type LikeExpr struct {
+	Field   string
+	Pattern string
+	re      *regexp.Regexp
+}
+
+func NewLike(field, pattern string) *LikeExpr {
+	var b strings.Builder
+	b.WriteString("(?s)^")
+	for _, r := range pattern {
+		switch r {
+		case '%':
+			b.WriteString(".*")
+		case '_':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	b.WriteString("$")
+	return &LikeExpr{Field: field, Pattern: pattern, re: regexp.MustCompile(b.String())}
+}
+
+func (e *LikeExpr) Match(doc toon.Document) bool {
+	v, ok := doc[e.Field]
+	if !ok || v == nil {
+		return false
+	}
+	return e.re.MatchString(fmt.Sprint(v))
+}
+
+func (e *LikeExpr) String() string {
+	return fmt.Sprintf("%s LIKE %s", e.Field, formatLiteral(e.Pattern))
+}
+
+type PrefixExpr struct {
+	Field  string
+	Prefix string
+}
+
+func (e *PrefixExpr) Match(doc toon.Document) bool {
+	v, ok := doc[e.Field]
+	if !ok || v == nil {
+		return false
+	}
+	return strings.HasPrefix(fmt.Sprint(v), e.Prefix)
+}
+
+func (e *PrefixExpr) String() string {
+	return fmt.Sprintf("%s PREFIX %s", e.Field, formatLiteral(e.Prefix))
+}
+
+type RegexExpr struct {
+	Field string
+	re    *regexp.Regexp
+}
+
+func NewRegex(field, pattern string) (*RegexExpr, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid regex %q: %w", pattern, err)
+	}
+	return &RegexExpr{Field: field, re: re}, nil
+}
+
+func (e *RegexExpr) Match(doc toon.Document) bool {
+	v, ok := doc[e.Field]
+	if !ok || v == nil {
+		return false
+	}
+	return e.re.MatchString(fmt.Sprint(v))
+}
+
+func (e *RegexExpr) String() string {
+	return fmt.Sprintf("%s ~ %s", e.Field, formatLiteral(e.re.String()))
+}
+
+func joinTerms(terms []Expr, sep string) string {
+	parts := make([]string, len(terms))
+	for i, t := range terms {
+		s := t.String()
+		switch t.(type) {
+		case *AndExpr, *OrExpr:
+			s = "(" + s + ")"
+		}
+		parts[i] = s
+	}
+	return strings.Join(parts, sep)
+}
+
+// Helpers for building filters in code rather than parsing them.
+
+func And(terms ...Expr) Expr { return &AndExpr{Terms: terms} }
+
+func Or(terms ...Expr) Expr { return &OrExpr{Terms: terms} }
+
+func Not(e Expr) Expr { return &NotExpr{Expr: e} }
+
+func Where(field string, op Op, value any) Expr {
+	return &CompareExpr{Field: field, Op: op, Value: value}
+}
+
+func Eq(field string, value any) Expr { return Where(field, OpEq, value) }
+
+func In(field string, values ...any) Expr { return &InExpr{Field: field, Values: values} }
+
+func Between(field string, low, high any) Expr {
+	return &BetweenExpr{Field: field, Low: low, High: high}
+}
+
+func Exists(field string) Expr { return &ExistsExpr{Field: field} }
+
+func Prefix(field, prefix string) Expr { return &PrefixExpr{Field: field, Prefix: prefix} }
+
+// Match reports whether doc satisfies e. A nil filter matches everything.
+func Match(e Expr, doc toon.Document) bool {
+	return e == nil || e.Match(doc)
+}
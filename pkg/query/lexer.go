@@ -0,0 +1,123 @@
+package query
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokWord
+	tokString
+	tokOp
+	tokLParen
+	tokRParen
+	tokComma
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+func (t token) String() string {
+	switch t.kind {
+	case tokEOF:
+		return "end of query"
+	case tokString:
+		return fmt.Sprintf("%q", t.text)
+	}
+	return fmt.Sprintf("'%s'", t.text)
+}
+
+// isKeyword reports whether an unquoted word token is the given keyword.
+// Keywords are case-insensitive; quoting a word turns it into a string.
+func (t token) isKeyword(kw string) bool {
+	return t.kind == tokWord && strings.EqualFold(t.text, kw)
+}
+
+var operators = []string{">=", "<=", "!=", "<>", "==", "=", ">", "<", "~"}
+
+func isOperatorStart(r rune) bool {
+	return strings.ContainsRune("=!<>~", r)
+}
+
+func isWordRune(r rune) bool {
+	return !unicode.IsSpace(r) && !isOperatorStart(r) && !strings.ContainsRune(`(),"'`, r)
+}
+
+// lex splits a query into tokens. Quoted strings may use single or double
+// quotes and support backslash escapes for the quote character and the
+// backslash itself.
+func lex(input string) ([]token, error) {
+	var tokens []token
+	runes := []rune(input)
+
+	for i := 0; i < len(runes); {
+		r := runes[i]
+
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(':
+			tokens = append(tokens, token{tokLParen, "(", i})
+			i++
+		case r == ')':
+			tokens = append(tokens, token{tokRParen, ")", i})
+			i++
+		case r == ',':
+			tokens = append(tokens, token{tokComma, ",", i})
+			i++
+		case r == '"' || r == '\'':
+			start := i
+			var b strings.Builder
+			i++
+			closed := false
+			for i < len(runes) {
+				c := runes[i]
+				if c == '\\' && i+1 < len(runes) {
+					b.WriteRune(runes[i+1])
+					i += 2
+					continue
+				}
+				if c == r {
+					closed = true
+					i++
+					break
+				}
+				b.WriteRune(c)
+				i++
+			}
+			if !closed {
+				return nil, fmt.Errorf("unterminated string starting at position %d", start)
+			}
+			tokens = append(tokens, token{tokString, b.String(), start})
+		case isOperatorStart(r):
+			matched := ""
+			for _, op := range operators {
+				if strings.HasPrefix(string(runes[i:]), op) {
+					matched = op
+					break
+				}
+			}
+			if matched == "" {
+				return nil, fmt.Errorf("unexpected character %q at position %d", r, i)
+			}
+			tokens = append(tokens, token{tokOp, matched, i})
+			i += len([]rune(matched))
+		default:
+			start := i
+			for i < len(runes) && isWordRune(runes[i]) {
+				i++
+			}
+			tokens = append(tokens, token{tokWord, string(runes[start:i]), start})
+		}
+	}
+
+	tokens = append(tokens, token{tokEOF, "", len(runes)})
+	return tokens, nil
+}
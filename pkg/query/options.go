@@ -0,0 +1,278 @@
+package query
+
+import (
+	"container/heap"
+	"fmt"
+	"sort"
+
+	"github.com/Al3x-Myku/FlyDB/pkg/toon"
+)
+
+type SortKey struct {
+	Field string
+	Desc  bool
+}
+
+// Projection limits the fields returned for each document. Only one of
+// Include and Exclude may be set. The id field is always kept, since a
+// document cannot be encoded without it.
+type Projection struct {
+	Include []string
+	Exclude []string
+}
+
+// Lookup embeds documents from another collection into each result. For
+// every result, the documents in collection From whose ForeignField equals
+// the result's LocalField are fetched and stored under As: the first match as
+// a document, or all matches as a slice when Many is set. ForeignField
+// defaults to "id".
+type Lookup struct {
+	From         string
+	LocalField   string
+	ForeignField string
+	As           string
+	Many         bool
+}
+
+func (l Lookup) Foreign() string {
+	if l.ForeignField == "" {
+		return "id"
+	}
+	return l.ForeignField
+}
+
+type Options struct {
+	Sort    []SortKey
+	Limit   int
+	Skip    int
+	Fields  Projection
+	Lookups []Lookup
+}
+
+// Query is a filter together with the options that shape its result set.
+type Query struct {
+	Filter Expr
+	Options
+}
+
+func (p Projection) IsZero() bool {
+	return len(p.Include) == 0 && len(p.Exclude) == 0
+}
+
+func (p Projection) Validate() error {
+	if len(p.Include) > 0 && len(p.Exclude) > 0 {
+		return fmt.Errorf("projection cannot both include and exclude fields")
+	}
+	return nil
+}
+
+// Apply returns a copy of doc restricted to the projected fields. The
+// original document is never modified.
+func (p Projection) Apply(doc toon.Document) toon.Document {
+	if p.IsZero() {
+		return doc
+	}
+
+	out := make(toon.Document)
+	if len(p.Include) > 0 {
+		if id, ok := doc["id"]; ok {
+			out["id"] = id
+		}
+		for _, f := range p.Include {
+			if v, ok := doc[f]; ok {
+				out[f] = v
+			}
+		}
+		return out
+	}
+
+	for k, v := range doc {
+		out[k] = v
+	}
+	for _, f := range p.Exclude {
+		if f != "id" {
+			delete(out, f)
+		}
+	}
+	return out
+}
+
+// Normalize converts a document value into the form it would have after a
+// round trip through a TOON block, so that a document still in the memtable
+// sorts exactly like its committed copy will.
+func Normalize(v any) any {
+	switch x := v.(type) {
+	case nil:
+		return nil
+	case string:
+		return toon.InferType(x)
+	case int64, float64, bool:
+		return x
+	}
+	return toon.InferType(fmt.Sprint(v))
+}
+
+// SortKeys extracts the normalized sort values of doc.
+func SortKeys(sortBy []SortKey, doc toon.Document) []any {
+	keys := make([]any, len(sortBy))
+	for i, k := range sortBy {
+		keys[i] = Normalize(doc[k.Field])
+	}
+	return keys
+}
+
+// CompareKeys orders two sets of sort values according to sortBy.
+func CompareKeys(sortBy []SortKey, a, b []any) int {
+	for i, k := range sortBy {
+		c := Order(a[i], b[i])
+		if k.Desc {
+			c = -c
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+type collected struct {
+	doc  toon.Document
+	keys []any
+	seq  int
+}
+
+// Collector accumulates matching documents and produces the final page of
+// results. Without a sort it simply keeps the first Skip+Limit documents;
+// with a sort and a limit it keeps only the best Skip+Limit in a bounded
+// heap, so memory stays proportional to the page rather than the collection.
+type Collector struct {
+	opts  Options
+	items resultHeap
+	seq   int
+}
+
+func NewCollector(opts Options) *Collector {
+	return &Collector{
+		opts:  opts,
+		items: resultHeap{sortBy: opts.Sort},
+	}
+}
+
+func (c *Collector) capacity() int {
+	if c.opts.Limit <= 0 {
+		return -1
+	}
+	return c.opts.Skip + c.opts.Limit
+}
+
+// Add offers a matching document to the collector. It returns false once no
+// further documents can change the result, which only happens for unsorted
+// queries that already have a full page.
+func (c *Collector) Add(doc toon.Document) bool {
+	limit := c.capacity()
+	item := collected{doc: doc, seq: c.seq}
+	c.seq++
+
+	if len(c.opts.Sort) == 0 {
+		c.items.items = append(c.items.items, item)
+		return limit < 0 || len(c.items.items) < limit
+	}
+
+	item.keys = SortKeys(c.opts.Sort, doc)
+	if limit < 0 {
+		c.items.items = append(c.items.items, item)
+		return true
+	}
+
+	if len(c.items.items) < limit {
+		heap.Push(&c.items, item)
+		return true
+	}
+	if c.items.worse(item, c.items.items[0]) {
+		return true
+	}
+	c.items.items[0] = item
+	heap.Fix(&c.items, 0)
+	return true
+}
+
+// Saturated reports whether the collector already holds a full page and no
+// document whose leading sort value is leading could displace any of it.
+// Callers feeding documents in leading-key order use this to stop early.
+func (c *Collector) Saturated(leading any) bool {
+	limit := c.capacity()
+	if limit < 0 || len(c.opts.Sort) == 0 || len(c.items.items) < limit {
+		return false
+	}
+	cmp := Order(leading, c.items.items[0].keys[0])
+	if c.opts.Sort[0].Desc {
+		cmp = -cmp
+	}
+	return cmp > 0
+}
+
+// Results returns the requested page, sorted and projected.
+func (c *Collector) Results() []toon.Document {
+	docs := c.Page()
+	for i, doc := range docs {
+		docs[i] = c.opts.Fields.Apply(doc)
+	}
+	return docs
+}
+
+// Page returns the requested page, sorted but not yet projected.
+func (c *Collector) Page() []toon.Document {
+	items := c.items.items
+	if len(c.opts.Sort) > 0 {
+		sort.SliceStable(items, func(i, j int) bool {
+			return c.items.better(items[i], items[j])
+		})
+	}
+
+	if c.opts.Skip >= len(items) {
+		return []toon.Document{}
+	}
+	items = items[c.opts.Skip:]
+	if c.opts.Limit > 0 && len(items) > c.opts.Limit {
+		items = items[:c.opts.Limit]
+	}
+
+	docs := make([]toon.Document, len(items))
+	for i, it := range items {
+		docs[i] = it.doc
+	}
+	return docs
+}
+
+// resultHeap is a max-heap on result order: the root is the worst document
+// currently kept, which is the one to evict when a better one arrives.
+type resultHeap struct {
+	sortBy []SortKey
+	items  []collected
+}
+
+// better reports whether a sorts before b. Documents with equal keys keep
+// the order in which they were added.
+func (h *resultHeap) better(a, b collected) bool {
+	if c := CompareKeys(h.sortBy, a.keys, b.keys); c != 0 {
+		return c < 0
+	}
+	return a.seq < b.seq
+}
+
+func (h *resultHeap) worse(a, b collected) bool {
+	return h.better(b, a)
+}
+
+func (h *resultHeap) Len() int           { return len(h.items) }
+func (h *resultHeap) Less(i, j int) bool { return h.worse(h.items[i], h.items[j]) }
+func (h *resultHeap) Swap(i, j int)      { h.items[i], h.items[j] = h.items[j], h.items[i] }
+func (h *resultHeap) Push(x any)         { h.items = append(h.items, x.(collected)) }
+
+func (h *resultHeap) Pop() any {
+	old := h.items
+	n := len(old)
+	item := old[n-1]
+	h.items = old[:n-1]
+	return item
+}
@@ -0,0 +1,497 @@
+package query
+
+import (
+	"errors"
+	"fmt"
+)
+
+var ErrEmptyQuery = errors.New("empty query")
+
+// Parse parses a filter expression such as
+//
+//	status = "active" AND (age >= 18 OR role IN ('admin', 'owner'))
+//
+// Supported predicates are the comparison operators (=, !=, <>, <, <=, >,
+// >=), IN (...), BETWEEN x AND y, EXISTS, LIKE, PREFIX and ~ / REGEX, each of
+// which can be negated with NOT. Unquoted literals are typed: integers,
+// floats, true/false and null; anything else is a string.
+func Parse(input string) (Expr, error) {
+	p, err := newParser(input)
+	if err != nil {
+		return nil, err
+	}
+	if p.peek().kind == tokEOF {
+		return nil, ErrEmptyQuery
+	}
+
+	expr, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != tokEOF {
+		return nil, p.unexpected(tok)
+	}
+	return expr, nil
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func newParser(input string) (*parser, error) {
+	tokens, err := lex(input)
+	if err != nil {
+		return nil, err
+	}
+	return &parser{tokens: tokens}, nil
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	tok := p.tokens[p.pos]
+	if tok.kind != tokEOF {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *parser) acceptKeyword(kw string) bool {
+	if p.peek().isKeyword(kw) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(kind tokenKind, what string) (token, error) {
+	tok := p.next()
+	if tok.kind != kind {
+		return tok, fmt.Errorf("expected %s at position %d, got %s", what, tok.pos, tok)
+	}
+	return tok, nil
+}
+
+func (p *parser) unexpected(tok token) error {
+	if tok.kind == tokWord {
+		return fmt.Errorf("unexpected %s at position %d (quote values that contain spaces)", tok, tok.pos)
+	}
+	return fmt.Errorf("unexpected %s at position %d", tok, tok.pos)
+}
+
+func (p *parser) parseOr() (Expr, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	terms := []Expr{left}
+	for p.acceptKeyword("OR") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		terms = append(terms, right)
+	}
+	if len(terms) == 1 {
+		return left, nil
+	}
+	return &OrExpr{Terms: terms}, nil
+}
+
+func (p *parser) parseAnd() (Expr, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	terms := []Expr{left}
+	for p.acceptKeyword("AND") {
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		terms = append(terms, right)
+	}
+	if len(terms) == 1 {
+		return left, nil
+	}
+	return &AndExpr{Terms: terms}, nil
+}
+
+func (p *parser) parseNot() (Expr, error) {
+	if p.acceptKeyword("NOT") {
+		inner, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &NotExpr{Expr: inner}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *parser) parsePrimary() (Expr, error) {
+	tok := p.peek()
+
+	if tok.kind == tokLParen {
+		p.next()
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := p.expect(tokRParen, "')'"); err != nil {
+			return nil, err
+		}
+		return expr, nil
+	}
+
+	if tok.isKeyword("EXISTS") {
+		p.next()
+		field, err := p.parseExistsField()
+		if err != nil {
+			return nil, err
+		}
+		return &ExistsExpr{Field: field}, nil
+	}
+
+	if tok.kind != tokWord {
+		return nil, fmt.Errorf("expected field name at position %d, got %s", tok.pos, tok)
+	}
+	p.next()
+	return p.parsePredicate(tok.text)
+}
+
+// parseExistsField accepts both "EXISTS field" and "EXISTS(field)".
+func (p *parser) parseExistsField() (string, error) {
+	paren := p.peek().kind == tokLParen
+	if paren {
+		p.next()
+	}
+	tok, err := p.expect(tokWord, "field name")
+	if err != nil {
+		return "", err
+	}
+	if paren {
+		if _, err := p.expect(tokRParen, "')'"); err != nil {
+			return "", err
+		}
+	}
+	return tok.text, nil
+}
+
+func (p *parser) parsePredicate(field string) (Expr, error) {
+	tok := p.next()
+
+	if tok.kind == tokOp {
+		if tok.text == "~" {
+			return p.parseRegex(field)
+		}
+		value, err := p.parseLiteral()
+		if err != nil {
+			return nil, err
+		}
+		return &CompareExpr{Field: field, Op: normalizeOp(tok.text), Value: value}, nil
+	}
+
+	negate := false
+	if tok.isKeyword("NOT") {
+		negate = true
+		tok = p.next()
+	}
+
+	var expr Expr
+	var err error
+	switch {
+	case tok.isKeyword("IN"):
+		expr, err = p.parseIn(field)
+	case tok.isKeyword("BETWEEN"):
+		expr, err = p.parseBetween(field)
+	case tok.isKeyword("EXISTS"):
+		expr = &ExistsExpr{Field: field}
+	case tok.isKeyword("LIKE"):
+		var pattern string
+		pattern, err = p.parseStringLiteral()
+		if err == nil {
+			expr = NewLike(field, pattern)
+		}
+	case tok.isKeyword("PREFIX"), tok.isKeyword("STARTSWITH"):
+		var prefix string
+		prefix, err = p.parseStringLiteral()
+		if err == nil {
+			expr = &PrefixExpr{Field: field, Prefix: prefix}
+		}
+	case tok.isKeyword("REGEX"), tok.isKeyword("MATCHES"):
+		expr, err = p.parseRegex(field)
+	default:
+		return nil, fmt.Errorf("expected operator after '%s' at position %d, got %s", field, tok.pos, tok)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if negate {
+		return &NotExpr{Expr: expr}, nil
+	}
+	return expr, nil
+}
+
+func normalizeOp(op string) Op {
+	switch op {
+	case "==":
+		return OpEq
+	case "<>":
+		return OpNe
+	}
+	return Op(op)
+}
+
+func (p *parser) parseIn(field string) (Expr, error) {
+	if _, err := p.expect(tokLParen, "'(' after IN"); err != nil {
+		return nil, err
+	}
+
+	var values []any
+	for {
+		v, err := p.parseLiteral()
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+
+		tok := p.next()
+		if tok.kind == tokRParen {
+			break
+		}
+		if tok.kind != tokComma {
+			return nil, fmt.Errorf("expected ',' or ')' in IN list at position %d, got %s", tok.pos, tok)
+		}
+	}
+
+	return &InExpr{Field: field, Values: values}, nil
+}
+
+func (p *parser) parseBetween(field string) (Expr, error) {
+	low, err := p.parseLiteral()
+	if err != nil {
+		return nil, err
+	}
+	if !p.acceptKeyword("AND") {
+		tok := p.peek()
+		return nil, fmt.Errorf("expected AND in BETWEEN at position %d, got %s", tok.pos, tok)
+	}
+	high, err := p.parseLiteral()
+	if err != nil {
+		return nil, err
+	}
+	return &BetweenExpr{Field: field, Low: low, High: high}, nil
+}
+
+func (p *parser) parseRegex(field string) (Expr, error) {
+	pattern, err := p.parseStringLiteral()
+	if err != nil {
+		return nil, err
+	}
+	return NewRegex(field, pattern)
+}
+
+func (p *parser) parseLiteral() (any, error) {
+	tok := p.next()
+	switch tok.kind {
+	case tokString:
+		return tok.text, nil
+	case tokWord:
+		return ParseLiteral(tok.text), nil
+	}
+	return nil, fmt.Errorf("expected value at position %d, got %s", tok.pos, tok)
+}
+
+// parseStringLiteral reads a value used as a pattern. Unquoted words are
+// accepted as-is rather than being typed, so "LIKE 42%" means the text 42%.
+func (p *parser) parseStringLiteral() (string, error) {
+	tok := p.next()
+	if tok.kind != tokString && tok.kind != tokWord {
+		return "", fmt.Errorf("expected pattern at position %d, got %s", tok.pos, tok)
+	}
+	return tok.text, nil
+}
+
+// ParseQuery parses a filter optionally followed by result clauses:
+//
+//	age > 25 ORDER BY age DESC, name LIMIT 10 OFFSET 20 FIELDS id, name
+//
+// SORT BY is accepted for ORDER BY and SKIP for OFFSET. FIELDS takes either
+// a list of fields to keep or a list of -field entries to drop. Any number
+// of LOOKUP clauses may be given:
+//
+//	LOOKUP users ON user_id = id AS user
+//	LOOKUP MANY orders ON id = user_id AS orders
+//
+// The filter may be omitted to select every document.
+func ParseQuery(input string) (*Query, error) {
+	p, err := newParser(input)
+	if err != nil {
+		return nil, err
+	}
+
+	q := &Query{}
+	if !p.atClause() && p.peek().kind != tokEOF {
+		q.Filter, err = p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	seen := make(map[string]bool)
+	for p.peek().kind != tokEOF {
+		tok := p.next()
+		clause := clauseName(tok)
+		if clause == "" {
+			return nil, p.unexpected(tok)
+		}
+		if clause == "LOOKUP" {
+			lookup, err := p.parseLookup()
+			if err != nil {
+				return nil, err
+			}
+			q.Lookups = append(q.Lookups, lookup)
+			continue
+		}
+		if seen[clause] {
+			return nil, fmt.Errorf("duplicate %s clause at position %d", clause, tok.pos)
+		}
+		seen[clause] = true
+
+		switch clause {
+		case "ORDER BY":
+			if !p.acceptKeyword("BY") {
+				return nil, fmt.Errorf("expected BY after %s at position %d", tok.text, tok.pos)
+			}
+			q.Sort, err = p.parseSortKeys()
+		case "LIMIT":
+			q.Limit, err = p.parseCount("LIMIT")
+		case "OFFSET":
+			q.Skip, err = p.parseCount(tok.text)
+		case "FIELDS":
+			q.Fields, err = p.parseProjection()
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return q, nil
+}
+
+func clauseName(tok token) string {
+	switch {
+	case tok.isKeyword("ORDER"), tok.isKeyword("SORT"):
+		return "ORDER BY"
+	case tok.isKeyword("LIMIT"):
+		return "LIMIT"
+	case tok.isKeyword("OFFSET"), tok.isKeyword("SKIP"):
+		return "OFFSET"
+	case tok.isKeyword("FIELDS"):
+		return "FIELDS"
+	case tok.isKeyword("LOOKUP"), tok.isKeyword("JOIN"):
+		return "LOOKUP"
+	}
+	return ""
+}
+
+func (p *parser) parseLookup() (Lookup, error) {
+	var l Lookup
+	l.Many = p.acceptKeyword("MANY")
+
+	from, err := p.expect(tokWord, "collection name")
+	if err != nil {
+		return l, err
+	}
+	l.From = from.text
+
+	if !p.acceptKeyword("ON") {
+		tok := p.peek()
+		return l, fmt.Errorf("expected ON in LOOKUP at position %d, got %s", tok.pos, tok)
+	}
+	local, err := p.expect(tokWord, "local field")
+	if err != nil {
+		return l, err
+	}
+	l.LocalField = local.text
+
+	if op := p.next(); op.kind != tokOp || normalizeOp(op.text) != OpEq {
+		return l, fmt.Errorf("expected '=' in LOOKUP at position %d, got %s", op.pos, op)
+	}
+	foreign, err := p.expect(tokWord, "foreign field")
+	if err != nil {
+		return l, err
+	}
+	l.ForeignField = foreign.text
+
+	l.As = l.From
+	if p.acceptKeyword("AS") {
+		as, err := p.expect(tokWord, "field name after AS")
+		if err != nil {
+			return l, err
+		}
+		l.As = as.text
+	}
+
+	return l, nil
+}
+
+func (p *parser) atClause() bool {
+	return clauseName(p.peek()) != ""
+}
+
+func (p *parser) parseSortKeys() ([]SortKey, error) {
+	var keys []SortKey
+	for {
+		tok, err := p.expect(tokWord, "sort field")
+		if err != nil {
+			return nil, err
+		}
+		key := SortKey{Field: tok.text}
+		if p.acceptKeyword("DESC") {
+			key.Desc = true
+		} else {
+			p.acceptKeyword("ASC")
+		}
+		keys = append(keys, key)
+
+		if p.peek().kind != tokComma {
+			return keys, nil
+		}
+		p.next()
+	}
+}
+
+func (p *parser) parseCount(clause string) (int, error) {
+	tok := p.next()
+	n, ok := ParseLiteral(tok.text).(int64)
+	if tok.kind != tokWord || !ok || n < 0 {
+		return 0, fmt.Errorf("%s expects a non-negative integer at position %d, got %s", clause, tok.pos, tok)
+	}
+	return int(n), nil
+}
+
+func (p *parser) parseProjection() (Projection, error) {
+	var proj Projection
+	for {
+		tok, err := p.expect(tokWord, "field name")
+		if err != nil {
+			return proj, err
+		}
+		if len(tok.text) > 1 && tok.text[0] == '-' {
+			proj.Exclude = append(proj.Exclude, tok.text[1:])
+		} else {
+			proj.Include = append(proj.Include, tok.text)
+		}
+
+		if p.peek().kind != tokComma {
+			break
+		}
+		p.next()
+	}
+	return proj, proj.Validate()
+}
@@ -0,0 +1,253 @@
+package query
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/Al3x-Myku/FlyDB/pkg/toon"
+)
+
+func TestParseAndMatch(t *testing.T) {
+	doc := toon.Document{
+		"id":      int64(7),
+		"name":    "Alice",
+		"age":     int64(30),
+		"score":   float64(88.5),
+		"active":  true,
+		"email":   "alice@example.com",
+		"formula": "a>=b",
+	}
+
+	tests := []struct {
+		query    string
+		expected bool
+	}{
+		{"name = Alice", true},
+		{"name = 'Alice'", true},
+		{"name == \"Bob\"", false},
+		{"id = '7'", true},
+		{"age > 25", true},
+		{"age >= 30 AND score < 90", true},
+		{"age > 30 OR name = Alice", true},
+		{"NOT active = true", false},
+		{"name != Alice", false},
+		{"name <> Bob", true},
+		{"(age < 18 OR age > 65) AND active = true", false},
+		{"age IN (10, 20, 30)", true},
+		{"name NOT IN ('Alice', 'Bob')", false},
+		{"score BETWEEN 80 AND 90.0", true},
+		{"age BETWEEN 31 AND 40 OR score > 88", true},
+		{"email EXISTS", true},
+		{"EXISTS(phone)", false},
+		{"NOT phone EXISTS", true},
+		{"phone = null", true},
+		{"name != null", true},
+		{"name LIKE 'Al%'", true},
+		{"name LIKE 'A_ice'", true},
+		{"name LIKE 'al%'", false},
+		{"email PREFIX 'alice@'", true},
+		{"email ~ '@example\\.com$'", true},
+		{"name REGEX '^B'", false},
+		{"formula = 'a>=b'", true},
+		{"active = true", true},
+		{"missing > 3", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			expr, err := Parse(tt.query)
+			if err != nil {
+				t.Fatalf("Parse(%q) failed: %v", tt.query, err)
+			}
+			if got := expr.Match(doc); got != tt.expected {
+				t.Errorf("Match(%q) = %v, want %v (parsed as %s)", tt.query, got, tt.expected, expr)
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []string{
+		"",
+		"age >",
+		"age > 3 AND",
+		"(age > 3",
+		"name = Alice Smith",
+		"age IN (1, 2",
+		"age BETWEEN 1 2",
+		"name ~ '('",
+		"name = 'unterminated",
+		"name ! Alice",
+	}
+
+	for _, q := range tests {
+		if _, err := Parse(q); err == nil {
+			t.Errorf("Parse(%q) expected error", q)
+		}
+	}
+}
+
+func TestOrder(t *testing.T) {
+	tests := []struct {
+		a, b     any
+		expected int
+	}{
+		{int64(2), float64(10.5), -1},
+		{int64(3), 3, 0},
+		{"b", "a", 1},
+		{nil, false, -1},
+		{true, int64(0), -1},
+		{int64(100), "1", -1},
+	}
+
+	for _, tt := range tests {
+		got := Order(tt.a, tt.b)
+		if (got < 0 && tt.expected >= 0) || (got > 0 && tt.expected <= 0) || (got == 0 && tt.expected != 0) {
+			t.Errorf("Order(%v, %v) = %d, want sign of %d", tt.a, tt.b, got, tt.expected)
+		}
+	}
+}
+
+func TestParseQuery(t *testing.T) {
+	q, err := ParseQuery("age > 25 ORDER BY age DESC, name LIMIT 10 OFFSET 5 FIELDS name, age")
+	if err != nil {
+		t.Fatalf("ParseQuery failed: %v", err)
+	}
+	if q.Filter == nil || q.Filter.String() != "age > 25" {
+		t.Errorf("Unexpected filter: %v", q.Filter)
+	}
+	expectedSort := []SortKey{{Field: "age", Desc: true}, {Field: "name"}}
+	if !reflect.DeepEqual(q.Sort, expectedSort) {
+		t.Errorf("Expected sort %v, got %v", expectedSort, q.Sort)
+	}
+	if q.Limit != 10 || q.Skip != 5 {
+		t.Errorf("Expected limit=10 skip=5, got limit=%d skip=%d", q.Limit, q.Skip)
+	}
+	if !reflect.DeepEqual(q.Fields.Include, []string{"name", "age"}) {
+		t.Errorf("Unexpected projection: %v", q.Fields)
+	}
+
+	q, err = ParseQuery("SORT BY price SKIP 2 FIELDS -notes")
+	if err != nil {
+		t.Fatalf("ParseQuery without filter failed: %v", err)
+	}
+	if q.Filter != nil || q.Skip != 2 || !reflect.DeepEqual(q.Fields.Exclude, []string{"notes"}) {
+		t.Errorf("Unexpected query: %+v", q)
+	}
+
+	for _, bad := range []string{"LIMIT -1", "LIMIT 1 LIMIT 2", "ORDER age", "FIELDS a, -b", "age > 1 LIMIT ten"} {
+		if _, err := ParseQuery(bad); err == nil {
+			t.Errorf("ParseQuery(%q) expected error", bad)
+		}
+	}
+}
+
+func TestCollector(t *testing.T) {
+	docs := []toon.Document{
+		{"id": "a", "price": int64(30), "name": "pen"},
+		{"id": "b", "price": 10.5, "name": "cup"},
+		{"id": "c", "price": int64(30), "name": "ink"},
+		{"id": "d", "name": "box"},
+		{"id": "e", "price": "7", "name": "mug"},
+	}
+
+	tests := []struct {
+		name     string
+		opts     Options
+		expected []string
+	}{
+		{"no options", Options{}, []string{"a", "b", "c", "d", "e"}},
+		{"limit without sort", Options{Limit: 2, Skip: 1}, []string{"b", "c"}},
+		{"sort asc", Options{Sort: []SortKey{{Field: "price"}}}, []string{"d", "e", "b", "a", "c"}},
+		{"top 2 desc", Options{Sort: []SortKey{{Field: "price", Desc: true}}, Limit: 2}, []string{"a", "c"}},
+		{"multi-key", Options{Sort: []SortKey{{Field: "price", Desc: true}, {Field: "name"}}, Limit: 3}, []string{"c", "a", "b"}},
+		{"skip past end", Options{Sort: []SortKey{{Field: "name"}}, Skip: 10}, []string{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewCollector(tt.opts)
+			for _, doc := range docs {
+				if !c.Add(doc) {
+					break
+				}
+			}
+			results := c.Results()
+			ids := make([]string, len(results))
+			for i, doc := range results {
+				ids[i] = doc["id"].(string)
+			}
+			if !reflect.DeepEqual(ids, tt.expected) {
+				t.Errorf("Expected %v, got %v", tt.expected, ids)
+			}
+		})
+	}
+
+	proj := Projection{Include: []string{"name"}}.Apply(docs[0])
+	if len(proj) != 2 || proj["id"] != "a" || proj["name"] != "pen" {
+		t.Errorf("Unexpected projection result: %v", proj)
+	}
+}
+
+func TestAggregate(t *testing.T) {
+	docs := []toon.Document{
+		{"id": "1", "status": "paid", "total": int64(10), "user": "u1"},
+		{"id": "2", "status": "paid", "total": 5.5, "user": "u2"},
+		{"id": "3", "status": "open", "total": int64(7), "user": "u1"},
+		{"id": "4", "status": "paid", "total": int64(20), "user": "u1"},
+		{"id": "5", "status": "open", "user": "u3"},
+	}
+
+	agg, err := ParseAggregation("count(), sum(total) AS revenue, avg(total), min(total), max(total), distinct(user), first(id), last(id) BY status WHERE id != '4'")
+	if err != nil {
+		t.Fatalf("ParseAggregation failed: %v", err)
+	}
+
+	ag, err := NewAggregator(agg)
+	if err != nil {
+		t.Fatalf("NewAggregator failed: %v", err)
+	}
+	for _, doc := range docs {
+		ag.Add(doc)
+	}
+	results := ag.Results()
+
+	expected := []toon.Document{
+		{"status": "open", "count": int64(2), "revenue": int64(7), "avg_total": 7.0, "min_total": int64(7), "max_total": int64(7), "count_distinct_user": int64(2), "first_id": int64(3), "last_id": int64(5)},
+		{"status": "paid", "count": int64(2), "revenue": 15.5, "avg_total": 7.75, "min_total": 5.5, "max_total": int64(10), "count_distinct_user": int64(2), "first_id": int64(1), "last_id": int64(2)},
+	}
+	if !reflect.DeepEqual(results, expected) {
+		t.Errorf("Expected %v, got %v", expected, results)
+	}
+
+	empty, _ := NewAggregator(&Aggregation{Accumulators: []Accumulator{{Op: AccCount}}})
+	if rows := empty.Results(); len(rows) != 1 || rows[0]["count"] != int64(0) {
+		t.Errorf("Expected a single zero count row, got %v", rows)
+	}
+
+	for _, bad := range []string{"", "sum()", "median(x)", "count() BY", "count(), count()", "count() GROUP status"} {
+		if _, err := ParseAggregation(bad); err == nil {
+			t.Errorf("ParseAggregation(%q) expected error", bad)
+		}
+	}
+}
+
+func TestParseLookup(t *testing.T) {
+	q, err := ParseQuery("total > 5 LOOKUP users ON user_id = id AS user JOIN MANY items ON id = order_id LIMIT 3")
+	if err != nil {
+		t.Fatalf("ParseQuery failed: %v", err)
+	}
+	expected := []Lookup{
+		{From: "users", LocalField: "user_id", ForeignField: "id", As: "user"},
+		{From: "items", LocalField: "id", ForeignField: "order_id", As: "items", Many: true},
+	}
+	if !reflect.DeepEqual(q.Lookups, expected) || q.Limit != 3 {
+		t.Errorf("Unexpected lookups: %+v", q.Lookups)
+	}
+
+	for _, bad := range []string{"LOOKUP users", "LOOKUP users ON a > b", "LOOKUP users ON a = b AS"} {
+		if _, err := ParseQuery(bad); err == nil {
+			t.Errorf("ParseQuery(%q) expected error", bad)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package query
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Documents coming back from disk hold the int64/float64/bool/string values
+// produced by toon's type inference, while documents still in the memtable
+// hold whatever the caller inserted (int, float32, json.Number, ...). The
+// helpers in this file normalize both so that comparisons behave the same no
+// matter where a document currently lives.
+
+func toFloat(v any) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case int8:
+		return float64(n), true
+	case int16:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint:
+		return float64(n), true
+	case uint8:
+		return float64(n), true
+	case uint16:
+		return float64(n), true
+	case uint32:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	case float32:
+		return float64(n), true
+	case float64:
+		return n, true
+	case fmt.Stringer:
+		// json.Number and friends
+		if f, err := strconv.ParseFloat(n.String(), 64); err == nil {
+			return f, true
+		}
+	}
+	return 0, false
+}
+
+func isNumeric(v any) bool {
+	switch v.(type) {
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64:
+		return true
+	}
+	return false
+}
+
+// numberFrom returns the numeric value of v if v is a number, or a string
+// that parses as one.
+func numberFrom(v any) (float64, bool) {
+	if isNumeric(v) {
+		return toFloat(v)
+	}
+	if s, ok := v.(string); ok {
+		if f, err := strconv.ParseFloat(strings.TrimSpace(s), 64); err == nil && !math.IsNaN(f) {
+			return f, true
+		}
+	}
+	return 0, false
+}
+
+func compareFloats(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// Equal reports whether two document values are equal. Numbers compare by
+// value regardless of their Go type, and a number equals a string that parses
+// to the same number, since IDs and other numeric-looking strings come back
+// from disk as numbers.
+func Equal(a, b any) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+
+	if isNumeric(a) || isNumeric(b) {
+		fa, okA := numberFrom(a)
+		fb, okB := numberFrom(b)
+		if okA && okB {
+			return fa == fb
+		}
+	}
+
+	switch x := a.(type) {
+	case bool:
+		if y, ok := b.(bool); ok {
+			return x == y
+		}
+	case string:
+		if y, ok := b.(string); ok {
+			return x == y
+		}
+	}
+
+	return fmt.Sprint(a) == fmt.Sprint(b)
+}
+
+// CompareValues orders two non-nil document values for the range operators.
+// Numbers (and numeric strings compared against numbers) compare by value,
+// booleans order false before true, and anything else falls back to
+// comparing the values' string forms.
+func CompareValues(a, b any) int {
+	if isNumeric(a) || isNumeric(b) {
+		fa, okA := numberFrom(a)
+		fb, okB := numberFrom(b)
+		if okA && okB {
+			return compareFloats(fa, fb)
+		}
+	}
+
+	if x, ok := a.(bool); ok {
+		if y, ok := b.(bool); ok {
+			return compareBools(x, y)
+		}
+	}
+
+	return strings.Compare(fmt.Sprint(a), fmt.Sprint(b))
+}
+
+func compareBools(a, b bool) int {
+	switch {
+	case a == b:
+		return 0
+	case !a:
+		return -1
+	}
+	return 1
+}
+
+// typeRank groups values into the buckets used by Order.
+func typeRank(v any) int {
+	switch {
+	case v == nil:
+		return 0
+	case isNumeric(v):
+		return 2
+	}
+	switch v.(type) {
+	case bool:
+		return 1
+	case string:
+		return 3
+	}
+	return 4
+}
+
+// Order is a total order over document values, used for sorting. Values of
+// different kinds are ordered null < bool < number < string < other, so a
+// sort never mixes numeric and lexical comparisons within a kind.
+func Order(a, b any) int {
+	ra, rb := typeRank(a), typeRank(b)
+	if ra != rb {
+		return ra - rb
+	}
+
+	switch ra {
+	case 0:
+		return 0
+	case 1:
+		return compareBools(a.(bool), b.(bool))
+	case 2:
+		fa, _ := toFloat(a)
+		fb, _ := toFloat(b)
+		return compareFloats(fa, fb)
+	case 3:
+		return strings.Compare(a.(string), b.(string))
+	}
+	return strings.Compare(fmt.Sprint(a), fmt.Sprint(b))
+}
+
+// ParseLiteral converts an unquoted token into a typed value the same way
+// toon infers types: integers, then floats, then booleans; "null" is nil and
+// anything else stays a string.
+func ParseLiteral(s string) any {
+	if strings.EqualFold(s, "null") {
+		return nil
+	}
+	if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return i
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return f
+	}
+	if b, err := strconv.ParseBool(s); err == nil {
+		return b
+	}
+	return s
+}
+
+func formatLiteral(v any) string {
+	switch x := v.(type) {
+	case nil:
+		return "null"
+	case string:
+		return strconv.Quote(x)
+	}
+	return fmt.Sprint(v)
+}
@@ -0,0 +1,91 @@
+package raft
+
+import (
+	"math/rand"
+	"sync"
+)
+
+// Network is an in-process transport for tests and simulations. Messages
+// are delivered straight to the attached nodes unless the network has been
+// told to lose them: links can be cut by partitions or isolation, and a
+// fraction of all messages can be dropped at random.
+type Network struct {
+	mu       sync.Mutex
+	nodes    map[string]func(Message)
+	group    map[string]int // nodes in different groups cannot talk
+	isolated int
+	dropRate float64
+	rand     *rand.Rand
+}
+
+func NewNetwork() *Network {
+	return &Network{
+		nodes: make(map[string]func(Message)),
+		group: make(map[string]int),
+		rand:  rand.New(rand.NewSource(1)),
+	}
+}
+
+// Attach delivers messages addressed to id to deliver, usually a node's
+// Step method.
+func (nw *Network) Attach(id string, deliver func(Message)) {
+	nw.mu.Lock()
+	defer nw.mu.Unlock()
+	nw.nodes[id] = deliver
+}
+
+// Detach stops delivering messages to id, as if the node had crashed.
+func (nw *Network) Detach(id string) {
+	nw.mu.Lock()
+	defer nw.mu.Unlock()
+	delete(nw.nodes, id)
+}
+
+// Partition splits the network so that only nodes in the same group can
+// reach each other. Nodes not named form a group of their own.
+func (nw *Network) Partition(groups ...[]string) {
+	nw.mu.Lock()
+	defer nw.mu.Unlock()
+	nw.group = make(map[string]int)
+	for i, g := range groups {
+		for _, id := range g {
+			nw.group[id] = i + 1
+		}
+	}
+}
+
+// Isolate cuts id off from every other node.
+func (nw *Network) Isolate(id string) {
+	nw.mu.Lock()
+	defer nw.mu.Unlock()
+	nw.isolated++
+	nw.group[id] = -nw.isolated
+}
+
+// Heal undoes partitions and isolation.
+func (nw *Network) Heal() {
+	nw.mu.Lock()
+	defer nw.mu.Unlock()
+	nw.group = make(map[string]int)
+}
+
+// SetDropRate makes the network lose each message with probability p.
+func (nw *Network) SetDropRate(p float64) {
+	nw.mu.Lock()
+	defer nw.mu.Unlock()
+	nw.dropRate = p
+}
+
+// Send implements Transport for every node on the network.
+func (nw *Network) Send(m Message) {
+	nw.mu.Lock()
+	deliver := nw.nodes[m.To]
+	if nw.group[m.From] != nw.group[m.To] || nw.dropRate > 0 && nw.rand.Float64() < nw.dropRate {
+		deliver = nil
+	}
+	nw.mu.Unlock()
+
+	if deliver != nil {
+		deliver(m)
+	}
+}
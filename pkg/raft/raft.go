@@ -0,0 +1,1003 @@
+// Package raft implements the Raft consensus algorithm: leader election, log
+// replication, single-server membership changes and ReadIndex reads for
+// linearizable queries. It knows nothing about what the log entries mean;
+// the application applies committed entries through Config.Apply.
+//
+// Messages travel over a Transport, so the same node runs over TCP or over
+// the in-process Network used in tests. Log compaction is not implemented:
+// the log grows without bound and a new member receives it from the start.
+package raft
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"slices"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNotLeader              = errors.New("raft: not the leader")
+	ErrStopped                = errors.New("raft: node stopped")
+	ErrProposalDropped        = errors.New("raft: proposal was replaced by another leader's entry")
+	ErrConfigChangeInProgress = errors.New("raft: another membership change is in progress")
+	ErrMemberExists           = errors.New("raft: already a member")
+	ErrUnknownMember          = errors.New("raft: not a member")
+)
+
+type State int
+
+const (
+	Follower State = iota
+	Candidate
+	Leader
+)
+
+func (s State) String() string {
+	switch s {
+	case Follower:
+		return "follower"
+	case Candidate:
+		return "candidate"
+	case Leader:
+		return "leader"
+	}
+	return fmt.Sprintf("State(%d)", int(s))
+}
+
+type EntryType int
+
+const (
+	EntryNormal EntryType = iota
+	// EntryNoop is appended by every new leader so it can commit an entry
+	// of its own term.
+	EntryNoop
+	// EntryConfig holds the JSON list of members. It takes effect as soon
+	// as it is appended, not when it commits.
+	EntryConfig
+)
+
+type Entry struct {
+	Index uint64    `json:"index"`
+	Term  uint64    `json:"term"`
+	Type  EntryType `json:"type,omitempty"`
+	Data  []byte    `json:"data,omitempty"`
+}
+
+type MessageType int
+
+const (
+	MsgVote MessageType = iota
+	MsgVoteResp
+	MsgApp
+	MsgAppResp
+)
+
+// Message is the unit a Transport carries between nodes. For MsgApp,
+// LogIndex and LogTerm identify the entry preceding Entries; for MsgVote,
+// the candidate's last entry. Match is the follower's last matching index
+// in a MsgAppResp, or its hint of where to retry if Reject is set. Context
+// carries the leader's read round, echoed back to confirm leadership.
+type Message struct {
+	Type     MessageType `json:"type"`
+	From     string      `json:"from"`
+	To       string      `json:"to"`
+	Term     uint64      `json:"term"`
+	LogIndex uint64      `json:"log_index,omitempty"`
+	LogTerm  uint64      `json:"log_term,omitempty"`
+	Entries  []Entry     `json:"entries,omitempty"`
+	Commit   uint64      `json:"commit,omitempty"`
+	Match    uint64      `json:"match,omitempty"`
+	Reject   bool        `json:"reject,omitempty"`
+	Granted  bool        `json:"granted,omitempty"`
+	Context  uint64      `json:"context,omitempty"`
+}
+
+// Transport delivers messages to other nodes on a best-effort basis: it may
+// drop, delay or reorder them, and Send must not block.
+type Transport interface {
+	Send(m Message)
+}
+
+type Config struct {
+	ID string
+
+	// Peers is the initial membership, including ID, used until the log
+	// holds a configuration entry. Every founding member must be given the
+	// same list. A node that will be added to a running cluster later
+	// starts with none and waits to be contacted.
+	Peers []string
+
+	Transport Transport
+
+	// Storage keeps the term, vote and log across restarts. Nil keeps them
+	// in memory only.
+	Storage Storage
+
+	// Apply is called from a single goroutine with committed entries, in
+	// log order, including no-op and configuration entries that most
+	// applications ignore. An error stops the node.
+	Apply func([]Entry) error
+
+	// Applied is the index of the last entry the application had applied
+	// before a restart. Entries up to it are not passed to Apply again.
+	Applied uint64
+
+	// A tick lasts TickInterval (default 100ms). A follower that hears
+	// nothing from a leader for ElectionTicks to twice that (default 10)
+	// starts an election; a leader sends heartbeats every HeartbeatTicks
+	// (default 1).
+	TickInterval   time.Duration
+	ElectionTicks  int
+	HeartbeatTicks int
+}
+
+type Status struct {
+	ID        string
+	State     State
+	Term      uint64
+	Leader    string
+	Commit    uint64
+	Applied   uint64
+	LastIndex uint64
+	Members   []string
+}
+
+const maxAppendEntries = 64
+
+type progress struct {
+	next, match uint64
+}
+
+type proposal struct {
+	data   []byte
+	typ    EntryType
+	result chan proposalResult
+}
+
+type proposalResult struct {
+	index uint64
+	done  chan error
+	err   error
+}
+
+type readRequest struct {
+	round  uint64
+	acks   map[string]bool
+	result chan proposalResult
+}
+
+type waiter struct {
+	term uint64
+	done chan error
+}
+
+// Node is one member of a Raft group. All protocol state is owned by a
+// single goroutine; committed entries are applied by a second one, so a
+// slow application never holds up elections or replication.
+type Node struct {
+	cfg     Config
+	id      string
+	storage Storage
+
+	msgC   chan Message
+	propC  chan proposal
+	readC  chan *readRequest
+	stopC  chan struct{}
+	doneC  chan struct{}
+	stopMu sync.Once
+
+	// Owned by run.
+	state            State
+	term             uint64
+	vote             string
+	leader           string
+	log              []Entry // log[0] is a sentinel with index and term 0
+	commit           uint64
+	members          []string
+	pendingConf      uint64
+	electionElapsed  int
+	heartbeatElapsed int
+	electionTimeout  int
+	votes            map[string]bool
+	progress         map[string]*progress
+	readRound        uint64
+	reads            []*readRequest
+	rand             *rand.Rand
+
+	// Shared with the applier.
+	mu       sync.Mutex
+	queue    []Entry
+	queued   chan struct{}
+	applied  uint64
+	appliedC chan struct{} // closed and replaced after every batch
+	waiters  map[uint64]waiter
+	err      error
+	status   Status
+}
+
+// NewNode starts a node. It campaigns for leadership on its own once its
+// election timeout passes without hearing from a leader.
+func NewNode(cfg Config) (*Node, error) {
+	if cfg.ID == "" {
+		return nil, errors.New("raft: node needs an ID")
+	}
+	if cfg.Transport == nil {
+		return nil, errors.New("raft: node needs a transport")
+	}
+	if cfg.Storage == nil {
+		cfg.Storage = NewMemoryStorage()
+	}
+	if cfg.TickInterval <= 0 {
+		cfg.TickInterval = 100 * time.Millisecond
+	}
+	if cfg.ElectionTicks <= 0 {
+		cfg.ElectionTicks = 10
+	}
+	if cfg.HeartbeatTicks <= 0 {
+		cfg.HeartbeatTicks = 1
+	}
+
+	hs, entries, err := cfg.Storage.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	n := &Node{
+		cfg:      cfg,
+		id:       cfg.ID,
+		storage:  cfg.Storage,
+		msgC:     make(chan Message, 1024),
+		propC:    make(chan proposal),
+		readC:    make(chan *readRequest),
+		stopC:    make(chan struct{}),
+		doneC:    make(chan struct{}),
+		term:     hs.Term,
+		vote:     hs.Vote,
+		log:      append([]Entry{{}}, entries...),
+		rand:     rand.New(rand.NewSource(time.Now().UnixNano())),
+		queued:   make(chan struct{}, 1),
+		applied:  cfg.Applied,
+		appliedC: make(chan struct{}),
+		waiters:  make(map[uint64]waiter),
+	}
+	n.members = n.configFromLog()
+	n.resetElectionTimeout()
+	n.updateStatus()
+
+	applierDone := make(chan struct{})
+	go n.applier(applierDone)
+	go func() {
+		n.run()
+		<-applierDone
+		close(n.doneC)
+	}()
+	return n, nil
+}
+
+// Step hands a message from the transport to the node. It never blocks;
+// if the node is overwhelmed the message is dropped, which Raft tolerates.
+func (n *Node) Step(m Message) {
+	select {
+	case n.msgC <- m:
+	default:
+	}
+}
+
+// Propose appends data to the log through the leader and waits until the
+// entry is committed and applied on this node. It fails with ErrNotLeader
+// on other nodes.
+func (n *Node) Propose(ctx context.Context, data []byte) error {
+	return n.propose(ctx, EntryNormal, data)
+}
+
+func (n *Node) propose(ctx context.Context, typ EntryType, data []byte) error {
+	p := proposal{typ: typ, data: data, result: make(chan proposalResult, 1)}
+	select {
+	case n.propC <- p:
+	case <-n.stopC:
+		return ErrStopped
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	res := <-p.result
+	if res.err != nil {
+		return res.err
+	}
+
+	select {
+	case err := <-res.done:
+		return err
+	case <-n.doneC:
+		return n.stoppedErr()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// ReadIndex waits until this node has applied every entry committed before
+// the call, after confirming with a majority that it is still the leader.
+// Reads made after it returns are linearizable. Only the leader can serve
+// them; other nodes return ErrNotLeader.
+func (n *Node) ReadIndex(ctx context.Context) error {
+	req := &readRequest{result: make(chan proposalResult, 1)}
+	select {
+	case n.readC <- req:
+	case <-n.stopC:
+		return ErrStopped
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	var res proposalResult
+	select {
+	case res = <-req.result:
+	case <-n.doneC:
+		return n.stoppedErr()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if res.err != nil {
+		return res.err
+	}
+	return n.WaitApplied(ctx, res.index)
+}
+
+// WaitApplied blocks until the entry at index has been applied.
+func (n *Node) WaitApplied(ctx context.Context, index uint64) error {
+	for {
+		n.mu.Lock()
+		applied, changed, err := n.applied, n.appliedC, n.err
+		n.mu.Unlock()
+		if applied >= index {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		select {
+		case <-changed:
+		case <-n.doneC:
+			return n.stoppedErr()
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// AddMember adds id to the group. It must be called on the leader, and
+// only one membership change may be in flight at a time.
+func (n *Node) AddMember(ctx context.Context, id string) error {
+	return n.changeMembers(ctx, id, true)
+}
+
+// RemoveMember removes id from the group. A leader that removes itself
+// steps down once the change commits.
+func (n *Node) RemoveMember(ctx context.Context, id string) error {
+	return n.changeMembers(ctx, id, false)
+}
+
+func (n *Node) changeMembers(ctx context.Context, id string, add bool) error {
+	members := n.Status().Members
+	switch {
+	case add && slices.Contains(members, id):
+		return ErrMemberExists
+	case !add && !slices.Contains(members, id):
+		return ErrUnknownMember
+	}
+
+	// The new list is computed again by the leader from its own log; this
+	// one only carries the request.
+	data, err := json.Marshal(memberChange{ID: id, Add: add})
+	if err != nil {
+		return err
+	}
+	return n.propose(ctx, EntryConfig, data)
+}
+
+type memberChange struct {
+	ID  string `json:"id"`
+	Add bool   `json:"add"`
+}
+
+func (n *Node) Status() Status {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	s := n.status
+	s.Applied = n.applied
+	s.Members = slices.Clone(s.Members)
+	return s
+}
+
+// Leader returns the ID of the leader as far as this node knows, or "".
+func (n *Node) Leader() string {
+	return n.Status().Leader
+}
+
+// Stop shuts the node down and waits for it to finish applying.
+func (n *Node) Stop() {
+	n.stopMu.Do(func() { close(n.stopC) })
+	<-n.doneC
+}
+
+func (n *Node) stoppedErr() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.err != nil {
+		return n.err
+	}
+	return ErrStopped
+}
+
+func (n *Node) run() {
+	ticker := time.NewTicker(n.cfg.TickInterval)
+	defer ticker.Stop()
+
+	defer func() {
+		for _, r := range n.reads {
+			r.result <- proposalResult{err: ErrStopped}
+		}
+	}()
+
+	for {
+		select {
+		case <-n.stopC:
+			return
+		case <-ticker.C:
+			n.tick()
+		case m := <-n.msgC:
+			if m.To == n.id {
+				n.step(m)
+			}
+		case p := <-n.propC:
+			n.handleProposal(p)
+		case r := <-n.readC:
+			n.handleRead(r)
+		}
+
+		n.mu.Lock()
+		failed := n.err != nil
+		n.mu.Unlock()
+		if failed {
+			return
+		}
+		n.updateStatus()
+	}
+}
+
+func (n *Node) updateStatus() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.status = Status{
+		ID:        n.id,
+		State:     n.state,
+		Term:      n.term,
+		Leader:    n.leader,
+		Commit:    n.commit,
+		LastIndex: n.lastIndex(),
+		Members:   n.members,
+	}
+}
+
+func (n *Node) lastIndex() uint64 {
+	return uint64(len(n.log) - 1)
+}
+
+func (n *Node) lastTerm() uint64 {
+	return n.log[len(n.log)-1].Term
+}
+
+func (n *Node) isMember(id string) bool {
+	return slices.Contains(n.members, id)
+}
+
+func (n *Node) quorum() int {
+	return len(n.members)/2 + 1
+}
+
+func (n *Node) resetElectionTimeout() {
+	n.electionElapsed = 0
+	n.electionTimeout = n.cfg.ElectionTicks + n.rand.Intn(n.cfg.ElectionTicks)
+}
+
+func (n *Node) tick() {
+	if n.state == Leader {
+		n.heartbeatElapsed++
+		if n.heartbeatElapsed >= n.cfg.HeartbeatTicks {
+			n.heartbeatElapsed = 0
+			n.broadcastAppend()
+		}
+		return
+	}
+
+	n.electionElapsed++
+	if n.electionElapsed >= n.electionTimeout && n.isMember(n.id) {
+		n.campaign()
+	}
+}
+
+func (n *Node) persistState() {
+	if err := n.storage.SaveState(HardState{Term: n.term, Vote: n.vote}); err != nil {
+		n.fail(fmt.Errorf("raft: could not save state: %w", err))
+	}
+}
+
+// fail stops the node after an error it cannot recover from.
+func (n *Node) fail(err error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.err == nil {
+		n.err = err
+		log.Printf("raft %s: %v", n.id, err)
+	}
+}
+
+func (n *Node) send(m Message) {
+	m.From = n.id
+	m.Term = n.term
+	n.cfg.Transport.Send(m)
+}
+
+func (n *Node) campaign() {
+	n.state = Candidate
+	n.term++
+	n.vote = n.id
+	n.leader = ""
+	n.persistState()
+	n.resetElectionTimeout()
+	n.votes = map[string]bool{n.id: true}
+
+	if n.quorum() == 1 {
+		n.becomeLeader()
+		return
+	}
+	for _, id := range n.members {
+		if id != n.id {
+			n.send(Message{Type: MsgVote, To: id, LogIndex: n.lastIndex(), LogTerm: n.lastTerm()})
+		}
+	}
+}
+
+func (n *Node) becomeFollower(term uint64, leader string) {
+	if n.state == Leader {
+		n.failReads(ErrNotLeader)
+	}
+	n.state = Follower
+	if term > n.term {
+		n.term = term
+		n.vote = ""
+		n.persistState()
+	}
+	n.leader = leader
+	n.resetElectionTimeout()
+}
+
+func (n *Node) becomeLeader() {
+	n.state = Leader
+	n.leader = n.id
+	n.heartbeatElapsed = 0
+	n.progress = make(map[string]*progress)
+	for _, id := range n.members {
+		if id != n.id {
+			n.progress[id] = &progress{next: n.lastIndex() + 1}
+		}
+	}
+	n.appendEntry(Entry{Type: EntryNoop})
+	n.broadcastAppend()
+	n.maybeCommit()
+}
+
+func (n *Node) failReads(err error) {
+	for _, r := range n.reads {
+		r.result <- proposalResult{err: err}
+	}
+	n.reads = nil
+}
+
+func (n *Node) step(m Message) {
+	switch {
+	case m.Term > n.term:
+		if m.Type == MsgVote && n.hasLeader() {
+			// A node removed from the group, or cut off for a while,
+			// must not be able to depose a leader that is still heard.
+			return
+		}
+		leader := ""
+		if m.Type == MsgApp {
+			leader = m.From
+		}
+		n.becomeFollower(m.Term, leader)
+
+	case m.Term < n.term:
+		switch m.Type {
+		case MsgApp:
+			n.send(Message{Type: MsgAppResp, To: m.From, Reject: true})
+		case MsgVote:
+			n.send(Message{Type: MsgVoteResp, To: m.From})
+		}
+		return
+	}
+
+	switch m.Type {
+	case MsgVote:
+		n.handleVote(m)
+	case MsgVoteResp:
+		n.handleVoteResp(m)
+	case MsgApp:
+		if n.state != Follower || n.leader != m.From {
+			n.becomeFollower(m.Term, m.From)
+		}
+		n.handleAppend(m)
+	case MsgAppResp:
+		n.handleAppendResp(m)
+	}
+}
+
+func (n *Node) hasLeader() bool {
+	if n.state == Leader {
+		return true
+	}
+	return n.leader != "" && n.electionElapsed < n.cfg.ElectionTicks
+}
+
+func (n *Node) handleVote(m Message) {
+	canVote := n.vote == m.From || (n.vote == "" && n.leader == "")
+	upToDate := m.LogTerm > n.lastTerm() || (m.LogTerm == n.lastTerm() && m.LogIndex >= n.lastIndex())
+	granted := canVote && upToDate
+	if granted {
+		n.vote = m.From
+		n.persistState()
+		n.resetElectionTimeout()
+	}
+	n.send(Message{Type: MsgVoteResp, To: m.From, Granted: granted})
+}
+
+func (n *Node) handleVoteResp(m Message) {
+	if n.state != Candidate || !n.isMember(m.From) {
+		return
+	}
+	n.votes[m.From] = m.Granted
+
+	granted, rejected := 0, 0
+	for _, v := range n.votes {
+		if v {
+			granted++
+		} else {
+			rejected++
+		}
+	}
+	switch {
+	case granted >= n.quorum():
+		n.becomeLeader()
+	case rejected >= n.quorum():
+		n.becomeFollower(n.term, "")
+	}
+}
+
+func (n *Node) handleAppend(m Message) {
+	n.electionElapsed = 0
+	resp := Message{Type: MsgAppResp, To: m.From, Context: m.Context}
+
+	if m.LogIndex > n.lastIndex() {
+		resp.Reject = true
+		resp.Match = n.lastIndex()
+		n.send(resp)
+		return
+	}
+	if n.log[m.LogIndex].Term != m.LogTerm {
+		resp.Reject = true
+		resp.Match = m.LogIndex - 1
+		n.send(resp)
+		return
+	}
+
+	for i, e := range m.Entries {
+		if e.Index <= n.lastIndex() && n.log[e.Index].Term == e.Term {
+			continue
+		}
+		if e.Index <= n.commit {
+			n.fail(fmt.Errorf("raft: leader %s tried to overwrite committed entry %d", m.From, e.Index))
+			return
+		}
+		newEntries := m.Entries[i:]
+		n.log = append(n.log[:e.Index], newEntries...)
+		if err := n.storage.Append(newEntries); err != nil {
+			n.fail(fmt.Errorf("raft: could not append to log: %w", err))
+			return
+		}
+		n.members = n.configFromLog()
+		break
+	}
+
+	lastNew := m.LogIndex + uint64(len(m.Entries))
+	if m.Commit > n.commit {
+		n.commitTo(min(m.Commit, lastNew))
+	}
+	resp.Match = lastNew
+	n.send(resp)
+}
+
+func (n *Node) handleAppendResp(m Message) {
+	if n.state != Leader {
+		return
+	}
+	pr := n.progress[m.From]
+	if pr == nil {
+		return
+	}
+	if m.Context > 0 {
+		n.ackRead(m.From, m.Context)
+	}
+
+	if m.Reject {
+		pr.next = max(1, min(pr.next-1, m.Match+1))
+		n.sendAppend(m.From)
+		return
+	}
+	if m.Match > pr.match {
+		pr.match = m.Match
+		if n.maybeCommit() {
+			n.broadcastAppend()
+		}
+	}
+	pr.next = max(pr.next, m.Match+1)
+	if pr.next <= n.lastIndex() {
+		n.sendAppend(m.From)
+	}
+}
+
+func (n *Node) broadcastAppend() {
+	for _, id := range n.members {
+		if id != n.id {
+			n.sendAppend(id)
+		}
+	}
+}
+
+func (n *Node) sendAppend(to string) {
+	pr := n.progress[to]
+	if pr == nil {
+		return
+	}
+	prev := pr.next - 1
+	end := min(n.lastIndex()+1, pr.next+maxAppendEntries)
+	n.send(Message{
+		Type:     MsgApp,
+		To:       to,
+		LogIndex: prev,
+		LogTerm:  n.log[prev].Term,
+		Entries:  slices.Clone(n.log[pr.next:end]),
+		Commit:   n.commit,
+		Context:  n.readRound,
+	})
+}
+
+// maybeCommit advances the commit index to the highest entry of the
+// current term stored on a majority, and reports whether it moved.
+func (n *Node) maybeCommit() bool {
+	for idx := n.lastIndex(); idx > n.commit; idx-- {
+		if n.log[idx].Term != n.term {
+			break
+		}
+		count := 0
+		for _, id := range n.members {
+			if id == n.id || n.progress[id] != nil && n.progress[id].match >= idx {
+				count++
+			}
+		}
+		if count >= n.quorum() {
+			n.commitTo(idx)
+			return true
+		}
+	}
+	return false
+}
+
+func (n *Node) commitTo(idx uint64) {
+	if idx <= n.commit {
+		return
+	}
+	entries := slices.Clone(n.log[n.commit+1 : idx+1])
+	n.commit = idx
+
+	n.mu.Lock()
+	n.queue = append(n.queue, entries...)
+	n.mu.Unlock()
+	select {
+	case n.queued <- struct{}{}:
+	default:
+	}
+
+	if n.pendingConf != 0 && n.commit >= n.pendingConf {
+		n.pendingConf = 0
+	}
+	if n.state == Leader {
+		n.serveReads()
+		if !n.isMember(n.id) {
+			// The leader committed its own removal.
+			n.becomeFollower(n.term, "")
+		}
+	}
+}
+
+func (n *Node) appendEntry(e Entry) uint64 {
+	e.Index = n.lastIndex() + 1
+	e.Term = n.term
+	n.log = append(n.log, e)
+	if err := n.storage.Append([]Entry{e}); err != nil {
+		n.fail(fmt.Errorf("raft: could not append to log: %w", err))
+	}
+
+	if e.Type == EntryConfig {
+		n.members = n.configFromLog()
+		n.pendingConf = e.Index
+		for _, id := range n.members {
+			if id != n.id && n.progress[id] == nil {
+				n.progress[id] = &progress{next: e.Index}
+			}
+		}
+		for id := range n.progress {
+			if !n.isMember(id) {
+				delete(n.progress, id)
+			}
+		}
+	}
+	return e.Index
+}
+
+func (n *Node) handleProposal(p proposal) {
+	if n.state != Leader {
+		p.result <- proposalResult{err: ErrNotLeader}
+		return
+	}
+
+	data := p.data
+	if p.typ == EntryConfig {
+		if n.pendingConf != 0 {
+			p.result <- proposalResult{err: ErrConfigChangeInProgress}
+			return
+		}
+		var change memberChange
+		if err := json.Unmarshal(p.data, &change); err != nil {
+			p.result <- proposalResult{err: err}
+			return
+		}
+		members := slices.Clone(n.members)
+		switch {
+		case change.Add && !slices.Contains(members, change.ID):
+			members = append(members, change.ID)
+		case !change.Add && slices.Contains(members, change.ID):
+			members = slices.DeleteFunc(members, func(id string) bool { return id == change.ID })
+		default:
+			p.result <- proposalResult{err: ErrConfigChangeInProgress}
+			return
+		}
+		data, _ = json.Marshal(members)
+	}
+
+	index := n.appendEntry(Entry{Type: p.typ, Data: data})
+	w := waiter{term: n.term, done: make(chan error, 1)}
+	n.mu.Lock()
+	n.waiters[index] = w
+	n.mu.Unlock()
+	p.result <- proposalResult{index: index, done: w.done}
+
+	n.broadcastAppend()
+	n.maybeCommit()
+}
+
+func (n *Node) handleRead(r *readRequest) {
+	if n.state != Leader {
+		r.result <- proposalResult{err: ErrNotLeader}
+		return
+	}
+	r.acks = map[string]bool{n.id: true}
+	n.readRound++
+	r.round = n.readRound
+	n.reads = append(n.reads, r)
+	if n.quorum() > 1 {
+		n.broadcastAppend()
+	}
+	n.serveReads()
+}
+
+func (n *Node) ackRead(from string, round uint64) {
+	for _, r := range n.reads {
+		if r.round <= round {
+			r.acks[from] = true
+		}
+	}
+	n.serveReads()
+}
+
+// serveReads answers the reads confirmed by a majority, once the leader has
+// committed an entry of its own term and so knows the latest commit index.
+func (n *Node) serveReads() {
+	if n.log[n.commit].Term != n.term {
+		return
+	}
+	kept := n.reads[:0]
+	for _, r := range n.reads {
+		if len(r.acks) >= n.quorum() {
+			r.result <- proposalResult{index: n.commit}
+		} else {
+			kept = append(kept, r)
+		}
+	}
+	n.reads = kept
+}
+
+// configFromLog returns the members named by the last configuration entry,
+// or the founding peers if there is none.
+func (n *Node) configFromLog() []string {
+	for i := len(n.log) - 1; i > 0; i-- {
+		if n.log[i].Type == EntryConfig {
+			var members []string
+			if err := json.Unmarshal(n.log[i].Data, &members); err == nil {
+				return members
+			}
+		}
+	}
+	return slices.Clone(n.cfg.Peers)
+}
+
+func (n *Node) applier(done chan struct{}) {
+	defer close(done)
+	for {
+		select {
+		case <-n.queued:
+		case <-n.stopC:
+			return
+		}
+
+		n.mu.Lock()
+		batch := n.queue
+		n.queue = nil
+		applied := n.applied
+		n.mu.Unlock()
+
+		var todo []Entry
+		for _, e := range batch {
+			if e.Index > applied {
+				todo = append(todo, e)
+			}
+		}
+		if len(todo) == 0 {
+			continue
+		}
+
+		var err error
+		if n.cfg.Apply != nil {
+			err = n.cfg.Apply(todo)
+		}
+
+		n.mu.Lock()
+		if err != nil {
+			n.err = fmt.Errorf("raft: could not apply entries: %w", err)
+			n.mu.Unlock()
+			log.Printf("raft %s: %v", n.id, n.err)
+			n.stopMu.Do(func() { close(n.stopC) })
+			return
+		}
+		n.applied = todo[len(todo)-1].Index
+		for _, e := range todo {
+			if w, ok := n.waiters[e.Index]; ok {
+				if w.term == e.Term {
+					w.done <- nil
+				} else {
+					w.done <- ErrProposalDropped
+				}
+				delete(n.waiters, e.Index)
+			}
+		}
+		close(n.appliedC)
+		n.appliedC = make(chan struct{})
+		n.mu.Unlock()
+	}
+}
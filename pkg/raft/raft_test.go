@@ -0,0 +1,326 @@
+package raft
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testNode struct {
+	*Node
+	mu      sync.Mutex
+	applied []string
+}
+
+func (tn *testNode) data() []string {
+	tn.mu.Lock()
+	defer tn.mu.Unlock()
+	return slices.Clone(tn.applied)
+}
+
+type testCluster struct {
+	t       *testing.T
+	network *Network
+	nodes   map[string]*testNode
+}
+
+func newTestCluster(t *testing.T, ids ...string) *testCluster {
+	tc := &testCluster{t: t, network: NewNetwork(), nodes: make(map[string]*testNode)}
+	for _, id := range ids {
+		tc.start(id, ids, nil)
+	}
+	t.Cleanup(func() {
+		for _, n := range tc.nodes {
+			n.Stop()
+		}
+	})
+	return tc
+}
+
+func (tc *testCluster) start(id string, peers []string, storage Storage) *testNode {
+	tn := &testNode{}
+	node, err := NewNode(Config{
+		ID:            id,
+		Peers:         peers,
+		Transport:     tc.network,
+		Storage:       storage,
+		TickInterval:  2 * time.Millisecond,
+		ElectionTicks: 10,
+		Apply: func(entries []Entry) error {
+			tn.mu.Lock()
+			defer tn.mu.Unlock()
+			for _, e := range entries {
+				if e.Type == EntryNormal {
+					tn.applied = append(tn.applied, string(e.Data))
+				}
+			}
+			return nil
+		},
+	})
+	if err != nil {
+		tc.t.Fatalf("NewNode failed: %v", err)
+	}
+	tn.Node = node
+	tc.nodes[id] = tn
+	tc.network.Attach(id, node.Step)
+	return tn
+}
+
+func (tc *testCluster) stop(id string) {
+	tc.network.Detach(id)
+	tc.nodes[id].Stop()
+	delete(tc.nodes, id)
+}
+
+// leader waits for exactly one of the given nodes to lead the others.
+func (tc *testCluster) leader(ids ...string) *testNode {
+	tc.t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		var leaders []string
+		agreed := true
+		for _, id := range ids {
+			s := tc.nodes[id].Status()
+			if s.State == Leader {
+				leaders = append(leaders, id)
+			}
+			if s.Leader == "" || s.Leader != tc.nodes[ids[0]].Status().Leader {
+				agreed = false
+			}
+		}
+		if len(leaders) == 1 && agreed {
+			return tc.nodes[leaders[0]]
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	tc.t.Fatalf("No leader elected among %v", ids)
+	return nil
+}
+
+func (tc *testCluster) propose(n *testNode, data string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return n.Propose(ctx, []byte(data))
+}
+
+// converge waits until every given node has applied want.
+func (tc *testCluster) converge(want []string, ids ...string) {
+	tc.t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for _, id := range ids {
+		for !slices.Equal(tc.nodes[id].data(), want) {
+			if time.Now().After(deadline) {
+				tc.t.Fatalf("Node %s applied %v, want %v", id, tc.nodes[id].data(), want)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+}
+
+func TestReplication(t *testing.T) {
+	tc := newTestCluster(t, "a", "b", "c")
+	leader := tc.leader("a", "b", "c")
+
+	var want []string
+	for i := 0; i < 20; i++ {
+		want = append(want, fmt.Sprint(i))
+		if err := tc.propose(leader, want[i]); err != nil {
+			t.Fatalf("Propose failed: %v", err)
+		}
+	}
+	if got := leader.data(); !slices.Equal(got, want) {
+		t.Errorf("Propose returned before the entry was applied: %v", got)
+	}
+	tc.converge(want, "a", "b", "c")
+
+	for id, n := range tc.nodes {
+		if n != leader {
+			if err := tc.propose(n, "x"); err != ErrNotLeader {
+				t.Errorf("Expected ErrNotLeader from %s, got %v", id, err)
+			}
+			if err := n.ReadIndex(context.Background()); err != ErrNotLeader {
+				t.Errorf("Expected ErrNotLeader for a read on %s, got %v", id, err)
+			}
+		}
+	}
+	if err := leader.ReadIndex(context.Background()); err != nil {
+		t.Errorf("ReadIndex failed: %v", err)
+	}
+}
+
+func TestLossyNetwork(t *testing.T) {
+	tc := newTestCluster(t, "a", "b", "c", "d", "e")
+	tc.network.SetDropRate(0.2)
+
+	var want []string
+	for i := 0; len(want) < 30; i++ {
+		leader := tc.leader("a", "b", "c", "d", "e")
+		err := tc.propose(leader, fmt.Sprint(i))
+		switch {
+		case err == nil:
+			want = append(want, fmt.Sprint(i))
+		case errors.Is(err, ErrNotLeader), errors.Is(err, ErrProposalDropped):
+		default:
+			t.Fatalf("Propose failed: %v", err)
+		}
+	}
+	tc.network.SetDropRate(0)
+
+	// Entries proposed by a leader that lost its position may still have
+	// been committed, so compare against one node rather than want.
+	tc.converge(tc.leader("a", "b", "c", "d", "e").data(), "a", "b", "c", "d", "e")
+	for _, v := range want {
+		if !slices.Contains(tc.nodes["a"].data(), v) {
+			t.Errorf("Acknowledged entry %s was lost", v)
+		}
+	}
+}
+
+func TestFailover(t *testing.T) {
+	tc := newTestCluster(t, "a", "b", "c")
+	old := tc.leader("a", "b", "c")
+	if err := tc.propose(old, "before"); err != nil {
+		t.Fatalf("Propose failed: %v", err)
+	}
+
+	var rest []string
+	for id, n := range tc.nodes {
+		if n != old {
+			rest = append(rest, id)
+		}
+	}
+	tc.network.Isolate(old.Status().ID)
+
+	// The cut-off leader can no longer commit or serve linearizable reads.
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := old.Propose(ctx, []byte("lost")); err == nil {
+		t.Errorf("Isolated leader committed an entry")
+	}
+	ctx2, cancel2 := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel2()
+	if err := old.ReadIndex(ctx2); err == nil {
+		t.Errorf("Isolated leader served a linearizable read")
+	}
+
+	leader := tc.leader(rest...)
+	if err := tc.propose(leader, "after"); err != nil {
+		t.Fatalf("Propose on new leader failed: %v", err)
+	}
+
+	// Once reconnected, the old leader drops its uncommitted entry.
+	tc.network.Heal()
+	tc.converge([]string{"before", "after"}, "a", "b", "c")
+	if s := old.Status(); s.State != Follower || s.Leader != leader.Status().ID {
+		t.Errorf("Old leader did not follow the new one: %+v", s)
+	}
+}
+
+func TestMembershipChanges(t *testing.T) {
+	tc := newTestCluster(t, "a", "b", "c")
+	leader := tc.leader("a", "b", "c")
+	tc.propose(leader, "1")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// A new node starts empty and receives the whole log.
+	tc.start("d", nil, nil)
+	if err := leader.AddMember(ctx, "d"); err != nil {
+		t.Fatalf("AddMember failed: %v", err)
+	}
+	if err := leader.AddMember(ctx, "d"); err != ErrMemberExists {
+		t.Errorf("Expected ErrMemberExists, got %v", err)
+	}
+	tc.propose(leader, "2")
+	tc.converge([]string{"1", "2"}, "a", "b", "c", "d")
+	if members := tc.nodes["d"].Status().Members; len(members) != 4 {
+		t.Errorf("New member has configuration %v", members)
+	}
+
+	// With four members, three are a majority: two failures block commits,
+	// but removing one of them first does not.
+	var others []string
+	for id, n := range tc.nodes {
+		if n != leader && id != "d" {
+			others = append(others, id)
+		}
+	}
+	if err := leader.RemoveMember(ctx, others[0]); err != nil {
+		t.Fatalf("RemoveMember failed: %v", err)
+	}
+	tc.stop(others[0])
+	tc.network.Isolate(others[1])
+	if err := tc.propose(leader, "3"); err != nil {
+		t.Fatalf("Propose after removal failed: %v", err)
+	}
+	tc.network.Heal()
+
+	// A leader that removes itself hands over to the rest.
+	leaderID := leader.Status().ID
+	if err := leader.RemoveMember(ctx, leaderID); err != nil {
+		t.Fatalf("Removing the leader failed: %v", err)
+	}
+	remaining := []string{others[1], "d"}
+	next := tc.leader(remaining...)
+	if err := tc.propose(next, "4"); err != nil {
+		t.Fatalf("Propose after leader removal failed: %v", err)
+	}
+	tc.converge([]string{"1", "2", "3", "4"}, remaining...)
+	if s := tc.nodes[leaderID].Status(); s.State == Leader {
+		t.Errorf("Removed leader still leads: %+v", s)
+	}
+}
+
+func TestFileStorageRestart(t *testing.T) {
+	dir := "./test-raft-storage"
+	defer os.RemoveAll(dir)
+
+	storage, err := OpenFileStorage(dir)
+	if err != nil {
+		t.Fatalf("OpenFileStorage failed: %v", err)
+	}
+	tc := newTestCluster(t)
+	node := tc.start("a", []string{"a"}, storage)
+	leader := tc.leader("a")
+	for _, v := range []string{"x", "y", "z"} {
+		if err := tc.propose(leader, v); err != nil {
+			t.Fatalf("Propose failed: %v", err)
+		}
+	}
+	term := node.Status().Term
+	tc.stop("a")
+	storage.Close()
+
+	// A torn final entry is discarded on restart.
+	f, _ := os.OpenFile(dir+"/"+logFileName, os.O_WRONLY|os.O_APPEND, 0644)
+	f.WriteString(`{"index":99,"te`)
+	f.Close()
+
+	storage, err = OpenFileStorage(dir)
+	if err != nil {
+		t.Fatalf("OpenFileStorage failed: %v", err)
+	}
+	defer storage.Close()
+	node = tc.start("a", []string{"a"}, storage)
+	tc.leader("a")
+	tc.converge([]string{"x", "y", "z"}, "a")
+	if s := node.Status(); s.Term <= term {
+		t.Errorf("Expected a new term after restart, got %+v (was %d)", s, term)
+	}
+
+	// Replacing entries from the middle rewrites the tail of the file.
+	s2, _ := OpenFileStorage(dir + "/copy")
+	defer s2.Close()
+	s2.Append([]Entry{{Index: 1, Term: 1}, {Index: 2, Term: 1}, {Index: 3, Term: 1}})
+	s2.Append([]Entry{{Index: 2, Term: 2, Data: []byte("new")}})
+	_, entries, err := s2.Load()
+	if err != nil || len(entries) != 2 || entries[1].Term != 2 || string(entries[1].Data) != "new" {
+		t.Errorf("Unexpected log after replacement: %+v, %v", entries, err)
+	}
+}
@@ -0,0 +1,211 @@
+package raft
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// HardState is what a node must remember across restarts besides its log.
+type HardState struct {
+	Term uint64 `json:"term"`
+	Vote string `json:"vote,omitempty"`
+}
+
+// Storage persists a node's state and log. Every call must be durable when
+// it returns.
+type Storage interface {
+	Load() (HardState, []Entry, error)
+	SaveState(HardState) error
+	// Append stores entries, which follow on from the log without gaps. If
+	// the first one has an index already stored, that entry and everything
+	// after it are replaced.
+	Append(entries []Entry) error
+}
+
+type MemoryStorage struct {
+	mu      sync.Mutex
+	state   HardState
+	entries []Entry
+}
+
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{}
+}
+
+func (s *MemoryStorage) Load() (HardState, []Entry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state, append([]Entry(nil), s.entries...), nil
+}
+
+func (s *MemoryStorage) SaveState(hs HardState) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.state = hs
+	return nil
+}
+
+func (s *MemoryStorage) Append(entries []Entry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	first := entries[0].Index
+	if first == 0 || first > uint64(len(s.entries))+1 {
+		return fmt.Errorf("raft: entry %d does not follow log ending at %d", first, len(s.entries))
+	}
+	s.entries = append(s.entries[:first-1], entries...)
+	return nil
+}
+
+const (
+	stateFileName = "state.json"
+	logFileName   = "log.jsonl"
+)
+
+// FileStorage keeps the state in a JSON file replaced atomically and the
+// log as one JSON line per entry, synced after every append.
+type FileStorage struct {
+	mu      sync.Mutex
+	dir     string
+	log     *os.File
+	offsets []int64 // offsets[i] is where entry i+1 starts
+	end     int64
+}
+
+// OpenFileStorage opens the storage in dir, creating it if needed. An entry
+// left half written by a crash is cut off.
+func OpenFileStorage(dir string) (*FileStorage, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("raft: could not create storage dir: %w", err)
+	}
+	f, err := os.OpenFile(filepath.Join(dir, logFileName), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("raft: could not open log: %w", err)
+	}
+	return &FileStorage{dir: dir, log: f}, nil
+}
+
+func (s *FileStorage) Load() (HardState, []Entry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var hs HardState
+	data, err := os.ReadFile(filepath.Join(s.dir, stateFileName))
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(data, &hs); err != nil {
+			return hs, nil, fmt.Errorf("raft: could not read state: %w", err)
+		}
+	case !errors.Is(err, os.ErrNotExist):
+		return hs, nil, fmt.Errorf("raft: could not read state: %w", err)
+	}
+
+	if _, err := s.log.Seek(0, io.SeekStart); err != nil {
+		return hs, nil, err
+	}
+	var entries []Entry
+	s.offsets = nil
+	s.end = 0
+	br := bufio.NewReader(s.log)
+	for {
+		line, err := br.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return hs, nil, fmt.Errorf("raft: could not read log: %w", err)
+		}
+		var e Entry
+		if err := json.Unmarshal(line, &e); err != nil {
+			return hs, nil, fmt.Errorf("raft: bad log entry at offset %d: %w", s.end, err)
+		}
+		if e.Index != uint64(len(entries))+1 {
+			return hs, nil, fmt.Errorf("raft: log entry %d follows entry %d", e.Index, len(entries))
+		}
+		entries = append(entries, e)
+		s.offsets = append(s.offsets, s.end)
+		s.end += int64(len(line))
+	}
+	if err := s.log.Truncate(s.end); err != nil {
+		return hs, nil, fmt.Errorf("raft: could not truncate log: %w", err)
+	}
+	return hs, entries, nil
+}
+
+func (s *FileStorage) SaveState(hs HardState) error {
+	data, err := json.Marshal(hs)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(s.dir, stateFileName)
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (s *FileStorage) Append(entries []Entry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	first := entries[0].Index
+	if first == 0 || first > uint64(len(s.offsets))+1 {
+		return fmt.Errorf("raft: entry %d does not follow log ending at %d", first, len(s.offsets))
+	}
+	if first <= uint64(len(s.offsets)) {
+		s.end = s.offsets[first-1]
+		s.offsets = s.offsets[:first-1]
+		if err := s.log.Truncate(s.end); err != nil {
+			return err
+		}
+	}
+
+	var buf []byte
+	offsets := s.offsets
+	end := s.end
+	for _, e := range entries {
+		line, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		offsets = append(offsets, end)
+		end += int64(len(line)) + 1
+		buf = append(append(buf, line...), '\n')
+	}
+	if _, err := s.log.WriteAt(buf, s.end); err != nil {
+		return err
+	}
+	if err := s.log.Sync(); err != nil {
+		return err
+	}
+	s.offsets, s.end = offsets, end
+	return nil
+}
+
+func (s *FileStorage) Close() error {
+	return s.log.Close()
+}
@@ -0,0 +1,162 @@
+package raft
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	tcpQueueSize    = 256
+	tcpDialTimeout  = time.Second
+	tcpWriteTimeout = 2 * time.Second
+)
+
+// TCPTransport carries messages as JSON over TCP. Node IDs are the
+// addresses the nodes listen on, so members added later need no extra
+// configuration.
+type TCPTransport struct {
+	ln      net.Listener
+	mu      sync.Mutex
+	peers   map[string]chan Message
+	conns   map[net.Conn]bool
+	closed  bool
+	closedC chan struct{}
+}
+
+// ListenTCP listens on addr for messages from other nodes. The node using
+// the transport should have the listener's address as its ID.
+func ListenTCP(addr string) (*TCPTransport, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &TCPTransport{
+		ln:      ln,
+		peers:   make(map[string]chan Message),
+		conns:   make(map[net.Conn]bool),
+		closedC: make(chan struct{}),
+	}, nil
+}
+
+func (t *TCPTransport) Addr() string {
+	return t.ln.Addr().String()
+}
+
+// Serve accepts connections and passes the messages read from them to
+// deliver until the transport is closed.
+func (t *TCPTransport) Serve(deliver func(Message)) error {
+	for {
+		conn, err := t.ln.Accept()
+		if err != nil {
+			select {
+			case <-t.closedC:
+				return nil
+			default:
+				return err
+			}
+		}
+		if !t.track(conn, true) {
+			conn.Close()
+			return nil
+		}
+		go func() {
+			defer t.track(conn, false)
+			defer conn.Close()
+			dec := json.NewDecoder(bufio.NewReader(conn))
+			for {
+				var m Message
+				if err := dec.Decode(&m); err != nil {
+					return
+				}
+				deliver(m)
+			}
+		}()
+	}
+}
+
+func (t *TCPTransport) track(conn net.Conn, add bool) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if add {
+		if t.closed {
+			return false
+		}
+		t.conns[conn] = true
+	} else {
+		delete(t.conns, conn)
+	}
+	return true
+}
+
+// Send queues m for its recipient. Each peer has its own connection and
+// queue, so a slow or unreachable peer only loses its own messages.
+func (t *TCPTransport) Send(m Message) {
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return
+	}
+	q, ok := t.peers[m.To]
+	if !ok {
+		q = make(chan Message, tcpQueueSize)
+		t.peers[m.To] = q
+		go t.sender(m.To, q)
+	}
+	t.mu.Unlock()
+
+	select {
+	case q <- m:
+	default:
+	}
+}
+
+func (t *TCPTransport) sender(addr string, q chan Message) {
+	var conn net.Conn
+	var enc *json.Encoder
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+
+	for {
+		var m Message
+		select {
+		case m = <-q:
+		case <-t.closedC:
+			return
+		}
+
+		if conn == nil {
+			c, err := net.DialTimeout("tcp", addr, tcpDialTimeout)
+			if err != nil {
+				continue
+			}
+			conn = c
+			enc = json.NewEncoder(conn)
+		}
+		conn.SetWriteDeadline(time.Now().Add(tcpWriteTimeout))
+		if err := enc.Encode(m); err != nil {
+			conn.Close()
+			conn = nil
+		}
+	}
+}
+
+func (t *TCPTransport) Close() error {
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return nil
+	}
+	t.closed = true
+	close(t.closedC)
+	for conn := range t.conns {
+		conn.Close()
+	}
+	t.mu.Unlock()
+	return t.ln.Close()
+}
@@ -0,0 +1,368 @@
+// Package schema validates documents against a JSON-Schema-like description
+// of their fields.
+package schema
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/Al3x-Myku/FlyDB/pkg/query"
+	"github.com/Al3x-Myku/FlyDB/pkg/toon"
+)
+
+const (
+	TypeString  = "string"
+	TypeInteger = "integer"
+	TypeNumber  = "number"
+	TypeBoolean = "boolean"
+	TypeObject  = "object"
+	TypeArray   = "array"
+)
+
+// Schema is a subset of JSON Schema. An empty Type accepts any value, and
+// every constraint only applies to values it makes sense for: Minimum and
+// Maximum to numbers, MinLength, MaxLength and Pattern to strings. A nil
+// AdditionalProperties allows fields not listed in Properties.
+//
+// A collection schema describes the top-level document, so it is an object
+// schema; the id field is always allowed.
+type Schema struct {
+	Type                 string             `json:"type,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	AdditionalProperties *bool              `json:"additionalProperties,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	Enum                 []any              `json:"enum,omitempty"`
+	Minimum              *float64           `json:"minimum,omitempty"`
+	Maximum              *float64           `json:"maximum,omitempty"`
+	MinLength            *int               `json:"minLength,omitempty"`
+	MaxLength            *int               `json:"maxLength,omitempty"`
+	Pattern              string             `json:"pattern,omitempty"`
+
+	pattern *regexp.Regexp
+}
+
+// Parse reads a schema from JSON and compiles it.
+func Parse(data []byte) (*Schema, error) {
+	var s Schema
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("invalid schema: %w", err)
+	}
+	if err := s.Compile(); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// Compile checks the schema for mistakes and prepares its patterns. It must
+// be called before Validate on a schema built by hand.
+func (s *Schema) Compile() error {
+	if s.Type == "" && (len(s.Properties) > 0 || len(s.Required) > 0) {
+		s.Type = TypeObject
+	}
+	return s.compile("")
+}
+
+func (s *Schema) compile(path string) error {
+	where := ""
+	if path != "" {
+		where = " at " + path
+	}
+
+	switch s.Type {
+	case "", TypeString, TypeInteger, TypeNumber, TypeBoolean, TypeObject, TypeArray:
+	default:
+		return fmt.Errorf("unknown type %q%s", s.Type, where)
+	}
+	if s.Minimum != nil && s.Maximum != nil && *s.Minimum > *s.Maximum {
+		return fmt.Errorf("minimum is greater than maximum%s", where)
+	}
+	if s.MinLength != nil && s.MaxLength != nil && *s.MinLength > *s.MaxLength {
+		return fmt.Errorf("minLength is greater than maxLength%s", where)
+	}
+
+	s.pattern = nil
+	if s.Pattern != "" {
+		re, err := regexp.Compile(s.Pattern)
+		if err != nil {
+			return fmt.Errorf("invalid pattern%s: %w", where, err)
+		}
+		s.pattern = re
+	}
+
+	for name, prop := range s.Properties {
+		if prop == nil {
+			return fmt.Errorf("property %s has no schema", join(path, name))
+		}
+		if err := prop.compile(join(path, name)); err != nil {
+			return err
+		}
+	}
+	if s.Items != nil {
+		if err := s.Items.compile(path + "[]"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Violation is one way in which a document breaks its schema.
+type Violation struct {
+	Path    string
+	Message string
+}
+
+func (v Violation) String() string {
+	if v.Path == "" {
+		return v.Message
+	}
+	return v.Path + ": " + v.Message
+}
+
+// ValidationError lists every violation found in a document.
+type ValidationError struct {
+	Violations []Violation
+}
+
+func (e *ValidationError) Error() string {
+	parts := make([]string, len(e.Violations))
+	for i, v := range e.Violations {
+		parts[i] = v.String()
+	}
+	return "schema validation failed: " + strings.Join(parts, "; ")
+}
+
+// Validate checks a document about to be written. It returns a
+// *ValidationError listing every violation, or nil.
+func (s *Schema) Validate(doc toon.Document) error {
+	return s.validate(doc, false)
+}
+
+// ValidateStored checks a document read back from disk. Every value is
+// stored as text, so a string field holding "42" or "true" reads back as a
+// number or a boolean; such values are accepted where a string is expected.
+func (s *Schema) ValidateStored(doc toon.Document) error {
+	return s.validate(doc, true)
+}
+
+// ValidatePatch checks a stored document with some of its top-level fields
+// replaced: those named in patched as Validate does, and the others, read
+// back from disk, as ValidateStored does.
+func (s *Schema) ValidatePatch(doc toon.Document, patched map[string]bool) error {
+	return s.validateWith(&validator{stored: true, strict: patched}, doc)
+}
+
+func (s *Schema) validate(doc toon.Document, stored bool) error {
+	return s.validateWith(&validator{stored: stored}, doc)
+}
+
+func (s *Schema) validateWith(v *validator, doc toon.Document) error {
+	v.object("", s, map[string]any(doc), true)
+	if len(v.violations) == 0 {
+		return nil
+	}
+	return &ValidationError{Violations: v.violations}
+}
+
+type validator struct {
+	stored     bool
+	strict     map[string]bool // top-level fields checked as not stored
+	violations []Violation
+}
+
+func (v *validator) fail(path, format string, args ...any) {
+	v.violations = append(v.violations, Violation{Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+func join(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+func (v *validator) object(path string, s *Schema, obj map[string]any, root bool) {
+	for _, name := range s.Required {
+		if val, ok := obj[name]; !ok || val == nil {
+			v.fail(join(path, name), "required field missing")
+		}
+	}
+
+	names := make([]string, 0, len(obj))
+	for name := range obj {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		val := obj[name]
+		prop, ok := s.Properties[name]
+		switch {
+		case ok:
+			if val != nil {
+				stored := v.stored
+				if root && v.strict[name] {
+					v.stored = false
+				}
+				v.value(join(path, name), prop, val)
+				v.stored = stored
+			}
+		case root && name == "id":
+		case s.AdditionalProperties != nil && !*s.AdditionalProperties:
+			v.fail(join(path, name), "field not allowed")
+		}
+	}
+}
+
+func (v *validator) value(path string, s *Schema, val any) {
+	if !v.checkType(path, s.Type, val) {
+		return
+	}
+
+	if len(s.Enum) > 0 {
+		found := false
+		for _, e := range s.Enum {
+			if query.Equal(query.Normalize(val), query.Normalize(e)) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			v.fail(path, "value %v is not one of %v", val, s.Enum)
+		}
+	}
+
+	if n, ok := number(val); ok {
+		if s.Minimum != nil && n < *s.Minimum {
+			v.fail(path, "%v is less than minimum %v", val, *s.Minimum)
+		}
+		if s.Maximum != nil && n > *s.Maximum {
+			v.fail(path, "%v is greater than maximum %v", val, *s.Maximum)
+		}
+	}
+
+	if str, ok := val.(string); ok {
+		length := utf8.RuneCountInString(str)
+		if s.MinLength != nil && length < *s.MinLength {
+			v.fail(path, "length %d is less than minLength %d", length, *s.MinLength)
+		}
+		if s.MaxLength != nil && length > *s.MaxLength {
+			v.fail(path, "length %d is greater than maxLength %d", length, *s.MaxLength)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(str) {
+			v.fail(path, "%q does not match pattern %s", str, s.Pattern)
+		}
+	}
+
+	switch x := val.(type) {
+	case map[string]any:
+		v.object(path, s, x, false)
+	case toon.Document:
+		v.object(path, s, x, false)
+	}
+
+	if s.Items != nil {
+		if items, ok := list(val); ok {
+			for i, item := range items {
+				if item != nil {
+					v.value(fmt.Sprintf("%s[%d]", path, i), s.Items, item)
+				}
+			}
+		}
+	}
+}
+
+// checkType reports a violation and returns false if val is not of type typ.
+func (v *validator) checkType(path, typ string, val any) bool {
+	ok := true
+	switch typ {
+	case "":
+	case TypeString:
+		_, ok = val.(string)
+		if !ok && v.stored {
+			_, isBool := val.(bool)
+			_, isNum := number(val)
+			ok = isBool || isNum
+		}
+	case TypeInteger:
+		n, isNum := number(val)
+		ok = isNum && n == math.Trunc(n)
+	case TypeNumber:
+		_, ok = number(val)
+	case TypeBoolean:
+		_, ok = val.(bool)
+	case TypeObject:
+		switch val.(type) {
+		case map[string]any, toon.Document:
+		default:
+			ok = false
+		}
+	case TypeArray:
+		_, ok = list(val)
+	}
+
+	if !ok {
+		v.fail(path, "expected %s, got %s", typ, typeName(val))
+	}
+	return ok
+}
+
+func number(val any) (float64, bool) {
+	switch n := val.(type) {
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	case bool, string:
+		return 0, false
+	}
+	rv := reflect.ValueOf(val)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(rv.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(rv.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		f := rv.Float()
+		return f, !math.IsNaN(f)
+	}
+	return 0, false
+}
+
+func list(val any) ([]any, bool) {
+	if items, ok := val.([]any); ok {
+		return items, true
+	}
+	rv := reflect.ValueOf(val)
+	if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+		return nil, false
+	}
+	items := make([]any, rv.Len())
+	for i := range items {
+		items[i] = rv.Index(i).Interface()
+	}
+	return items, true
+}
+
+func typeName(val any) string {
+	if _, ok := number(val); ok {
+		return TypeNumber
+	}
+	switch val.(type) {
+	case string:
+		return TypeString
+	case bool:
+		return TypeBoolean
+	case map[string]any, toon.Document:
+		return TypeObject
+	}
+	if _, ok := list(val); ok {
+		return TypeArray
+	}
+	return fmt.Sprintf("%T", val)
+}
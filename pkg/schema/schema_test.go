@@ -0,0 +1,104 @@
+package schema
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/Al3x-Myku/FlyDB/pkg/toon"
+)
+
+const userSchema = `{
+	"properties": {
+		"email":   {"type": "string", "pattern": "^[^@]+@[^@]+$"},
+		"age":     {"type": "integer", "minimum": 0, "maximum": 150},
+		"role":    {"type": "string", "enum": ["admin", "user"]},
+		"name":    {"type": "string", "minLength": 1, "maxLength": 5},
+		"zip":     {"type": "string"},
+		"address": {"type": "object", "required": ["city"], "properties": {"city": {"type": "string"}}},
+		"tags":    {"type": "array", "items": {"type": "string"}}
+	},
+	"required": ["email", "age"],
+	"additionalProperties": false
+}`
+
+func TestValidate(t *testing.T) {
+	s, err := Parse([]byte(userSchema))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+
+	valid := toon.Document{
+		"id":      "u1",
+		"email":   "a@b.c",
+		"age":     float64(30),
+		"role":    "admin",
+		"address": map[string]any{"city": "Oslo"},
+		"tags":    []any{"x", "y"},
+	}
+	if err := s.Validate(valid); err != nil {
+		t.Errorf("Expected valid document, got %v", err)
+	}
+
+	invalid := toon.Document{
+		"id":      "u2",
+		"email":   "nope",
+		"age":     12.5,
+		"role":    "root",
+		"name":    "Bartholomew",
+		"extra":   true,
+		"address": map[string]any{},
+		"tags":    []any{"x", int64(3)},
+	}
+	err = s.Validate(invalid)
+	var verr *ValidationError
+	if !errors.As(err, &verr) {
+		t.Fatalf("Expected *ValidationError, got %v", err)
+	}
+
+	var paths []string
+	for _, v := range verr.Violations {
+		paths = append(paths, v.Path)
+	}
+	want := []string{"address.city", "age", "email", "extra", "name", "role", "tags[1]"}
+	if !reflect.DeepEqual(paths, want) {
+		t.Errorf("Expected violations at %v, got %v", want, verr.Violations)
+	}
+
+	missing := s.Validate(toon.Document{"id": "u3", "age": int64(200)})
+	if missing == nil || len(missing.(*ValidationError).Violations) != 2 {
+		t.Errorf("Expected missing email and maximum violations, got %v", missing)
+	}
+
+	// A numeric-looking string reads back from disk as a number.
+	stored := toon.Document{"id": "u4", "email": "a@b.c", "age": int64(1), "zip": int64(1234)}
+	if err := s.Validate(stored); err == nil {
+		t.Errorf("Expected a number in a string field to fail on write")
+	}
+	if err := s.ValidateStored(stored); err != nil {
+		t.Errorf("Expected stored document to pass, got %v", err)
+	}
+
+	// A patch is strict only about the fields it changes.
+	if err := s.ValidatePatch(stored, map[string]bool{"age": true}); err != nil {
+		t.Errorf("Expected patch of age to pass, got %v", err)
+	}
+	if err := s.ValidatePatch(stored, map[string]bool{"zip": true}); err == nil {
+		t.Errorf("Expected patch setting zip to a number to fail")
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []string{
+		`{"type": "strnig"}`,
+		`{"properties": {"a": {"pattern": "("}}}`,
+		`{"properties": {"a": {"minimum": 5, "maximum": 1}}}`,
+		`{"properties": {"a": {"type": "array", "items": {"type": "nope"}}}}`,
+		`not json`,
+	}
+	for _, input := range tests {
+		if _, err := Parse([]byte(input)); err == nil {
+			t.Errorf("Expected error for %s", input)
+		}
+	}
+}
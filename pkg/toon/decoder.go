@@ -27,7 +27,7 @@ func Decode(data []byte, targetID string) (Document, error) {
 		}
 
 		line := scanner.Text()
-		row := parseTOONRow(line)
+		row, missing := parseTOONFields(line)
 
 		if len(row) != len(schema) {
 			return nil, ErrSchemaMismatch
@@ -35,11 +35,7 @@ func Decode(data []byte, targetID string) (Document, error) {
 
 		if row[idColumnIndex] == targetID {
 
-			doc := make(Document)
-			for j, key := range schema {
-				doc[key] = inferType(row[j])
-			}
-			return doc, nil
+			return decodeRow(schema, row, missing), nil
 		}
 	}
 
@@ -50,6 +46,23 @@ func Decode(data []byte, targetID string) (Document, error) {
 	return nil, nil
 }
 
+// missingValue is what Encode writes for a field a document does not have,
+// or holds nil. A value that prints the same is escaped as \<nil>.
+const missingValue = "<nil>"
+
+// decodeRow builds a document from one row. Missing fields are left out, so
+// a document reads back with the same fields it was written with.
+func decodeRow(schema, row []string, missing []bool) Document {
+	doc := make(Document, len(schema))
+	for j, key := range schema {
+		if missing[j] {
+			continue
+		}
+		doc[key] = inferType(row[j])
+	}
+	return doc
+}
+
 func DecodeAll(data []byte) ([]Document, error) {
 	reader := bytes.NewReader(data)
 	scanner := bufio.NewScanner(reader)
@@ -70,17 +83,13 @@ func DecodeAll(data []byte) ([]Document, error) {
 		}
 
 		line := scanner.Text()
-		row := parseTOONRow(line)
+		row, missing := parseTOONFields(line)
 
 		if len(row) != len(schema) {
 			return nil, ErrSchemaMismatch
 		}
 
-		doc := make(Document)
-		for j, key := range schema {
-			doc[key] = inferType(row[j])
-		}
-		docs = append(docs, doc)
+		docs = append(docs, decodeRow(schema, row, missing))
 	}
 
 	if err := scanner.Err(); err != nil {
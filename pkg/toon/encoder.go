@@ -51,9 +51,16 @@ func Encode(name string, docs []Document) ([]byte, error) {
 
 	for _, doc := range docs {
 		for i, key := range schema {
-			val, _ := doc[key]
+			val, ok := doc[key]
 			valStr := fmt.Sprint(val)
-			values[i] = escapeTOON(valStr)
+			switch {
+			case !ok || val == nil:
+				values[i] = missingValue
+			case valStr == missingValue:
+				values[i] = `\` + valStr
+			default:
+				values[i] = escapeTOON(valStr)
+			}
 		}
 		dataBuf.WriteString(strings.Join(values, ","))
 		dataBuf.WriteByte('\n')
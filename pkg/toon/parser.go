@@ -7,10 +7,25 @@ import (
 )
 
 func parseTOONRow(line string) []string {
+	values, _ := parseTOONFields(line)
+	return values
+}
+
+// parseTOONFields splits a row into its unescaped values and reports which
+// of them are missing, written as a bare missingValue. Encode escapes a value
+// that prints the same, so it is not taken for one.
+func parseTOONFields(line string) ([]string, []bool) {
 	var values []string
+	var missing []bool
 	var current strings.Builder
-	var escaped bool
+	var escaped, literal bool
 
+	end := func() {
+		missing = append(missing, !literal && current.String() == missingValue)
+		values = append(values, current.String())
+		current.Reset()
+		literal = false
+	}
 	for _, r := range line {
 		if escaped {
 			switch r {
@@ -22,22 +37,24 @@ func parseTOONRow(line string) []string {
 				current.WriteRune('\n')
 			case 'r':
 				current.WriteRune('\r')
+			case '<':
+				current.WriteRune('<')
 			default:
 				current.WriteRune('\\')
 				current.WriteRune(r)
 			}
 			escaped = false
+			literal = true
 		} else if r == '\\' {
 			escaped = true
 		} else if r == ',' {
-			values = append(values, current.String())
-			current.Reset()
+			end()
 		} else {
 			current.WriteRune(r)
 		}
 	}
-	values = append(values, current.String())
-	return values
+	end()
+	return values, missing
 }
 
 func ParseHeader(header string) (int, []string, int, error) {
@@ -74,6 +91,12 @@ func ParseHeader(header string) (int, []string, int, error) {
 	return count, schema, idColumnIndex, nil
 }
 
+// InferType converts a raw TOON value into the int64, float64, bool or string
+// it is decoded as.
+func InferType(s string) interface{} {
+	return inferType(s)
+}
+
 func inferType(s string) interface{} {
 	if i, err := strconv.ParseInt(s, 10, 64); err == nil {
 		return i
@@ -78,6 +78,53 @@ func TestDecodeAll(t *testing.T) {
 	}
 }
 
+func TestMissingFields(t *testing.T) {
+	docs := []Document{
+		{"id": "u1", "name": "Alice"},
+		{"id": "u2", "email": "bob@example.com"},
+	}
+
+	encoded, err := Encode("users", docs)
+	if err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+
+	decoded, err := DecodeAll(encoded)
+	if err != nil {
+		t.Fatalf("DecodeAll failed: %v", err)
+	}
+	for i, doc := range decoded {
+		if !reflect.DeepEqual(doc, docs[i]) {
+			t.Errorf("Expected %v, got %v", docs[i], doc)
+		}
+	}
+}
+
+func TestNilString(t *testing.T) {
+	docs := []Document{
+		{"id": "u1", "name": "<nil>"},
+		{"id": "u2", "email": "<nil>,\\<nil>"},
+	}
+
+	encoded, err := Encode("users", docs)
+	if err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+
+	decoded, err := DecodeAll(encoded)
+	if err != nil {
+		t.Fatalf("DecodeAll failed: %v", err)
+	}
+	for i, doc := range decoded {
+		if !reflect.DeepEqual(doc, docs[i]) {
+			t.Errorf("Expected %v, got %v", docs[i], doc)
+		}
+	}
+	if doc, _ := Decode(encoded, "u1"); doc["name"] != "<nil>" {
+		t.Errorf("Expected the string <nil>, got %v", doc)
+	}
+}
+
 func TestExtractIDs(t *testing.T) {
 	docs := []Document{
 		{"id": "1", "name": "Alice"},